@@ -1,9 +1,8 @@
 use rayon::prelude::*;
 use serde::{Deserialize, Serialize};
-use std::ffi::{CStr, CString};
-use std::os::raw::c_char;
 use tauri::Emitter;
 
+use crate::platform;
 use crate::resource_monitor::AppResourceUsage;
 
 #[derive(Debug, Serialize, Deserialize, Clone)]
@@ -15,65 +14,12 @@ pub struct AppMetadata {
     pub resource_usage: Option<AppResourceUsage>,
 }
 
-extern "C" {
-    fn get_combined_apps_swift() -> *mut c_char;
-    fn get_running_apps_swift() -> *mut c_char;
-    fn get_app_icon_swift(path: *const c_char) -> *mut c_char;
-    fn switch_to_app_swift(pid: i32) -> bool;
-    fn force_quit_app_swift(pid: i32) -> bool;
-    fn restart_app_swift(path: *const c_char) -> bool;
-    fn check_process_running_swift(pid: i32) -> bool;
-    fn free_string_swift(pointer: *mut c_char);
-}
-
-#[derive(Deserialize)]
-struct AppsResponse {
-    running_apps: Vec<AppMetadata>,
-    installed_apps: Vec<AppMetadata>,
-}
-
 pub fn get_running_apps() -> Result<Vec<AppMetadata>, String> {
-    let apps_json_ptr = unsafe { get_running_apps_swift() };
-    if apps_json_ptr.is_null() {
-        return Err("Failed to get apps".to_string());
-    }
-    let apps_json = unsafe {
-        let c_str = CStr::from_ptr(apps_json_ptr);
-        let result = c_str
-            .to_str()
-            .map_err(|_| "Invalid UTF-8".to_string())?
-            .to_owned();
-        free_string_swift(apps_json_ptr);
-        result
-    };
-
-    let apps_response: Vec<AppMetadata> =
-        serde_json::from_str(&apps_json).map_err(|e| e.to_string())?;
-
-    Ok(apps_response)
+    platform::get_running_apps()
 }
 
 pub fn get_app_icon(app_path: &str) -> Result<Option<String>, String> {
-    let path_cstring =
-        CString::new(app_path).map_err(|_| "Failed to create C string".to_string())?;
-
-    let icon_ptr = unsafe { get_app_icon_swift(path_cstring.as_ptr()) };
-
-    if icon_ptr.is_null() {
-        return Ok(None);
-    }
-
-    let icon = unsafe {
-        let c_str = CStr::from_ptr(icon_ptr);
-        let result = c_str
-            .to_str()
-            .map_err(|_| "Invalid UTF-8".to_string())?
-            .to_owned();
-        free_string_swift(icon_ptr);
-        result
-    };
-
-    Ok(Some(icon))
+    platform::get_app_icon(app_path)
 }
 
 fn filter_apps(app: Vec<AppMetadata>) -> Vec<AppMetadata> {
@@ -89,13 +35,7 @@ fn filter_apps(app: Vec<AppMetadata>) -> Vec<AppMetadata> {
                 || name.starts_with("com.")
                 || name.starts_with("plugin_")
                 || name.starts_with(".")
-                || path.contains(".framework")
-                || path.contains("Contents/Frameworks/")
-                || path.contains("Contents/XPCServices/")
-                || path.contains("Contents/PlugIns/")
-                || path.contains("Contents/Helpers/")
-                || path.contains("/usr/libexec")
-                || path.contains("System/Library/CoreServices/")
+                || platform::is_auxiliary_app_path(path)
                 || name.contains("Crash Reporter")
                 || name.contains("Updater")
                 || name.contains("Diagnostics"))
@@ -107,29 +47,9 @@ fn filter_apps(app: Vec<AppMetadata>) -> Vec<AppMetadata> {
 
 #[tauri::command]
 pub fn get_apps_data() -> Result<Vec<AppMetadata>, String> {
-    let apps_json_ptr = unsafe { get_combined_apps_swift() };
-
-    if apps_json_ptr.is_null() {
-        return Err("Failed to get apps".to_string());
-    }
-
-    let apps_json = unsafe {
-        let c_str = CStr::from_ptr(apps_json_ptr);
-        let result = c_str
-            .to_str()
-            .map_err(|_| "Invalid UTF-8".to_string())?
-            .to_owned();
-        free_string_swift(apps_json_ptr);
-        result
-    };
+    let (mut combined_apps, installed_apps) = platform::get_apps()?;
 
-    let apps_response: AppsResponse =
-        serde_json::from_str(&apps_json).map_err(|e| e.to_string())?;
-
-    let mut combined_apps = apps_response.running_apps;
-
-    let unique_installed_apps: Vec<AppMetadata> = apps_response
-        .installed_apps
+    let unique_installed_apps: Vec<AppMetadata> = installed_apps
         .into_iter()
         .filter(|installed| {
             !combined_apps
@@ -155,8 +75,7 @@ pub async fn launch_or_switch_to_app(
     app_handle: tauri::AppHandle,
 ) -> Result<(), String> {
     if let Some(pid) = app.pid {
-        let int3pid = pid as i32;
-        let switched = unsafe { switch_to_app_swift(int3pid) };
+        let switched = platform::switch_to_app(pid);
 
         if switched {
             tokio::spawn(async move {
@@ -175,10 +94,7 @@ pub async fn launch_or_switch_to_app(
     }
 
     // If switching fails or no PID, launch the app
-    let path_cstring =
-        CString::new(app.path.clone()).map_err(|_| "Failed to create C string".to_string())?;
-
-    let restarted = unsafe { restart_app_swift(path_cstring.as_ptr()) };
+    let restarted = platform::launch_app(&app.path);
 
     if !restarted {
         return Err(format!("Failed to launch application: {}", app.path));
@@ -209,7 +125,7 @@ pub async fn launch_or_switch_to_app(
 #[tauri::command]
 pub async fn force_quit_application(pid: u32) -> Result<(), String> {
     // Initial attempt to force quit
-    let result = unsafe { force_quit_app_swift(pid as i32) };
+    let result = platform::force_quit_app(pid);
 
     if !result {
         return Err(format!(
@@ -220,7 +136,7 @@ pub async fn force_quit_application(pid: u32) -> Result<(), String> {
 
     // Now poll to see if the application has actually terminated
     // Define a timeout (5 seconds)
-    // the swift .terminate() method sends a kill signal to the app, but the app might be saving data and take time to close, so we poll it to see if the process is still running, since we can't call async functions from rust to swift
+    // on macOS the swift .terminate() method sends a kill signal to the app, but the app might be saving data and take time to close, so we poll it to see if the process is still running, since we can't call async functions from rust to swift
     let timeout = std::time::Duration::from_secs(5);
     let start_time = std::time::Instant::now();
 
@@ -246,7 +162,7 @@ pub async fn force_quit_application(pid: u32) -> Result<(), String> {
 }
 
 fn is_process_running(pid: u32) -> bool {
-    unsafe { check_process_running_swift(pid as i32) }
+    platform::is_process_running(pid)
 }
 
 #[tauri::command]
@@ -262,12 +178,8 @@ pub async fn restart_application(
         tokio::time::sleep(tokio::time::Duration::from_millis(500)).await;
     }
 
-    // Prepare path as C string
-    let path_cstring =
-        CString::new(app.path.clone()).map_err(|_| "Failed to create C string".to_string())?;
-
     // Restart the application
-    let restarted = unsafe { restart_app_swift(path_cstring.as_ptr()) };
+    let restarted = platform::launch_app(&app.path);
 
     if !restarted {
         return Err(format!("Failed to restart application: {}", app.path));
@@ -0,0 +1,659 @@
+/// Chunker for source code. Files are cut along their top-level definitions (functions, classes, types) so every
+/// chunk holds one whole definition with the comments above it, definitions that are too big are cut again along the
+/// ones nested in them. Definitions are found with a few patterns per language, which is enough to name them without
+/// a full parser. The same patterns feed the symbols table, see symbols.rs
+use async_trait::async_trait;
+use regex::Regex;
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::OnceLock;
+
+use crate::file_processor::FileMetadata;
+
+use super::common::{Chunk, ChunkMetadata, ChunkerConfig, ChunkerError, ChunkerResult};
+use super::util;
+use super::Chunker;
+
+/// Segments with fewer words than this (a lone import block, a one line constant) are merged into the next one
+const MIN_SEGMENT_WORDS: usize = 12;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum Language {
+    C,
+    CSharp,
+    Go,
+    Java,
+    JavaScript,
+    Kotlin,
+    Php,
+    Python,
+    Ruby,
+    Rust,
+    Swift,
+}
+
+impl Language {
+    pub fn mime_type(&self) -> &'static str {
+        match self {
+            Language::C => "text/x-c",
+            Language::CSharp => "text/x-csharp",
+            Language::Go => "text/x-go",
+            Language::Java => "text/x-java",
+            Language::JavaScript => "application/javascript",
+            Language::Kotlin => "text/x-kotlin",
+            Language::Php => "text/x-php",
+            Language::Python => "text/x-python",
+            Language::Ruby => "text/x-ruby",
+            Language::Rust => "text/rust",
+            Language::Swift => "text/x-swift",
+        }
+    }
+}
+
+/// TypeScript shares the JavaScript patterns, C++ the C ones
+pub fn language_for_extension(ext: &str) -> Option<Language> {
+    match ext.to_lowercase().as_str() {
+        "c" | "h" | "cc" | "cpp" | "cxx" | "hh" | "hpp" | "hxx" => Some(Language::C),
+        "cs" => Some(Language::CSharp),
+        "go" => Some(Language::Go),
+        "java" => Some(Language::Java),
+        "js" | "jsx" | "mjs" | "cjs" | "ts" | "tsx" | "mts" | "cts" => Some(Language::JavaScript),
+        "kt" | "kts" => Some(Language::Kotlin),
+        "php" => Some(Language::Php),
+        "py" | "pyi" => Some(Language::Python),
+        "rb" => Some(Language::Ruby),
+        "rs" => Some(Language::Rust),
+        "swift" => Some(Language::Swift),
+        _ => None,
+    }
+}
+
+pub fn language_for_path(path: &Path) -> Option<Language> {
+    path.extension()
+        .and_then(|ext| language_for_extension(&ext.to_string_lossy()))
+}
+
+pub fn is_code_extension(ext: &str) -> bool {
+    language_for_extension(ext).is_some()
+}
+
+/// A named definition in a source file
+#[derive(Debug, Clone, PartialEq)]
+pub struct Symbol {
+    pub name: String,
+    pub kind: String,
+    /// 1-based line of the definition
+    pub line: usize,
+    /// leading whitespace of the definition line, tells nested definitions apart
+    pub indent: usize,
+}
+
+impl Symbol {
+    fn label(&self) -> String {
+        format!("{} {}", self.kind, self.name)
+    }
+}
+
+/// A pattern matched against a trimmed line. The name is the `name` group, the kind is the `kind` group when there
+/// is one and the default kind otherwise
+struct SymbolPattern {
+    kind: &'static str,
+    regex: Regex,
+}
+
+fn pattern(kind: &'static str, regex: &str) -> SymbolPattern {
+    SymbolPattern {
+        kind,
+        regex: Regex::new(regex).unwrap(),
+    }
+}
+
+/// Words that look like a call or a definition in the method patterns but are control flow
+const KEYWORDS: &[&str] = &[
+    "if", "else", "for", "foreach", "while", "switch", "catch", "return", "do", "try", "using",
+    "lock", "sizeof", "new", "delete", "throw", "case", "elif", "when", "guard", "match",
+];
+
+fn patterns_for(language: Language) -> &'static [SymbolPattern] {
+    static PATTERNS: OnceLock<HashMap<Language, Vec<SymbolPattern>>> = OnceLock::new();
+
+    let patterns = PATTERNS.get_or_init(|| {
+        let mut patterns = HashMap::new();
+
+        patterns.insert(
+            Language::Rust,
+            vec![
+                pattern(
+                    "function",
+                    r#"^(?:pub(?:\([^)]*\))?\s+)?(?:(?:const|async|unsafe|extern(?:\s+"[^"]*")?)\s+)*fn\s+(?P<name>[A-Za-z_]\w*)"#,
+                ),
+                pattern(
+                    "type",
+                    r"^(?:pub(?:\([^)]*\))?\s+)?(?:unsafe\s+)?(?P<kind>struct|enum|trait|union|type)\s+(?P<name>[A-Za-z_]\w*)",
+                ),
+                pattern(
+                    "impl",
+                    r"^(?:unsafe\s+)?impl(?:<[^>]*>)?\s+(?:[\w:<>, &']+?\s+for\s+)?(?P<name>[A-Za-z_][\w:]*)",
+                ),
+                // only inline modules, `mod foo;` just points at another file
+                pattern(
+                    "module",
+                    r"^(?:pub(?:\([^)]*\))?\s+)?mod\s+(?P<name>[A-Za-z_]\w*)\s*\{",
+                ),
+                pattern("macro", r"^macro_rules!\s*(?P<name>[A-Za-z_]\w*)"),
+            ],
+        );
+
+        patterns.insert(
+            Language::Go,
+            vec![
+                pattern("method", r"^func\s+\([^)]*\)\s*(?P<name>[A-Za-z_]\w*)"),
+                pattern("function", r"^func\s+(?P<name>[A-Za-z_]\w*)"),
+                pattern(
+                    "type",
+                    r"^type\s+(?P<name>[A-Za-z_]\w*)(?:\[[^\]]*\])?\s+(?P<kind>struct|interface)?",
+                ),
+            ],
+        );
+
+        patterns.insert(
+            Language::Python,
+            vec![
+                pattern("function", r"^(?:async\s+)?def\s+(?P<name>[A-Za-z_]\w*)"),
+                pattern("class", r"^class\s+(?P<name>[A-Za-z_]\w*)"),
+            ],
+        );
+
+        patterns.insert(
+            Language::JavaScript,
+            vec![
+                pattern(
+                    "function",
+                    r"^(?:export\s+)?(?:default\s+)?(?:declare\s+)?(?:async\s+)?function\s*\*?\s*(?P<name>[A-Za-z_$][\w$]*)",
+                ),
+                pattern(
+                    "class",
+                    r"^(?:export\s+)?(?:default\s+)?(?:declare\s+)?(?:abstract\s+)?class\s+(?P<name>[A-Za-z_$][\w$]*)",
+                ),
+                pattern(
+                    "type",
+                    r"^(?:export\s+)?(?:declare\s+)?(?:const\s+)?(?P<kind>interface|type|enum|namespace)\s+(?P<name>[A-Za-z_$][\w$]*)",
+                ),
+                // const handler = async (req, res) => { ... } and const handler = function () { ... }
+                pattern(
+                    "function",
+                    r"^(?:export\s+)?(?:const|let|var)\s+(?P<name>[A-Za-z_$][\w$]*)\s*(?::[^=]+)?=\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*(?::[^=]+)?=>|[A-Za-z_$][\w$]*\s*=>)",
+                ),
+                pattern(
+                    "method",
+                    r"^(?:(?:public|private|protected|static|async|readonly|override|get|set)\s+)*(?P<name>[A-Za-z_$][\w$]*)\s*\([^)]*\)\s*(?::\s*[^{=]+)?\{\s*$",
+                ),
+            ],
+        );
+
+        let class_like = r"^(?:(?:public|private|protected|internal|abstract|final|static|sealed|open|data|partial|readonly|fileprivate|inner|enum|annotation)\s+)*(?P<kind>class|interface|enum|struct|record|object|protocol|extension|trait)\s+(?P<name>[A-Za-z_]\w*)";
+
+        patterns.insert(
+            Language::Java,
+            vec![
+                pattern("class", class_like),
+                pattern(
+                    "method",
+                    r"^(?:@\w+\s+)*(?:(?:public|private|protected|static|final|abstract|synchronized|native|default)\s+)+(?:<[^>]*>\s*)?[\w<>\[\],.? ]+\s+(?P<name>[A-Za-z_]\w*)\s*\(",
+                ),
+            ],
+        );
+
+        patterns.insert(
+            Language::CSharp,
+            vec![
+                pattern("class", class_like),
+                pattern(
+                    "method",
+                    r"^(?:\[[^\]]*\]\s*)*(?:(?:public|private|protected|internal|static|virtual|override|abstract|async|sealed|extern|unsafe|new)\s+)+[\w<>\[\],.?() ]+\s+(?P<name>[A-Za-z_]\w*)\s*(?:<[^>]*>)?\s*\(",
+                ),
+            ],
+        );
+
+        patterns.insert(
+            Language::Kotlin,
+            vec![
+                pattern("class", class_like),
+                pattern(
+                    "function",
+                    r"^(?:(?:public|private|protected|internal|override|suspend|inline|open|abstract|operator|infix|tailrec)\s+)*fun\s+(?:<[^>]*>\s*)?(?:[\w.<>]+\.)?(?P<name>[A-Za-z_]\w*)",
+                ),
+            ],
+        );
+
+        patterns.insert(
+            Language::Swift,
+            vec![
+                pattern("class", class_like),
+                pattern(
+                    "function",
+                    r"^(?:@\w+\s+)*(?:(?:public|private|fileprivate|internal|open|static|class|override|mutating|final)\s+)*func\s+(?P<name>[A-Za-z_]\w*)",
+                ),
+            ],
+        );
+
+        patterns.insert(
+            Language::Php,
+            vec![
+                pattern(
+                    "class",
+                    r"^(?:(?:abstract|final|readonly)\s+)*(?P<kind>class|interface|trait|enum)\s+(?P<name>[A-Za-z_]\w*)",
+                ),
+                pattern(
+                    "function",
+                    r"^(?:(?:public|private|protected|static|abstract|final)\s+)*function\s+&?(?P<name>[A-Za-z_]\w*)",
+                ),
+            ],
+        );
+
+        patterns.insert(
+            Language::Ruby,
+            vec![
+                pattern("method", r"^def\s+(?:self\.)?(?P<name>[A-Za-z_]\w*[?!=]?)"),
+                pattern("class", r"^(?P<kind>class|module)\s+(?P<name>[A-Z][\w:]*)"),
+            ],
+        );
+
+        patterns.insert(
+            Language::C,
+            vec![
+                pattern(
+                    "type",
+                    r"^(?:typedef\s+)?(?:template\s*<[^>]*>\s*)?(?P<kind>struct|class|union|enum|namespace)\s+(?P<name>[A-Za-z_]\w*)\s*(?::[^;{]*)?\{?\s*$",
+                ),
+                // a definition starts at the beginning of the line and doesn't end with a semicolon
+                pattern(
+                    "function",
+                    r"^(?:[A-Za-z_][\w:<>,*&]*\s+[*&]*)+(?P<name>[A-Za-z_~][\w:~]*)\s*\([^;]*$",
+                ),
+            ],
+        );
+
+        patterns
+    });
+
+    patterns.get(&language).map(Vec::as_slice).unwrap_or(&[])
+}
+
+fn match_symbol(language: Language, line: &str, line_number: usize) -> Option<Symbol> {
+    let trimmed = line.trim_start();
+    if trimmed.is_empty() || is_comment(language, trimmed) {
+        return None;
+    }
+    let indent = line.len() - trimmed.len();
+
+    patterns_for(language).iter().find_map(|pattern| {
+        // C functions are only recognized at the top level, anything indented is a statement
+        if language == Language::C && indent > 0 && pattern.kind == "function" {
+            return None;
+        }
+        let captures = pattern.regex.captures(trimmed)?;
+        let name = captures.name("name")?.as_str();
+        if KEYWORDS.contains(&name) {
+            return None;
+        }
+        let kind = captures
+            .name("kind")
+            .map(|kind| kind.as_str())
+            .unwrap_or(pattern.kind);
+
+        Some(Symbol {
+            name: name.to_string(),
+            kind: kind.to_string(),
+            line: line_number,
+            indent,
+        })
+    })
+}
+
+/// Every definition in the file, in order
+pub fn extract_symbols(language: Language, text: &str) -> Vec<Symbol> {
+    text.lines()
+        .enumerate()
+        .filter_map(|(i, line)| match_symbol(language, line, i + 1))
+        .collect()
+}
+
+fn is_comment(language: Language, trimmed: &str) -> bool {
+    match language {
+        Language::Python | Language::Ruby => trimmed.starts_with('#'),
+        Language::Php => {
+            trimmed.starts_with("//")
+                || trimmed.starts_with('#')
+                || trimmed.starts_with("/*")
+                || trimmed.starts_with('*')
+        }
+        _ => trimmed.starts_with("//") || trimmed.starts_with("/*") || trimmed.starts_with('*'),
+    }
+}
+
+/// Lines right above a definition that belong to it: doc comments, decorators, annotations and attributes
+fn is_preamble(language: Language, trimmed: &str) -> bool {
+    !trimmed.is_empty()
+        && (is_comment(language, trimmed)
+            || trimmed.starts_with('@')
+            || trimmed.starts_with("#[")
+            || (language == Language::CSharp && trimmed.starts_with('[')))
+}
+
+fn count_words(lines: &[&str]) -> usize {
+    lines
+        .iter()
+        .map(|line| line.split_whitespace().count())
+        .sum()
+}
+
+/// A run of lines [start, end) and the definition it holds
+struct Segment {
+    start: usize,
+    end: usize,
+    section: Option<String>,
+}
+
+/// Moves a definition's start up over the comments and decorators above it, never above `floor`
+fn extend_over_preamble(language: Language, lines: &[&str], start: usize, floor: usize) -> usize {
+    let mut start = start;
+    while start > floor && is_preamble(language, lines[start - 1].trim()) {
+        start -= 1;
+    }
+    start
+}
+
+/// Cuts [start, end) at the outermost of the given definitions. `header` labels the lines before the first one,
+/// which are the enclosing definition's own opening lines or the imports at the top of the file
+fn split_at_definitions<'a>(
+    language: Language,
+    lines: &[&str],
+    start: usize,
+    end: usize,
+    definitions: Vec<&'a Symbol>,
+    header: Option<String>,
+) -> Vec<(Segment, Option<&'a Symbol>)> {
+    let mut current = Segment {
+        start,
+        end,
+        section: header,
+    };
+    let Some(outer_indent) = definitions.iter().map(|symbol| symbol.indent).min() else {
+        return vec![(current, None)];
+    };
+
+    let mut segments = Vec::new();
+    let mut current_symbol: Option<&Symbol> = None;
+
+    for symbol in definitions
+        .into_iter()
+        .filter(|symbol| symbol.indent == outer_indent)
+    {
+        let boundary = extend_over_preamble(language, lines, symbol.line - 1, current.start);
+        if boundary > current.start {
+            current.end = boundary;
+            segments.push((current, current_symbol));
+        } else if current_symbol.is_some() {
+            continue;
+        }
+
+        // a definition right at the start takes over the segment instead of leaving an empty one before it
+        current = Segment {
+            start: boundary,
+            end,
+            section: Some(symbol.label()),
+        };
+        current_symbol = Some(symbol);
+    }
+    segments.push((current, current_symbol));
+
+    segments
+}
+
+/// Splits lines that are over the size budget and have no definitions left to cut at, keeping whole lines
+fn split_by_lines(lines: &[&str], segment: Segment, max_words: usize, out: &mut Vec<Segment>) {
+    let mut start = segment.start;
+    let mut words = 0;
+
+    for i in segment.start..segment.end {
+        let line_words = lines[i].split_whitespace().count();
+        if words > 0 && words + line_words > max_words {
+            out.push(Segment {
+                start,
+                end: i,
+                section: segment.section.clone(),
+            });
+            start = i;
+            words = 0;
+        }
+        words += line_words;
+    }
+
+    if start >= segment.end {
+        return;
+    }
+    // a few closing lines stay with the window before them rather than becoming a chunk of their own
+    match out.last_mut() {
+        Some(last)
+            if last.end == start
+                && last.section == segment.section
+                && words < MIN_SEGMENT_WORDS =>
+        {
+            last.end = segment.end
+        }
+        _ => out.push(Segment {
+            start,
+            end: segment.end,
+            section: segment.section,
+        }),
+    }
+}
+
+/// Cuts a segment that is over the budget along its nested definitions, then by lines
+fn split_oversized(
+    language: Language,
+    lines: &[&str],
+    segment: Segment,
+    symbol: Option<&Symbol>,
+    symbols: &[Symbol],
+    max_words: usize,
+    out: &mut Vec<Segment>,
+) {
+    if count_words(&lines[segment.start..segment.end]) <= max_words {
+        out.push(segment);
+        return;
+    }
+
+    let Some(symbol) = symbol else {
+        split_by_lines(lines, segment, max_words, out);
+        return;
+    };
+
+    // the first line of the range is the enclosing definition itself, symbols hold 1-based lines
+    let start = symbol.line - 1;
+    let nested = symbols
+        .iter()
+        .filter(|nested| nested.line - 1 > start && nested.line - 1 < segment.end)
+        .collect();
+    let pieces = split_at_definitions(
+        language,
+        lines,
+        start,
+        segment.end,
+        nested,
+        segment.section.clone(),
+    );
+    if pieces.len() == 1 {
+        split_by_lines(lines, segment, max_words, out);
+        return;
+    }
+
+    for (mut piece, nested) in pieces {
+        // the comments above the enclosing definition stay with its header
+        if piece.start == start {
+            piece.start = segment.start;
+        }
+        if let (Some(nested), Some(parent)) = (nested, &segment.section) {
+            // methods read as "class Server / method handle"
+            piece.section = Some(format!("{} / {}", parent, nested.label()));
+        }
+        split_oversized(language, lines, piece, nested, symbols, max_words, out);
+    }
+}
+
+/// Merges tiny segments into the one after them when the result still fits
+fn merge_small(lines: &[&str], segments: Vec<Segment>, max_words: usize) -> Vec<Segment> {
+    let mut merged: Vec<Segment> = Vec::new();
+    let mut pending: Option<Segment> = None;
+
+    for segment in segments {
+        let segment = match pending.take() {
+            Some(small)
+                if count_words(&lines[small.start..segment.end]) <= max_words
+                    && small.end == segment.start =>
+            {
+                Segment {
+                    start: small.start,
+                    end: segment.end,
+                    section: match (small.section, segment.section) {
+                        // a class header merged into its first method is already named by it
+                        (Some(first), Some(second)) if second.starts_with(&first) => Some(second),
+                        (Some(first), Some(second)) => Some(format!("{}, {}", first, second)),
+                        (first, second) => second.or(first),
+                    },
+                }
+            }
+            Some(small) => {
+                merged.push(small);
+                segment
+            }
+            None => segment,
+        };
+
+        if count_words(&lines[segment.start..segment.end]) < MIN_SEGMENT_WORDS {
+            pending = Some(segment);
+        } else {
+            merged.push(segment);
+        }
+    }
+    merged.extend(pending);
+
+    merged
+}
+
+/// Splits source code into (section, text) pieces along its definitions
+pub fn chunk_code(
+    language: Language,
+    text: &str,
+    max_words: usize,
+) -> Vec<(Option<String>, String)> {
+    let lines: Vec<&str> = text.lines().collect();
+    if lines.is_empty() {
+        return Vec::new();
+    }
+    let symbols = extract_symbols(language, text);
+    let max_words = max_words.max(MIN_SEGMENT_WORDS);
+
+    // the top level is always cut at every definition, even in small files, so each one can be found on its own
+    let top_level = split_at_definitions(
+        language,
+        &lines,
+        0,
+        lines.len(),
+        symbols.iter().collect(),
+        None,
+    );
+
+    let mut segments = Vec::new();
+    for (segment, symbol) in top_level {
+        split_oversized(
+            language,
+            &lines,
+            segment,
+            symbol,
+            &symbols,
+            max_words,
+            &mut segments,
+        );
+    }
+
+    merge_small(&lines, segments, max_words)
+        .into_iter()
+        .filter_map(|segment| {
+            let content = lines[segment.start..segment.end].join("\n");
+            if content.trim().is_empty() {
+                None
+            } else {
+                Some((segment.section, content))
+            }
+        })
+        .collect()
+}
+
+/// Chunker for source files, one chunk per definition
+#[derive(Default)]
+pub struct CodeChunker;
+
+#[async_trait]
+impl Chunker for CodeChunker {
+    fn supported_mime_types(&self) -> Vec<&str> {
+        vec![
+            "text/x-c",
+            "text/x-c++",
+            "text/x-csharp",
+            "text/x-go",
+            "text/x-java",
+            "application/javascript",
+            "application/typescript",
+            "text/x-kotlin",
+            "text/x-php",
+            "text/x-python",
+            "text/x-ruby",
+            "text/rust",
+            "text/x-swift",
+        ]
+    }
+
+    fn can_chunk_file_type(&self, path: &Path) -> bool {
+        language_for_path(path).is_some()
+    }
+
+    async fn extract_chunks(
+        &self,
+        file: &FileMetadata,
+        config: &ChunkerConfig,
+    ) -> ChunkerResult<Vec<Chunk>> {
+        let path = Path::new(&file.base.path);
+        let language = language_for_path(path)
+            .ok_or_else(|| ChunkerError::UnsupportedType(file.extension.clone()))?;
+
+        let bytes = tokio::fs::read(path).await?;
+        let text = String::from_utf8(bytes)
+            .map_err(|e| ChunkerError::TextFileError(format!("{}: {}", path.display(), e)))?;
+        let text = if config.normalize_text {
+            util::normalize_text(&text.replace("\r\n", "\n"))
+        } else {
+            text
+        };
+
+        let pieces = chunk_code(language, &text, config.chunk_size);
+        let total_chunks = pieces.len();
+
+        Ok(pieces
+            .into_iter()
+            .enumerate()
+            .map(|(chunk_index, (section, content))| Chunk {
+                content,
+                metadata: ChunkMetadata {
+                    source_path: path.to_path_buf(),
+                    chunk_index,
+                    total_chunks: Some(total_chunks),
+                    page_number: None,
+                    section,
+                    mime_type: language.mime_type().to_string(),
+                },
+            })
+            .collect())
+    }
+}
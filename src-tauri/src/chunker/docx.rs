@@ -1,18 +1,31 @@
 use async_trait::async_trait;
-use docx_rs::read_docx;
+use std::io::{Cursor, Read};
 use std::path::Path;
-use std::sync::Arc;
 use tokio::fs::File;
 use tokio::io::AsyncReadExt;
+use xml::attribute::OwnedAttribute;
+use xml::name::OwnedName;
+use xml::reader::{ParserConfig, XmlEvent};
+use zip::result::ZipError;
+use zip::ZipArchive;
 
-use crate::embedder::Embedder;
 use crate::file_processor::FileMetadata;
 
 use super::common::{Chunk, ChunkMetadata, ChunkerConfig, ChunkerResult};
 use super::Chunker;
 use super::{util, ChunkerError};
 
-/// Extremely simplified Parser for DOCX files that just extracts all text
+const WORD_NAMESPACES: [&str; 2] = [
+    "http://schemas.openxmlformats.org/wordprocessingml/2006/main",
+    "http://purl.oclc.org/ooxml/wordprocessingml/main",
+];
+const MARKUP_COMPATIBILITY_NAMESPACE: &str =
+    "http://schemas.openxmlformats.org/markup-compatibility/2006";
+const MAIN_PART: &str = "word/document.xml";
+const NOTES_PARTS: [&str; 2] = ["word/footnotes.xml", "word/endnotes.xml"];
+
+/// Parser for DOCX files that reads the WordprocessingML parts of the package directly: the body with its tables
+/// and text boxes, then the headers, footers, footnotes and endnotes
 #[derive(Default)]
 pub struct DocxChunker;
 
@@ -43,12 +56,11 @@ impl Chunker for DocxChunker {
         }
     }
 
-    async fn chunk_file(
+    async fn extract_chunks(
         &self,
         file: &FileMetadata,
         config: &ChunkerConfig,
-        embedder: Arc<Embedder>,
-    ) -> ChunkerResult<Vec<(Chunk, Vec<f32>)>> {
+    ) -> ChunkerResult<Vec<Chunk>> {
         println!("Creating DOCX chunks for file {:?}", file.base.path);
 
         let path = Path::new(&file.base.path);
@@ -62,7 +74,7 @@ impl Chunker for DocxChunker {
 
         // Extract text and create chunks
         let chunks = tokio::task::spawn_blocking(move || {
-            // Parse the DOCX document and extract all text using a simplified approach
+            // Parse the DOCX package and extract the text of all its parts
             let extracted_text = match extract_text_from_docx(&buffer) {
                 Ok(text) => text,
                 Err(e) => return Err(e),
@@ -75,8 +87,8 @@ impl Chunker for DocxChunker {
                 extracted_text
             };
 
-            // Use the common text chunking utility
-            let text_chunks = util::chunk_text(
+            // paragraphs and table rows are on their own lines, chunking by lines keeps them apart
+            let text_chunks = util::chunk_lines(
                 &processed_text,
                 config_clone.chunk_size,
                 config_clone.chunk_overlap,
@@ -105,107 +117,279 @@ impl Chunker for DocxChunker {
         .await
         .map_err(|e| ChunkerError::Other(format!("Thread error: {:?}", e)))??;
 
-        if chunks.is_empty() {
-            return Ok(Vec::new());
-        }
+        Ok(chunks)
+    }
+}
 
-        // Process embeddings in a single batch
-        tokio::task::spawn_blocking(move || {
-            let texts: Vec<&str> = chunks.iter().map(|chunk| chunk.content.as_str()).collect();
+/// Extract the text of a DOCX file, part by part. Headers and footers that repeat between sections are kept once
+fn extract_text_from_docx(buffer: &[u8]) -> ChunkerResult<String> {
+    let mut archive = ZipArchive::new(Cursor::new(buffer))
+        .map_err(|e| ChunkerError::Other(format!("Failed to open DOCX: {}", e)))?;
 
-            match embedder.model.embed(texts, None) {
-                Ok(embeddings) => {
-                    let chunk_embeddings: Vec<(Chunk, Vec<f32>)> = chunks
-                        .into_iter()
-                        .zip(embeddings.into_iter())
-                        .filter(|(_, embedding)| !embedding.is_empty())
-                        .collect();
+    let body = read_part(&mut archive, MAIN_PART)?.ok_or_else(|| {
+        ChunkerError::Other(format!("Failed to parse DOCX: {} is missing", MAIN_PART))
+    })?;
+    let mut sections = vec![body];
 
-                    Ok(chunk_embeddings)
-                }
-                Err(_) => Err(ChunkerError::Other(
-                    "Failed to generate embeddings".to_string(),
-                )),
-            }
+    let mut headers_and_footers: Vec<String> = archive
+        .file_names()
+        .filter(|name| {
+            (name.starts_with("word/header") || name.starts_with("word/footer"))
+                && name.ends_with(".xml")
         })
-        .await
-        .map_err(|e| ChunkerError::Other(format!("Thread error: {:?}", e)))?
+        .map(str::to_string)
+        .collect();
+    headers_and_footers.sort_by_key(|name| (name.starts_with("word/footer"), name.clone()));
+
+    let other_parts = headers_and_footers
+        .iter()
+        .map(String::as_str)
+        .chain(NOTES_PARTS);
+    for name in other_parts {
+        if let Some(text) = read_part(&mut archive, name)? {
+            if !text.is_empty() && !sections.contains(&text) {
+                sections.push(text);
+            }
+        }
     }
+
+    Ok(sections.join("\n\n"))
 }
 
-/// Extract all text from a DOCX file using a much simpler approach
-fn extract_text_from_docx(buffer: &[u8]) -> ChunkerResult<String> {
-    // Parse the DOCX document
-    let doc = read_docx(buffer)
-        .map_err(|e| ChunkerError::Other(format!("Failed to parse DOCX: {:?}", e)))?;
+/// Returns None if the package doesn't have the part
+fn read_part(archive: &mut ZipArchive<Cursor<&[u8]>>, name: &str) -> ChunkerResult<Option<String>> {
+    let mut part = match archive.by_name(name) {
+        Ok(part) => part,
+        Err(ZipError::FileNotFound) => return Ok(None),
+        Err(e) => {
+            return Err(ChunkerError::Other(format!(
+                "Failed to read {} from DOCX: {}",
+                name, e
+            )))
+        }
+    };
 
-    // Ultra-simplified approach: extract text from paragraphs only
-    let mut text = String::new();
+    let mut xml = Vec::new();
+    part.read_to_end(&mut xml)?;
 
-    // Walk through the document structure
-    extract_text_recursive(&doc.document, &mut text);
+    extract_part_text(&xml).map(Some)
+}
 
-    Ok(text)
+/// Text collected for a part, a table cell, a text box or a note
+#[derive(Default)]
+struct Block {
+    lines: Vec<String>,
+    paragraph: String,
+    /// Text boxes anchored in the current paragraph, they are read after it
+    floating: Vec<String>,
 }
 
-/// Recursively extract text from a document structure
-fn extract_text_recursive(doc: &docx_rs::Document, text: &mut String) {
-    for child in &doc.children {
-        match child {
-            docx_rs::DocumentChild::Paragraph(para) => {
-                // Process paragraphs
-                for run_child in &para.children {
-                    if let docx_rs::ParagraphChild::Run(run) = run_child {
-                        for text_child in &run.children {
-                            if let docx_rs::RunChild::Text(t) = text_child {
-                                text.push_str(&t.text);
-                            }
+impl Block {
+    fn end_paragraph(&mut self) {
+        let paragraph = std::mem::take(&mut self.paragraph);
+        if !paragraph.trim().is_empty() {
+            self.lines.push(paragraph.trim().to_string());
+        }
+        self.lines.append(&mut self.floating);
+    }
+
+    fn into_lines(mut self) -> Vec<String> {
+        self.end_paragraph();
+        self.lines
+    }
+}
+
+#[derive(Default)]
+struct Table {
+    rows: Vec<String>,
+    cells: Vec<String>,
+}
+
+enum Frame {
+    Block(Block),
+    Table(Table),
+}
+
+/// Walks the WordprocessingML of one part (the body, a header, the footnotes, ...) and returns its text,
+/// one paragraph per line and one table row per line with the cells separated by tabs
+fn extract_part_text(xml: &[u8]) -> ChunkerResult<String> {
+    let reader = ParserConfig::new()
+        .whitespace_to_characters(true)
+        .cdata_to_characters(true)
+        .ignore_comments(true)
+        .create_reader(xml);
+
+    let mut frames = vec![Frame::Block(Block::default())];
+    let mut in_text = false;
+    // the note being read in the footnotes and endnotes parts
+    let mut note_id: Option<String> = None;
+    // depth inside an mc:Fallback, which repeats the content of the mc:Choice next to it
+    let mut skip_depth = 0usize;
+
+    for event in reader {
+        let event =
+            event.map_err(|e| ChunkerError::Other(format!("Failed to parse DOCX: {}", e)))?;
+
+        if skip_depth > 0 {
+            match event {
+                XmlEvent::StartElement { .. } => skip_depth += 1,
+                XmlEvent::EndElement { .. } => skip_depth -= 1,
+                _ => {}
+            }
+            continue;
+        }
+
+        match event {
+            XmlEvent::StartElement {
+                name, attributes, ..
+            } => {
+                if name.namespace.as_deref() == Some(MARKUP_COMPATIBILITY_NAMESPACE)
+                    && name.local_name == "Fallback"
+                {
+                    skip_depth = 1;
+                    continue;
+                }
+                if !is_word(&name) {
+                    continue;
+                }
+
+                match name.local_name.as_str() {
+                    "t" => in_text = true,
+                    "tab" | "br" | "cr" => {
+                        // cells are tab separated, so breaks inside them become spaces
+                        let separator = match (name.local_name.as_str(), in_table(&frames)) {
+                            ("tab", false) => '\t',
+                            (_, false) => '\n',
+                            _ => ' ',
+                        };
+                        current_block(&mut frames).paragraph.push(separator);
+                    }
+                    "footnoteReference" | "endnoteReference" => {
+                        if let Some(id) = attribute(&attributes, "id") {
+                            current_block(&mut frames)
+                                .paragraph
+                                .push_str(&format!("[{}]", id));
+                        }
+                    }
+                    "tbl" => frames.push(Frame::Table(Table::default())),
+                    "tc" | "txbxContent" => frames.push(Frame::Block(Block::default())),
+                    "footnote" | "endnote" => {
+                        // the separator lines between the body and the notes
+                        if attribute(&attributes, "type").is_some_and(|kind| kind != "normal") {
+                            skip_depth = 1;
+                            continue;
                         }
+                        note_id = attribute(&attributes, "id").map(str::to_string);
+                        frames.push(Frame::Block(Block::default()));
                     }
+                    // the note's own mark at the start of its text
+                    "footnoteRef" | "endnoteRef" => {
+                        if let Some(id) = &note_id {
+                            current_block(&mut frames)
+                                .paragraph
+                                .push_str(&format!("[{}]", id));
+                        }
+                    }
+                    _ => {}
                 }
-                text.push('\n'); // Add newline after paragraphs
             }
-            docx_rs::DocumentChild::Table(table) => {
-                // Process tables
-                for row_child in &table.rows {
-                    // Since TableChild has only one variant, we can directly extract it
-                    let row = match row_child {
-                        docx_rs::TableChild::TableRow(row) => row,
-                    };
-
-                    for cell_child in &row.cells {
-                        // Extract text from each cell
-                        // Since TableRowChild has only one variant, we can directly extract it
-                        let cell = match cell_child {
-                            docx_rs::TableRowChild::TableCell(cell) => cell,
-                        };
+            XmlEvent::EndElement { name } => {
+                if !is_word(&name) {
+                    continue;
+                }
 
-                        for cell_content in &cell.children {
-                            match cell_content {
-                                docx_rs::TableCellContent::Paragraph(p) => {
-                                    for run_child in &p.children {
-                                        if let docx_rs::ParagraphChild::Run(run) = run_child {
-                                            for text_child in &run.children {
-                                                if let docx_rs::RunChild::Text(t) = text_child {
-                                                    text.push_str(&t.text);
-                                                }
-                                            }
-                                        }
-                                    }
-                                    text.push(' '); // Space between paragraphs in cell
-                                }
-                                _ => {} // Ignore other cell content types
+                match name.local_name.as_str() {
+                    "t" => in_text = false,
+                    "p" => current_block(&mut frames).end_paragraph(),
+                    "tc" => {
+                        let cell = pop_block(&mut frames).into_lines().join(" ");
+                        if let Some(Frame::Table(table)) = frames.last_mut() {
+                            table.cells.push(cell);
+                        }
+                    }
+                    "tr" => {
+                        if let Some(Frame::Table(table)) = frames.last_mut() {
+                            let row = std::mem::take(&mut table.cells).join("\t");
+                            if !row.trim().is_empty() {
+                                table.rows.push(row);
                             }
                         }
-                        text.push('\t'); // Tab between cells
                     }
-                    text.push('\n'); // Newline between rows
+                    "tbl" => {
+                        let Some(Frame::Table(table)) = frames.pop() else {
+                            continue;
+                        };
+                        let nested = in_table(&frames);
+                        let block = current_block(&mut frames);
+                        block.end_paragraph();
+                        if nested {
+                            // a table inside a cell can't keep its own rows and columns
+                            block.lines.push(table.rows.join(" ").replace('\t', " "));
+                        } else {
+                            block.lines.extend(table.rows);
+                        }
+                    }
+                    "txbxContent" => {
+                        let lines = pop_block(&mut frames).into_lines();
+                        current_block(&mut frames).floating.extend(lines);
+                    }
+                    "footnote" | "endnote" => {
+                        let note = pop_block(&mut frames).into_lines().join(" ");
+                        current_block(&mut frames).lines.push(note);
+                    }
+                    _ => {}
                 }
-                text.push('\n'); // Extra newline after table
             }
-            _ => {
-                // Skip other types
+            XmlEvent::Characters(text) if in_text => {
+                current_block(&mut frames).paragraph.push_str(&text);
             }
+            _ => {}
+        }
+    }
+
+    let lines = match frames.into_iter().next() {
+        Some(Frame::Block(block)) => block.into_lines(),
+        _ => Vec::new(),
+    };
+    Ok(lines.join("\n"))
+}
+
+fn is_word(name: &OwnedName) -> bool {
+    name.namespace
+        .as_deref()
+        .is_some_and(|namespace| WORD_NAMESPACES.contains(&namespace))
+}
+
+fn attribute<'a>(attributes: &'a [OwnedAttribute], local_name: &str) -> Option<&'a str> {
+    attributes
+        .iter()
+        .find(|attribute| attribute.name.local_name == local_name)
+        .map(|attribute| attribute.value.as_str())
+}
+
+fn in_table(frames: &[Frame]) -> bool {
+    frames.iter().any(|frame| matches!(frame, Frame::Table(_)))
+}
+
+/// The innermost block, the part itself is always at the bottom of the stack
+fn current_block(frames: &mut [Frame]) -> &mut Block {
+    frames
+        .iter_mut()
+        .rev()
+        .find_map(|frame| match frame {
+            Frame::Block(block) => Some(block),
+            Frame::Table(_) => None,
+        })
+        .expect("the part block is never popped")
+}
+
+/// Closes the innermost block, the XML is well formed so it is the one the closing element opened
+fn pop_block(frames: &mut Vec<Frame>) -> Block {
+    match frames.pop() {
+        Some(Frame::Block(block)) => block,
+        other => {
+            frames.extend(other);
+            Block::default()
         }
     }
 }
@@ -1,11 +1,9 @@
 use async_trait::async_trait;
 use serde_json::{Map, Value};
 use std::path::Path;
-use std::sync::Arc;
 use tokio::fs::File;
 use tokio::io::AsyncReadExt;
 
-use crate::embedder::Embedder;
 use crate::file_processor::FileMetadata;
 
 use super::common::{Chunk, ChunkMetadata, ChunkerConfig, ChunkerResult};
@@ -29,12 +27,11 @@ impl Chunker for JsonChunker {
         }
     }
 
-    async fn chunk_file(
+    async fn extract_chunks(
         &self,
         file: &FileMetadata,
         config: &ChunkerConfig,
-        embedder: Arc<Embedder>,
-    ) -> ChunkerResult<Vec<(Chunk, Vec<f32>)>> {
+    ) -> ChunkerResult<Vec<Chunk>> {
         println!("Creating JSON chunks for file {:?}", file.base.path);
 
         let path = Path::new(&file.base.path);
@@ -58,34 +55,7 @@ impl Chunker for JsonChunker {
         // Generate chunks based on JSON structure
         let chunks = chunk_json_value(json_value, path, config)?;
 
-        if chunks.is_empty() {
-            return Ok(Vec::new());
-        }
-
-        // Process embeddings in a single batch
-        tokio::task::spawn_blocking(move || {
-            // Extract just the text content for embedding
-            let texts: Vec<&str> = chunks.iter().map(|chunk| chunk.content.as_str()).collect();
-
-            // Generate embeddings
-            match embedder.model.embed(texts, None) {
-                Ok(embeddings) => {
-                    // Pair chunks with their embeddings
-                    let chunk_embeddings: Vec<(Chunk, Vec<f32>)> = chunks
-                        .into_iter()
-                        .zip(embeddings.into_iter())
-                        .filter(|(_, embedding)| !embedding.is_empty())
-                        .collect();
-
-                    Ok(chunk_embeddings)
-                }
-                Err(_) => Err(ChunkerError::JSONFileError(
-                    "Failed to generate embeddings".to_string(),
-                )),
-            }
-        })
-        .await
-        .map_err(|e| ChunkerError::JSONFileError(format!("Thread error: {:?}", e)))?
+        Ok(chunks)
     }
 }
 
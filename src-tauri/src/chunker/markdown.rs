@@ -1,15 +1,13 @@
 use async_trait::async_trait;
 use std::path::Path;
-use std::sync::Arc;
 use tokio::fs::File;
 use tokio::io::{AsyncBufReadExt, BufReader};
 
-use crate::embedder::Embedder;
 use crate::file_processor::FileMetadata;
 
 use super::common::{Chunk, ChunkMetadata, ChunkerConfig, ChunkerResult};
+use super::util;
 use super::Chunker;
-use super::{util, ChunkerError};
 
 // Parser for markdown files
 #[derive(Default)]
@@ -30,12 +28,11 @@ impl Chunker for MarkdownChunker {
         }
     }
 
-    async fn chunk_file(
+    async fn extract_chunks(
         &self,
         file: &FileMetadata,
         config: &ChunkerConfig,
-        embedder: Arc<Embedder>,
-    ) -> ChunkerResult<Vec<(Chunk, Vec<f32>)>> {
+    ) -> ChunkerResult<Vec<Chunk>> {
         let path = Path::new(&file.base.path);
 
         // Get chunks based on file size
@@ -47,34 +44,7 @@ impl Chunker for MarkdownChunker {
             get_chunks_from_small_file(path, config).await?
         };
 
-        if chunks.is_empty() {
-            return Ok(Vec::new());
-        }
-
-        // Process embeddings in a single batch
-        tokio::task::spawn_blocking(move || {
-            // Extract just the text content for embedding and convert from chunks to strings
-            let texts: Vec<&str> = chunks.iter().map(|chunk| chunk.content.as_str()).collect();
-
-            // Generate embeddings in one batch call
-            match embedder.model.embed(texts, None) {
-                Ok(embeddings) => {
-                    // Pair chunks with their embeddings
-                    let chunk_embeddings: Vec<(Chunk, Vec<f32>)> = chunks
-                        .into_iter()
-                        .zip(embeddings.into_iter())
-                        .filter(|(_, embedding)| !embedding.is_empty())
-                        .collect();
-
-                    Ok(chunk_embeddings)
-                }
-                Err(_) => Err(ChunkerError::TextFileError(
-                    "Failed to generate embeddings".to_string(),
-                )),
-            }
-        })
-        .await
-        .map_err(|e| ChunkerError::TextFileError(format!("Thread error: {:?}", e)))?
+        Ok(chunks)
     }
 }
 
@@ -8,12 +8,14 @@ use std::sync::Arc;
 use thiserror::Error;
 use tracing::error;
 
+pub mod code;
 pub mod docx;
 pub mod json;
 pub mod markdown;
 pub mod pdf;
 pub mod txt;
 
+use crate::fault_injection::{self, FaultPoint};
 use crate::{embedder::Embedder, file_processor::FileMetadata};
 
 pub use self::common::{Chunk, ChunkerConfig, ChunkerError, ChunkerResult};
@@ -66,6 +68,12 @@ pub mod common {
         #[error("Text File Parsing error: {0}")]
         TextFileError(String),
 
+        #[error("Embedding error: {0}")]
+        EmbeddingError(String),
+
+        #[error("Embedding quota exceeded: {0}")]
+        QuotaExceeded(String),
+
         #[error("Other error: {0}")]
         Other(String),
     }
@@ -78,12 +86,12 @@ pub trait Chunker: Send + Sync {
 
     fn can_chunk_file_type(&self, path: &Path) -> bool;
 
-    async fn chunk_file(
+    /// Reads the file and splits its text into chunks, without embedding them
+    async fn extract_chunks(
         &self,
         file: &FileMetadata,
         config: &ChunkerConfig,
-        embedder: Arc<Embedder>,
-    ) -> ChunkerResult<Vec<(Chunk, Vec<f32>)>>;
+    ) -> ChunkerResult<Vec<Chunk>>;
 }
 
 pub struct ChunkerOrchestrator {
@@ -107,6 +115,7 @@ impl ChunkerOrchestrator {
         orchestrator.register_chunker(Box::new(json::JsonChunker::default()));
         orchestrator.register_chunker(Box::new(docx::DocxChunker::default()));
         orchestrator.register_chunker(Box::new(markdown::MarkdownChunker::default()));
+        orchestrator.register_chunker(Box::new(code::CodeChunker::default()));
 
         orchestrator
     }
@@ -139,13 +148,50 @@ impl ChunkerOrchestrator {
                     self.extension_map.insert("rs".to_string(), chunker_index);
                 }
                 "application/javascript" => {
-                    self.extension_map.insert("js".to_string(), chunker_index);
+                    for ext in ["js", "jsx", "mjs", "cjs"] {
+                        self.extension_map.insert(ext.to_string(), chunker_index);
+                    }
                 }
                 "application/typescript" => {
-                    self.extension_map.insert("ts".to_string(), chunker_index);
+                    for ext in ["ts", "tsx", "mts", "cts"] {
+                        self.extension_map.insert(ext.to_string(), chunker_index);
+                    }
                 }
                 "text/x-python" => {
                     self.extension_map.insert("py".to_string(), chunker_index);
+                    self.extension_map.insert("pyi".to_string(), chunker_index);
+                }
+                "text/x-go" => {
+                    self.extension_map.insert("go".to_string(), chunker_index);
+                }
+                "text/x-java" => {
+                    self.extension_map.insert("java".to_string(), chunker_index);
+                }
+                "text/x-kotlin" => {
+                    self.extension_map.insert("kt".to_string(), chunker_index);
+                    self.extension_map.insert("kts".to_string(), chunker_index);
+                }
+                "text/x-swift" => {
+                    self.extension_map
+                        .insert("swift".to_string(), chunker_index);
+                }
+                "text/x-csharp" => {
+                    self.extension_map.insert("cs".to_string(), chunker_index);
+                }
+                "text/x-c" => {
+                    self.extension_map.insert("c".to_string(), chunker_index);
+                    self.extension_map.insert("h".to_string(), chunker_index);
+                }
+                "text/x-c++" => {
+                    for ext in ["cc", "cpp", "cxx", "hh", "hpp", "hxx"] {
+                        self.extension_map.insert(ext.to_string(), chunker_index);
+                    }
+                }
+                "text/x-ruby" => {
+                    self.extension_map.insert("rb".to_string(), chunker_index);
+                }
+                "text/x-php" => {
+                    self.extension_map.insert("php".to_string(), chunker_index);
                 }
                 "application/json" => {
                     self.extension_map.insert("json".to_string(), chunker_index);
@@ -177,6 +223,13 @@ impl ChunkerOrchestrator {
             if let Some(&chunker_idx) = self.extension_map.get(&ext_str) {
                 return Some(self.chunkers[chunker_idx].as_ref());
             }
+
+            // code and config files on the plain text allowlist go through the txt chunker
+            if txt::is_plain_text_extension(&ext_str) {
+                if let Some(&chunker_idx) = self.mime_map.get("text/plain") {
+                    return Some(self.chunkers[chunker_idx].as_ref());
+                }
+            }
         }
 
         // If that fails, try MIME type detection
@@ -203,17 +256,28 @@ impl ChunkerOrchestrator {
         None
     }
 
-    /// Find the right chunker for the file and chunk a single file
+    /// Find the right chunker for the file and extract its chunks
+    pub async fn extract_chunks(&self, file: &FileMetadata) -> ChunkerResult<Vec<Chunk>> {
+        let chunker: &dyn Chunker = self
+            .find_chunker_for_file(Path::new(&file.base.path))
+            .ok_or_else(|| ChunkerError::UnsupportedType(file.extension.clone()))?;
+
+        fault_injection::inject(FaultPoint::Extract, Path::new(&file.base.path))
+            .await
+            .map_err(|e| ChunkerError::Other(e.to_string()))?;
+
+        chunker.extract_chunks(file, &self.config).await
+    }
+
+    /// Find the right chunker for the file, chunk a single file and embed the chunks
     pub async fn chunk_file(
         &self,
         file: &FileMetadata,
         embedder: Arc<Embedder>,
     ) -> ChunkerResult<Vec<(Chunk, Vec<f32>)>> {
-        let chunker: &dyn Chunker = self
-            .find_chunker_for_file(Path::new(&file.base.path))
-            .ok_or_else(|| ChunkerError::UnsupportedType(file.extension.clone()))?;
+        let chunks = self.extract_chunks(file).await?;
 
-        chunker.chunk_file(file, &self.config, embedder).await
+        util::embed_chunks(chunks, embedder).await
     }
 }
 
@@ -293,6 +357,45 @@ pub mod util {
             "File has no extension and couldn't be identified by content".to_string(),
         ))
     }
+    /// Embeds the chunks in a single batch and pairs each chunk with its embedding
+    /// Chunks that come back with an empty embedding are dropped
+    pub async fn embed_chunks(
+        chunks: Vec<Chunk>,
+        embedder: Arc<Embedder>,
+    ) -> ChunkerResult<Vec<(Chunk, Vec<f32>)>> {
+        if chunks.is_empty() {
+            return Ok(Vec::new());
+        }
+
+        fault_injection::inject(FaultPoint::Embed, &chunks[0].metadata.source_path)
+            .await
+            .map_err(|e| ChunkerError::EmbeddingError(e.to_string()))?;
+
+        tokio::task::spawn_blocking(move || {
+            let texts: Vec<&str> = chunks.iter().map(|chunk| chunk.content.as_str()).collect();
+
+            match embedder.embed_batch(texts) {
+                Ok(embeddings) => {
+                    // Pair chunks with their embeddings
+                    let chunk_embeddings: Vec<(Chunk, Vec<f32>)> = chunks
+                        .into_iter()
+                        .zip(embeddings.into_iter())
+                        .filter(|(_, embedding)| !embedding.is_empty())
+                        .collect();
+
+                    Ok(chunk_embeddings)
+                }
+                Err(e) if e.is_quota_exceeded() => Err(ChunkerError::QuotaExceeded(e.to_string())),
+                Err(e) => Err(ChunkerError::EmbeddingError(format!(
+                    "Failed to generate embeddings: {}",
+                    e
+                ))),
+            }
+        })
+        .await
+        .map_err(|e| ChunkerError::EmbeddingError(format!("Thread error: {:?}", e)))?
+    }
+
     /// Normalize text: unify line endings, trim whitespace, etc.
     pub fn normalize_text(text: &str) -> String {
         let mut normalized = text.replace("\r", "\n"); // Normalize Mac line endings
@@ -338,4 +441,57 @@ pub mod util {
         }
         chunks
     }
+
+    /// Chunks texts like chunk_text but keeps the line breaks, so paragraphs and table rows stay apart.
+    /// Chunks end at line boundaries, only lines longer than chunk_size are cut between words
+    pub fn chunk_lines(text: &str, chunk_size: usize, overlap: usize) -> Vec<String> {
+        let mut lines: Vec<(String, usize)> = Vec::new();
+        for line in text.lines() {
+            let words: Vec<&str> = line.split_whitespace().collect();
+            if words.len() <= chunk_size {
+                lines.push((line.trim_end().to_string(), words.len()));
+                continue;
+            }
+            for piece in chunk_text(line, chunk_size, overlap) {
+                let count = piece.split_whitespace().count();
+                lines.push((piece, count));
+            }
+        }
+
+        let mut chunks: Vec<String> = Vec::new();
+        let mut current: Vec<usize> = Vec::new();
+        let mut words = 0;
+        // whether the chunk has lines besides the ones it shares with the previous chunk
+        let mut fresh = false;
+
+        for (i, (_, line_words)) in lines.iter().enumerate() {
+            if fresh && words + line_words > chunk_size {
+                chunks.push(join_lines(&lines, &current));
+
+                // the last lines of the chunk, up to overlap words, start the next one
+                let mut kept = 0;
+                let mut start = current.len();
+                while start > 0 && kept + lines[current[start - 1]].1 <= overlap {
+                    start -= 1;
+                    kept += lines[current[start]].1;
+                }
+                current.drain(..start);
+                words = kept;
+                fresh = false;
+            }
+            current.push(i);
+            words += line_words;
+            fresh |= *line_words > 0;
+        }
+        if fresh {
+            chunks.push(join_lines(&lines, &current));
+        }
+
+        chunks
+    }
+
+    fn join_lines(lines: &[(String, usize)], indexes: &[usize]) -> String {
+        let joined: Vec<&str> = indexes.iter().map(|&i| lines[i].0.as_str()).collect();
+        joined.join("\n").trim_matches('\n').to_string()
+    }
 }
@@ -1,15 +1,27 @@
 use async_trait::async_trait;
-use pdf_extract::extract_text;
+use lopdf::Document;
+use pdf_extract::{output_doc, MediaBox, OutputDev, OutputError, Transform};
 use std::path::Path;
-use std::sync::Arc;
 
-use crate::embedder::Embedder;
 use crate::file_processor::FileMetadata;
 
 use super::common::{Chunk, ChunkMetadata, ChunkerConfig, ChunkerResult};
 use super::Chunker;
 use super::{util, ChunkerError};
 
+/// A gap wider than this many font sizes splits a line into separate fragments, e.g. two columns
+const FRAGMENT_GAP: f64 = 1.5;
+/// A gap wider than this many font sizes between two glyphs is a space
+const WORD_GAP: f64 = 0.15;
+/// Glyphs whose baselines are closer than this many font sizes are on the same line
+const LINE_TOLERANCE: f64 = 0.4;
+/// Narrowest empty vertical strip that counts as the gutter between two columns, in points
+const MIN_GUTTER_WIDTH: f64 = 8.0;
+/// Each side of a gutter needs at least this many lines to be a column
+const MIN_COLUMN_LINES: usize = 3;
+/// Three columns is the most seen in practice (newsletters, papers with a margin column)
+const MAX_COLUMN_DEPTH: usize = 2;
+
 #[derive(Default)]
 pub struct PdfChunker;
 
@@ -26,100 +38,322 @@ impl Chunker for PdfChunker {
         }
     }
 
-    async fn chunk_file(
+    async fn extract_chunks(
         &self,
         file: &FileMetadata,
         config: &ChunkerConfig,
-        embedder: Arc<Embedder>,
-    ) -> ChunkerResult<Vec<(Chunk, Vec<f32>)>> {
+    ) -> ChunkerResult<Vec<Chunk>> {
         let path = Path::new(&file.base.path);
 
-        // Extract text from PDF
-        let pdf_text = extract_pdf_text(path).await?;
+        // Extract the text of every page in reading order
+        let pages = extract_pdf_pages(path).await?;
+
+        let chunks = chunk_pdf_pages(pages, path, config);
+
+        Ok(chunks)
+    }
+}
+
+/// A glyph as it was drawn on the page, in PDF space (y grows upwards)
+struct Glyph {
+    x: f64,
+    y: f64,
+    width: f64,
+    size: f64,
+    text: String,
+}
+
+/// Glyphs on one line that are close enough to be read together
+struct Fragment {
+    x0: f64,
+    x1: f64,
+    y: f64,
+    text: String,
+}
+
+/// Collects the glyphs of each page so they can be put in reading order once the page is done,
+/// instead of the content stream order which jumps between columns
+#[derive(Default)]
+struct PageCollector {
+    pages: Vec<(usize, String)>,
+    page_number: usize,
+    glyphs: Vec<Glyph>,
+}
+
+impl OutputDev for PageCollector {
+    fn begin_page(
+        &mut self,
+        page_num: u32,
+        _media_box: &MediaBox,
+        _art_box: Option<(f64, f64, f64, f64)>,
+    ) -> Result<(), OutputError> {
+        self.page_number = page_num as usize;
+        self.glyphs.clear();
+        Ok(())
+    }
+
+    fn end_page(&mut self) -> Result<(), OutputError> {
+        let text = layout_page(std::mem::take(&mut self.glyphs));
+        if !text.trim().is_empty() {
+            self.pages.push((self.page_number, text));
+        }
+        Ok(())
+    }
+
+    fn output_character(
+        &mut self,
+        trm: &Transform,
+        width: f64,
+        _spacing: f64,
+        font_size: f64,
+        char: &str,
+    ) -> Result<(), OutputError> {
+        // the font size scaled by the text rendering matrix, the same way pdf-extract's text output does it
+        let scaled_x = font_size * (trm.m11 + trm.m21);
+        let scaled_y = font_size * (trm.m12 + trm.m22);
+        let size = (scaled_x * scaled_y).abs().sqrt().max(1.0);
 
-        let chunks = chunk_pdf_text(&pdf_text, path, config).await?;
+        self.glyphs.push(Glyph {
+            x: trm.m31,
+            y: trm.m32,
+            width: width * size,
+            size,
+            text: char.to_string(),
+        });
+        Ok(())
+    }
+
+    fn begin_word(&mut self) -> Result<(), OutputError> {
+        Ok(())
+    }
+
+    fn end_word(&mut self) -> Result<(), OutputError> {
+        Ok(())
+    }
+
+    fn end_line(&mut self) -> Result<(), OutputError> {
+        Ok(())
+    }
+}
+
+/// Groups glyphs into lines, top to bottom, and cuts each line where it has a wide gap
+fn to_fragments(mut glyphs: Vec<Glyph>) -> Vec<Fragment> {
+    glyphs.sort_by(|a, b| b.y.total_cmp(&a.y));
 
-        if chunks.is_empty() {
-            return Ok(Vec::new());
+    let mut lines: Vec<Vec<Glyph>> = Vec::new();
+    for glyph in glyphs {
+        match lines.last_mut() {
+            Some(line) if (line[0].y - glyph.y).abs() <= line[0].size * LINE_TOLERANCE => {
+                line.push(glyph)
+            }
+            _ => lines.push(vec![glyph]),
         }
+    }
+
+    let mut fragments = Vec::new();
+    for mut line in lines {
+        line.sort_by(|a, b| a.x.total_cmp(&b.x));
+
+        let mut current: Option<Fragment> = None;
+        for glyph in line {
+            let end = glyph.x + glyph.width;
+            match current.as_mut() {
+                Some(fragment) if glyph.x - fragment.x1 <= glyph.size * FRAGMENT_GAP => {
+                    let gap = glyph.x - fragment.x1;
+                    let needs_space = gap > glyph.size * WORD_GAP
+                        && !fragment.text.ends_with(char::is_whitespace)
+                        && !glyph.text.starts_with(char::is_whitespace);
+                    if needs_space {
+                        fragment.text.push(' ');
+                    }
+                    fragment.text.push_str(&glyph.text);
+                    fragment.x1 = fragment.x1.max(end);
+                }
+                _ => {
+                    fragments.extend(current.take());
+                    current = Some(Fragment {
+                        x0: glyph.x,
+                        x1: end,
+                        y: glyph.y,
+                        text: glyph.text,
+                    });
+                }
+            }
+        }
+        fragments.extend(current);
+    }
 
-        tokio::task::spawn_blocking(move || {
-            let texts: Vec<&str> = chunks.iter().map(|chunk| chunk.content.as_str()).collect();
+    fragments.retain(|fragment| !fragment.text.trim().is_empty());
+    fragments
+}
+
+/// The widest empty vertical strip that has enough lines on both sides of it. Fragments that cross it
+/// (titles, full width figures captions) are allowed as long as they are few
+fn find_gutter(fragments: &[&Fragment]) -> Option<f64> {
+    let left = fragments.iter().map(|f| f.x0).fold(f64::INFINITY, f64::min);
+    let right = fragments
+        .iter()
+        .map(|f| f.x1)
+        .fold(f64::NEG_INFINITY, f64::max);
+    let width = right - left;
+    if !width.is_finite() || width < MIN_GUTTER_WIDTH * 4.0 {
+        return None;
+    }
 
-            match embedder.model.embed(texts, None) {
-                Ok(embeddings) => {
-                    // Pair chunks with their embeddings
-                    let chunk_embeddings: Vec<(Chunk, Vec<f32>)> = chunks
-                        .into_iter()
-                        .zip(embeddings.into_iter())
-                        .filter(|(_, embedding)| !embedding.is_empty())
-                        .collect();
+    let allowed_crossings = (fragments.len() / 10).max(1);
+    // columns are never squeezed against the edge of the text
+    let start = (left + width * 0.2).floor() as i64;
+    let end = (right - width * 0.2).ceil() as i64;
 
-                    Ok(chunk_embeddings)
+    let mut best: Option<(f64, f64)> = None;
+    let mut run_start: Option<i64> = None;
+    for x in start..=end + 1 {
+        let is_clear = x <= end
+            && fragments
+                .iter()
+                .filter(|f| f.x0 < x as f64 && f.x1 > x as f64)
+                .count()
+                <= allowed_crossings;
+
+        match (is_clear, run_start) {
+            (true, None) => run_start = Some(x),
+            (false, Some(from)) => {
+                let run = (x - from) as f64;
+                if run >= MIN_GUTTER_WIDTH && best.map_or(true, |(_, width)| run > width) {
+                    best = Some((from as f64 + run / 2.0, run));
                 }
-                Err(_) => Err(ChunkerError::PdFilefError(
-                    "Failed to generate embeddings".to_string(),
-                )),
+                run_start = None;
             }
-        })
-        .await
-        .map_err(|e| ChunkerError::PdFilefError(format!("Thread error: {:?}", e)))?
+            _ => {}
+        }
+    }
+
+    let (gutter, _) = best?;
+    let on_left = fragments.iter().filter(|f| f.x1 <= gutter).count();
+    let on_right = fragments.iter().filter(|f| f.x0 >= gutter).count();
+
+    (on_left >= MIN_COLUMN_LINES && on_right >= MIN_COLUMN_LINES).then_some(gutter)
+}
+
+/// Puts fragments in reading order: top to bottom, and column by column between the lines
+/// that span the whole width
+fn order_fragments<'a>(fragments: Vec<&'a Fragment>, depth: usize) -> Vec<&'a Fragment> {
+    let gutter = if depth < MAX_COLUMN_DEPTH {
+        find_gutter(&fragments)
+    } else {
+        None
+    };
+    let Some(gutter) = gutter else {
+        let mut ordered = fragments;
+        ordered.sort_by(|a, b| b.y.total_cmp(&a.y).then(a.x0.total_cmp(&b.x0)));
+        return ordered;
+    };
+
+    let mut by_height = fragments;
+    by_height.sort_by(|a, b| b.y.total_cmp(&a.y).then(a.x0.total_cmp(&b.x0)));
+
+    let mut ordered = Vec::with_capacity(by_height.len());
+    let mut left = Vec::new();
+    let mut right = Vec::new();
+    for fragment in by_height {
+        if fragment.x1 <= gutter {
+            left.push(fragment);
+        } else if fragment.x0 >= gutter {
+            right.push(fragment);
+        } else {
+            // a spanning line closes the columns above it
+            ordered.extend(order_fragments(std::mem::take(&mut left), depth + 1));
+            ordered.extend(order_fragments(std::mem::take(&mut right), depth + 1));
+            ordered.push(fragment);
+        }
+    }
+    ordered.extend(order_fragments(left, depth + 1));
+    ordered.extend(order_fragments(right, depth + 1));
+
+    ordered
+}
+
+/// Turns the glyphs of a page into its text in reading order
+fn layout_page(glyphs: Vec<Glyph>) -> String {
+    let fragments = to_fragments(glyphs);
+    let ordered = order_fragments(fragments.iter().collect(), 0);
+
+    let mut text = String::new();
+    let mut previous: Option<&Fragment> = None;
+    for fragment in ordered {
+        if let Some(previous) = previous {
+            // fragments on the same line that weren't split into columns are read together
+            let same_line = (previous.y - fragment.y).abs() < 0.5 && fragment.x0 >= previous.x1;
+            text.push(if same_line { ' ' } else { '\n' });
+        }
+        text.push_str(fragment.text.trim());
+        previous = Some(fragment);
     }
+
+    text
 }
 
-async fn extract_pdf_text(path: &Path) -> ChunkerResult<String> {
+/// Returns (page number, text) for every page that has text, page numbers start at 1
+async fn extract_pdf_pages(path: &Path) -> ChunkerResult<Vec<(usize, String)>> {
     // Use blocking operation in a spawn_blocking task since PDF processing can be intensive
-    let path_str = path.to_string_lossy().to_string();
-
-    let text = tokio::task::spawn_blocking(move || match extract_text(&path_str) {
-        Ok(text) => Ok(text),
-        Err(e) => Err(ChunkerError::PdFilefError(format!(
-            "Failed to extract PDF text: {}",
-            e
-        ))),
+    let path = path.to_path_buf();
+
+    let pages = tokio::task::spawn_blocking(move || {
+        let mut doc = Document::load(&path)
+            .map_err(|e| ChunkerError::PdFilefError(format!("Failed to load PDF: {}", e)))?;
+        // a lot of PDFs are encrypted with an empty user password just to set permissions
+        if doc.is_encrypted() {
+            let _ = doc.decrypt("");
+        }
+
+        let mut collector = PageCollector::default();
+        output_doc(&doc, &mut collector).map_err(|e| {
+            ChunkerError::PdFilefError(format!("Failed to extract PDF text: {}", e))
+        })?;
+
+        Ok(collector.pages)
     })
     .await
     .map_err(|e| ChunkerError::PdFilefError(format!("Thread error: {:?}", e)))??;
 
-    Ok(text)
+    Ok(pages)
 }
 
-async fn chunk_pdf_text(
-    text: &str,
-    path: &Path,
-    config: &ChunkerConfig,
-) -> ChunkerResult<Vec<Chunk>> {
-    // Process content
-    let processed_content = if config.normalize_text {
-        util::normalize_text(text)
-    } else {
-        text.to_string()
-    };
+/// Chunks every page on its own so each chunk knows the page it came from
+fn chunk_pdf_pages(pages: Vec<(usize, String)>, path: &Path, config: &ChunkerConfig) -> Vec<Chunk> {
+    let mut chunks = Vec::new();
+
+    for (page_number, text) in pages {
+        // Process content
+        let processed_content = if config.normalize_text {
+            util::normalize_text(&text)
+        } else {
+            text
+        };
+
+        // Create text chunks using the same function as for TXT files
+        let text_chunks =
+            util::chunk_text(&processed_content, config.chunk_size, config.chunk_overlap);
+
+        for content in text_chunks {
+            chunks.push(Chunk {
+                content,
+                metadata: ChunkMetadata {
+                    source_path: path.to_path_buf(),
+                    chunk_index: chunks.len(),
+                    total_chunks: None, // Will update later
+                    page_number: Some(page_number),
+                    section: None,
+                    mime_type: "application/pdf".to_string(),
+                },
+            });
+        }
+    }
+
+    let total_chunks = chunks.len();
+    for chunk in &mut chunks {
+        chunk.metadata.total_chunks = Some(total_chunks);
+    }
 
-    // Create text chunks using the same function as for TXT files
-    let text_chunks = util::chunk_text(&processed_content, config.chunk_size, config.chunk_overlap);
-
-    if text_chunks.is_empty() {
-        return Ok(Vec::new());
-    }
-
-    // Create chunks
-    let total_chunks = text_chunks.len();
-    let chunks = text_chunks
-        .into_iter()
-        .enumerate()
-        .map(|(idx, content)| Chunk {
-            content,
-            metadata: ChunkMetadata {
-                source_path: path.to_path_buf(),
-                chunk_index: idx,
-                total_chunks: Some(total_chunks),
-                page_number: None,
-                section: None,
-                mime_type: "application/pdf".to_string(),
-            },
-        })
-        .collect();
-
-    Ok(chunks)
+    chunks
 }
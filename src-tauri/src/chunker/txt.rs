@@ -1,16 +1,96 @@
 use async_trait::async_trait;
+use std::collections::HashSet;
+use std::io::Read;
 use std::path::Path;
-use std::sync::Arc;
+use std::sync::{OnceLock, RwLock};
 use tokio::fs::File;
 use tokio::io::{AsyncBufReadExt, BufReader};
 use tracing::debug;
 
-use crate::embedder::Embedder;
 use crate::file_processor::FileMetadata;
 
 use super::common::{Chunk, ChunkMetadata, ChunkerConfig, ChunkerResult};
+use super::util;
 use super::Chunker;
-use super::{util, ChunkerError};
+
+/// Extensions read as plain text out of the box. Users can add more with the `plain_text_extensions` setting
+pub const DEFAULT_PLAIN_TEXT_EXTENSIONS: [&str; 9] = [
+    "txt", "text", "yaml", "yml", "toml", "go", "rs", "proto", "sql",
+];
+
+/// How much of a file is sampled to decide whether it is text
+const TEXT_SAMPLE_BYTES: usize = 8192;
+/// Share of printable characters a sample needs to count as text
+const MIN_PRINTABLE_RATIO: f32 = 0.95;
+
+/// Extensions added through the settings, shared by the walker, the watcher and the orchestrator
+static EXTRA_PLAIN_TEXT_EXTENSIONS: OnceLock<RwLock<HashSet<String>>> = OnceLock::new();
+
+fn extra_extensions() -> &'static RwLock<HashSet<String>> {
+    EXTRA_PLAIN_TEXT_EXTENSIONS.get_or_init(|| RwLock::new(HashSet::new()))
+}
+
+/// Accepts "go", ".go" and "GO" alike
+fn normalize_extension(extension: &str) -> String {
+    extension.trim().trim_start_matches('.').to_lowercase()
+}
+
+/// Replaces the user configured plain text extensions
+pub fn set_plain_text_extensions(extensions: &[String]) {
+    let normalized: HashSet<String> = extensions
+        .iter()
+        .map(|ext| normalize_extension(ext))
+        .filter(|ext| !ext.is_empty())
+        .collect();
+
+    *extra_extensions().write().unwrap() = normalized;
+}
+
+pub fn is_plain_text_extension(extension: &str) -> bool {
+    let extension = normalize_extension(extension);
+
+    DEFAULT_PLAIN_TEXT_EXTENSIONS.contains(&extension.as_str())
+        || extra_extensions().read().unwrap().contains(&extension)
+}
+
+/// Samples the start of a file and decides whether it is text: valid UTF-8, no NUL bytes and almost only printable characters.
+/// Used for files whose extension isn't on any list, like README, Makefile or .bashrc
+pub fn looks_like_text(path: &Path) -> bool {
+    let Ok(file) = std::fs::File::open(path) else {
+        return false;
+    };
+
+    let mut sample = Vec::with_capacity(TEXT_SAMPLE_BYTES);
+    if file
+        .take(TEXT_SAMPLE_BYTES as u64)
+        .read_to_end(&mut sample)
+        .is_err()
+    {
+        return false;
+    }
+
+    if sample.is_empty() || sample.contains(&0) {
+        return false;
+    }
+
+    let text = match std::str::from_utf8(&sample) {
+        Ok(text) => text,
+        // the sample can end in the middle of a multi byte character
+        Err(e) if e.error_len().is_none() && e.valid_up_to() > 0 => {
+            // safe to unwrap, the bytes up to valid_up_to are valid UTF-8
+            std::str::from_utf8(&sample[..e.valid_up_to()]).unwrap()
+        }
+        Err(_) => return false,
+    };
+
+    let total = text.chars().count();
+    let printable = text
+        .chars()
+        .filter(|c| !c.is_control() || matches!(c, '\n' | '\r' | '\t' | '\x0c'))
+        .count();
+
+    printable as f32 / total as f32 >= MIN_PRINTABLE_RATIO
+}
 
 /// Parser for plain text files
 #[derive(Default)]
@@ -25,16 +105,16 @@ impl Chunker for TxtChunker {
     fn can_chunk_file_type(&self, path: &Path) -> bool {
         match util::detect_mime_type(path) {
             Ok(mime) => mime == "text/plain",
-            Err(_) => false,
+            // files without a known type are read as text when their content looks like text
+            Err(_) => looks_like_text(path),
         }
     }
 
-    async fn chunk_file(
+    async fn extract_chunks(
         &self,
         file: &FileMetadata,
         config: &ChunkerConfig,
-        embedder: Arc<Embedder>,
-    ) -> ChunkerResult<Vec<(Chunk, Vec<f32>)>> {
+    ) -> ChunkerResult<Vec<Chunk>> {
         let path = Path::new(&file.base.path);
 
         // Get chunks based on file size
@@ -46,34 +126,7 @@ impl Chunker for TxtChunker {
             get_chunks_from_small_file(path, config).await?
         };
 
-        if chunks.is_empty() {
-            return Ok(Vec::new());
-        }
-
-        // Process embeddings in a single batch
-        tokio::task::spawn_blocking(move || {
-            // Extract just the text content for embedding and convert from chunks to strings
-            let texts: Vec<&str> = chunks.iter().map(|chunk| chunk.content.as_str()).collect();
-
-            // Generate embeddings in one batch call
-            match embedder.model.embed(texts, None) {
-                Ok(embeddings) => {
-                    // Pair chunks with their embeddings
-                    let chunk_embeddings: Vec<(Chunk, Vec<f32>)> = chunks
-                        .into_iter()
-                        .zip(embeddings.into_iter())
-                        .filter(|(_, embedding)| !embedding.is_empty())
-                        .collect();
-
-                    Ok(chunk_embeddings)
-                }
-                Err(_) => Err(ChunkerError::TextFileError(
-                    "Failed to generate embeddings".to_string(),
-                )),
-            }
-        })
-        .await
-        .map_err(|e| ChunkerError::TextFileError(format!("Thread error: {:?}", e)))?
+        Ok(chunks)
     }
 }
 
@@ -0,0 +1,234 @@
+/// Apple Notes connector. Reads the NoteStore.sqlite database of the Notes app on macOS, which needs Full Disk
+/// Access. Note bodies are gzipped protobuf documents, only their plain text is pulled out. Locked notes are skipped
+use flate2::read::GzDecoder;
+use rusqlite::{Connection, OpenFlags, OptionalExtension};
+use std::collections::HashSet;
+use std::io::Read;
+use std::path::{Path, PathBuf};
+
+use super::{
+    ChangeSet, ConnectorError, ConnectorResult, LocalConnector, RemoteDocument, RemoteItem,
+};
+use crate::platform::DocumentAttributes;
+
+/// Core Data dates count seconds from 2001-01-01
+const CORE_DATA_EPOCH_OFFSET: f64 = 978_307_200.0;
+/// Attachments show up in the note text as object replacement characters
+const ATTACHMENT_PLACEHOLDER: char = '\u{fffc}';
+
+fn open_store(path: &Path) -> ConnectorResult<Connection> {
+    Connection::open_with_flags(
+        path,
+        OpenFlags::SQLITE_OPEN_READ_ONLY | OpenFlags::SQLITE_OPEN_NO_MUTEX,
+    )
+    .map_err(|e| {
+        ConnectorError::Other(format!(
+            "Can't open the Notes database at {} (kita needs Full Disk Access): {}",
+            path.display(),
+            e
+        ))
+    })
+}
+
+fn to_unix_secs(core_data_secs: f64) -> i64 {
+    (core_data_secs + CORE_DATA_EPOCH_OFFSET) as i64
+}
+
+fn read_varint(buf: &[u8], pos: &mut usize) -> Option<u64> {
+    let mut value = 0u64;
+    for shift in (0..64).step_by(7) {
+        let byte = *buf.get(*pos)?;
+        *pos += 1;
+        value |= u64::from(byte & 0x7f) << shift;
+        if byte & 0x80 == 0 {
+            return Some(value);
+        }
+    }
+    None
+}
+
+/// First length-delimited field with the given number in a protobuf message
+fn protobuf_field(buf: &[u8], number: u64) -> Option<&[u8]> {
+    let mut pos = 0;
+    while pos < buf.len() {
+        let key = read_varint(buf, &mut pos)?;
+        match key & 0x7 {
+            0 => {
+                read_varint(buf, &mut pos)?;
+            }
+            1 => pos += 8,
+            2 => {
+                let len = read_varint(buf, &mut pos)? as usize;
+                let end = pos.checked_add(len).filter(|end| *end <= buf.len())?;
+                if key >> 3 == number {
+                    return Some(&buf[pos..end]);
+                }
+                pos = end;
+            }
+            5 => pos += 4,
+            _ => return None,
+        }
+    }
+    None
+}
+
+/// The text of a note is at document (2) -> note (3) -> note_text (2) in the protobuf
+fn note_text(data: &[u8]) -> Option<String> {
+    let mut decompressed = Vec::new();
+    let data = if data.starts_with(&[0x1f, 0x8b]) {
+        GzDecoder::new(data).read_to_end(&mut decompressed).ok()?;
+        &decompressed[..]
+    } else {
+        data
+    };
+
+    let document = protobuf_field(data, 2)?;
+    let note = protobuf_field(document, 3)?;
+    let text = protobuf_field(note, 2)?;
+
+    Some(
+        String::from_utf8_lossy(text)
+            .chars()
+            .filter(|c| *c != ATTACHMENT_PLACEHOLDER)
+            .collect(),
+    )
+}
+
+#[derive(Default)]
+pub struct AppleNotesConnector;
+
+impl LocalConnector for AppleNotesConnector {
+    fn kind(&self) -> &'static str {
+        "apple-notes"
+    }
+
+    fn default_root(&self) -> Option<PathBuf> {
+        if !cfg!(target_os = "macos") {
+            return None;
+        }
+        dirs::home_dir().map(|home| {
+            home.join("Library/Group Containers/group.com.apple.notes/NoteStore.sqlite")
+        })
+    }
+
+    fn changes(
+        &self,
+        root: &Path,
+        cursor: Option<&str>,
+        known: &HashSet<String>,
+    ) -> ConnectorResult<ChangeSet> {
+        let conn = open_store(root)?;
+        let mut stmt = conn.prepare(
+            r#"
+            SELECT ZIDENTIFIER, ZTITLE1, ZMODIFICATIONDATE1
+            FROM ZICCLOUDSYNCINGOBJECT
+            WHERE ZNOTEDATA IS NOT NULL
+              AND ZIDENTIFIER IS NOT NULL
+              AND IFNULL(ZMARKEDFORDELETION, 0) = 0
+              AND IFNULL(ZISPASSWORDPROTECTED, 0) = 0
+            "#,
+        )?;
+        let notes = stmt
+            .query_map([], |row| {
+                Ok((
+                    row.get::<_, String>(0)?,
+                    row.get::<_, Option<String>>(1)?,
+                    row.get::<_, Option<f64>>(2)?,
+                ))
+            })?
+            .collect::<Result<Vec<_>, _>>()?;
+
+        // the cursor is the newest modification date seen, in unix seconds
+        let since = cursor.and_then(|cursor| cursor.parse::<i64>().ok());
+        let mut change_set = ChangeSet {
+            cursor: since.unwrap_or(0).to_string(),
+            ..Default::default()
+        };
+        let mut newest = since.unwrap_or(0);
+        let mut present = HashSet::new();
+
+        for (identifier, title, modified) in notes {
+            let modified_at = modified.map(to_unix_secs);
+            let changed = !known.contains(&identifier)
+                || match (since, modified_at) {
+                    (Some(since), Some(modified_at)) => modified_at > since,
+                    _ => true,
+                };
+
+            newest = newest.max(modified_at.unwrap_or(0));
+            present.insert(identifier.clone());
+            if changed {
+                let name = title.unwrap_or_else(|| "Untitled".to_string());
+                change_set.changed.push(RemoteItem {
+                    // titles aren't unique, so the identifier is part of the path
+                    path: format!("{}/{}", identifier, name),
+                    id: identifier,
+                    name,
+                    mime_type: Some("text/plain".to_string()),
+                    size: 0,
+                    modified_at,
+                });
+            }
+        }
+
+        change_set.cursor = newest.to_string();
+        change_set.removed = known
+            .iter()
+            .filter(|id| !present.contains(*id))
+            .cloned()
+            .collect();
+
+        Ok(change_set)
+    }
+
+    fn read_document(
+        &self,
+        root: &Path,
+        item: &RemoteItem,
+    ) -> ConnectorResult<Option<RemoteDocument>> {
+        let conn = open_store(root)?;
+        let row = conn
+            .query_row(
+                r#"
+                SELECT d.ZDATA, n.ZCREATIONDATE1, f.ZTITLE2
+                FROM ZICCLOUDSYNCINGOBJECT n
+                JOIN ZICNOTEDATA d ON d.Z_PK = n.ZNOTEDATA
+                LEFT JOIN ZICCLOUDSYNCINGOBJECT f ON f.Z_PK = n.ZFOLDER
+                WHERE n.ZIDENTIFIER = ?1
+                "#,
+                [&item.id],
+                |row| {
+                    Ok((
+                        row.get::<_, Option<Vec<u8>>>(0)?,
+                        row.get::<_, Option<f64>>(1)?,
+                        row.get::<_, Option<String>>(2)?,
+                    ))
+                },
+            )
+            .optional()?;
+
+        let Some((Some(data), created, folder)) = row else {
+            return Ok(None);
+        };
+        let Some(text) = note_text(&data) else {
+            return Ok(None);
+        };
+
+        let attributes = DocumentAttributes {
+            title: Some(item.name.clone()),
+            authors: Vec::new(),
+            // the folder works as a tag, it's how people group their notes
+            tags: folder.into_iter().collect(),
+            content_created_at: created.and_then(|secs| {
+                chrono::DateTime::from_timestamp(to_unix_secs(secs), 0)
+                    .map(|date| date.format("%Y-%m-%d %H:%M:%S").to_string())
+            }),
+        };
+
+        Ok(Some(RemoteDocument {
+            text,
+            attributes: Some(attributes),
+            email: None,
+        }))
+    }
+}
@@ -0,0 +1,154 @@
+/// Dropbox connector. list_folder walks the whole account on the first sync, its cursor is saved and
+/// list_folder/continue returns what changed since then. Moves show up as a deletion plus a new file
+use async_trait::async_trait;
+use reqwest::Client;
+use serde::Deserialize;
+use serde_json::json;
+
+use super::{check_response, ChangeSet, Connector, ConnectorResult, RemoteItem};
+use crate::chunker::txt::is_plain_text_extension;
+
+const API_BASE: &str = "https://api.dropboxapi.com/2";
+const CONTENT_BASE: &str = "https://content.dropboxapi.com/2";
+
+#[derive(Deserialize)]
+#[serde(tag = ".tag", rename_all = "lowercase")]
+enum Entry {
+    File {
+        name: String,
+        path_display: Option<String>,
+        path_lower: Option<String>,
+        size: i64,
+        server_modified: Option<String>,
+    },
+    Folder {},
+    Deleted {
+        path_lower: Option<String>,
+    },
+}
+
+#[derive(Deserialize)]
+struct ListFolderResult {
+    entries: Vec<Entry>,
+    cursor: String,
+    has_more: bool,
+}
+
+fn is_text_name(name: &str) -> bool {
+    let extension = std::path::Path::new(name)
+        .extension()
+        .map(|ext| ext.to_string_lossy().to_lowercase())
+        .unwrap_or_default();
+
+    extension == "md" || extension == "json" || is_plain_text_extension(&extension)
+}
+
+#[derive(Default)]
+pub struct DropboxConnector;
+
+#[async_trait]
+impl Connector for DropboxConnector {
+    fn kind(&self) -> &'static str {
+        "dropbox"
+    }
+
+    fn auth_endpoint(&self) -> &'static str {
+        "https://www.dropbox.com/oauth2/authorize"
+    }
+
+    fn token_endpoint(&self) -> &'static str {
+        "https://api.dropboxapi.com/oauth2/token"
+    }
+
+    fn auth_params(&self) -> Vec<(&'static str, &'static str)> {
+        // offline access gets us a refresh token, dropbox access tokens are short lived
+        vec![("token_access_type", "offline")]
+    }
+
+    async fn changes(
+        &self,
+        client: &Client,
+        access_token: &str,
+        cursor: Option<&str>,
+    ) -> ConnectorResult<ChangeSet> {
+        let mut change_set = ChangeSet::default();
+
+        let mut request = match cursor {
+            Some(cursor) => client
+                .post(format!("{}/files/list_folder/continue", API_BASE))
+                .json(&json!({ "cursor": cursor })),
+            None => client
+                .post(format!("{}/files/list_folder", API_BASE))
+                .json(&json!({ "path": "", "recursive": true })),
+        };
+
+        loop {
+            let response = check_response(request.bearer_auth(access_token).send().await?).await?;
+            let result: ListFolderResult = response.json().await?;
+
+            for entry in result.entries {
+                match entry {
+                    Entry::File {
+                        name,
+                        path_display,
+                        path_lower,
+                        size,
+                        server_modified,
+                    } => {
+                        // deletions only carry the lowercased path, so that is the id we track items by
+                        let Some(path_lower) = path_lower else {
+                            continue;
+                        };
+                        if !is_text_name(&name) {
+                            continue;
+                        }
+
+                        change_set.changed.push(RemoteItem {
+                            path: path_display.unwrap_or_else(|| path_lower.clone()),
+                            id: path_lower,
+                            name,
+                            mime_type: None,
+                            size,
+                            modified_at: server_modified
+                                .as_deref()
+                                .and_then(|time| chrono::DateTime::parse_from_rfc3339(time).ok())
+                                .map(|time| time.timestamp()),
+                        });
+                    }
+                    Entry::Deleted {
+                        path_lower: Some(path_lower),
+                    } => change_set.removed.push(path_lower),
+                    _ => {}
+                }
+            }
+
+            change_set.cursor = result.cursor;
+            if !result.has_more {
+                break;
+            }
+
+            request = client
+                .post(format!("{}/files/list_folder/continue", API_BASE))
+                .json(&json!({ "cursor": change_set.cursor }));
+        }
+
+        Ok(change_set)
+    }
+
+    async fn fetch_text(
+        &self,
+        client: &Client,
+        access_token: &str,
+        item: &RemoteItem,
+    ) -> ConnectorResult<Option<String>> {
+        let response = client
+            .post(format!("{}/files/download", CONTENT_BASE))
+            .bearer_auth(access_token)
+            .header("Dropbox-API-Arg", json!({ "path": item.id }).to_string())
+            .send()
+            .await?;
+        let bytes = check_response(response).await?.bytes().await?;
+
+        Ok(String::from_utf8(bytes.to_vec()).ok())
+    }
+}
@@ -0,0 +1,263 @@
+/// Google Drive connector. The first sync lists every file, later syncs follow the changes feed from the
+/// page token saved as the cursor. Google Docs, Sheets and Slides are exported as text
+use async_trait::async_trait;
+use reqwest::Client;
+use serde::Deserialize;
+
+use super::{check_response, ChangeSet, Connector, ConnectorResult, RemoteItem};
+use crate::chunker::txt::is_plain_text_extension;
+
+const API_BASE: &str = "https://www.googleapis.com/drive/v3";
+const FILE_FIELDS: &str = "id,name,mimeType,size,modifiedTime,trashed";
+const PAGE_SIZE: &str = "1000";
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct DriveFile {
+    id: String,
+    name: String,
+    mime_type: String,
+    /// sent as a string, and not at all for Google Docs
+    size: Option<String>,
+    modified_time: Option<String>,
+    #[serde(default)]
+    trashed: bool,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct FileList {
+    files: Vec<DriveFile>,
+    next_page_token: Option<String>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct StartPageToken {
+    start_page_token: String,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct Change {
+    file_id: String,
+    #[serde(default)]
+    removed: bool,
+    file: Option<DriveFile>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct ChangeList {
+    changes: Vec<Change>,
+    next_page_token: Option<String>,
+    new_start_page_token: Option<String>,
+}
+
+/// The text format Google's own file types are exported as
+fn export_mime_type(mime_type: &str) -> Option<&'static str> {
+    match mime_type {
+        "application/vnd.google-apps.document" => Some("text/plain"),
+        "application/vnd.google-apps.presentation" => Some("text/plain"),
+        "application/vnd.google-apps.spreadsheet" => Some("text/csv"),
+        _ => None,
+    }
+}
+
+fn is_text_file(file: &DriveFile) -> bool {
+    let extension = std::path::Path::new(&file.name)
+        .extension()
+        .map(|ext| ext.to_string_lossy().to_lowercase())
+        .unwrap_or_default();
+
+    file.mime_type.starts_with("text/")
+        || file.mime_type == "application/json"
+        || extension == "md"
+        || is_plain_text_extension(&extension)
+}
+
+/// Folders and binary files are left out, they have nothing to index
+fn to_remote_item(file: DriveFile) -> Option<RemoteItem> {
+    if file.trashed || !(export_mime_type(&file.mime_type).is_some() || is_text_file(&file)) {
+        return None;
+    }
+
+    let modified_at = file
+        .modified_time
+        .as_deref()
+        .and_then(|time| chrono::DateTime::parse_from_rfc3339(time).ok())
+        .map(|time| time.timestamp());
+
+    Some(RemoteItem {
+        // names aren't unique in Drive, so the id is part of the path
+        path: format!("{}/{}", file.id, file.name),
+        size: file.size.and_then(|s| s.parse().ok()).unwrap_or(0),
+        id: file.id,
+        name: file.name,
+        mime_type: Some(file.mime_type),
+        modified_at,
+    })
+}
+
+#[derive(Default)]
+pub struct GoogleDriveConnector;
+
+impl GoogleDriveConnector {
+    async fn list_all(&self, client: &Client, access_token: &str) -> ConnectorResult<ChangeSet> {
+        // take the token before listing, so nothing that changes during the listing is missed
+        let response = client
+            .get(format!("{}/changes/startPageToken", API_BASE))
+            .bearer_auth(access_token)
+            .send()
+            .await?;
+        let start: StartPageToken = check_response(response).await?.json().await?;
+
+        let mut change_set = ChangeSet {
+            cursor: start.start_page_token,
+            ..Default::default()
+        };
+        let mut page_token: Option<String> = None;
+        let fields = format!("nextPageToken,files({})", FILE_FIELDS);
+
+        loop {
+            let mut request = client
+                .get(format!("{}/files", API_BASE))
+                .bearer_auth(access_token)
+                .query(&[
+                    ("q", "trashed = false"),
+                    ("pageSize", PAGE_SIZE),
+                    ("fields", fields.as_str()),
+                ]);
+            if let Some(token) = &page_token {
+                request = request.query(&[("pageToken", token)]);
+            }
+
+            let list: FileList = check_response(request.send().await?).await?.json().await?;
+            change_set
+                .changed
+                .extend(list.files.into_iter().filter_map(to_remote_item));
+
+            match list.next_page_token {
+                Some(token) => page_token = Some(token),
+                None => break,
+            }
+        }
+
+        Ok(change_set)
+    }
+
+    async fn list_changes(
+        &self,
+        client: &Client,
+        access_token: &str,
+        cursor: &str,
+    ) -> ConnectorResult<ChangeSet> {
+        let mut change_set = ChangeSet::default();
+        let mut page_token = cursor.to_string();
+        let fields = format!(
+            "nextPageToken,newStartPageToken,changes(fileId,removed,file({}))",
+            FILE_FIELDS
+        );
+
+        loop {
+            let response = client
+                .get(format!("{}/changes", API_BASE))
+                .bearer_auth(access_token)
+                .query(&[
+                    ("pageToken", page_token.as_str()),
+                    ("pageSize", PAGE_SIZE),
+                    ("fields", fields.as_str()),
+                ])
+                .send()
+                .await?;
+            let list: ChangeList = check_response(response).await?.json().await?;
+
+            for change in list.changes {
+                let item = if change.removed {
+                    None
+                } else {
+                    change.file.and_then(to_remote_item)
+                };
+
+                match item {
+                    Some(item) => change_set.changed.push(item),
+                    // trashed, deleted, or no longer something we index
+                    None => change_set.removed.push(change.file_id),
+                }
+            }
+
+            if let Some(token) = list.new_start_page_token {
+                change_set.cursor = token;
+                break;
+            }
+            match list.next_page_token {
+                Some(token) => page_token = token,
+                None => {
+                    change_set.cursor = page_token;
+                    break;
+                }
+            }
+        }
+
+        Ok(change_set)
+    }
+}
+
+#[async_trait]
+impl Connector for GoogleDriveConnector {
+    fn kind(&self) -> &'static str {
+        "gdrive"
+    }
+
+    fn auth_endpoint(&self) -> &'static str {
+        "https://accounts.google.com/o/oauth2/v2/auth"
+    }
+
+    fn token_endpoint(&self) -> &'static str {
+        "https://oauth2.googleapis.com/token"
+    }
+
+    fn auth_params(&self) -> Vec<(&'static str, &'static str)> {
+        vec![
+            ("scope", "https://www.googleapis.com/auth/drive.readonly"),
+            // needed to get a refresh token
+            ("access_type", "offline"),
+            ("prompt", "consent"),
+        ]
+    }
+
+    async fn changes(
+        &self,
+        client: &Client,
+        access_token: &str,
+        cursor: Option<&str>,
+    ) -> ConnectorResult<ChangeSet> {
+        match cursor {
+            Some(cursor) => self.list_changes(client, access_token, cursor).await,
+            None => self.list_all(client, access_token).await,
+        }
+    }
+
+    async fn fetch_text(
+        &self,
+        client: &Client,
+        access_token: &str,
+        item: &RemoteItem,
+    ) -> ConnectorResult<Option<String>> {
+        let mime_type = item.mime_type.as_deref().unwrap_or_default();
+
+        let request = match export_mime_type(mime_type) {
+            Some(export) => client
+                .get(format!("{}/files/{}/export", API_BASE, item.id))
+                .query(&[("mimeType", export)]),
+            None => client
+                .get(format!("{}/files/{}", API_BASE, item.id))
+                .query(&[("alt", "media")]),
+        };
+
+        let response = check_response(request.bearer_auth(access_token).send().await?).await?;
+        let bytes = response.bytes().await?;
+
+        Ok(String::from_utf8(bytes.to_vec()).ok())
+    }
+}
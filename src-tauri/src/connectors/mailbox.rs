@@ -0,0 +1,545 @@
+/// Mailbox connector for local mail stores: mbox files (Thunderbird profiles keep one per folder), Apple Mail
+/// .emlx files and plain .eml files. Sender, subject and date become the author, title and creation date of the
+/// document, the message ids are kept in the emails table so whole threads can be pulled up. mbox files are read
+/// one message at a time and only where each message sits in the file is remembered, so large mailboxes don't end up in memory
+use mail_parser::{Address, HeaderValue, Message, MessageParser};
+use regex::bytes::Regex;
+use rusqlite::{params, Connection, OptionalExtension};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::{HashMap, HashSet};
+use std::fs::File;
+use std::io::{BufRead, BufReader, Read, Seek, SeekFrom};
+use std::path::{Path, PathBuf};
+use std::sync::{Mutex, OnceLock};
+use std::time::UNIX_EPOCH;
+use tauri::State;
+use walkdir::WalkDir;
+
+use super::{
+    now_secs, with_connection, ChangeSet, ConnectorError, ConnectorResult, LocalConnector,
+    RemoteDocument, RemoteItem,
+};
+use crate::file_processor::{get_processor, FileProcessorState};
+use crate::platform::DocumentAttributes;
+
+/// Structured fields of a message, stored in the emails table by indexed path
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct EmailHeaders {
+    pub message_id: Option<String>,
+    /// Message id of the first message of the thread
+    pub thread_id: Option<String>,
+    pub in_reply_to: Option<String>,
+    pub sender: Option<String>,
+    pub recipients: Vec<String>,
+    pub subject: Option<String>,
+    /// "YYYY-MM-DD HH:MM:SS" in UTC
+    pub sent_at: Option<String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct EmailMessage {
+    pub path: String,
+    pub headers: EmailHeaders,
+}
+
+/// How a file in the mail store holds its messages
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum MailFile {
+    /// Many messages separated by "From " lines
+    Mbox,
+    /// Apple Mail: the byte count on the first line, the message, then a plist
+    Emlx,
+    Eml,
+}
+
+fn mail_file_kind(path: &Path) -> Option<MailFile> {
+    let name = path.file_name()?.to_string_lossy().to_lowercase();
+    if name.ends_with(".emlx") {
+        return Some(MailFile::Emlx);
+    }
+    if name.ends_with(".eml") {
+        return Some(MailFile::Eml);
+    }
+    if name.ends_with(".mbox") || path.extension().is_none() {
+        // Thunderbird folders are extensionless mbox files, the only way to tell is the first line
+        let mut start = [0u8; 5];
+        let mut file = std::fs::File::open(path).ok()?;
+        std::io::Read::read_exact(&mut file, &mut start).ok()?;
+        return (&start == b"From ").then_some(MailFile::Mbox);
+    }
+    None
+}
+
+/// Where a message of an mbox file is, after its "From " line
+#[derive(Debug, Clone)]
+struct MboxSpan {
+    file: PathBuf,
+    offset: u64,
+    len: u64,
+}
+
+/// "From sender Mon Jan  1 00:00:00 2024", the line that starts a message. Thunderbird writes "From - " and a date
+fn postmark_regex() -> &'static Regex {
+    static POSTMARK: OnceLock<Regex> = OnceLock::new();
+    POSTMARK.get_or_init(|| {
+        Regex::new(r"^From \S+ +\S.*\b\d{1,2}:\d{2}(:\d{2})?\b.*\b\d{4}\b").unwrap()
+    })
+}
+
+/// A "From " line only starts a message at the start of the file or after a blank line, and when it looks like a postmark.
+/// Writers that don't escape "From " in bodies leave lines like "From what I heard" that are part of the message
+fn is_message_start(line: &[u8], after_blank: bool) -> bool {
+    after_blank && line.starts_with(b"From ") && postmark_regex().is_match(line)
+}
+
+/// Undoes the ">From " escaping of a message
+fn unescape_mbox(raw: &[u8]) -> Vec<u8> {
+    let mut message = Vec::with_capacity(raw.len());
+    for line in raw.split_inclusive(|byte| *byte == b'\n') {
+        let unescaped = line
+            .iter()
+            .position(|byte| *byte != b'>')
+            .filter(|start| *start > 0 && line[*start..].starts_with(b"From "))
+            .map_or(line, |_| &line[1..]);
+        message.extend_from_slice(unescaped);
+    }
+    message
+}
+
+/// Reads an mbox file one message at a time and hands each one, unescaped, to `on_message` with where it is in the file
+fn read_mbox(path: &Path, mut on_message: impl FnMut(MboxSpan, &[u8])) -> std::io::Result<()> {
+    let mut reader = BufReader::new(File::open(path)?);
+    let mut position = 0u64;
+    let mut after_blank = true;
+    let mut current: Option<(MboxSpan, Vec<u8>)> = None;
+    let mut line = Vec::new();
+
+    loop {
+        line.clear();
+        let read = reader.read_until(b'\n', &mut line)? as u64;
+        if read == 0 {
+            break;
+        }
+        position += read;
+
+        if is_message_start(&line, after_blank) {
+            if let Some((span, raw)) = current.take() {
+                on_message(span, &unescape_mbox(&raw));
+            }
+            let span = MboxSpan {
+                file: path.to_path_buf(),
+                offset: position,
+                len: 0,
+            };
+            current = Some((span, Vec::new()));
+            after_blank = false;
+            continue;
+        }
+
+        after_blank = line.iter().all(|byte| byte.is_ascii_whitespace());
+        if let Some((span, raw)) = current.as_mut() {
+            span.len += read;
+            raw.extend_from_slice(&line);
+        }
+    }
+    if let Some((span, raw)) = current {
+        on_message(span, &unescape_mbox(&raw));
+    }
+
+    Ok(())
+}
+
+/// Reads one message of an mbox file back from where it was found
+fn read_mbox_message(span: &MboxSpan) -> std::io::Result<Vec<u8>> {
+    let mut file = File::open(&span.file)?;
+    file.seek(SeekFrom::Start(span.offset))?;
+    let mut raw = Vec::new();
+    file.take(span.len).read_to_end(&mut raw)?;
+    Ok(unescape_mbox(&raw))
+}
+
+fn emlx_message(data: &[u8]) -> Option<&[u8]> {
+    let line_end = data.iter().position(|byte| *byte == b'\n')?;
+    let length: usize = std::str::from_utf8(&data[..line_end])
+        .ok()?
+        .trim()
+        .parse()
+        .ok()?;
+    data.get(line_end + 1..line_end + 1 + length)
+}
+
+fn header_ids(value: &HeaderValue) -> Vec<String> {
+    match value {
+        HeaderValue::Text(id) => vec![id.to_string()],
+        HeaderValue::TextList(ids) => ids.iter().map(|id| id.to_string()).collect(),
+        _ => Vec::new(),
+    }
+}
+
+fn format_address(address: Option<&Address>) -> Vec<String> {
+    let Some(address) = address else {
+        return Vec::new();
+    };
+
+    address
+        .iter()
+        .map(|addr| match (addr.name(), addr.address()) {
+            (Some(name), Some(email)) => format!("{} <{}>", name, email),
+            (None, Some(email)) => email.to_string(),
+            (Some(name), None) => name.to_string(),
+            (None, None) => String::new(),
+        })
+        .filter(|address| !address.is_empty())
+        .collect()
+}
+
+fn to_headers(message: &Message) -> EmailHeaders {
+    let references = header_ids(message.references());
+    let in_reply_to = header_ids(message.in_reply_to()).into_iter().next();
+    let message_id = message.message_id().map(|id| id.to_string());
+
+    EmailHeaders {
+        // the first reference is the start of the thread
+        thread_id: references
+            .first()
+            .cloned()
+            .or_else(|| in_reply_to.clone())
+            .or_else(|| message_id.clone()),
+        message_id,
+        in_reply_to,
+        sender: format_address(message.from()).into_iter().next(),
+        recipients: format_address(message.to()),
+        subject: message.subject().map(|subject| subject.to_string()),
+        sent_at: message.date().and_then(|date| {
+            chrono::DateTime::from_timestamp(date.to_timestamp(), 0)
+                .map(|date| date.format("%Y-%m-%d %H:%M:%S").to_string())
+        }),
+    }
+}
+
+/// A message ready to be indexed
+struct ParsedMessage {
+    headers: EmailHeaders,
+    text: String,
+    sent_at: Option<i64>,
+}
+
+fn parse_message(data: &[u8]) -> Option<ParsedMessage> {
+    let message = MessageParser::default().parse(data)?;
+    let headers = to_headers(&message);
+    let body = message
+        .body_text(0)
+        .map(|body| body.into_owned())
+        .unwrap_or_default();
+
+    // the headers go in the text too, so searching for a person finds their mail
+    let mut text = String::new();
+    if let Some(sender) = &headers.sender {
+        text.push_str(&format!("From: {}\n", sender));
+    }
+    if !headers.recipients.is_empty() {
+        text.push_str(&format!("To: {}\n", headers.recipients.join(", ")));
+    }
+    if let Some(subject) = &headers.subject {
+        text.push_str(&format!("Subject: {}\n", subject));
+    }
+    text.push('\n');
+    text.push_str(&body);
+
+    Some(ParsedMessage {
+        sent_at: message.date().map(|date| date.to_timestamp()),
+        headers,
+        text,
+    })
+}
+
+/// Stable key of a message inside an mbox file
+fn message_key(headers: &EmailHeaders, data: &[u8]) -> String {
+    let mut hasher = Sha256::new();
+    match &headers.message_id {
+        Some(id) => hasher.update(id.as_bytes()),
+        None => hasher.update(data),
+    }
+    hasher
+        .finalize()
+        .iter()
+        .take(12)
+        .map(|byte| format!("{:02x}", byte))
+        .collect()
+}
+
+pub struct MailboxConnector {
+    kind: &'static str,
+    /// Where the listed messages of mbox files are, so read_document reads just the message instead of the whole file
+    spans: Mutex<HashMap<String, MboxSpan>>,
+}
+
+impl MailboxConnector {
+    pub fn new(kind: &'static str) -> Self {
+        Self {
+            kind,
+            spans: Mutex::new(HashMap::new()),
+        }
+    }
+
+    fn to_item(id: String, path: String, size: usize, message: &ParsedMessage) -> RemoteItem {
+        RemoteItem {
+            name: message
+                .headers
+                .subject
+                .clone()
+                .filter(|subject| !subject.is_empty())
+                .unwrap_or_else(|| "(no subject)".to_string()),
+            id: id.clone(),
+            path,
+            mime_type: Some("message/rfc822".to_string()),
+            size: size as i64,
+            modified_at: message.sent_at,
+        }
+    }
+}
+
+impl LocalConnector for MailboxConnector {
+    fn kind(&self) -> &'static str {
+        self.kind
+    }
+
+    fn default_root(&self) -> Option<PathBuf> {
+        let root = match self.kind {
+            "apple-mail" if cfg!(target_os = "macos") => dirs::home_dir()?.join("Library/Mail"),
+            "thunderbird" if cfg!(target_os = "macos") => {
+                dirs::home_dir()?.join("Library/Thunderbird/Profiles")
+            }
+            "thunderbird" if cfg!(target_os = "windows") => {
+                dirs::config_dir()?.join("Thunderbird/Profiles")
+            }
+            "thunderbird" => dirs::home_dir()?.join(".thunderbird"),
+            _ => return None,
+        };
+        root.exists().then_some(root)
+    }
+
+    fn changes(
+        &self,
+        root: &Path,
+        cursor: Option<&str>,
+        known: &HashSet<String>,
+    ) -> ConnectorResult<ChangeSet> {
+        if !root.is_dir() {
+            return Err(ConnectorError::Other(format!(
+                "{} is not a folder",
+                root.display()
+            )));
+        }
+
+        let mut change_set = ChangeSet {
+            cursor: now_secs().to_string(),
+            ..Default::default()
+        };
+        let since = cursor.and_then(|cursor| cursor.parse::<i64>().ok());
+        let mut present = HashSet::new();
+        // messages of mbox files that didn't change aren't listed, they are kept as they are
+        let mut unchanged_mboxes = HashSet::new();
+
+        let entries = WalkDir::new(root)
+            .into_iter()
+            .filter_entry(|entry| {
+                entry.depth() == 0 || !entry.file_name().to_string_lossy().starts_with('.')
+            })
+            .filter_map(|entry| entry.ok());
+
+        for entry in entries {
+            if !entry.file_type().is_file() {
+                continue;
+            }
+            let Some(file_kind) = mail_file_kind(entry.path()) else {
+                continue;
+            };
+            let Ok(relative) = entry.path().strip_prefix(root) else {
+                continue;
+            };
+            let Ok(metadata) = entry.metadata() else {
+                continue;
+            };
+
+            let file_id = relative.to_string_lossy().replace('\\', "/");
+            let modified_at = metadata
+                .modified()
+                .ok()
+                .and_then(|time| time.duration_since(UNIX_EPOCH).ok())
+                .map(|duration| duration.as_secs() as i64);
+            let touched = match (since, modified_at) {
+                (Some(since), Some(modified_at)) => modified_at >= since,
+                _ => true,
+            };
+
+            if file_kind != MailFile::Mbox {
+                present.insert(file_id.clone());
+                if !touched && known.contains(&file_id) {
+                    continue;
+                }
+
+                let data = std::fs::read(entry.path())?;
+                let message = match file_kind {
+                    MailFile::Emlx => emlx_message(&data),
+                    _ => Some(&data[..]),
+                };
+                if let Some(message) = message.and_then(parse_message) {
+                    change_set.changed.push(Self::to_item(
+                        file_id.clone(),
+                        file_id,
+                        data.len(),
+                        &message,
+                    ));
+                }
+                continue;
+            }
+
+            if !touched {
+                unchanged_mboxes.insert(file_id);
+                continue;
+            }
+
+            // a changed mbox is read again, only the messages that weren't indexed yet are listed
+            let mut spans = self.spans.lock().unwrap();
+            read_mbox(entry.path(), |span, raw| {
+                let Some(message) = parse_message(raw) else {
+                    return;
+                };
+                let id = format!("{}/{}", file_id, message_key(&message.headers, raw));
+                if !present.insert(id.clone()) || known.contains(&id) {
+                    return;
+                }
+
+                let path = format!("{}.eml", id);
+                change_set
+                    .changed
+                    .push(Self::to_item(id.clone(), path, raw.len(), &message));
+                spans.insert(id, span);
+            })?;
+        }
+
+        change_set.removed = known
+            .iter()
+            .filter(|id| !present.contains(*id))
+            .filter(|id| {
+                id.rsplit_once('/')
+                    .map_or(true, |(file, _)| !unchanged_mboxes.contains(file))
+            })
+            .cloned()
+            .collect();
+
+        Ok(change_set)
+    }
+
+    fn read_document(
+        &self,
+        root: &Path,
+        item: &RemoteItem,
+    ) -> ConnectorResult<Option<RemoteDocument>> {
+        let span = self.spans.lock().unwrap().remove(&item.id);
+        let message = match span {
+            Some(span) => parse_message(&read_mbox_message(&span)?),
+            None => {
+                // only single message files get here without being listed from an mbox first
+                let data = std::fs::read(root.join(&item.id))?;
+                match mail_file_kind(&root.join(&item.id)) {
+                    Some(MailFile::Emlx) => emlx_message(&data).and_then(parse_message),
+                    Some(MailFile::Eml) => parse_message(&data),
+                    _ => None,
+                }
+            }
+        };
+        let Some(message) = message else {
+            return Ok(None);
+        };
+
+        let attributes = DocumentAttributes {
+            title: message.headers.subject.clone(),
+            authors: message.headers.sender.iter().cloned().collect(),
+            tags: Vec::new(),
+            content_created_at: message.headers.sent_at.clone(),
+        };
+
+        Ok(Some(RemoteDocument {
+            text: message.text,
+            attributes: Some(attributes),
+            email: Some(message.headers),
+        }))
+    }
+}
+
+pub fn save_headers(conn: &Connection, path: &str, headers: &EmailHeaders) -> rusqlite::Result<()> {
+    conn.execute(
+        r#"
+        INSERT OR REPLACE INTO emails
+            (path, message_id, thread_id, in_reply_to, sender, recipients, subject, sent_at)
+        VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)
+        "#,
+        params![
+            path,
+            headers.message_id,
+            headers.thread_id,
+            headers.in_reply_to,
+            headers.sender,
+            serde_json::to_string(&headers.recipients).unwrap_or_default(),
+            headers.subject,
+            headers.sent_at
+        ],
+    )?;
+    Ok(())
+}
+
+/// Every indexed message in the thread of the one at `path`, oldest first
+#[tauri::command]
+pub async fn get_email_thread(
+    path: String,
+    state: State<'_, FileProcessorState>,
+) -> Result<Vec<EmailMessage>, String> {
+    let processor = get_processor(&state)?;
+
+    with_connection(processor.db_path, move |conn| {
+        let thread_id: Option<Option<String>> = conn
+            .query_row(
+                "SELECT thread_id FROM emails WHERE path = ?1",
+                [&path],
+                |row| row.get(0),
+            )
+            .optional()?;
+        let Some(Some(thread_id)) = thread_id else {
+            return Ok(Vec::new());
+        };
+
+        let mut stmt = conn.prepare(
+            r#"
+            SELECT path, message_id, thread_id, in_reply_to, sender, recipients, subject, sent_at
+            FROM emails
+            WHERE thread_id = ?1
+            ORDER BY sent_at
+            "#,
+        )?;
+        let messages = stmt
+            .query_map([&thread_id], |row| {
+                let recipients: Option<String> = row.get(5)?;
+                Ok(EmailMessage {
+                    path: row.get(0)?,
+                    headers: EmailHeaders {
+                        message_id: row.get(1)?,
+                        thread_id: row.get(2)?,
+                        in_reply_to: row.get(3)?,
+                        sender: row.get(4)?,
+                        recipients: recipients
+                            .and_then(|json| serde_json::from_str(&json).ok())
+                            .unwrap_or_default(),
+                        subject: row.get(6)?,
+                        sent_at: row.get(7)?,
+                    },
+                })
+            })?
+            .collect::<Result<Vec<_>, _>>()?;
+        Ok(messages)
+    })
+    .await
+    .map_err(|e| format!("Failed to get email thread: {}", e))
+}
@@ -0,0 +1,316 @@
+/// Markdown vault connector for Obsidian and Logseq. Notes are read straight from the vault folder and indexed
+/// under their own path. Front-matter (and Logseq page properties) become the title, authors, tags and creation
+/// date of the note, wiki-links are indexed as the text they display
+use regex::Regex;
+use std::collections::HashSet;
+use std::path::Path;
+use std::sync::OnceLock;
+use std::time::UNIX_EPOCH;
+use walkdir::{DirEntry, WalkDir};
+
+use super::{
+    now_secs, ChangeSet, ConnectorError, ConnectorResult, LocalConnector, RemoteDocument,
+    RemoteItem,
+};
+use crate::platform::DocumentAttributes;
+
+/// Key and values of a front-matter or page property, keys lowercased
+type Property = (String, Vec<String>);
+
+pub struct MarkdownVaultConnector {
+    kind: &'static str,
+}
+
+impl MarkdownVaultConnector {
+    pub fn obsidian() -> Self {
+        Self { kind: "obsidian" }
+    }
+
+    pub fn logseq() -> Self {
+        Self { kind: "logseq" }
+    }
+
+    /// Hidden folders hold app state (.obsidian, .trash, .git), Logseq keeps its config and backups in logseq/
+    fn is_skipped(&self, entry: &DirEntry) -> bool {
+        let name = entry.file_name().to_string_lossy();
+        entry.depth() > 0
+            && entry.file_type().is_dir()
+            && (name.starts_with('.')
+                || (self.kind == "logseq" && entry.depth() == 1 && name == "logseq"))
+    }
+}
+
+fn is_markdown(path: &Path) -> bool {
+    path.extension()
+        .map(|ext| ext.eq_ignore_ascii_case("md") || ext.eq_ignore_ascii_case("markdown"))
+        .unwrap_or(false)
+}
+
+/// Splits off a leading front-matter block delimited by --- lines
+fn split_front_matter(content: &str) -> (Option<&str>, &str) {
+    let Some(rest) = content.strip_prefix("---").and_then(|rest| {
+        rest.strip_prefix('\n')
+            .or_else(|| rest.strip_prefix("\r\n"))
+    }) else {
+        return (None, content);
+    };
+
+    let mut offset = 0;
+    for line in rest.split_inclusive('\n') {
+        if line.trim_end() == "---" {
+            return (Some(&rest[..offset]), &rest[offset + line.len()..]);
+        }
+        offset += line.len();
+    }
+
+    // never closed, so it's just a horizontal rule
+    (None, content)
+}
+
+fn unquote(value: &str) -> String {
+    value
+        .trim()
+        .trim_matches(|c| c == '"' || c == '\'')
+        .trim_start_matches("[[")
+        .trim_end_matches("]]")
+        .trim_start_matches('#')
+        .to_string()
+}
+
+fn split_values(value: &str, separator: char) -> Vec<String> {
+    let value = value.trim();
+    let list = value
+        .strip_prefix('[')
+        .and_then(|v| v.strip_suffix(']'))
+        .filter(|_| !value.starts_with("[["))
+        .unwrap_or(value);
+
+    list.split(separator)
+        .map(unquote)
+        .filter(|v| !v.is_empty())
+        .collect()
+}
+
+/// The subset of YAML front-matter notes use: `key: value`, `key: [a, b]` and `key:` followed by `- item` lines
+fn parse_front_matter(block: &str) -> Vec<Property> {
+    let mut properties: Vec<Property> = Vec::new();
+
+    for line in block.lines() {
+        let trimmed = line.trim();
+        if trimmed.is_empty() || trimmed.starts_with('#') {
+            continue;
+        }
+
+        if let Some(item) = trimmed.strip_prefix("- ") {
+            if let Some((_, values)) = properties.last_mut() {
+                let item = unquote(item);
+                if !item.is_empty() {
+                    values.push(item);
+                }
+            }
+        } else if let Some((key, value)) = trimmed.split_once(':') {
+            properties.push((key.trim().to_lowercase(), split_values(value, ',')));
+        }
+    }
+
+    properties
+}
+
+/// Logseq keeps page properties as `key:: value` lines at the top of the page
+fn parse_page_properties(body: &str) -> Vec<Property> {
+    body.lines()
+        .take_while(|line| line.contains("::"))
+        .filter_map(|line| {
+            let (key, value) = line.split_once("::")?;
+            let key = key.trim().trim_start_matches("- ").trim().to_lowercase();
+            Some((key, split_values(value, ',')))
+        })
+        .collect()
+}
+
+/// Dates in front-matter are written by hand, so a few common formats are accepted
+fn parse_date(value: &str) -> Option<String> {
+    const FORMAT: &str = "%Y-%m-%d %H:%M:%S";
+
+    if let Ok(date) = chrono::DateTime::parse_from_rfc3339(value) {
+        return Some(date.naive_utc().format(FORMAT).to_string());
+    }
+    for format in [
+        "%Y-%m-%dT%H:%M:%S",
+        "%Y-%m-%d %H:%M:%S",
+        "%Y-%m-%dT%H:%M",
+        "%Y-%m-%d %H:%M",
+    ] {
+        if let Ok(date) = chrono::NaiveDateTime::parse_from_str(value, format) {
+            return Some(date.format(FORMAT).to_string());
+        }
+    }
+    chrono::NaiveDate::parse_from_str(value, "%Y-%m-%d")
+        .ok()
+        .and_then(|date| date.and_hms_opt(0, 0, 0))
+        .map(|date| date.format(FORMAT).to_string())
+}
+
+fn to_attributes(properties: &[Property]) -> DocumentAttributes {
+    let mut attributes = DocumentAttributes::default();
+
+    for (key, values) in properties {
+        match key.as_str() {
+            "title" => attributes.title = values.first().cloned().or(attributes.title),
+            "author" | "authors" => attributes.authors.extend(values.iter().cloned()),
+            "tag" | "tags" => attributes.tags.extend(values.iter().cloned()),
+            "created" | "created_at" | "date" => {
+                if let Some(date) = values.first().and_then(|v| parse_date(v)) {
+                    attributes.content_created_at = Some(date);
+                }
+            }
+            _ => {}
+        }
+    }
+
+    attributes
+}
+
+fn wiki_link_regex() -> &'static Regex {
+    static WIKI_LINK: OnceLock<Regex> = OnceLock::new();
+    WIKI_LINK
+        .get_or_init(|| Regex::new(r"!?\[\[([^\]|#]*)(?:#[^\]|]*)?(?:\|([^\]]*))?\]\]").unwrap())
+}
+
+fn inline_tag_regex() -> &'static Regex {
+    static INLINE_TAG: OnceLock<Regex> = OnceLock::new();
+    INLINE_TAG.get_or_init(|| Regex::new(r"(?:^|\s)#([A-Za-z][\w/-]*)").unwrap())
+}
+
+/// [[Note]] reads as "Note" and [[Note|shown text]] as "shown text"
+fn render_wiki_links(text: &str) -> String {
+    wiki_link_regex()
+        .replace_all(text, |captures: &regex::Captures| {
+            captures
+                .get(2)
+                .or_else(|| captures.get(1))
+                .map(|m| m.as_str().trim().to_string())
+                .unwrap_or_default()
+        })
+        .into_owned()
+}
+
+impl LocalConnector for MarkdownVaultConnector {
+    fn kind(&self) -> &'static str {
+        self.kind
+    }
+
+    fn default_root(&self) -> Option<std::path::PathBuf> {
+        // vaults live wherever the user put them
+        None
+    }
+
+    fn changes(
+        &self,
+        root: &Path,
+        cursor: Option<&str>,
+        known: &HashSet<String>,
+    ) -> ConnectorResult<ChangeSet> {
+        if !root.is_dir() {
+            return Err(ConnectorError::Other(format!(
+                "{} is not a folder",
+                root.display()
+            )));
+        }
+
+        // anything touched from now on is picked up by the next sync
+        let mut change_set = ChangeSet {
+            cursor: now_secs().to_string(),
+            ..Default::default()
+        };
+        let since = cursor.and_then(|cursor| cursor.parse::<i64>().ok());
+        let mut present = HashSet::new();
+
+        let entries = WalkDir::new(root)
+            .into_iter()
+            .filter_entry(|entry| !self.is_skipped(entry))
+            .filter_map(|entry| entry.ok());
+
+        for entry in entries {
+            if !entry.file_type().is_file() || !is_markdown(entry.path()) {
+                continue;
+            }
+            let Ok(relative) = entry.path().strip_prefix(root) else {
+                continue;
+            };
+            let Ok(metadata) = entry.metadata() else {
+                continue;
+            };
+
+            let id = relative.to_string_lossy().replace('\\', "/");
+            let modified_at = metadata
+                .modified()
+                .ok()
+                .and_then(|time| time.duration_since(UNIX_EPOCH).ok())
+                .map(|duration| duration.as_secs() as i64);
+            let changed = !known.contains(&id)
+                || match (since, modified_at) {
+                    (Some(since), Some(modified_at)) => modified_at >= since,
+                    _ => true,
+                };
+
+            present.insert(id.clone());
+            if changed {
+                change_set.changed.push(RemoteItem {
+                    name: entry.file_name().to_string_lossy().into_owned(),
+                    path: id.clone(),
+                    id,
+                    mime_type: Some("text/markdown".to_string()),
+                    size: metadata.len() as i64,
+                    modified_at,
+                });
+            }
+        }
+
+        change_set.removed = known
+            .iter()
+            .filter(|id| !present.contains(*id))
+            .cloned()
+            .collect();
+
+        Ok(change_set)
+    }
+
+    fn read_document(
+        &self,
+        root: &Path,
+        item: &RemoteItem,
+    ) -> ConnectorResult<Option<RemoteDocument>> {
+        let content = std::fs::read_to_string(root.join(&item.path))?;
+        let (front_matter, body) = split_front_matter(&content);
+
+        let mut properties = front_matter.map(parse_front_matter).unwrap_or_default();
+        if self.kind == "logseq" {
+            properties.extend(parse_page_properties(body));
+        }
+
+        let mut attributes = to_attributes(&properties);
+        for captures in inline_tag_regex().captures_iter(body) {
+            attributes.tags.push(captures[1].to_string());
+        }
+        attributes.tags.sort();
+        attributes.tags.dedup();
+        if attributes.title.is_none() {
+            // the file name is the note title in both apps
+            attributes.title = Path::new(&item.name)
+                .file_stem()
+                .map(|stem| stem.to_string_lossy().into_owned());
+        }
+
+        Ok(Some(RemoteDocument {
+            text: render_wiki_links(body),
+            attributes: Some(attributes),
+            email: None,
+        }))
+    }
+
+    fn document_path(&self, root: &Path, item: &RemoteItem) -> String {
+        // the notes are real files, so they are indexed where they are and can be opened
+        root.join(&item.path).to_string_lossy().into_owned()
+    }
+}
@@ -0,0 +1,1247 @@
+/// Common module for connectors: sources that aren't plain folders of documents (cloud drives, note apps, ...).
+/// Cloud sources implement the Connector trait and sources read from disk the LocalConnector trait. This module
+/// handles the OAuth tokens, the change cursors and turning items into indexed documents under the remote:// path scheme
+use async_trait::async_trait;
+use reqwest::{Client, Url};
+use rusqlite::{params, Connection, OptionalExtension};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use tauri::{AppHandle, Emitter, Manager, State};
+use tauri_plugin_opener::OpenerExt;
+use thiserror::Error;
+use tokio::task;
+
+pub mod apple_notes;
+pub mod dropbox;
+pub mod google_drive;
+pub mod mailbox;
+pub mod markdown_vault;
+pub mod oauth;
+
+use crate::database_handler::default_database_path;
+use crate::file_processor::{
+    get_processor, remove_indexed_files, BaseMetadata, FileMetadata, FileProcessor,
+    FileProcessorState, SearchSectionType,
+};
+use crate::network::configure_client;
+use crate::platform::DocumentAttributes;
+use crate::secrets::{
+    connector_client_secret_name, connector_tokens_name, delete_secret, get_secret, set_secret,
+    SecretsError,
+};
+use crate::settings::{AppSettings, SettingsManager, SettingsManagerState};
+use mailbox::EmailHeaders;
+use oauth::AuthorizationPrompt;
+
+/// Paths of remote documents look like remote://gdrive/<id>/<name>
+pub const REMOTE_SCHEME: &str = "remote://";
+/// Every connector get_connector knows about
+pub const CONNECTOR_KINDS: [&str; 2] = ["gdrive", "dropbox"];
+/// Every connector get_local_connector knows about
+pub const LOCAL_CONNECTOR_KINDS: [&str; 6] = [
+    "obsidian",
+    "logseq",
+    "apple-notes",
+    "apple-mail",
+    "thunderbird",
+    "mbox",
+];
+/// Larger files are listed but not downloaded
+pub const MAX_DOWNLOAD_BYTES: i64 = 10 * 1024 * 1024;
+/// Access tokens are refreshed when they expire within this many seconds
+const TOKEN_REFRESH_MARGIN_SECS: i64 = 60;
+/// Documents of a local source read and indexed at a time, a large mailbox isn't held in memory whole
+const LOCAL_BATCH_SIZE: usize = 200;
+const REQUEST_TIMEOUT_SECS: u64 = 60;
+
+#[derive(Error, Debug)]
+pub enum ConnectorError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Network error: {0}")]
+    Network(#[from] reqwest::Error),
+
+    #[error("Service returned {0}: {1}")]
+    Service(u16, String),
+
+    #[error("Secrets error: {0}")]
+    Secrets(#[from] SecretsError),
+
+    #[error("Authorization error: {0}")]
+    Auth(String),
+
+    #[error("Indexing error: {0}")]
+    Indexing(String),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+pub type ConnectorResult<T> = std::result::Result<T, ConnectorError>;
+
+/// A file in a remote source
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RemoteItem {
+    /// Id of the item in the source, stable across renames where the source supports it
+    pub id: String,
+    pub name: String,
+    /// Path of the item inside the source, used for the remote:// path
+    pub path: String,
+    pub mime_type: Option<String>,
+    pub size: i64,
+    /// Unix seconds
+    pub modified_at: Option<i64>,
+}
+
+/// What changed in a source since the last cursor
+#[derive(Debug, Default)]
+pub struct ChangeSet {
+    pub changed: Vec<RemoteItem>,
+    /// Ids of removed items
+    pub removed: Vec<String>,
+    /// Where the next incremental sync continues from
+    pub cursor: String,
+}
+
+/// The text of an item and the metadata the source keeps about it
+#[derive(Debug, Clone)]
+pub struct RemoteDocument {
+    pub text: String,
+    pub attributes: Option<DocumentAttributes>,
+    /// Set by the mailbox connector, stored in the emails table
+    pub email: Option<EmailHeaders>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct OAuthTokens {
+    pub access_token: String,
+    pub refresh_token: Option<String>,
+    /// Unix seconds
+    pub expires_at: Option<i64>,
+}
+
+/// The OAuth app kita is registered as with the provider
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ClientCredentials {
+    pub client_id: String,
+    pub client_secret: Option<String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ConnectorStatus {
+    pub kind: String,
+    pub connected: bool,
+    pub last_synced_at: Option<String>,
+    pub indexed_items: usize,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SyncSummary {
+    pub kind: String,
+    pub indexed: usize,
+    pub removed: usize,
+    pub skipped: usize,
+    /// Items that couldn't be fetched, they keep what was indexed of them and are fetched again on the next sync
+    pub failed: usize,
+}
+
+#[async_trait]
+pub trait Connector: Send + Sync {
+    /// Short stable name used in remote:// paths and as the account key, e.g. "gdrive"
+    fn kind(&self) -> &'static str;
+
+    fn auth_endpoint(&self) -> &'static str;
+
+    fn token_endpoint(&self) -> &'static str;
+
+    /// Provider specific parameters added to the authorization url (scopes, offline access, ...)
+    fn auth_params(&self) -> Vec<(&'static str, &'static str)>;
+
+    /// Lists the changes since `cursor`, or every item when there is no cursor yet
+    async fn changes(
+        &self,
+        client: &Client,
+        access_token: &str,
+        cursor: Option<&str>,
+    ) -> ConnectorResult<ChangeSet>;
+
+    /// Downloads or exports the text of an item. None for items without text content
+    async fn fetch_text(
+        &self,
+        client: &Client,
+        access_token: &str,
+        item: &RemoteItem,
+    ) -> ConnectorResult<Option<String>>;
+}
+
+/// Sources read from disk. Their methods block, sync_connector runs them on the blocking pool
+pub trait LocalConnector: Send + Sync {
+    fn kind(&self) -> &'static str;
+
+    /// Where the source lives when no root is given, for apps that keep their data in a fixed place
+    fn default_root(&self) -> Option<PathBuf>;
+
+    /// Lists the changes under `root` since `cursor`. `known` are the ids indexed so far,
+    /// the ones that are gone end up in the removed list
+    fn changes(
+        &self,
+        root: &Path,
+        cursor: Option<&str>,
+        known: &HashSet<String>,
+    ) -> ConnectorResult<ChangeSet>;
+
+    /// Reads the text of an item. None for items without text content
+    fn read_document(
+        &self,
+        root: &Path,
+        item: &RemoteItem,
+    ) -> ConnectorResult<Option<RemoteDocument>>;
+
+    /// Path the item is indexed under
+    fn document_path(&self, _root: &Path, item: &RemoteItem) -> String {
+        remote_path(self.kind(), &item.path)
+    }
+}
+
+pub fn get_connector(kind: &str) -> ConnectorResult<Box<dyn Connector>> {
+    match kind {
+        "gdrive" => Ok(Box::new(google_drive::GoogleDriveConnector)),
+        "dropbox" => Ok(Box::new(dropbox::DropboxConnector)),
+        _ => Err(ConnectorError::Other(format!("Unknown connector {}", kind))),
+    }
+}
+
+pub fn get_local_connector(kind: &str) -> ConnectorResult<Box<dyn LocalConnector>> {
+    match kind {
+        "obsidian" => Ok(Box::new(markdown_vault::MarkdownVaultConnector::obsidian())),
+        "logseq" => Ok(Box::new(markdown_vault::MarkdownVaultConnector::logseq())),
+        "apple-notes" => Ok(Box::new(apple_notes::AppleNotesConnector)),
+        "apple-mail" => Ok(Box::new(mailbox::MailboxConnector::new("apple-mail"))),
+        "thunderbird" => Ok(Box::new(mailbox::MailboxConnector::new("thunderbird"))),
+        "mbox" => Ok(Box::new(mailbox::MailboxConnector::new("mbox"))),
+        _ => Err(ConnectorError::Other(format!("Unknown connector {}", kind))),
+    }
+}
+
+/// Client with the proxy and TLS settings applied
+pub fn http_client(app_handle: &AppHandle) -> ConnectorResult<Client> {
+    let settings = app_handle
+        .state::<SettingsManagerState>()
+        .0
+        .get_settings()
+        .unwrap_or_default();
+
+    client_from_settings(&settings)
+}
+
+fn client_from_settings(settings: &AppSettings) -> ConnectorResult<Client> {
+    let builder = Client::builder().timeout(Duration::from_secs(REQUEST_TIMEOUT_SECS));
+    let builder = configure_client(builder, settings)
+        .map_err(|e| ConnectorError::Other(format!("Invalid network settings: {}", e)))?;
+
+    Ok(builder.build()?)
+}
+
+/// Turns non 2xx responses into a ConnectorError carrying the response body
+pub async fn check_response(response: reqwest::Response) -> ConnectorResult<reqwest::Response> {
+    if response.status().is_success() {
+        return Ok(response);
+    }
+
+    let status = response.status().as_u16();
+    let body = response.text().await.unwrap_or_default();
+    Err(ConnectorError::Service(status, body))
+}
+
+pub fn remote_path(kind: &str, item_path: &str) -> String {
+    format!(
+        "{}{}/{}",
+        REMOTE_SCHEME,
+        kind,
+        item_path.trim_start_matches('/')
+    )
+}
+
+fn now_secs() -> i64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs() as i64)
+        .unwrap_or(0)
+}
+
+/// Query parameters of the authorization url
+fn authorization_params<'a>(
+    connector: &dyn Connector,
+    client_id: &'a str,
+    redirect_uri: &'a str,
+) -> Vec<(&'a str, &'a str)> {
+    let mut params = vec![
+        ("client_id", client_id),
+        ("redirect_uri", redirect_uri),
+        ("response_type", "code"),
+    ];
+    params.extend(connector.auth_params());
+    params
+}
+
+pub fn authorize_url(
+    connector: &dyn Connector,
+    client_id: &str,
+    redirect_uri: &str,
+) -> ConnectorResult<String> {
+    let params = authorization_params(connector, client_id, redirect_uri);
+
+    Url::parse_with_params(connector.auth_endpoint(), &params)
+        .map(|url| url.to_string())
+        .map_err(|e| ConnectorError::Other(e.to_string()))
+}
+
+#[derive(Deserialize)]
+struct TokenResponse {
+    access_token: String,
+    refresh_token: Option<String>,
+    expires_in: Option<i64>,
+}
+
+async fn request_tokens(
+    client: &Client,
+    connector: &dyn Connector,
+    credentials: &ClientCredentials,
+    grant: &[(&str, &str)],
+) -> ConnectorResult<OAuthTokens> {
+    let mut form: Vec<(&str, &str)> = vec![("client_id", credentials.client_id.as_str())];
+    if let Some(secret) = &credentials.client_secret {
+        form.push(("client_secret", secret.as_str()));
+    }
+    form.extend_from_slice(grant);
+
+    let response = client
+        .post(connector.token_endpoint())
+        .form(&form)
+        .send()
+        .await?;
+    let tokens: TokenResponse = check_response(response)
+        .await
+        .map_err(|e| ConnectorError::Auth(e.to_string()))?
+        .json()
+        .await?;
+
+    Ok(to_oauth_tokens(tokens))
+}
+
+fn to_oauth_tokens(tokens: TokenResponse) -> OAuthTokens {
+    OAuthTokens {
+        access_token: tokens.access_token,
+        refresh_token: tokens.refresh_token,
+        expires_at: tokens.expires_in.map(|secs| now_secs() + secs),
+    }
+}
+
+/// Runs the OAuth flow of the connector and saves the account
+pub async fn connect_with_flow(
+    client: &Client,
+    connector: &dyn Connector,
+    db_path: PathBuf,
+    credentials: ClientCredentials,
+    on_prompt: impl Fn(&AuthorizationPrompt),
+) -> ConnectorResult<()> {
+    let tokens = oauth::authorize(client, connector, &credentials, on_prompt).await?;
+
+    let kind = connector.kind();
+    with_connection(db_path, move |conn| {
+        save_account(conn, kind, &credentials, &tokens)
+    })
+    .await
+}
+
+pub async fn exchange_code(
+    client: &Client,
+    connector: &dyn Connector,
+    credentials: &ClientCredentials,
+    code: &str,
+    redirect_uri: &str,
+) -> ConnectorResult<OAuthTokens> {
+    request_tokens(
+        client,
+        connector,
+        credentials,
+        &[
+            ("grant_type", "authorization_code"),
+            ("code", code),
+            ("redirect_uri", redirect_uri),
+        ],
+    )
+    .await
+}
+
+async fn refresh_tokens(
+    client: &Client,
+    connector: &dyn Connector,
+    credentials: &ClientCredentials,
+    refresh_token: &str,
+) -> ConnectorResult<OAuthTokens> {
+    let mut tokens = request_tokens(
+        client,
+        connector,
+        credentials,
+        &[
+            ("grant_type", "refresh_token"),
+            ("refresh_token", refresh_token),
+        ],
+    )
+    .await?;
+
+    // providers usually don't send a new refresh token, the old one stays valid
+    if tokens.refresh_token.is_none() {
+        tokens.refresh_token = Some(refresh_token.to_string());
+    }
+    Ok(tokens)
+}
+
+/// A connected account. The connectors table only keeps the client id and the cursor,
+/// the tokens and the client secret are in the keychain
+struct Account {
+    credentials: ClientCredentials,
+    tokens: OAuthTokens,
+    cursor: Option<String>,
+}
+
+fn load_tokens(kind: &str) -> ConnectorResult<Option<OAuthTokens>> {
+    match get_secret(&connector_tokens_name(kind))? {
+        Some(json) => serde_json::from_str(&json)
+            .map(Some)
+            .map_err(|e| ConnectorError::Other(format!("Invalid stored tokens: {}", e))),
+        None => Ok(None),
+    }
+}
+
+fn save_secrets(
+    kind: &str,
+    credentials: &ClientCredentials,
+    tokens: &OAuthTokens,
+) -> ConnectorResult<()> {
+    let json = serde_json::to_string(tokens)
+        .map_err(|e| ConnectorError::Other(format!("Failed to serialize tokens: {}", e)))?;
+    set_secret(&connector_tokens_name(kind), &json)?;
+
+    match &credentials.client_secret {
+        Some(secret) => set_secret(&connector_client_secret_name(kind), secret)?,
+        None => delete_secret(&connector_client_secret_name(kind))?,
+    }
+    Ok(())
+}
+
+fn load_account(conn: &Connection, kind: &str) -> ConnectorResult<Option<Account>> {
+    let row = conn
+        .query_row(
+            "SELECT client_id, cursor FROM connectors WHERE kind = ?1",
+            [kind],
+            |row| Ok((row.get::<_, String>(0)?, row.get::<_, Option<String>>(1)?)),
+        )
+        .optional()?;
+
+    let Some((client_id, cursor)) = row else {
+        return Ok(None);
+    };
+    let tokens = load_tokens(kind)?.ok_or_else(|| {
+        ConnectorError::Auth(format!(
+            "no tokens in the keychain for {}, connect it again",
+            kind
+        ))
+    })?;
+
+    Ok(Some(Account {
+        credentials: ClientCredentials {
+            client_id,
+            client_secret: get_secret(&connector_client_secret_name(kind))?,
+        },
+        tokens,
+        cursor,
+    }))
+}
+
+fn save_account(
+    conn: &Connection,
+    kind: &str,
+    credentials: &ClientCredentials,
+    tokens: &OAuthTokens,
+) -> ConnectorResult<()> {
+    save_secrets(kind, credentials, tokens)?;
+
+    conn.execute(
+        r#"
+        INSERT INTO connectors (kind, client_id)
+        VALUES (?1, ?2)
+        ON CONFLICT(kind) DO UPDATE SET client_id = excluded.client_id
+        "#,
+        params![kind, credentials.client_id],
+    )?;
+
+    Ok(())
+}
+
+/// Databases from before the keychain kept the tokens in the connectors table. They are moved into the keychain
+/// and the table is rebuilt without them. While the keychain can't be reached the tokens stay where they are, but the
+/// table is rebuilt with them optional so accounts can still be connected, and the move is tried again on the next start
+pub fn move_tokens_to_keychain(conn: &Connection) -> ConnectorResult<()> {
+    // name and whether it is NOT NULL, for each column
+    let columns = conn
+        .prepare("PRAGMA table_info(connectors)")?
+        .query_map([], |row| {
+            Ok((row.get::<_, String>(1)?, row.get::<_, bool>(3)?))
+        })?
+        .collect::<Result<Vec<_>, _>>()?;
+    let Some(&(_, tokens_required)) = columns.iter().find(|(name, _)| name == "access_token")
+    else {
+        return Ok(());
+    };
+
+    let accounts = {
+        let mut stmt = conn.prepare(
+            "SELECT kind, client_id, client_secret, access_token, refresh_token, expires_at FROM connectors
+             WHERE access_token IS NOT NULL",
+        )?;
+        let rows = stmt.query_map([], |row| {
+            Ok((
+                row.get::<_, String>(0)?,
+                ClientCredentials {
+                    client_id: row.get(1)?,
+                    client_secret: row.get(2)?,
+                },
+                OAuthTokens {
+                    access_token: row.get(3)?,
+                    refresh_token: row.get(4)?,
+                    expires_at: row.get(5)?,
+                },
+            ))
+        })?;
+        let accounts = rows.collect::<Result<Vec<_>, _>>()?;
+        accounts
+    };
+
+    // only drop the columns once every account made it into the keychain
+    let moved = accounts
+        .iter()
+        .try_for_each(|(kind, credentials, tokens)| save_secrets(kind, credentials, tokens));
+    if let Err(e) = moved {
+        if tokens_required {
+            rebuild_connectors_table(conn, true)?;
+        }
+        return Err(e);
+    }
+
+    rebuild_connectors_table(conn, false)?;
+    println!(
+        "Moved {} connector account(s) to the keychain",
+        accounts.len()
+    );
+    Ok(())
+}
+
+/// Rebuilds the connectors table of an older database in the current layout, SQLite can't change a column in place.
+/// With `keep_tokens` the old token columns are kept, without NOT NULL
+fn rebuild_connectors_table(conn: &Connection, keep_tokens: bool) -> rusqlite::Result<()> {
+    let (token_columns, copied) = if keep_tokens {
+        (
+            ", client_secret TEXT, access_token TEXT, refresh_token TEXT, expires_at INTEGER",
+            "kind, client_id, root, cursor, last_synced_at, created_at, client_secret, access_token, refresh_token, expires_at",
+        )
+    } else {
+        (
+            "",
+            "kind, client_id, root, cursor, last_synced_at, created_at",
+        )
+    };
+
+    conn.execute_batch(&format!(
+        r#"
+        BEGIN;
+        CREATE TABLE connectors_rebuilt (
+            kind TEXT PRIMARY KEY,
+            client_id TEXT NOT NULL,
+            root TEXT,
+            cursor TEXT,
+            last_synced_at DATETIME,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP{token_columns}
+        );
+        INSERT INTO connectors_rebuilt ({copied}) SELECT {copied} FROM connectors;
+        DROP TABLE connectors;
+        ALTER TABLE connectors_rebuilt RENAME TO connectors;
+        COMMIT;
+        "#
+    ))
+}
+
+async fn with_connection<T: Send + 'static>(
+    db_path: PathBuf,
+    f: impl FnOnce(&mut Connection) -> ConnectorResult<T> + Send + 'static,
+) -> ConnectorResult<T> {
+    task::spawn_blocking(move || {
+        let mut conn = Connection::open(db_path)?;
+        f(&mut conn)
+    })
+    .await
+    .map_err(|e| ConnectorError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+/// Returns a valid access token, refreshing and storing it when it is about to expire
+async fn access_token(
+    client: &Client,
+    connector: &dyn Connector,
+    db_path: PathBuf,
+    account: &mut Account,
+) -> ConnectorResult<String> {
+    let expired = account
+        .tokens
+        .expires_at
+        .map_or(false, |at| at - TOKEN_REFRESH_MARGIN_SECS <= now_secs());
+
+    if expired {
+        let refresh_token = account.tokens.refresh_token.clone().ok_or_else(|| {
+            ConnectorError::Auth("access token expired and there is no refresh token".into())
+        })?;
+
+        account.tokens =
+            refresh_tokens(client, connector, &account.credentials, &refresh_token).await?;
+
+        let kind = connector.kind();
+        let credentials = account.credentials.clone();
+        let tokens = account.tokens.clone();
+        with_connection(db_path, move |conn| {
+            save_account(conn, kind, &credentials, &tokens)
+        })
+        .await?;
+    }
+
+    Ok(account.tokens.access_token.clone())
+}
+
+fn to_file_metadata(
+    path: String,
+    item: &RemoteItem,
+    attributes: Option<DocumentAttributes>,
+) -> FileMetadata {
+    // the path, names can be note titles or mail subjects
+    let extension = std::path::Path::new(&item.path)
+        .extension()
+        .map(|ext| ext.to_string_lossy().into_owned())
+        .unwrap_or_default();
+
+    FileMetadata {
+        base: BaseMetadata {
+            id: None,
+            name: item.name.clone(),
+            path,
+        },
+        file_type: SearchSectionType::Files,
+        extension,
+        size: item.size,
+        created_at: None,
+        updated_at: None,
+        modified_at: item.modified_at,
+        link_target: None,
+        attributes,
+        summary: None,
+        ranking: None,
+        icon: None,
+    }
+}
+
+/// Paths indexed for the given item ids, from the remote_items table
+fn indexed_paths(conn: &Connection, kind: &str, ids: &[String]) -> ConnectorResult<Vec<String>> {
+    // a removed folder takes everything below it along
+    let mut stmt = conn.prepare(
+        r#"
+        SELECT path FROM remote_items
+        WHERE connector = ?1
+          AND (item_id = ?2 OR substr(item_id, 1, length(?2) + 1) = ?2 || '/')
+        "#,
+    )?;
+
+    let mut paths = Vec::new();
+    for id in ids {
+        let rows = stmt.query_map(params![kind, id], |row| row.get::<_, String>(0))?;
+        for path in rows {
+            paths.push(path?);
+        }
+    }
+    Ok(paths)
+}
+
+/// Pulls the changes of a source since its last cursor and brings the index up to date
+pub async fn sync_connector(
+    app_handle: &AppHandle,
+    processor: &FileProcessor,
+    kind: &str,
+) -> ConnectorResult<SyncSummary> {
+    if LOCAL_CONNECTOR_KINDS.contains(&kind) {
+        return sync_local_connector(app_handle, processor, kind).await;
+    }
+
+    let connector = get_connector(kind)?;
+    let client = http_client(app_handle)?;
+    let db_path = processor.db_path.clone();
+
+    let account_kind = kind.to_string();
+    let mut account = with_connection(db_path.clone(), move |conn| {
+        load_account(conn, &account_kind)
+    })
+    .await?
+    .ok_or_else(|| ConnectorError::Auth(format!("{} is not connected", kind)))?;
+
+    let token = access_token(&client, connector.as_ref(), db_path.clone(), &mut account).await?;
+    let changes = connector
+        .changes(&client, &token, account.cursor.as_deref())
+        .await?;
+
+    let mut documents = Vec::new();
+    let mut skipped = 0;
+    let mut failed = HashSet::new();
+    for item in &changes.changed {
+        if item.size > MAX_DOWNLOAD_BYTES {
+            skipped += 1;
+            continue;
+        }
+
+        match connector.fetch_text(&client, &token, item).await {
+            Ok(Some(text)) if !text.trim().is_empty() => {
+                let file = to_file_metadata(remote_path(kind, &item.path), item, None);
+                let document = RemoteDocument {
+                    text,
+                    attributes: None,
+                    email: None,
+                };
+                documents.push((item.id.clone(), file, document));
+            }
+            Ok(_) => skipped += 1,
+            Err(e) => {
+                eprintln!("Failed to fetch {} from {}: {}", item.path, kind, e);
+                failed.insert(item.id.clone());
+            }
+        }
+    }
+
+    apply_changes(
+        app_handle, processor, kind, changes, documents, skipped, failed, true,
+    )
+    .await
+}
+
+/// sync_connector for sources read from disk
+async fn sync_local_connector(
+    app_handle: &AppHandle,
+    processor: &FileProcessor,
+    kind: &str,
+) -> ConnectorResult<SyncSummary> {
+    let connector: Arc<dyn LocalConnector> = Arc::from(get_local_connector(kind)?);
+    let db_path = processor.db_path.clone();
+
+    let source_kind = kind.to_string();
+    let (root, cursor, known) = with_connection(db_path.clone(), move |conn| {
+        let source = conn
+            .query_row(
+                "SELECT root, cursor FROM connectors WHERE kind = ?1",
+                [&source_kind],
+                |row| {
+                    Ok((
+                        row.get::<_, Option<String>>(0)?,
+                        row.get::<_, Option<String>>(1)?,
+                    ))
+                },
+            )
+            .optional()?;
+        let Some((root, cursor)) = source else {
+            return Ok(None);
+        };
+
+        let mut stmt = conn.prepare("SELECT item_id FROM remote_items WHERE connector = ?1")?;
+        let known = stmt
+            .query_map([&source_kind], |row| row.get::<_, String>(0))?
+            .collect::<Result<HashSet<_>, _>>()?;
+        Ok(Some((root, cursor, known)))
+    })
+    .await?
+    .ok_or_else(|| ConnectorError::Auth(format!("{} is not connected", kind)))?;
+
+    let root = root
+        .map(PathBuf::from)
+        .or_else(|| connector.default_root())
+        .ok_or_else(|| ConnectorError::Other(format!("{} has no folder configured", kind)))?;
+
+    let changes = task::spawn_blocking({
+        let connector = connector.clone();
+        let root = root.clone();
+        move || connector.changes(&root, cursor.as_deref(), &known)
+    })
+    .await
+    .map_err(|e| ConnectorError::Other(format!("spawn_blocking error: {e}")))??;
+
+    // the documents are read and indexed a batch at a time. Removals go with the first batch,
+    // the cursor only moves with the last one and only when no batch had failures
+    let ChangeSet {
+        changed,
+        removed,
+        cursor,
+    } = changes;
+    let mut batches: Vec<Vec<RemoteItem>> = changed
+        .chunks(LOCAL_BATCH_SIZE)
+        .map(|batch| batch.to_vec())
+        .collect();
+    if batches.is_empty() {
+        batches.push(Vec::new());
+    }
+    let last = batches.len() - 1;
+
+    let mut removed = Some(removed);
+    let mut any_failed = false;
+    let mut summary = SyncSummary {
+        kind: kind.to_string(),
+        indexed: 0,
+        removed: 0,
+        skipped: 0,
+        failed: 0,
+    };
+    for (i, batch) in batches.into_iter().enumerate() {
+        let (batch, documents, skipped, failed) =
+            read_local_documents(connector.clone(), root.clone(), batch).await?;
+
+        let changes = ChangeSet {
+            changed: batch,
+            removed: removed.take().unwrap_or_default(),
+            cursor: cursor.clone(),
+        };
+        let batch_summary = apply_changes(
+            app_handle,
+            processor,
+            kind,
+            changes,
+            documents,
+            skipped,
+            failed,
+            i == last && !any_failed,
+        )
+        .await?;
+        // items of an earlier batch that couldn't be read or stored have to be listed again
+        any_failed |= batch_summary.failed > 0;
+
+        summary.indexed += batch_summary.indexed;
+        summary.removed += batch_summary.removed;
+        summary.skipped += batch_summary.skipped;
+        summary.failed += batch_summary.failed;
+    }
+
+    Ok(summary)
+}
+
+/// Reads the text of a batch of items of a local source, on the blocking pool
+async fn read_local_documents(
+    connector: Arc<dyn LocalConnector>,
+    root: PathBuf,
+    items: Vec<RemoteItem>,
+) -> ConnectorResult<(
+    Vec<RemoteItem>,
+    Vec<(String, FileMetadata, RemoteDocument)>,
+    usize,
+    HashSet<String>,
+)> {
+    task::spawn_blocking(move || {
+        let mut documents = Vec::new();
+        let mut skipped = 0;
+        let mut failed = HashSet::new();
+        for item in &items {
+            if item.size > MAX_DOWNLOAD_BYTES {
+                skipped += 1;
+                continue;
+            }
+
+            match connector.read_document(&root, item) {
+                Ok(Some(document)) if !document.text.trim().is_empty() => {
+                    let path = connector.document_path(&root, item);
+                    let file = to_file_metadata(path, item, document.attributes.clone());
+                    documents.push((item.id.clone(), file, document));
+                }
+                Ok(_) => skipped += 1,
+                Err(e) => {
+                    eprintln!(
+                        "Failed to read {} from {}: {}",
+                        item.path,
+                        connector.kind(),
+                        e
+                    );
+                    failed.insert(item.id.clone());
+                }
+            }
+        }
+
+        (items, documents, skipped, failed)
+    })
+    .await
+    .map_err(|e| ConnectorError::Other(format!("spawn_blocking error: {e}")))
+}
+
+/// Indexes the fetched documents, removes what changed or disappeared from the index
+/// and moves the cursor of the source forward when `advance_cursor` is set. Items in `failed` couldn't be fetched
+/// and documents that couldn't be stored count as failed too: they keep their old rows, and the cursor stays
+/// where it was so the next sync lists them again
+#[allow(clippy::too_many_arguments)]
+async fn apply_changes(
+    app_handle: &AppHandle,
+    processor: &FileProcessor,
+    kind: &str,
+    changes: ChangeSet,
+    documents: Vec<(String, FileMetadata, RemoteDocument)>,
+    skipped: usize,
+    mut failed: HashSet<String>,
+    advance_cursor: bool,
+) -> ConnectorResult<SyncSummary> {
+    let db_path = processor.db_path.clone();
+
+    let mut fetched_items = Vec::new();
+    let mut texts = Vec::new();
+    for (id, file, document) in documents {
+        fetched_items.push((id, file.base.path.clone(), document.email));
+        texts.push((file, document.text));
+    }
+    // a stored document replaces its old version in place
+    let stored: HashSet<String> = processor
+        .index_documents(texts, app_handle)
+        .await
+        .map_err(|e| ConnectorError::Indexing(e.to_string()))?
+        .into_iter()
+        .collect();
+    let mut indexed_items = Vec::new();
+    for (id, path, email) in fetched_items {
+        if stored.contains(&path) {
+            indexed_items.push((id, path, email));
+        } else {
+            failed.insert(id);
+        }
+    }
+
+    // removed items go, and so do the old rows of changed items that were skipped on purpose
+    // or moved to another path
+    let stale_ids: Vec<String> = changes
+        .removed
+        .iter()
+        .cloned()
+        .chain(
+            changes
+                .changed
+                .iter()
+                .filter(|item| !failed.contains(&item.id))
+                .map(|item| item.id.clone()),
+        )
+        .collect();
+    let stale_kind = kind.to_string();
+    let stale_paths: Vec<String> = with_connection(db_path.clone(), move |conn| {
+        indexed_paths(conn, &stale_kind, &stale_ids)
+    })
+    .await?
+    .into_iter()
+    .filter(|path| !stored.contains(path))
+    .collect();
+    let removed = remove_indexed_files(app_handle, db_path.clone(), stale_paths.clone())
+        .await
+        .map_err(|e| ConnectorError::Indexing(e.to_string()))?;
+    let indexed = indexed_items.len();
+
+    let sync_kind = kind.to_string();
+    let removed_ids = changes.removed;
+    let cursor = (advance_cursor && failed.is_empty()).then_some(changes.cursor);
+    with_connection(db_path, move |conn| {
+        let tx = conn.transaction()?;
+        for path in &stale_paths {
+            tx.execute("DELETE FROM emails WHERE path = ?1", [path])?;
+        }
+        for id in &removed_ids {
+            tx.execute(
+                r#"
+                DELETE FROM remote_items
+                WHERE connector = ?1
+                  AND (item_id = ?2 OR substr(item_id, 1, length(?2) + 1) = ?2 || '/')
+                "#,
+                params![sync_kind, id],
+            )?;
+        }
+        for (id, path, email) in &indexed_items {
+            tx.execute(
+                "INSERT OR REPLACE INTO remote_items (connector, item_id, path) VALUES (?1, ?2, ?3)",
+                params![sync_kind, id, path],
+            )?;
+            if let Some(headers) = email {
+                mailbox::save_headers(&tx, path, headers)?;
+            }
+        }
+        match &cursor {
+            Some(cursor) => tx.execute(
+                "UPDATE connectors SET cursor = ?1, last_synced_at = CURRENT_TIMESTAMP WHERE kind = ?2",
+                params![cursor, sync_kind],
+            )?,
+            None => tx.execute(
+                "UPDATE connectors SET last_synced_at = CURRENT_TIMESTAMP WHERE kind = ?1",
+                [&sync_kind],
+            )?,
+        };
+        tx.commit()?;
+        Ok(())
+    })
+    .await?;
+
+    Ok(SyncSummary {
+        kind: kind.to_string(),
+        indexed,
+        removed,
+        skipped,
+        failed: failed.len(),
+    })
+}
+
+#[tauri::command]
+pub fn get_connector_auth_url(
+    kind: String,
+    client_id: String,
+    redirect_uri: String,
+) -> Result<String, String> {
+    let connector = get_connector(&kind).map_err(|e| e.to_string())?;
+
+    authorize_url(connector.as_ref(), &client_id, &redirect_uri)
+        .map_err(|e| format!("Failed to build authorization url: {}", e))
+}
+
+/// Runs the whole OAuth flow from the app. The prompt goes out as a connector-authorization event
+/// and the url is opened in the default browser
+#[tauri::command]
+pub async fn authorize_connector(
+    kind: String,
+    credentials: ClientCredentials,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> Result<(), String> {
+    let processor = get_processor(&state)?;
+    let connector = get_connector(&kind).map_err(|e| e.to_string())?;
+    let client = http_client(&app_handle).map_err(|e| e.to_string())?;
+
+    connect_with_flow(
+        &client,
+        connector.as_ref(),
+        processor.db_path,
+        credentials,
+        |prompt| {
+            let AuthorizationPrompt::Browser { url } = prompt;
+            if let Err(e) = app_handle.opener().open_url(url, None::<&str>) {
+                eprintln!("Failed to open the browser: {}", e);
+            }
+            let _ = app_handle.emit("connector-authorization", prompt);
+        },
+    )
+    .await
+    .map_err(|e| format!("Failed to connect {}: {}", kind, e))
+}
+
+/// Finishes the OAuth flow with the code the provider redirected back with
+#[tauri::command]
+pub async fn connect_connector(
+    kind: String,
+    credentials: ClientCredentials,
+    code: String,
+    redirect_uri: String,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> Result<(), String> {
+    let processor = get_processor(&state)?;
+    let connector = get_connector(&kind).map_err(|e| e.to_string())?;
+    let client = http_client(&app_handle).map_err(|e| e.to_string())?;
+
+    let tokens = exchange_code(
+        &client,
+        connector.as_ref(),
+        &credentials,
+        &code,
+        &redirect_uri,
+    )
+    .await
+    .map_err(|e| format!("Failed to connect {}: {}", kind, e))?;
+
+    with_connection(processor.db_path, move |conn| {
+        save_account(conn, &kind, &credentials, &tokens)
+    })
+    .await
+    .map_err(|e| format!("Failed to save connector: {}", e))
+}
+
+/// Connects a local source. Without a root the app's default location is used
+#[tauri::command]
+pub async fn connect_local_connector(
+    kind: String,
+    root: Option<String>,
+    state: State<'_, FileProcessorState>,
+) -> Result<(), String> {
+    let processor = get_processor(&state)?;
+    let connector = get_local_connector(&kind).map_err(|e| e.to_string())?;
+
+    let root = root
+        .filter(|root| !root.is_empty())
+        .map(PathBuf::from)
+        .or_else(|| connector.default_root())
+        .ok_or_else(|| format!("{} needs a folder to read from", kind))?;
+    if !root.exists() {
+        return Err(format!("{} does not exist", root.display()));
+    }
+
+    let root = root.to_string_lossy().into_owned();
+    with_connection(processor.db_path, move |conn| {
+        // local sources have no OAuth app, the client id stays empty
+        conn.execute(
+            r#"
+            INSERT INTO connectors (kind, client_id, root)
+            VALUES (?1, '', ?2)
+            ON CONFLICT(kind) DO UPDATE SET root = excluded.root, cursor = NULL
+            "#,
+            params![kind, root],
+        )?;
+        Ok(())
+    })
+    .await
+    .map_err(|e| format!("Failed to save connector: {}", e))
+}
+
+#[tauri::command]
+pub async fn sync_connector_command(
+    kind: String,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> Result<SyncSummary, String> {
+    let processor = get_processor(&state)?;
+
+    sync_connector(&app_handle, &processor, &kind)
+        .await
+        .map_err(|e| format!("Failed to sync {}: {}", kind, e))
+}
+
+#[tauri::command]
+pub async fn list_connectors(
+    state: State<'_, FileProcessorState>,
+) -> Result<Vec<ConnectorStatus>, String> {
+    let processor = get_processor(&state)?;
+
+    with_connection(processor.db_path, |conn| {
+        let mut statuses = Vec::new();
+        for kind in CONNECTOR_KINDS.iter().chain(LOCAL_CONNECTOR_KINDS.iter()) {
+            let last_synced_at: Option<Option<String>> = conn
+                .query_row(
+                    "SELECT last_synced_at FROM connectors WHERE kind = ?1",
+                    [kind],
+                    |row| row.get(0),
+                )
+                .optional()?;
+            let indexed_items: i64 = conn.query_row(
+                "SELECT COUNT(*) FROM remote_items WHERE connector = ?1",
+                [kind],
+                |row| row.get(0),
+            )?;
+
+            statuses.push(ConnectorStatus {
+                kind: kind.to_string(),
+                connected: last_synced_at.is_some(),
+                last_synced_at: last_synced_at.flatten(),
+                indexed_items: indexed_items as usize,
+            });
+        }
+        Ok(statuses)
+    })
+    .await
+    .map_err(|e| format!("Failed to list connectors: {}", e))
+}
+
+/// Forgets the account and removes everything indexed from it
+#[tauri::command]
+pub async fn disconnect_connector(
+    kind: String,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> Result<usize, String> {
+    let processor = get_processor(&state)?;
+
+    let paths = with_connection(processor.db_path.clone(), move |conn| {
+        let paths = {
+            let mut stmt = conn.prepare("SELECT path FROM remote_items WHERE connector = ?1")?;
+            let paths = stmt
+                .query_map([&kind], |row| row.get(0))?
+                .collect::<Result<Vec<String>, _>>()?;
+            paths
+        };
+
+        conn.execute(
+            "DELETE FROM emails WHERE path IN (SELECT path FROM remote_items WHERE connector = ?1)",
+            [&kind],
+        )?;
+        conn.execute("DELETE FROM remote_items WHERE connector = ?1", [&kind])?;
+        conn.execute("DELETE FROM connectors WHERE kind = ?1", [&kind])?;
+        delete_secret(&connector_tokens_name(&kind))?;
+        delete_secret(&connector_client_secret_name(&kind))?;
+        Ok(paths)
+    })
+    .await
+    .map_err(|e| format!("Failed to disconnect: {}", e))?;
+
+    remove_indexed_files(&app_handle, processor.db_path, paths)
+        .await
+        .map_err(|e| format!("Failed to remove indexed items: {}", e))
+}
+
+/// `kita connect <kind> <client id>`, reads the client secret from stdin (empty when there is none)
+/// and saves the account in the database of the app
+pub fn run_connect_command(args: &[String]) -> Result<(), String> {
+    let [kind, client_id] = args else {
+        return Err("Usage: kita connect <kind> <client id>".to_string());
+    };
+    let connector = get_connector(kind).map_err(|e| e.to_string())?;
+    let db_path = default_database_path()
+        .filter(|path| path.exists())
+        .ok_or_else(|| "No kita database found, start kita once first".to_string())?;
+
+    eprint!("Client secret (empty if there is none): ");
+    let mut secret = String::new();
+    std::io::stdin()
+        .read_line(&mut secret)
+        .map_err(|e| format!("Failed to read client secret: {}", e))?;
+    let secret = secret.trim();
+    let credentials = ClientCredentials {
+        client_id: client_id.clone(),
+        client_secret: (!secret.is_empty()).then(|| secret.to_string()),
+    };
+
+    let settings_manager = SettingsManager::new(&db_path.to_string_lossy());
+    settings_manager
+        .initialize()
+        .map_err(|e| format!("Failed to load settings: {}", e))?;
+    let settings = settings_manager.get_settings().unwrap_or_default();
+    let client = client_from_settings(&settings).map_err(|e| e.to_string())?;
+
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .map_err(|e| format!("Failed to start runtime: {}", e))?;
+    runtime
+        .block_on(connect_with_flow(
+            &client,
+            connector.as_ref(),
+            db_path,
+            credentials,
+            |prompt| {
+                let AuthorizationPrompt::Browser { url } = prompt;
+                println!("Open this url in your browser:\n{}", url)
+            },
+        ))
+        .map_err(|e| format!("Failed to connect {}: {}", kind, e))?;
+
+    println!("Connected {}", kind);
+    Ok(())
+}
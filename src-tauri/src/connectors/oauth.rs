@@ -0,0 +1,145 @@
+/// Interactive OAuth flow shared by every connector: a loopback redirect with PKCE. There is no device-code flow,
+/// Dropbox doesn't have one and Google's doesn't allow the Drive scopes. Whoever drives the flow (the app or
+/// `kita connect`) only shows the prompt, the tokens come back ready to be saved with the account
+use base64::engine::general_purpose::URL_SAFE_NO_PAD;
+use base64::Engine;
+use rand::RngCore;
+use reqwest::{Client, Url};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+use super::{
+    authorization_params, request_tokens, ClientCredentials, Connector, ConnectorError,
+    ConnectorResult, OAuthTokens,
+};
+
+/// How long the loopback listener waits for the browser to come back
+const LOOPBACK_TIMEOUT_SECS: u64 = 5 * 60;
+
+const LOOPBACK_DONE_PAGE: &str =
+    "<html><body><h3>kita is connected, you can close this window.</h3></body></html>";
+const LOOPBACK_FAILED_PAGE: &str = "<html><body><h3>kita could not be connected, go back to the app for details.</h3></body></html>";
+
+/// What the user has to do to authorize kita
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum AuthorizationPrompt {
+    /// Open `url` in a browser on this machine, the provider redirects back to kita
+    Browser { url: String },
+}
+
+fn random_token() -> String {
+    let mut bytes = [0u8; 32];
+    rand::thread_rng().fill_bytes(&mut bytes);
+    URL_SAFE_NO_PAD.encode(bytes)
+}
+
+/// Has the user authorize kita in the browser and returns the tokens
+pub async fn authorize(
+    client: &Client,
+    connector: &dyn Connector,
+    credentials: &ClientCredentials,
+    on_prompt: impl Fn(&AuthorizationPrompt),
+) -> ConnectorResult<OAuthTokens> {
+    let listener = TcpListener::bind("127.0.0.1:0").await?;
+    let redirect_uri = format!("http://127.0.0.1:{}", listener.local_addr()?.port());
+
+    // PKCE, so the code is useless to anything else that sees the redirect
+    let verifier = random_token();
+    let challenge = URL_SAFE_NO_PAD.encode(Sha256::digest(verifier.as_bytes()));
+    let state = random_token();
+
+    let mut params = authorization_params(connector, &credentials.client_id, &redirect_uri);
+    params.extend([
+        ("code_challenge", challenge.as_str()),
+        ("code_challenge_method", "S256"),
+        ("state", state.as_str()),
+    ]);
+    let url = Url::parse_with_params(connector.auth_endpoint(), &params)
+        .map_err(|e| ConnectorError::Other(e.to_string()))?;
+
+    on_prompt(&AuthorizationPrompt::Browser {
+        url: url.to_string(),
+    });
+
+    let code = tokio::time::timeout(
+        Duration::from_secs(LOOPBACK_TIMEOUT_SECS),
+        wait_for_redirect(&listener, &state),
+    )
+    .await
+    .map_err(|_| ConnectorError::Auth("timed out waiting for the browser".into()))??;
+
+    request_tokens(
+        client,
+        connector,
+        credentials,
+        &[
+            ("grant_type", "authorization_code"),
+            ("code", code.as_str()),
+            ("redirect_uri", redirect_uri.as_str()),
+            ("code_verifier", verifier.as_str()),
+        ],
+    )
+    .await
+}
+
+/// Answers requests on the loopback address until the provider redirects back with a code or an error
+async fn wait_for_redirect(listener: &TcpListener, state: &str) -> ConnectorResult<String> {
+    loop {
+        let (mut stream, _) = listener.accept().await?;
+
+        let mut buffer = vec![0u8; 8192];
+        let read = stream.read(&mut buffer).await?;
+        let request = String::from_utf8_lossy(&buffer[..read]);
+        let target = request
+            .lines()
+            .next()
+            .and_then(|line| line.split_whitespace().nth(1))
+            .unwrap_or("/");
+
+        let Ok(url) = Url::parse(&format!("http://127.0.0.1{}", target)) else {
+            continue;
+        };
+        let param = |name: &str| {
+            url.query_pairs()
+                .find(|(key, _)| key == name)
+                .map(|(_, value)| value.into_owned())
+        };
+
+        let result = match (param("code"), param("error")) {
+            (Some(code), _) if param("state").as_deref() == Some(state) => Ok(code),
+            (Some(_), _) => Err(ConnectorError::Auth(
+                "state mismatch in the redirect".into(),
+            )),
+            (None, Some(error)) => Err(ConnectorError::Auth(
+                param("error_description").unwrap_or(error),
+            )),
+            // the browser asking for a favicon and the like
+            (None, None) => {
+                let _ = stream
+                    .write_all(
+                        b"HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+                    )
+                    .await;
+                continue;
+            }
+        };
+
+        let page = if result.is_ok() {
+            LOOPBACK_DONE_PAGE
+        } else {
+            LOOPBACK_FAILED_PAGE
+        };
+        let response = format!(
+            "HTTP/1.1 200 OK\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+            page.len(),
+            page
+        );
+        let _ = stream.write_all(response.as_bytes()).await;
+
+        return result;
+    }
+}
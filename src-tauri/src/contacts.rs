@@ -1,5 +1,7 @@
 use serde::{Deserialize, Serialize};
+#[cfg(target_os = "macos")]
 use std::ffi::{c_char, CStr};
+#[cfg(target_os = "macos")]
 use std::os::raw::c_int;
 use std::str;
 use thiserror::Error;
@@ -34,6 +36,7 @@ pub enum ContactError {
     JsonError(String),
 }
 
+#[cfg(target_os = "macos")]
 extern "C" {
     fn check_contacts_permission_swift() -> c_int;
     fn request_contacts_permission_swift() -> c_int;
@@ -41,6 +44,7 @@ extern "C" {
     fn free_string_swift(pointer: *mut c_char);
 }
 
+#[cfg(target_os = "macos")]
 pub fn check_contacts_permission() -> Result<bool, ContactError> {
     // CNAuthorizationStatus: NotDetermined = 0, Restricted = 1, Denied = 2, Authorized = 3
     let status = unsafe { check_contacts_permission_swift() };
@@ -50,6 +54,7 @@ pub fn check_contacts_permission() -> Result<bool, ContactError> {
     }
 }
 
+#[cfg(target_os = "macos")]
 pub fn request_contacts_permission() -> Result<bool, ContactError> {
     let status = unsafe { request_contacts_permission_swift() };
     match status {
@@ -58,6 +63,7 @@ pub fn request_contacts_permission() -> Result<bool, ContactError> {
     }
 }
 
+#[cfg(target_os = "macos")]
 pub fn get_contacts() -> Result<Vec<Contact>, ContactError> {
     println!("getting contacts...");
     if !check_contacts_permission()? {
@@ -105,6 +111,14 @@ pub fn get_contacts() -> Result<Vec<Contact>, ContactError> {
     Ok(contacts)
 }
 
+/// Contacts are read through the macOS Contacts framework, other platforms have no contacts source yet
+#[cfg(not(target_os = "macos"))]
+pub fn get_contacts() -> Result<Vec<Contact>, ContactError> {
+    Err(ContactError::AccessError(
+        "contacts are only supported on macOS".to_string(),
+    ))
+}
+
 #[tauri::command]
 pub async fn get_contacts_command() -> Result<Vec<Contact>, String> {
     match get_contacts() {
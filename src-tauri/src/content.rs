@@ -0,0 +1,199 @@
+/*
+This file contains the API to fetch stored content by id, so the preview pane and external RAG pipelines can read the indexed text and metadata through kita instead of re-reading and re-parsing the original file
+*/
+
+use rusqlite::{params, Connection, OptionalExtension};
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use tauri::{AppHandle, State};
+use thiserror::Error;
+use tokio::task;
+
+use crate::file_processor::{
+    attributes_from_row, get_processor, open_summary, BaseMetadata, FileMetadata,
+    FileProcessorState, SearchSectionType,
+};
+use crate::vectordb_manager::{chunk_index, StoredChunk, VectorDbManager};
+
+#[derive(Error, Debug)]
+pub enum ContentError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Vector DB error: {0}")]
+    VectorDb(String),
+
+    #[error("Not found: {0}")]
+    NotFound(String),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = ContentError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ChunkContent {
+    pub id: String,
+    pub file_id: String,
+    pub index: usize,
+    pub page_number: Option<u32>,
+    pub text: String,
+}
+
+/// A file as it is stored in the index
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct StoredFileContent {
+    pub file: FileMetadata,
+    pub tags: Vec<String>,
+    /// The chunk texts joined in order
+    pub text: String,
+    pub chunks: Vec<ChunkContent>,
+}
+
+/// A single chunk together with the file it came from
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct StoredChunkContent {
+    pub chunk: ChunkContent,
+    pub file: FileMetadata,
+    pub tags: Vec<String>,
+}
+
+impl From<StoredChunk> for ChunkContent {
+    fn from(chunk: StoredChunk) -> Self {
+        Self {
+            index: chunk_index(&chunk.id),
+            id: chunk.id,
+            file_id: chunk.file_id,
+            page_number: chunk.page_number,
+            text: chunk.text,
+        }
+    }
+}
+
+pub async fn get_file_content(
+    app_handle: &AppHandle,
+    db_path: PathBuf,
+    file_id: i64,
+) -> Result<StoredFileContent> {
+    let (file, tags) = load_file(db_path, file_id).await?;
+
+    let chunks: Vec<ChunkContent> =
+        VectorDbManager::get_chunks_for_file(app_handle, &file_id.to_string())
+            .await
+            .map_err(|e| ContentError::VectorDb(e.to_string()))?
+            .into_iter()
+            .map(ChunkContent::from)
+            .collect();
+
+    let text = chunks
+        .iter()
+        .map(|chunk| chunk.text.as_str())
+        .collect::<Vec<_>>()
+        .join("\n");
+
+    Ok(StoredFileContent {
+        file,
+        tags,
+        text,
+        chunks,
+    })
+}
+
+pub async fn get_chunk_content(
+    app_handle: &AppHandle,
+    db_path: PathBuf,
+    chunk_id: &str,
+) -> Result<StoredChunkContent> {
+    let chunk = VectorDbManager::get_chunk(app_handle, chunk_id)
+        .await
+        .map_err(|e| ContentError::VectorDb(e.to_string()))?
+        .ok_or_else(|| ContentError::NotFound(format!("chunk {}", chunk_id)))?;
+
+    let file_id: i64 = chunk
+        .file_id
+        .parse()
+        .map_err(|_| ContentError::Other(format!("invalid file id {}", chunk.file_id)))?;
+    let (file, tags) = load_file(db_path, file_id).await?;
+
+    Ok(StoredChunkContent {
+        chunk: chunk.into(),
+        file,
+        tags,
+    })
+}
+
+async fn load_file(db_path: PathBuf, file_id: i64) -> Result<(FileMetadata, Vec<String>)> {
+    task::spawn_blocking(move || read_file_row(&db_path, file_id))
+        .await
+        .map_err(|e| ContentError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+/// The category is the only tag files currently carry
+fn read_file_row(db_path: &Path, file_id: i64) -> Result<(FileMetadata, Vec<String>)> {
+    let conn = Connection::open(db_path)?;
+
+    let row = conn
+        .query_row(
+            r#"
+            SELECT id, name, path, extension, size, created_at, updated_at, category, link_target,
+                   title, authors, tags, content_created_at,
+                   (SELECT summary FROM summaries WHERE file_id = files.id)
+            FROM files
+            WHERE id = ?1
+            "#,
+            params![file_id],
+            |row| {
+                let file = FileMetadata {
+                    base: BaseMetadata {
+                        id: Some(row.get(0)?),
+                        name: row.get(1)?,
+                        path: row.get(2)?,
+                    },
+                    file_type: SearchSectionType::Files,
+                    extension: row.get(3)?,
+                    size: row.get(4)?,
+                    created_at: row.get(5).ok(),
+                    updated_at: row.get(6).ok(),
+                    modified_at: None,
+                    link_target: row.get(8)?,
+                    attributes: attributes_from_row(row, 9),
+                    summary: row.get::<_, Option<String>>(13)?.and_then(open_summary),
+                    ranking: None,
+                    icon: None,
+                };
+                let category: Option<String> = row.get(7)?;
+
+                Ok((file, category.into_iter().collect()))
+            },
+        )
+        .optional()?;
+
+    row.ok_or_else(|| ContentError::NotFound(format!("file {}", file_id)))
+}
+
+#[tauri::command]
+pub async fn get_file(
+    file_id: i64,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> std::result::Result<StoredFileContent, String> {
+    let processor = get_processor(&state)?;
+
+    get_file_content(&app_handle, processor.db_path, file_id)
+        .await
+        .map_err(|e| format!("Failed to get file: {}", e))
+}
+
+#[tauri::command]
+pub async fn get_chunk(
+    chunk_id: String,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> std::result::Result<StoredChunkContent, String> {
+    let processor = get_processor(&state)?;
+
+    get_chunk_content(&app_handle, processor.db_path, &chunk_id)
+        .await
+        .map_err(|e| format!("Failed to get chunk: {}", e))
+}
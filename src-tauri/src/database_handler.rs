@@ -4,8 +4,19 @@ use std::path::PathBuf;
 use tauri::AppHandle;
 use tauri::Manager;
 
+use crate::connectors;
+use crate::index_runs;
 use crate::AppResult;
 
+/// Bundle identifier from tauri.conf.json, Tauri keeps the app data in a folder named after it
+const APP_IDENTIFIER: &str = "com.kita.app";
+pub const DATABASE_FILE: &str = "kita-database.sqlite";
+
+/// Where the app keeps its database, for CLI commands that run without a Tauri app
+pub fn default_database_path() -> Option<PathBuf> {
+    dirs::data_dir().map(|dir| dir.join(APP_IDENTIFIER).join(DATABASE_FILE))
+}
+
 /// Initialize the database and return the path to the created database file
 pub fn init_database(app_handle: AppHandle) -> AppResult<std::path::PathBuf> {
     let app_data_dir: PathBuf = match app_handle.path().app_data_dir() {
@@ -17,7 +28,7 @@ pub fn init_database(app_handle: AppHandle) -> AppResult<std::path::PathBuf> {
         }
     };
 
-    let db_path: PathBuf = app_data_dir.join("kita-database.sqlite");
+    let db_path: PathBuf = app_data_dir.join(DATABASE_FILE);
 
     let conn: Connection = match Connection::open(&db_path) {
         Ok(conn) => conn,
@@ -44,6 +55,13 @@ pub fn init_database(app_handle: AppHandle) -> AppResult<std::path::PathBuf> {
             extension TEXT,
             size INTEGER,
             category TEXT,
+            link_target TEXT,
+            title TEXT,
+            authors TEXT,
+            tags TEXT,
+            content_created_at DATETIME,
+            content_hash TEXT,
+            modified_at INTEGER,
             created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
             updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
              FOREIGN KEY (directory_id) REFERENCES directories (id)
@@ -61,7 +79,211 @@ pub fn init_database(app_handle: AppHandle) -> AppResult<std::path::PathBuf> {
             content=''
         );"#;
 
-    let statements = vec![directories_table, files_table, settings_table, fts_table];
+    let feedback_table = r#"CREATE TABLE IF NOT EXISTS search_feedback (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            query TEXT NOT NULL,
+            file_id INTEGER NOT NULL,
+            signal TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );"#;
+
+    let feedback_index =
+        "CREATE INDEX IF NOT EXISTS idx_search_feedback_file ON search_feedback (file_id);";
+
+    let versions_table = r#"CREATE TABLE IF NOT EXISTS file_versions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            path TEXT NOT NULL,
+            version INTEGER NOT NULL,
+            size INTEGER NOT NULL,
+            content_hash TEXT NOT NULL,
+            text TEXT NOT NULL,
+            embedding BLOB,
+            indexed_at DATETIME NOT NULL,
+            replaced_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            UNIQUE (path, version)
+        );"#;
+
+    let connectors_table = r#"CREATE TABLE IF NOT EXISTS connectors (
+            kind TEXT PRIMARY KEY,
+            client_id TEXT NOT NULL,
+            root TEXT,
+            cursor TEXT,
+            last_synced_at DATETIME,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );"#;
+
+    let remote_items_table = r#"CREATE TABLE IF NOT EXISTS remote_items (
+            connector TEXT NOT NULL,
+            item_id TEXT NOT NULL,
+            path TEXT NOT NULL,
+            PRIMARY KEY (connector, item_id)
+        );"#;
+
+    let emails_table = r#"CREATE TABLE IF NOT EXISTS emails (
+            path TEXT PRIMARY KEY,
+            message_id TEXT,
+            thread_id TEXT,
+            in_reply_to TEXT,
+            sender TEXT,
+            recipients TEXT,
+            subject TEXT,
+            sent_at DATETIME
+        );"#;
+
+    let emails_index = "CREATE INDEX IF NOT EXISTS idx_emails_thread ON emails (thread_id);";
+
+    let symbols_table = r#"CREATE TABLE IF NOT EXISTS symbols (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            file_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            kind TEXT NOT NULL,
+            line INTEGER NOT NULL,
+            FOREIGN KEY (file_id) REFERENCES files (id)
+        );"#;
+
+    let symbols_name_index = "CREATE INDEX IF NOT EXISTS idx_symbols_name ON symbols (name);";
+    let symbols_file_index = "CREATE INDEX IF NOT EXISTS idx_symbols_file ON symbols (file_id);";
+
+    let summaries_table = r#"CREATE TABLE IF NOT EXISTS summaries (
+            file_id INTEGER PRIMARY KEY,
+            summary TEXT NOT NULL,
+            model TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (file_id) REFERENCES files (id)
+        );"#;
+
+    let pins_table = r#"CREATE TABLE IF NOT EXISTS pins (
+            path TEXT PRIMARY KEY,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );"#;
+
+    let entities_table = r#"CREATE TABLE IF NOT EXISTS entities (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            file_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            kind TEXT NOT NULL,
+            count INTEGER NOT NULL,
+            FOREIGN KEY (file_id) REFERENCES files (id)
+        );"#;
+
+    let entities_name_index =
+        "CREATE INDEX IF NOT EXISTS idx_entities_name ON entities (name COLLATE NOCASE);";
+    let entities_file_index = "CREATE INDEX IF NOT EXISTS idx_entities_file ON entities (file_id);";
+
+    let sensitive_findings_table = r#"CREATE TABLE IF NOT EXISTS sensitive_findings (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            path TEXT NOT NULL,
+            kind TEXT NOT NULL,
+            count INTEGER NOT NULL,
+            action TEXT NOT NULL,
+            found_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );"#;
+
+    let sensitive_findings_index =
+        "CREATE INDEX IF NOT EXISTS idx_sensitive_findings_path ON sensitive_findings (path);";
+
+    let encryption_table = r#"CREATE TABLE IF NOT EXISTS encryption (
+            id INTEGER PRIMARY KEY CHECK (id = 1),
+            salt BLOB NOT NULL,
+            key_check TEXT NOT NULL
+        );"#;
+
+    let index_runs_table = r#"CREATE TABLE IF NOT EXISTS index_runs (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            paths TEXT NOT NULL,
+            status TEXT NOT NULL,
+            reason TEXT,
+            total_files INTEGER NOT NULL DEFAULT 0,
+            processed_files INTEGER NOT NULL DEFAULT 0,
+            indexed_files INTEGER NOT NULL DEFAULT 0,
+            errors INTEGER NOT NULL DEFAULT 0,
+            started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            finished_at DATETIME
+        );"#;
+
+    let thumbnails_table = r#"CREATE TABLE IF NOT EXISTS thumbnails (
+            file_id INTEGER PRIMARY KEY,
+            mime TEXT NOT NULL,
+            data BLOB NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (file_id) REFERENCES files (id)
+        );"#;
+
+    let opens_table = r#"CREATE TABLE IF NOT EXISTS opens (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            path TEXT NOT NULL,
+            opened_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );"#;
+
+    let opens_path_index = "CREATE INDEX IF NOT EXISTS idx_opens_path ON opens (path);";
+    let opens_time_index = "CREATE INDEX IF NOT EXISTS idx_opens_opened_at ON opens (opened_at);";
+
+    let vector_space_table = r#"CREATE TABLE IF NOT EXISTS vector_space (
+            id INTEGER PRIMARY KEY CHECK (id = 1),
+            table_name TEXT NOT NULL,
+            model TEXT NOT NULL,
+            dimension INTEGER NOT NULL,
+            previous_table TEXT,
+            previous_dimension INTEGER,
+            switched_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );"#;
+
+    let embedding_migration_table = r#"CREATE TABLE IF NOT EXISTS embedding_migration (
+            id INTEGER PRIMARY KEY CHECK (id = 1),
+            provider TEXT NOT NULL,
+            model TEXT NOT NULL,
+            endpoint TEXT,
+            table_name TEXT NOT NULL,
+            dimension INTEGER NOT NULL,
+            started_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );"#;
+
+    let health_reports_table = r#"CREATE TABLE IF NOT EXISTS health_reports (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            report TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );"#;
+
+    let evicted_files_table = r#"CREATE TABLE IF NOT EXISTS evicted_files (
+            file_id INTEGER PRIMARY KEY,
+            bytes INTEGER NOT NULL,
+            evicted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (file_id) REFERENCES files (id)
+        );"#;
+
+    let statements = vec![
+        directories_table,
+        files_table,
+        settings_table,
+        fts_table,
+        feedback_table,
+        feedback_index,
+        versions_table,
+        connectors_table,
+        remote_items_table,
+        emails_table,
+        emails_index,
+        symbols_table,
+        symbols_name_index,
+        symbols_file_index,
+        summaries_table,
+        pins_table,
+        entities_table,
+        entities_name_index,
+        entities_file_index,
+        sensitive_findings_table,
+        sensitive_findings_index,
+        encryption_table,
+        index_runs_table,
+        vector_space_table,
+        embedding_migration_table,
+        thumbnails_table,
+        opens_table,
+        opens_path_index,
+        opens_time_index,
+        health_reports_table,
+        evicted_files_table,
+    ];
 
     for (i, stmt) in statements.iter().enumerate() {
         if let Err(e) = conn.execute(stmt, []) {
@@ -71,6 +293,61 @@ pub fn init_database(app_handle: AppHandle) -> AppResult<std::path::PathBuf> {
         }
     }
 
+    // columns added after the first release, existing databases need them added
+    let migrations = [
+        ("files", "link_target", "TEXT"),
+        ("files", "title", "TEXT"),
+        ("files", "authors", "TEXT"),
+        ("files", "tags", "TEXT"),
+        ("files", "content_created_at", "DATETIME"),
+        ("files", "content_hash", "TEXT"),
+        ("files", "modified_at", "INTEGER"),
+        ("connectors", "root", "TEXT"),
+    ];
+
+    for (table, column, column_type) in migrations {
+        if let Err(e) = add_column_if_missing(&conn, table, column, column_type) {
+            let error_msg = format!("Error adding column {}.{}: {}", table, column, e);
+            eprintln!("{}", error_msg);
+            return Err(Box::new(Error::new(ErrorKind::Other, error_msg)));
+        }
+    }
+
+    // a locked or missing keychain shouldn't keep the app from starting, the move is retried next launch
+    if let Err(e) = connectors::move_tokens_to_keychain(&conn) {
+        eprintln!("Failed to move connector tokens to the keychain: {}", e);
+    }
+
+    // scans still marked as running were cut short when the app last exited
+    if let Err(e) = index_runs::close_interrupted_runs(&conn) {
+        eprintln!("Failed to close interrupted index runs: {}", e);
+    }
+
     println!("Database initialized");
     Ok(db_path)
 }
+
+fn add_column_if_missing(
+    conn: &Connection,
+    table: &str,
+    column: &str,
+    column_type: &str,
+) -> rusqlite::Result<()> {
+    let mut stmt = conn.prepare(&format!("PRAGMA table_info({})", table))?;
+    let exists = stmt
+        .query_map([], |row| row.get::<_, String>(1))?
+        .filter_map(|name| name.ok())
+        .any(|name| name == column);
+
+    if !exists {
+        conn.execute(
+            &format!(
+                "ALTER TABLE {} ADD COLUMN {} {}",
+                table, column, column_type
+            ),
+            [],
+        )?;
+    }
+
+    Ok(())
+}
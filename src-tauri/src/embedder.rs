@@ -1,8 +1,65 @@
 use fastembed::{EmbeddingModel, InitOptions, TextEmbedding};
+use reqwest::Client;
+use serde::{Deserialize, Serialize};
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex, RwLock};
+use std::time::{Duration, Instant};
+use thiserror::Error;
 
-/// Holds embedding model
+use crate::network::{
+    client_identity, configure_client, post_json_unix, unix_socket_path, NetworkError,
+};
+use crate::secrets::{get_secret, EMBEDDING_API_KEY};
+use crate::settings::AppSettings;
+
+const LOCAL_MODEL_NAME: &str = "all-MiniLM-L6-v2";
+const DEFAULT_REMOTE_MODEL: &str = "all-minilm";
+const DEFAULT_WARM_CONNECTIONS: usize = 4;
+const KEEPALIVE_INTERVAL_SECS: u64 = 30;
+/// Connections are only kept warm this long after the last embedding, an idle app doesn't keep calling the service
+const KEEP_WARM_IDLE_SECS: u64 = 10 * 60;
+const REQUEST_TIMEOUT_SECS: u64 = 60;
+
+#[derive(Error, Debug)]
+pub enum EmbedderError {
+    #[error("Model error: {0}")]
+    Model(String),
+
+    #[error("Network error: {0}")]
+    Network(#[from] reqwest::Error),
+
+    #[error("Transport error: {0}")]
+    Transport(#[from] NetworkError),
+
+    #[error("Invalid response: {0}")]
+    Json(#[from] serde_json::Error),
+
+    #[error("Embedding service timed out after {0}s")]
+    Timeout(u64),
+
+    #[error("Embedding service returned {0}: {1}")]
+    Service(u16, String),
+}
+
+impl EmbedderError {
+    /// The service refused because the quota or rate limit is used up, retrying right away won't help
+    pub fn is_quota_exceeded(&self) -> bool {
+        matches!(self, Self::Service(402 | 429, _))
+    }
+}
+
+/// Where the embeddings are computed
+enum EmbeddingBackend {
+    /// In-process ONNX model
+    Local(TextEmbedding),
+    /// OpenAI compatible /v1/embeddings endpoint (Ollama, llama.cpp server, etc.)
+    Remote(RemoteEmbedder),
+}
+
+/// Holds embedding model. The backend can be swapped while the app runs, see `replace`
 pub struct Embedder {
-    pub model: TextEmbedding,
+    backend: RwLock<Arc<EmbeddingBackend>>,
 }
 
 impl Embedder {
@@ -11,15 +68,367 @@ impl Embedder {
 
         let model = TextEmbedding::try_new(init_options)?;
 
-        Ok(Self { model })
-    } 
+        Ok(Self::with_backend(EmbeddingBackend::Local(model)))
+    }
+
+    fn with_backend(backend: EmbeddingBackend) -> Self {
+        Self {
+            backend: RwLock::new(Arc::new(backend)),
+        }
+    }
+
+    /// Requests that already started finish with the backend they started with
+    fn backend(&self) -> Arc<EmbeddingBackend> {
+        self.backend.read().unwrap().clone()
+    }
+
+    /// Moves to the model of another embedder, used when a migration switches the model while the app runs
+    pub fn replace(&self, other: Embedder) {
+        let backend = other.backend();
+        *self.backend.write().unwrap() = backend;
+    }
+
+    /// Uses the remote embedding endpoint from the settings if one is configured, otherwise the local model
+    pub fn from_settings(settings: &AppSettings) -> Result<Self, Box<dyn std::error::Error>> {
+        match &settings.embedding_endpoint {
+            Some(endpoint) if !endpoint.is_empty() => {
+                let remote = RemoteEmbedder::new(
+                    settings,
+                    endpoint,
+                    settings
+                        .embedding_model
+                        .clone()
+                        .unwrap_or_else(|| DEFAULT_REMOTE_MODEL.to_string()),
+                    settings
+                        .embedding_connections
+                        .unwrap_or(DEFAULT_WARM_CONNECTIONS),
+                    settings.embedding_http2.unwrap_or(false),
+                )?;
+
+                Ok(Self::with_backend(EmbeddingBackend::Remote(remote)))
+            }
+            _ => Self::new(),
+        }
+    }
 
     /// Get embeddings for a single chunk of text
     /// If there is an error this will return back an empty vector
-    pub fn embed_single_text(&self, text: &str) -> Vec<f32> {
-        self.model
-            .embed(vec![text], None)
-            .map(|embeddings| embeddings.get(0).cloned().unwrap_or_default())
-            .unwrap_or_default()
+    pub async fn embed_single_text(&self, text: &str) -> Vec<f32> {
+        match &*self.backend() {
+            EmbeddingBackend::Local(model) => model
+                .embed(vec![text], None)
+                .map(|embeddings| embeddings.get(0).cloned().unwrap_or_default())
+                .unwrap_or_default(),
+            EmbeddingBackend::Remote(remote) => remote
+                .embed(vec![text.to_string()])
+                .await
+                .map(|embeddings| embeddings.get(0).cloned().unwrap_or_default())
+                .unwrap_or_default(),
+        }
+    }
+
+    /// Get embeddings for a batch of texts. This blocks, so it should be called from a blocking task
+    pub fn embed_batch(&self, texts: Vec<&str>) -> Result<Vec<Vec<f32>>, EmbedderError> {
+        match &*self.backend() {
+            EmbeddingBackend::Local(model) => model
+                .embed(texts, None)
+                .map_err(|e| EmbedderError::Model(e.to_string())),
+            EmbeddingBackend::Remote(remote) => {
+                let owned: Vec<String> = texts.into_iter().map(String::from).collect();
+                tauri::async_runtime::block_on(remote.embed(owned))
+            }
+        }
+    }
+
+    /// Opens the pooled connections to the remote endpoint ahead of time and keeps them warm.
+    /// Does nothing for the local model
+    pub async fn warm_up(&self) {
+        if let EmbeddingBackend::Remote(remote) = &*self.backend() {
+            remote.warm_up().await;
+        }
+    }
+
+    /// Sends periodic requests so idle pooled connections aren't closed between indexing runs. The pings stop
+    /// KEEP_WARM_IDLE_SECS after the last embedding and start again with the next one
+    pub async fn keep_warm(&self) {
+        let mut ticker = tokio::time::interval(Duration::from_secs(KEEPALIVE_INTERVAL_SECS));
+        loop {
+            ticker.tick().await;
+            // the backend may have been replaced since the last tick
+            if let EmbeddingBackend::Remote(remote) = &*self.backend() {
+                if remote.is_in_use() {
+                    remote.ping_all().await;
+                }
+            }
+        }
+    }
+
+    /// Name of the model the settings select, without loading it
+    pub fn configured_model_name(settings: &AppSettings) -> String {
+        match &settings.embedding_endpoint {
+            Some(endpoint) if !endpoint.is_empty() => settings
+                .embedding_model
+                .clone()
+                .unwrap_or_else(|| DEFAULT_REMOTE_MODEL.to_string()),
+            _ => LOCAL_MODEL_NAME.to_string(),
+        }
+    }
+
+    /// Name of the model the embeddings come from, recorded with exported vectors
+    pub fn model_name(&self) -> String {
+        match &*self.backend() {
+            EmbeddingBackend::Local(_) => LOCAL_MODEL_NAME.to_string(),
+            EmbeddingBackend::Remote(remote) => remote.model.clone(),
+        }
+    }
+
+    pub fn stats(&self) -> EmbedderStats {
+        match &*self.backend() {
+            EmbeddingBackend::Local(_) => EmbedderStats {
+                backend: "local".to_string(),
+                ..EmbedderStats::default()
+            },
+            EmbeddingBackend::Remote(remote) => remote.stats(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct EmbedderStats {
+    pub backend: String,
+    pub requests: u64,
+    pub average_latency_ms: f64,
+    pub warmup_latency_ms: Option<f64>,
+}
+
+#[derive(Serialize)]
+struct EmbeddingRequest<'a> {
+    model: &'a str,
+    input: Vec<String>,
+}
+
+#[derive(Deserialize)]
+struct EmbeddingResponse {
+    data: Vec<EmbeddingData>,
+}
+
+#[derive(Deserialize)]
+struct EmbeddingData {
+    index: usize,
+    embedding: Vec<f32>,
+}
+
+/// How requests reach the embedding service
+enum Transport {
+    /// The reqwest client keeps a pool of connections (or a single multiplexed HTTP/2 connection) that is reused for every call
+    Http(Client),
+    /// Plain HTTP/1.1 over a Unix socket, so only processes allowed by the socket's permissions can serve or reach it
+    Unix(PathBuf),
+}
+
+/// Client for a remote embedding service
+struct RemoteEmbedder {
+    transport: Transport,
+    endpoint: String,
+    /// From the keychain, sent as a bearer token when set
+    api_key: Option<String>,
+    /// Header the API key is sent in instead of Authorization
+    auth_header: Option<String>,
+    model: String,
+    warm_connections: usize,
+    requests: AtomicU64,
+    total_latency_us: AtomicU64,
+    warmup_latency_us: AtomicU64,
+    /// When something was last embedded, or the connections were warmed up
+    last_used: Mutex<Instant>,
+}
+
+impl RemoteEmbedder {
+    fn new(
+        settings: &AppSettings,
+        endpoint: &str,
+        model: String,
+        warm_connections: usize,
+        http2: bool,
+    ) -> Result<Self, NetworkError> {
+        let transport = match unix_socket_path(endpoint) {
+            Some(socket) if cfg!(unix) => Transport::Unix(PathBuf::from(socket)),
+            Some(_) => return Err(NetworkError::UnixSocketUnsupported),
+            None => Transport::Http(Self::http_client(settings, warm_connections, http2)?),
+        };
+
+        Ok(Self {
+            transport,
+            endpoint: endpoint.trim_end_matches('/').to_string(),
+            api_key: get_secret(EMBEDDING_API_KEY).unwrap_or_else(|e| {
+                eprintln!("Failed to read the embedding API key: {}", e);
+                None
+            }),
+            auth_header: settings
+                .embedding_auth_header
+                .clone()
+                .filter(|header| !header.is_empty()),
+            model,
+            warm_connections: warm_connections.max(1),
+            requests: AtomicU64::new(0),
+            total_latency_us: AtomicU64::new(0),
+            warmup_latency_us: AtomicU64::new(0),
+            last_used: Mutex::new(Instant::now()),
+        })
+    }
+
+    fn http_client(
+        settings: &AppSettings,
+        warm_connections: usize,
+        http2: bool,
+    ) -> Result<Client, NetworkError> {
+        let mut builder = Client::builder()
+            .pool_idle_timeout(None)
+            .pool_max_idle_per_host(warm_connections.max(1))
+            .tcp_keepalive(Duration::from_secs(KEEPALIVE_INTERVAL_SECS))
+            .tcp_nodelay(true)
+            .timeout(Duration::from_secs(REQUEST_TIMEOUT_SECS));
+
+        if http2 {
+            // local embedding servers usually speak h2c, so skip the HTTP/1.1 upgrade dance
+            builder = builder
+                .http2_prior_knowledge()
+                .http2_keep_alive_interval(Duration::from_secs(KEEPALIVE_INTERVAL_SECS))
+                .http2_keep_alive_while_idle(true);
+        }
+
+        if let (Some(cert), Some(key)) = (
+            settings.embedding_client_cert.as_deref(),
+            settings.embedding_client_key.as_deref(),
+        ) {
+            builder = builder.identity(client_identity(cert, key)?);
+        }
+
+        Ok(configure_client(builder, settings)?.build()?)
+    }
+
+    /// The header the API key goes in, when there is one
+    fn auth(&self) -> Option<(String, String)> {
+        let api_key = self.api_key.as_ref()?;
+        Some(match &self.auth_header {
+            Some(header) => (header.clone(), api_key.clone()),
+            None => ("Authorization".to_string(), format!("Bearer {}", api_key)),
+        })
+    }
+
+    /// Embeds the input and counts the request in the stats
+    async fn embed(&self, input: Vec<String>) -> Result<Vec<Vec<f32>>, EmbedderError> {
+        let started = Instant::now();
+        *self.last_used.lock().unwrap() = started;
+        let embeddings = self.request(input).await?;
+
+        self.requests.fetch_add(1, Ordering::Relaxed);
+        self.total_latency_us
+            .fetch_add(started.elapsed().as_micros() as u64, Ordering::Relaxed);
+
+        Ok(embeddings)
     }
+
+    async fn request(&self, input: Vec<String>) -> Result<Vec<Vec<f32>>, EmbedderError> {
+        let body = EmbeddingRequest {
+            model: &self.model,
+            input,
+        };
+
+        let (status, bytes) = match &self.transport {
+            Transport::Http(client) => {
+                let mut request = client
+                    .post(format!("{}/v1/embeddings", self.endpoint))
+                    .json(&body);
+                if let Some((header, value)) = self.auth() {
+                    request = request.header(header, value);
+                }
+
+                let response = request.send().await?;
+                (response.status().as_u16(), response.bytes().await?.to_vec())
+            }
+            Transport::Unix(socket) => {
+                let headers: Vec<(String, String)> = self.auth().into_iter().collect();
+                let request = post_json_unix(
+                    socket,
+                    "/v1/embeddings",
+                    &headers,
+                    &serde_json::to_vec(&body)?,
+                );
+                tokio::time::timeout(Duration::from_secs(REQUEST_TIMEOUT_SECS), request)
+                    .await
+                    .map_err(|_| EmbedderError::Timeout(REQUEST_TIMEOUT_SECS))??
+            }
+        };
+
+        if !(200..300).contains(&status) {
+            let body = String::from_utf8_lossy(&bytes).to_string();
+            return Err(EmbedderError::Service(status, body));
+        }
+
+        let mut parsed: EmbeddingResponse = serde_json::from_slice(&bytes)?;
+        parsed.data.sort_by_key(|d| d.index);
+
+        Ok(parsed.data.into_iter().map(|d| d.embedding).collect())
+    }
+
+    /// Fires one request per pooled connection concurrently so each one gets established
+    async fn warm_up(&self) {
+        let started = Instant::now();
+        *self.last_used.lock().unwrap() = started;
+        self.ping_all().await;
+        let elapsed = started.elapsed();
+
+        self.warmup_latency_us
+            .store(elapsed.as_micros() as u64, Ordering::Relaxed);
+
+        println!(
+            "Warmed {} connection(s) to embedding service {} in {:?}",
+            self.warm_connections, self.endpoint, elapsed
+        );
+    }
+
+    /// Whether something was embedded lately enough for the connections to be worth keeping warm
+    fn is_in_use(&self) -> bool {
+        self.last_used.lock().unwrap().elapsed() < Duration::from_secs(KEEP_WARM_IDLE_SECS)
+    }
+
+    /// Pings don't count in the stats, they would skew the average latency of real requests
+    async fn ping_all(&self) {
+        let pings = (0..self.warm_connections).map(|_| self.request(vec!["warmup".to_string()]));
+
+        for result in futures::future::join_all(pings).await {
+            if let Err(e) = result {
+                eprintln!("Embedding service warmup request failed: {}", e);
+            }
+        }
+    }
+
+    fn stats(&self) -> EmbedderStats {
+        let requests = self.requests.load(Ordering::Relaxed);
+        let total_us = self.total_latency_us.load(Ordering::Relaxed);
+        let warmup_us = self.warmup_latency_us.load(Ordering::Relaxed);
+
+        EmbedderStats {
+            backend: format!("remote ({})", self.endpoint),
+            requests,
+            average_latency_ms: if requests > 0 {
+                total_us as f64 / requests as f64 / 1000.0
+            } else {
+                0.0
+            },
+            warmup_latency_ms: if warmup_us > 0 {
+                Some(warmup_us as f64 / 1000.0)
+            } else {
+                None
+            },
+        }
+    }
+}
+
+#[tauri::command]
+pub fn get_embedder_stats(
+    embedder: tauri::State<'_, std::sync::Arc<Embedder>>,
+) -> Result<EmbedderStats, String> {
+    Ok(embedder.stats())
 }
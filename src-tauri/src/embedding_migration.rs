@@ -0,0 +1,627 @@
+/*
+This file contains `kita migrate-embeddings --to <provider/model>`, which moves the index to another embedding model, also one with vectors of another size.
+The new vectors go into a table of their own while kita keeps searching the old one, so both vector spaces exist until the new one is complete. The chunk text
+is taken from the old table and vectors that already come from the new model are copied as they are, so no file is read or embedded twice. The migration can be
+stopped at any time and picks up where it was when the command runs again.
+
+Once every file is in the new table the switch is a single SQLite transaction: the table searches go to and the embedding settings change together. A running kita
+notices the switch within seconds, reads the settings again and moves searches and indexing to the new table and model. It then carries over the files it indexed
+into the old table in the meantime and drops the old table, in the background like a scan. A kita that wasn't running does the same once it has started
+*/
+
+use rusqlite::{params, Connection, OptionalExtension};
+use std::collections::{BTreeMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use tauri::{AppHandle, Manager};
+use thiserror::Error;
+use tokio::sync::Mutex;
+
+use crate::database_handler::{default_database_path, DATABASE_FILE};
+use crate::embedder::Embedder;
+use crate::encryption;
+use crate::indexing_control::{IndexingControl, Lane};
+use crate::reembed::{self, ReembedError};
+use crate::settings::{SettingsManager, SettingsManagerState};
+use crate::vectordb_manager::{
+    chunk_index, StoredChunk, VectorDbError, VectorDbManager, EMBEDDING_DIMENSION, TABLE_NAME,
+};
+use crate::AppResult;
+
+/// Files read from the tables at once
+const BATCH_FILES: usize = 50;
+/// Files kita indexes while a pass runs are picked up by the next one
+const MAX_CATCH_UP_PASSES: usize = 3;
+/// How often a running kita checks whether the index was switched to another model
+const SWITCH_CHECK_INTERVAL_SECS: u64 = 10;
+
+#[derive(Error, Debug)]
+pub enum MigrationError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Vector DB error: {0}")]
+    VectorDb(#[from] VectorDbError),
+
+    #[error("{0}")]
+    Reembed(#[from] ReembedError),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = MigrationError> = std::result::Result<T, E>;
+
+/// The table searches go to and the size of its vectors
+#[derive(Debug, Clone)]
+pub struct VectorSpace {
+    pub table: String,
+    /// None for an index that was never migrated
+    pub model: Option<String>,
+    pub dimension: i32,
+    /// Table of the space the last migration switched away from, until kita has carried over what it indexed into it
+    pub previous: Option<(String, i32)>,
+}
+
+impl Default for VectorSpace {
+    fn default() -> Self {
+        Self {
+            table: TABLE_NAME.to_string(),
+            model: None,
+            dimension: EMBEDDING_DIMENSION,
+            previous: None,
+        }
+    }
+}
+
+/// A migration that was started and hasn't switched over yet
+#[derive(Debug, Clone, PartialEq)]
+struct Migration {
+    provider: String,
+    model: String,
+    endpoint: Option<String>,
+    table: String,
+    dimension: i32,
+}
+
+/// The space the index is in, the original table for databases that were never migrated
+pub fn active_space(db_path: &Path) -> VectorSpace {
+    let space = Connection::open(db_path).and_then(|conn| read_space(&conn));
+    match space {
+        Ok(Some(space)) => space,
+        Ok(None) => VectorSpace::default(),
+        Err(e) => {
+            eprintln!(
+                "Failed to read the vector space, using the default one: {}",
+                e
+            );
+            VectorSpace::default()
+        }
+    }
+}
+
+fn read_space(conn: &Connection) -> rusqlite::Result<Option<VectorSpace>> {
+    conn.query_row(
+        "SELECT table_name, model, dimension, previous_table, previous_dimension
+         FROM vector_space WHERE id = 1",
+        [],
+        |row| {
+            let previous_table: Option<String> = row.get(3)?;
+            let previous_dimension: Option<i32> = row.get(4)?;
+            Ok(VectorSpace {
+                table: row.get(0)?,
+                model: row.get(1)?,
+                dimension: row.get(2)?,
+                previous: previous_table.zip(previous_dimension),
+            })
+        },
+    )
+    .optional()
+}
+
+fn read_migration(conn: &Connection) -> rusqlite::Result<Option<Migration>> {
+    conn.query_row(
+        "SELECT provider, model, endpoint, table_name, dimension FROM embedding_migration WHERE id = 1",
+        [],
+        |row| {
+            Ok(Migration {
+                provider: row.get(0)?,
+                model: row.get(1)?,
+                endpoint: row.get(2)?,
+                table: row.get(3)?,
+                dimension: row.get(4)?,
+            })
+        },
+    )
+    .optional()
+}
+
+fn save_migration(conn: &Connection, migration: &Migration) -> rusqlite::Result<()> {
+    conn.execute(
+        "INSERT OR REPLACE INTO embedding_migration (id, provider, model, endpoint, table_name, dimension)
+         VALUES (1, ?1, ?2, ?3, ?4, ?5)",
+        params![
+            migration.provider,
+            migration.model,
+            migration.endpoint,
+            migration.table,
+            migration.dimension
+        ],
+    )?;
+    Ok(())
+}
+
+/// Points searches at the new table and the embedder at the new model in one transaction, so kita never starts with one without the other
+fn switch_space(
+    db_path: &Path,
+    migration: &Migration,
+    previous: &VectorSpace,
+    settings_json: &str,
+) -> rusqlite::Result<()> {
+    let mut conn = Connection::open(db_path)?;
+    let tx = conn.transaction()?;
+
+    tx.execute(
+        "INSERT OR REPLACE INTO vector_space (id, table_name, model, dimension, previous_table, previous_dimension, switched_at)
+         VALUES (1, ?1, ?2, ?3, ?4, ?5, CURRENT_TIMESTAMP)",
+        params![
+            migration.table,
+            migration.model,
+            migration.dimension,
+            previous.table,
+            previous.dimension
+        ],
+    )?;
+    tx.execute(
+        "INSERT OR REPLACE INTO settings (id, data, updated_at) VALUES (1, ?1, CURRENT_TIMESTAMP)",
+        params![settings_json],
+    )?;
+    tx.execute("DELETE FROM embedding_migration", [])?;
+
+    tx.commit()
+}
+
+/// Ids of the files in the SQLite index, the ones whose vectors are worth keeping
+fn indexed_file_ids(db_path: &Path) -> Result<HashSet<String>> {
+    let conn = Connection::open(db_path)?;
+    let mut stmt = conn.prepare("SELECT id FROM files")?;
+    let ids = stmt
+        .query_map([], |row| row.get::<_, i64>(0))?
+        .map(|id| id.map(|id| id.to_string()))
+        .collect::<rusqlite::Result<HashSet<_>>>()?;
+    Ok(ids)
+}
+
+/// Brings the files of `source` that are still `indexed` into `target`: files whose chunks differ are written again, with the vectors
+/// of the embedder's model, and files that are no longer indexed are removed from `target`. A file is stored in SQLite before its vectors,
+/// so one indexed after `indexed` was read isn't in `target` yet and is left for the next sync. Returns the number of files written
+async fn sync_space(
+    source: &VectorDbManager,
+    target: &VectorDbManager,
+    embedder: &Arc<Embedder>,
+    indexed: &HashSet<String>,
+) -> Result<usize> {
+    let model = embedder.model_name();
+    let file_ids: Vec<String> = source
+        .file_ids()
+        .await?
+        .into_iter()
+        .filter(|file_id| indexed.contains(file_id))
+        .collect();
+    let total = file_ids.len();
+    let mut written = 0;
+
+    for (i, batch) in file_ids.chunks(BATCH_FILES).enumerate() {
+        let existing = group_by_file(target.chunks_for_files(batch).await?);
+
+        for (file_id, chunks) in group_by_file(source.chunks_for_files(batch).await?) {
+            if existing
+                .get(&file_id)
+                .is_some_and(|current| same_chunks(current, &chunks))
+            {
+                continue;
+            }
+
+            let chunks = carry_over(embedder, &model, target.dimension(), chunks).await?;
+            target.replace_file_chunks(&file_id, chunks).await?;
+            written += 1;
+        }
+
+        println!(
+            "Checked {}/{} files",
+            (i * BATCH_FILES + batch.len()).min(total),
+            total
+        );
+    }
+
+    let removed: Vec<String> = target
+        .file_ids()
+        .await?
+        .into_iter()
+        .filter(|file_id| !indexed.contains(file_id))
+        .collect();
+    target.delete_files(&removed).await?;
+
+    Ok(written)
+}
+
+/// The chunks with vectors of the embedder's model, the ones that already have them are kept as they are
+async fn carry_over(
+    embedder: &Arc<Embedder>,
+    model: &str,
+    dimension: i32,
+    chunks: Vec<StoredChunk>,
+) -> Result<Vec<StoredChunk>> {
+    let (mut kept, stale): (Vec<StoredChunk>, Vec<StoredChunk>) =
+        chunks.into_iter().partition(|chunk| {
+            chunk.embedding_model.as_deref() == Some(model)
+                && chunk.embedding.len() == dimension as usize
+        });
+
+    if !stale.is_empty() {
+        kept.extend(reembed::embed_stored_chunks(embedder.clone(), stale).await?);
+    }
+    kept.sort_by_key(|chunk| chunk_index(&chunk.id));
+
+    Ok(kept)
+}
+
+fn group_by_file(chunks: Vec<StoredChunk>) -> BTreeMap<String, Vec<StoredChunk>> {
+    let mut files: BTreeMap<String, Vec<StoredChunk>> = BTreeMap::new();
+    for chunk in chunks {
+        files.entry(chunk.file_id.clone()).or_default().push(chunk);
+    }
+    files
+}
+
+/// Both tables hold the same version of the file
+fn same_chunks(a: &[StoredChunk], b: &[StoredChunk]) -> bool {
+    a.iter()
+        .map(|chunk| (&chunk.id, &chunk.text))
+        .eq(b.iter().map(|chunk| (&chunk.id, &chunk.text)))
+}
+
+/// Finishes the last migration once the app is up, then follows the switches `kita migrate-embeddings` makes while the app runs
+pub fn init_migration_watch(app: &tauri::App) -> AppResult<()> {
+    let app_handle = app.app_handle().clone();
+    tauri::async_runtime::spawn(async move {
+        if let Err(e) = retire_previous_space(&app_handle).await {
+            eprintln!("Failed to finish the embedding migration: {}", e);
+        }
+
+        let mut ticker = tokio::time::interval(Duration::from_secs(SWITCH_CHECK_INTERVAL_SECS));
+        loop {
+            ticker.tick().await;
+            match follow_switch(&app_handle).await {
+                Ok(true) => {
+                    if let Err(e) = retire_previous_space(&app_handle).await {
+                        eprintln!("Failed to finish the embedding migration: {}", e);
+                    }
+                }
+                Ok(false) => {}
+                Err(e) => eprintln!("Failed to switch to the migrated index: {}", e),
+            }
+        }
+    });
+
+    Ok(())
+}
+
+fn database_path(app_handle: &AppHandle) -> Result<PathBuf> {
+    app_handle
+        .path()
+        .app_data_dir()
+        .map(|dir| dir.join(DATABASE_FILE))
+        .map_err(|_| MigrationError::Other("Failed to get app data directory".into()))
+}
+
+/// Moves the running app to the table and model `kita migrate-embeddings` or `kita reembed` switched to, the settings they saved
+/// are read again. Waits for running scans to finish first, so no run stores vectors of both models. Returns whether it switched
+async fn follow_switch(app_handle: &AppHandle) -> Result<bool> {
+    let db_path = database_path(app_handle)?;
+    let space = active_space(&db_path);
+    let vectordb = app_handle
+        .state::<Arc<Mutex<VectorDbManager>>>()
+        .inner()
+        .clone();
+
+    // read apart from the app's settings, which only take the saved ones when there is a switch to follow
+    let saved = SettingsManager::new(&db_path.to_string_lossy());
+    saved
+        .initialize()
+        .map_err(|e| MigrationError::Other(format!("Failed to load settings: {}", e)))?;
+    let saved_model = Embedder::configured_model_name(&saved.get_settings().unwrap_or_default());
+
+    let table_switched = vectordb.lock().await.table_name() != space.table;
+    let model_switched = app_handle.state::<Arc<Embedder>>().model_name() != saved_model;
+    if !table_switched && !model_switched {
+        return Ok(false);
+    }
+
+    // checked again on the next tick
+    let control = app_handle.state::<Arc<IndexingControl>>().inner().clone();
+    if control.is_running() {
+        return Ok(false);
+    }
+    let _run = control.begin_run(Lane::Background);
+
+    // the migration saved the embedding settings of the new model
+    let settings_manager = app_handle.state::<SettingsManagerState>().0.clone();
+    settings_manager
+        .initialize()
+        .map_err(|e| MigrationError::Other(format!("Failed to load settings: {}", e)))?;
+    let settings = settings_manager.get_settings().unwrap_or_default();
+    let embedder = Embedder::from_settings(&settings)
+        .map_err(|e| MigrationError::Other(format!("Failed to set up the embedder: {}", e)))?;
+
+    let mut manager = vectordb.lock().await;
+    if table_switched {
+        let switched = manager.open_space(&space.table, space.dimension).await?;
+        *manager = switched;
+    }
+    app_handle.state::<Arc<Embedder>>().replace(embedder);
+    drop(manager);
+
+    println!(
+        "Switched to the embedding model {}",
+        app_handle.state::<Arc<Embedder>>().model_name()
+    );
+    app_handle.state::<Arc<Embedder>>().warm_up().await;
+    Ok(true)
+}
+
+/// Carries the files kita indexed into the old table between a migration's switch and the app moving over to the new one, then drops the old table.
+/// Holds the vector DB while it runs: nothing has written to the new table since the switch except through this app,
+/// which has just moved over, so a file that differs between the tables was last written to the old one
+async fn retire_previous_space(app_handle: &AppHandle) -> Result<()> {
+    let db_path = database_path(app_handle)?;
+    let Some((table, dimension)) = active_space(&db_path).previous else {
+        return Ok(());
+    };
+
+    // counts as an indexing run, so scans wait for it
+    let control = app_handle.state::<Arc<IndexingControl>>().inner().clone();
+    let _run = control.begin_run(Lane::Background);
+
+    let embedder = app_handle.state::<Arc<Embedder>>().inner().clone();
+    let vectordb = app_handle
+        .state::<Arc<Mutex<VectorDbManager>>>()
+        .inner()
+        .clone();
+    let manager = vectordb.lock().await;
+    let previous = manager.open_space(&table, dimension).await?;
+
+    let indexed = indexed_file_ids(&db_path)?;
+    let written = sync_space(&previous, &manager, &embedder, &indexed).await?;
+    if written > 0 {
+        println!(
+            "Carried over {} files indexed during the embedding migration",
+            written
+        );
+    }
+
+    previous.drop_space().await?;
+    Connection::open(&db_path)?.execute(
+        "UPDATE vector_space SET previous_table = NULL, previous_dimension = NULL WHERE id = 1",
+        [],
+    )?;
+    println!("Dropped the vectors of the previous embedding model");
+
+    Ok(())
+}
+
+/// `kita migrate-embeddings --to <provider/model> [--endpoint <url>]` moves the index to another embedding model,
+/// `kita migrate-embeddings --abort` drops a migration that hasn't switched over yet
+pub fn run_migrate_embeddings_command(args: &[String]) -> std::result::Result<(), String> {
+    const USAGE: &str = "Usage: kita migrate-embeddings --to <local|remote>/<model> [--endpoint <url>]\n       kita migrate-embeddings --abort";
+
+    let mut target = None;
+    let mut endpoint = None;
+    let mut abort = false;
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--to" => target = args.next().cloned(),
+            "--endpoint" => endpoint = args.next().cloned(),
+            "--abort" => abort = true,
+            _ => return Err(USAGE.to_string()),
+        }
+    }
+
+    let db_path = default_database_path()
+        .filter(|path| path.exists())
+        .ok_or_else(|| "No kita database found, start kita once first".to_string())?;
+    let conn =
+        Connection::open(&db_path).map_err(|e| format!("Failed to open the database: {}", e))?;
+    // older databases don't have the tables until the app has started once
+    let (space, pending) = read_space(&conn)
+        .and_then(|space| Ok((space.unwrap_or_default(), read_migration(&conn)?)))
+        .map_err(|e| {
+            format!(
+                "Failed to read the migration state, start kita once so the database is up to date: {}",
+                e
+            )
+        })?;
+
+    let settings_manager = SettingsManager::new(&db_path.to_string_lossy());
+    settings_manager
+        .initialize()
+        .map_err(|e| format!("Failed to load settings: {}", e))?;
+    let settings = settings_manager.get_settings().unwrap_or_default();
+    encryption::init_encryption(&settings, &db_path);
+
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .map_err(|e| format!("Failed to start runtime: {}", e))?;
+    let vectordb = runtime
+        .block_on(VectorDbManager::open_default())
+        .map_err(|e| format!("Failed to open the vector DB: {}", e))?;
+
+    if abort {
+        let Some(migration) = pending else {
+            println!("No embedding migration in progress");
+            return Ok(());
+        };
+        runtime
+            .block_on(async {
+                vectordb
+                    .open_space(&migration.table, migration.dimension)
+                    .await?
+                    .drop_space()
+                    .await
+            })
+            .map_err(|e| format!("Failed to drop the new vectors: {}", e))?;
+        conn.execute("DELETE FROM embedding_migration", [])
+            .map_err(|e| format!("Failed to abort the migration: {}", e))?;
+        println!(
+            "Aborted the migration to {}/{}",
+            migration.provider, migration.model
+        );
+        return Ok(());
+    }
+
+    let (provider, model) = target
+        .as_deref()
+        .and_then(|target| target.split_once('/'))
+        .filter(|(_, model)| !model.is_empty())
+        .ok_or_else(|| USAGE.to_string())?;
+
+    let mut target_settings = settings.clone();
+    match provider {
+        "local" => {
+            target_settings.embedding_endpoint = None;
+            target_settings.embedding_model = None;
+            if Embedder::configured_model_name(&target_settings) != model {
+                return Err(format!(
+                    "The built-in model is {}, use remote/<model> for other models",
+                    Embedder::configured_model_name(&target_settings)
+                ));
+            }
+        }
+        "remote" => {
+            target_settings.embedding_endpoint = endpoint
+                .clone()
+                .or_else(|| settings.embedding_endpoint.clone())
+                .filter(|endpoint| !endpoint.is_empty());
+            if target_settings.embedding_endpoint.is_none() {
+                return Err(
+                    "No embedding endpoint configured, pass one with --endpoint".to_string()
+                );
+            }
+            target_settings.embedding_model = Some(model.to_string());
+        }
+        _ => {
+            return Err(format!(
+                "Unknown provider {}, expected local or remote",
+                provider
+            ))
+        }
+    }
+
+    let current = Embedder::configured_model_name(&settings);
+    if pending.is_none()
+        && current == model
+        && target_settings.embedding_endpoint == settings.embedding_endpoint
+    {
+        println!("The index already uses {}/{}", provider, model);
+        return Ok(());
+    }
+    if let Some(migration) = &pending {
+        if migration.provider != provider
+            || migration.model != model
+            || migration.endpoint != target_settings.embedding_endpoint
+        {
+            return Err(format!(
+                "A migration to {}/{} is in progress, finish it or run kita migrate-embeddings --abort first",
+                migration.provider, migration.model
+            ));
+        }
+    }
+    if space.previous.is_some() {
+        return Err(
+            "Start kita once to finish the last migration before starting another one".to_string(),
+        );
+    }
+
+    // vectors stored before models were recorded come from the model configured until now
+    runtime
+        .block_on(vectordb.stamp_unversioned_rows(&current))
+        .map_err(|e| format!("Failed to read the vector DB: {}", e))?;
+
+    let embedder = Arc::new(
+        Embedder::from_settings(&target_settings)
+            .map_err(|e| format!("Failed to set up the embedder: {}", e))?,
+    );
+    let dimension = runtime
+        .block_on(reembed::probe_dimension(&embedder))
+        .map_err(|e| format!("Failed to reach {}/{}: {}", provider, model, e))?;
+    if dimension == 0 {
+        return Err(format!("{}/{} returned no vector", provider, model));
+    }
+
+    let migration = match pending {
+        Some(migration) if migration.dimension == dimension as i32 => {
+            println!("Resuming the migration to {}/{}", provider, model);
+            migration
+        }
+        Some(migration) => {
+            return Err(format!(
+                "{}/{} now returns {} dimensions instead of {}, run kita migrate-embeddings --abort and start again",
+                provider, model, dimension, migration.dimension
+            ))
+        }
+        None => {
+            let started = SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map(|d| d.as_secs())
+                .unwrap_or(0);
+            let migration = Migration {
+                provider: provider.to_string(),
+                model: model.to_string(),
+                endpoint: target_settings.embedding_endpoint.clone(),
+                table: format!("{}_{}", TABLE_NAME, started),
+                dimension: dimension as i32,
+            };
+            save_migration(&conn, &migration)
+                .map_err(|e| format!("Failed to record the migration: {}", e))?;
+            println!(
+                "Migrating the index from {} to {}/{} ({} dimensions), kita keeps searching the current vectors until it is done",
+                current, provider, model, dimension
+            );
+            migration
+        }
+    };
+
+    let shadow = runtime
+        .block_on(vectordb.open_space(&migration.table, migration.dimension))
+        .map_err(|e| format!("Failed to create the new vector table: {}", e))?;
+
+    // kita may index files while a pass runs, the next pass picks them up
+    for pass in 0..MAX_CATCH_UP_PASSES {
+        let indexed = indexed_file_ids(&db_path)
+            .map_err(|e| format!("Failed to read the indexed files: {}", e))?;
+        let written = runtime
+            .block_on(sync_space(&vectordb, &shadow, &embedder, &indexed))
+            .map_err(|e| {
+                format!(
+                    "Stopped: {}. Run the command again to carry on where it stopped",
+                    e
+                )
+            })?;
+        if written == 0 || pass + 1 == MAX_CATCH_UP_PASSES {
+            break;
+        }
+        println!("{} files changed during the pass, checking again", written);
+    }
+
+    let settings_json = serde_json::to_string(&target_settings)
+        .map_err(|e| format!("Failed to save settings: {}", e))?;
+    switch_space(&db_path, &migration, &space, &settings_json)
+        .map_err(|e| format!("Failed to switch to the new vectors: {}", e))?;
+
+    println!("Switched the index to {}/{}", provider, model);
+    println!("A running kita moves over to the new vectors within a few seconds");
+    Ok(())
+}
@@ -0,0 +1,271 @@
+/*
+This file contains encryption at rest for what is extracted from documents: chunk text, embeddings, summaries, version history and thumbnails. With encrypt_at_rest on, they are
+sealed with AES-256-GCM before they are stored and opened again transparently when they are read. The key is derived from the encryption_passphrase secret when the
+user set one, otherwise a random key is generated and kept in the OS keychain. Sealed and plain values can live side by side, so turning the setting on or off only
+changes what is written from then on, and database maintenance rewrites the existing vector rows.
+Searching sealed embeddings decrypts them into memory, where they stay while the app runs, see opened_chunks in vectordb_manager.rs.
+Not covered, because they are looked up with SQL and can't be searched sealed: file names, paths, titles, authors and tags, the full-text index,
+symbol names, entity names, email headers (subject, sender, recipients) and the rest of the file metadata.
+Content that leaves the index is opened: `kita export` only writes an archive of an encrypted index with --plaintext, and `kita sync` only sends
+entries to a side that has encrypt_at_rest on too, which seals them again when it stores them
+*/
+
+use aes_gcm::aead::{Aead, KeyInit};
+use aes_gcm::{Aes256Gcm, Nonce};
+use base64::{engine::general_purpose::STANDARD, Engine};
+use pbkdf2::pbkdf2_hmac;
+use rand::rngs::OsRng;
+use rand::RngCore;
+use rusqlite::{params, Connection, OptionalExtension};
+use sha2::Sha256;
+use std::path::Path;
+use std::sync::OnceLock;
+use thiserror::Error;
+
+use crate::secrets::{self, SecretsError, ENCRYPTION_KEY, ENCRYPTION_PASSPHRASE};
+use crate::settings::AppSettings;
+
+/// Marks a sealed value, followed by base64 of the nonce and the ciphertext
+const SEALED_PREFIX: &str = "kita:enc1:";
+const NONCE_LEN: usize = 12;
+const KEY_LEN: usize = 32;
+const SALT_LEN: usize = 16;
+/// PBKDF2-HMAC-SHA256 rounds for passphrases, runs once at startup
+const PASSPHRASE_ROUNDS: u32 = 600_000;
+/// Sealed into the database when the key is first used, so a wrong key is noticed before anything is decrypted with it
+const KEY_CHECK: &[u8] = b"kita";
+
+static AT_REST: OnceLock<AtRest> = OnceLock::new();
+
+#[derive(Error, Debug)]
+pub enum EncryptionError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Keychain error: {0}")]
+    Secrets(#[from] SecretsError),
+
+    #[error("Encryption key unavailable: {0}")]
+    Unavailable(String),
+
+    #[error("Cipher error: {0}")]
+    Cipher(String),
+}
+
+pub type Result<T, E = EncryptionError> = std::result::Result<T, E>;
+
+struct AtRest {
+    /// Whether new content is sealed
+    sealing: bool,
+    /// None when nothing was ever encrypted and the setting is off, the error when the key couldn't be loaded
+    cipher: Option<std::result::Result<Aes256Gcm, String>>,
+}
+
+impl AtRest {
+    fn cipher(&self) -> Result<&Aes256Gcm> {
+        match &self.cipher {
+            Some(Ok(cipher)) => Ok(cipher),
+            Some(Err(e)) => Err(EncryptionError::Unavailable(e.clone())),
+            None => Err(EncryptionError::Unavailable(
+                "encryption at rest was never set up".to_string(),
+            )),
+        }
+    }
+}
+
+/// Loads the key when encryption is on or the index has encrypted content. Has to run before anything is read from
+/// or written to the index. A key that can't be loaded doesn't keep the app from starting, but nothing is written
+/// in plain text in its place: storing new content fails until the key is back
+pub fn init_encryption(settings: &AppSettings, db_path: &Path) {
+    let sealing = settings.encrypt_at_rest.unwrap_or(false);
+
+    let cipher = match load_cipher(db_path, sealing) {
+        Ok(cipher) => cipher.map(Ok),
+        Err(e) => {
+            eprintln!("Failed to load the encryption key: {}", e);
+            Some(Err(e.to_string()))
+        }
+    };
+    if sealing && matches!(cipher, Some(Ok(_))) {
+        println!("Encryption at rest enabled");
+    }
+
+    let _ = AT_REST.set(AtRest { sealing, cipher });
+}
+
+fn load_cipher(db_path: &Path, sealing: bool) -> Result<Option<Aes256Gcm>> {
+    let conn = Connection::open(db_path)?;
+    let stored: Option<(Vec<u8>, String)> = conn
+        .query_row(
+            "SELECT salt, key_check FROM encryption WHERE id = 1",
+            [],
+            |row| Ok((row.get(0)?, row.get(1)?)),
+        )
+        .optional()?;
+
+    // the key is only needed once something is or will be encrypted
+    if stored.is_none() && !sealing {
+        return Ok(None);
+    }
+
+    let salt = match &stored {
+        Some((salt, _)) => salt.clone(),
+        None => random_bytes(SALT_LEN),
+    };
+    let key = derive_key(&salt, stored.is_none())?;
+    let cipher =
+        Aes256Gcm::new_from_slice(&key).map_err(|e| EncryptionError::Cipher(e.to_string()))?;
+
+    match stored {
+        Some((_, key_check)) => {
+            if open_with(&cipher, &key_check).ok().as_deref() != Some(KEY_CHECK) {
+                return Err(EncryptionError::Unavailable(
+                    "the key doesn't match the one the index was encrypted with".to_string(),
+                ));
+            }
+        }
+        None => {
+            conn.execute(
+                "INSERT INTO encryption (id, salt, key_check) VALUES (1, ?1, ?2)",
+                params![salt, seal_with(&cipher, KEY_CHECK)?],
+            )?;
+        }
+    }
+
+    Ok(Some(cipher))
+}
+
+/// The user's passphrase wins over the generated key. The generated key is only created on first use,
+/// if it disappears from the keychain later the encrypted content can't be read anymore
+fn derive_key(salt: &[u8], first_use: bool) -> Result<Vec<u8>> {
+    if let Some(passphrase) = secrets::get_secret(ENCRYPTION_PASSPHRASE)? {
+        let mut key = vec![0u8; KEY_LEN];
+        pbkdf2_hmac::<Sha256>(passphrase.as_bytes(), salt, PASSPHRASE_ROUNDS, &mut key);
+        return Ok(key);
+    }
+
+    match secrets::get_secret(ENCRYPTION_KEY)? {
+        Some(encoded) => STANDARD
+            .decode(encoded)
+            .ok()
+            .filter(|key| key.len() == KEY_LEN)
+            .ok_or_else(|| {
+                EncryptionError::Unavailable("the key in the keychain is invalid".to_string())
+            }),
+        None if first_use => {
+            let key = random_bytes(KEY_LEN);
+            secrets::set_secret(ENCRYPTION_KEY, &STANDARD.encode(&key))?;
+            Ok(key)
+        }
+        None => Err(EncryptionError::Unavailable(
+            "the key is missing from the keychain".to_string(),
+        )),
+    }
+}
+
+fn random_bytes(len: usize) -> Vec<u8> {
+    let mut bytes = vec![0u8; len];
+    OsRng.fill_bytes(&mut bytes);
+    bytes
+}
+
+fn seal_with(cipher: &Aes256Gcm, data: &[u8]) -> Result<String> {
+    let nonce = random_bytes(NONCE_LEN);
+    let ciphertext = cipher
+        .encrypt(Nonce::from_slice(&nonce), data)
+        .map_err(|e| EncryptionError::Cipher(e.to_string()))?;
+
+    let mut sealed = nonce;
+    sealed.extend_from_slice(&ciphertext);
+    Ok(format!("{}{}", SEALED_PREFIX, STANDARD.encode(sealed)))
+}
+
+fn open_with(cipher: &Aes256Gcm, sealed: &str) -> Result<Vec<u8>> {
+    let sealed = sealed
+        .strip_prefix(SEALED_PREFIX)
+        .and_then(|encoded| STANDARD.decode(encoded).ok())
+        .filter(|sealed| sealed.len() > NONCE_LEN)
+        .ok_or_else(|| EncryptionError::Cipher("malformed sealed value".to_string()))?;
+
+    let (nonce, ciphertext) = sealed.split_at(NONCE_LEN);
+    cipher
+        .decrypt(Nonce::from_slice(nonce), ciphertext)
+        .map_err(|e| EncryptionError::Cipher(e.to_string()))
+}
+
+/// Whether new content is sealed
+pub fn is_sealing() -> bool {
+    AT_REST.get().is_some_and(|at_rest| at_rest.sealing)
+}
+
+/// The cipher new content is sealed with, None when encryption at rest is off
+fn sealing_cipher() -> Result<Option<&'static Aes256Gcm>> {
+    match AT_REST.get() {
+        Some(at_rest) if at_rest.sealing => at_rest.cipher().map(Some),
+        _ => Ok(None),
+    }
+}
+
+fn opening_cipher() -> Result<&'static Aes256Gcm> {
+    AT_REST
+        .get()
+        .ok_or_else(|| EncryptionError::Unavailable("encryption isn't initialized".to_string()))?
+        .cipher()
+}
+
+fn is_sealed(data: &[u8]) -> bool {
+    data.starts_with(SEALED_PREFIX.as_bytes())
+}
+
+pub fn seal_text(text: &str) -> Result<String> {
+    match sealing_cipher()? {
+        Some(cipher) => seal_with(cipher, text.as_bytes()),
+        None => Ok(text.to_string()),
+    }
+}
+
+/// Text that wasn't sealed is returned as is
+pub fn open_text(text: &str) -> Result<String> {
+    if !is_sealed(text.as_bytes()) {
+        return Ok(text.to_string());
+    }
+
+    let opened = open_with(opening_cipher()?, text)?;
+    String::from_utf8(opened).map_err(|e| EncryptionError::Cipher(e.to_string()))
+}
+
+pub fn seal_bytes(data: &[u8]) -> Result<Vec<u8>> {
+    match sealing_cipher()? {
+        Some(cipher) => seal_with(cipher, data).map(String::into_bytes),
+        None => Ok(data.to_vec()),
+    }
+}
+
+/// Bytes that weren't sealed are returned as is
+pub fn open_bytes(data: &[u8]) -> Result<Vec<u8>> {
+    if !is_sealed(data) {
+        return Ok(data.to_vec());
+    }
+
+    let sealed = std::str::from_utf8(data).map_err(|e| EncryptionError::Cipher(e.to_string()))?;
+    open_with(opening_cipher()?, sealed)
+}
+
+/// None when encryption at rest is off and the embedding is stored as is
+pub fn seal_embedding(embedding: &[f32]) -> Result<Option<String>> {
+    match sealing_cipher()? {
+        Some(cipher) => {
+            let bytes: Vec<u8> = embedding.iter().flat_map(|v| v.to_le_bytes()).collect();
+            seal_with(cipher, &bytes).map(Some)
+        }
+        None => Ok(None),
+    }
+}
+
+pub fn open_embedding(sealed: &str) -> Result<Vec<f32>> {
+    let bytes = open_with(opening_cipher()?, sealed)?;
+    Ok(bytes
+        .chunks_exact(4)
+        .map(|b| f32::from_le_bytes([b[0], b[1], b[2], b[3]]))
+        .collect())
+}
@@ -0,0 +1,707 @@
+/*
+This file contains the entity and keyword index used for faceted browsing. When a document is indexed, the people, organizations and dates it mentions and its top keywords
+are pulled out of its text with a few heuristics (no model involved) and stored in the entities table with the file, so the UI can list what the corpus talks about
+and show everything mentioning "Acme Corp"
+*/
+
+use regex::Regex;
+use rusqlite::{params, Connection};
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use std::path::PathBuf;
+use std::sync::OnceLock;
+use tauri::State;
+use thiserror::Error;
+use tokio::task;
+
+use crate::file_processor::{get_processor, FileProcessorState};
+
+const DEFAULT_LIST_LIMIT: usize = 50;
+/// Names and dates kept per file, the most mentioned ones
+const MAX_ENTITIES_PER_FILE: usize = 50;
+const MAX_KEYWORDS_PER_FILE: usize = 10;
+/// A word has to come up this often to be a keyword of the file
+const MIN_KEYWORD_COUNT: usize = 2;
+const MIN_KEYWORD_LENGTH: usize = 4;
+
+/// Words that end (or start, as in "Bank of America") an organization name
+const ORGANIZATION_WORDS: &[&str] = &[
+    "inc",
+    "corp",
+    "corporation",
+    "co",
+    "company",
+    "llc",
+    "llp",
+    "ltd",
+    "limited",
+    "gmbh",
+    "ag",
+    "sa",
+    "plc",
+    "group",
+    "holdings",
+    "partners",
+    "bank",
+    "university",
+    "college",
+    "institute",
+    "foundation",
+    "association",
+    "agency",
+    "ministry",
+    "department",
+    "labs",
+    "technologies",
+    "systems",
+];
+
+const PERSON_TITLES: &[&str] = &["mr", "mrs", "ms", "miss", "dr", "prof", "sir"];
+
+const MONTHS: &[&str] = &[
+    "january",
+    "february",
+    "march",
+    "april",
+    "may",
+    "june",
+    "july",
+    "august",
+    "september",
+    "october",
+    "november",
+    "december",
+];
+
+/// Capitalized words that start sentences and headings far more often than names
+const NOT_NAMES: &[&str] = &[
+    "a",
+    "an",
+    "the",
+    "this",
+    "that",
+    "these",
+    "those",
+    "it",
+    "its",
+    "we",
+    "our",
+    "you",
+    "your",
+    "they",
+    "their",
+    "he",
+    "she",
+    "his",
+    "her",
+    "i",
+    "in",
+    "on",
+    "at",
+    "to",
+    "for",
+    "from",
+    "by",
+    "with",
+    "and",
+    "or",
+    "but",
+    "if",
+    "when",
+    "then",
+    "as",
+    "of",
+    "not",
+    "no",
+    "yes",
+    "all",
+    "any",
+    "some",
+    "each",
+    "every",
+    "there",
+    "here",
+    "what",
+    "which",
+    "who",
+    "how",
+    "why",
+    "monday",
+    "tuesday",
+    "wednesday",
+    "thursday",
+    "friday",
+    "saturday",
+    "sunday",
+    "dear",
+    "hello",
+    "hi",
+    "thanks",
+    "regards",
+    "best",
+    "page",
+    "table",
+    "figure",
+    "section",
+    "chapter",
+    "note",
+    "see",
+];
+
+/// Common words that are never keywords
+const STOPWORDS: &[&str] = &[
+    "about",
+    "above",
+    "after",
+    "again",
+    "against",
+    "also",
+    "although",
+    "because",
+    "been",
+    "before",
+    "being",
+    "below",
+    "between",
+    "both",
+    "could",
+    "does",
+    "doing",
+    "down",
+    "during",
+    "each",
+    "even",
+    "ever",
+    "every",
+    "from",
+    "further",
+    "have",
+    "having",
+    "here",
+    "hers",
+    "herself",
+    "himself",
+    "however",
+    "into",
+    "itself",
+    "just",
+    "like",
+    "made",
+    "make",
+    "many",
+    "more",
+    "most",
+    "much",
+    "must",
+    "myself",
+    "need",
+    "only",
+    "other",
+    "ours",
+    "ourselves",
+    "over",
+    "same",
+    "shall",
+    "should",
+    "since",
+    "some",
+    "such",
+    "than",
+    "that",
+    "their",
+    "theirs",
+    "them",
+    "themselves",
+    "then",
+    "there",
+    "these",
+    "they",
+    "this",
+    "those",
+    "through",
+    "under",
+    "until",
+    "upon",
+    "very",
+    "want",
+    "were",
+    "what",
+    "when",
+    "where",
+    "which",
+    "while",
+    "will",
+    "with",
+    "within",
+    "without",
+    "would",
+    "your",
+    "yours",
+    "yourself",
+    "yourselves",
+    "said",
+    "says",
+    "using",
+    "used",
+    "well",
+    "still",
+    "thing",
+    "things",
+    "know",
+    "really",
+    "going",
+    "page",
+];
+
+#[derive(Error, Debug)]
+pub enum EntitiesError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = EntitiesError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum EntityKind {
+    Person,
+    Organization,
+    Date,
+    Keyword,
+}
+
+impl EntityKind {
+    fn as_str(&self) -> &'static str {
+        match self {
+            Self::Person => "person",
+            Self::Organization => "organization",
+            Self::Date => "date",
+            Self::Keyword => "keyword",
+        }
+    }
+}
+
+/// An entity found in a document. Dates are normalized to YYYY-MM-DD so every way of writing a day matches
+#[derive(Debug, Clone, PartialEq)]
+pub struct Entity {
+    pub name: String,
+    pub kind: EntityKind,
+    pub count: usize,
+}
+
+/// An entity and how many files mention it, for browsing
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct EntityFacet {
+    pub name: String,
+    pub kind: String,
+    pub file_count: i64,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct EntityFile {
+    pub file_id: i64,
+    pub name: String,
+    pub path: String,
+    /// How many times the file mentions the entity
+    pub mentions: i64,
+}
+
+struct Patterns {
+    name_run: Regex,
+    iso_date: Regex,
+    month_first_date: Regex,
+    day_first_date: Regex,
+    word: Regex,
+}
+
+fn patterns() -> &'static Patterns {
+    static PATTERNS: OnceLock<Patterns> = OnceLock::new();
+    PATTERNS.get_or_init(|| {
+        let month = r"(January|February|March|April|May|June|July|August|September|October|November|December|Jan|Feb|Mar|Apr|Jun|Jul|Aug|Sep|Sept|Oct|Nov|Dec)\.?";
+        Patterns {
+            // capitalized words on one line, "&" and "of" may join them ("Bank of America", "Johnson & Johnson").
+            // A period ends the run, except after a title
+            name_run: Regex::new(
+                r"(?:(?:Mr|Mrs|Ms|Dr|Prof)\.[ \t]+)?\p{Lu}[\p{L}'’-]*(?:[ \t]+(?:(?:&|of|and|de|van|von)[ \t]+)?\p{Lu}[\p{L}'’-]*)*",
+            )
+            .unwrap(),
+            iso_date: Regex::new(r"\b(\d{4})-(\d{2})-(\d{2})\b").unwrap(),
+            month_first_date: Regex::new(&format!(
+                r"\b{}[ \t]+(\d{{1,2}})(?:st|nd|rd|th)?,?[ \t]+(\d{{4}})\b",
+                month
+            ))
+            .unwrap(),
+            day_first_date: Regex::new(&format!(
+                r"\b(\d{{1,2}})(?:st|nd|rd|th)?[ \t]+(?:of[ \t]+)?{},?[ \t]+(\d{{4}})\b",
+                month
+            ))
+            .unwrap(),
+            word: Regex::new(r"\p{L}[\p{L}'’-]*\p{L}").unwrap(),
+        }
+    })
+}
+
+fn is_one_of(word: &str, list: &[&str]) -> bool {
+    let word = word.trim_end_matches('.').to_lowercase();
+    list.contains(&word.as_str())
+}
+
+fn month_number(name: &str) -> Option<u32> {
+    let name = name.trim_end_matches('.').to_lowercase();
+    MONTHS
+        .iter()
+        .position(|month| month.starts_with(&name) && name.len() >= 3)
+        .map(|index| index as u32 + 1)
+}
+
+fn format_date(year: &str, month: u32, day: &str) -> Option<String> {
+    let year: u32 = year.parse().ok()?;
+    let day: u32 = day.parse().ok()?;
+    ((1..=12).contains(&month) && (1..=31).contains(&day) && (1000..=2999).contains(&year))
+        .then(|| format!("{:04}-{:02}-{:02}", year, month, day))
+}
+
+/// Dates written as 2024-03-05, March 5, 2024 or 5 March 2024. Numeric forms like 03/05/2024 are left out,
+/// there is no telling the month from the day
+fn find_dates(text: &str) -> Vec<String> {
+    let patterns = patterns();
+    let mut dates = Vec::new();
+
+    for captures in patterns.iso_date.captures_iter(text) {
+        if let Ok(month) = captures[2].parse() {
+            dates.extend(format_date(&captures[1], month, &captures[3]));
+        }
+    }
+    for captures in patterns.month_first_date.captures_iter(text) {
+        if let Some(month) = month_number(&captures[1]) {
+            dates.extend(format_date(&captures[3], month, &captures[2]));
+        }
+    }
+    for captures in patterns.day_first_date.captures_iter(text) {
+        if let Some(month) = month_number(&captures[2]) {
+            dates.extend(format_date(&captures[3], month, &captures[1]));
+        }
+    }
+
+    dates
+}
+
+/// Words joining the capitalized words of a run, a run that isn't one name is split at them
+fn is_joining_word(word: &str) -> bool {
+    matches!(word, "&" | "of" | "and")
+}
+
+/// Name particles that stay lowercase in a person's name
+fn is_particle(word: &str) -> bool {
+    matches!(word, "de" | "van" | "von")
+}
+
+/// Sorts a run of capitalized words into a person or an organization, or nothing when it doesn't look like either
+fn classify_name(words: &[&str]) -> Option<(String, EntityKind)> {
+    let mut words = words.to_vec();
+
+    let titled = words.first().is_some_and(|w| is_one_of(w, PERSON_TITLES));
+    if titled {
+        words.remove(0);
+    }
+    // "The", "In", ... at the start of a sentence
+    while words.first().is_some_and(|w| is_one_of(w, NOT_NAMES)) {
+        words.remove(0);
+    }
+    while words
+        .last()
+        .is_some_and(|w| is_joining_word(w) || is_particle(w))
+    {
+        words.pop();
+    }
+    // "Apple and Google" is two names, "&" is how one name is written ("Johnson & Johnson")
+    if words.is_empty() || words.contains(&"and") {
+        return None;
+    }
+
+    let name = words
+        .iter()
+        .map(|w| w.trim_end_matches('.'))
+        .collect::<Vec<_>>()
+        .join(" ");
+    let is_organization = words.len() >= 2
+        && (is_one_of(words[0], ORGANIZATION_WORDS)
+            || is_one_of(words[words.len() - 1], ORGANIZATION_WORDS));
+    if is_organization {
+        return Some((name, EntityKind::Organization));
+    }
+
+    // John Smith, Mary Ann Lee, Ludwig van Beethoven: two or three plain capitalized words, no acronyms or months
+    let name_words: Vec<&str> = words.iter().copied().filter(|w| !is_particle(w)).collect();
+    let looks_like_person = (2..=3).contains(&name_words.len())
+        && name_words.iter().all(|w| {
+            let w = w.trim_end_matches('.');
+            let mut chars = w.chars();
+            chars.next().is_some_and(char::is_uppercase)
+                && w.chars().count() >= 2
+                && chars.all(|c| c.is_lowercase() || c == '\'' || c == '’' || c == '-')
+                && month_number(w).is_none()
+                && !is_one_of(w, NOT_NAMES)
+        });
+    if looks_like_person || (titled && name_words.len() <= 3) {
+        return Some((name, EntityKind::Person));
+    }
+
+    None
+}
+
+/// Names in a run of capitalized words. "John Smith of Bank of America" isn't one name, so a run
+/// that isn't is split at its first joining word and both sides are tried again
+fn classify_run(words: &[&str]) -> Vec<(String, EntityKind)> {
+    if let Some(entity) = classify_name(words) {
+        return vec![entity];
+    }
+
+    match words.iter().position(|w| is_joining_word(w)) {
+        Some(index) => {
+            let mut entities = classify_run(&words[..index]);
+            entities.extend(classify_run(&words[index + 1..]));
+            entities
+        }
+        None => Vec::new(),
+    }
+}
+
+fn is_whole_line(text: &str, start: usize, end: usize) -> bool {
+    let before = text[..start].rsplit('\n').next().unwrap_or("");
+    let after = text[end..].split('\n').next().unwrap_or("");
+    before.trim().is_empty() && after.trim_end_matches(':').trim().is_empty()
+}
+
+/// The most frequent words that aren't stopwords, lowercased
+fn find_keywords(text: &str, names: &HashSet<String>) -> Vec<(String, usize)> {
+    let mut counts: HashMap<String, usize> = HashMap::new();
+    for word in patterns().word.find_iter(text) {
+        let word = word.as_str().to_lowercase();
+        if word.chars().count() < MIN_KEYWORD_LENGTH
+            || STOPWORDS.contains(&word.as_str())
+            || NOT_NAMES.contains(&word.as_str())
+            // words of the names found are already entities
+            || names.contains(&word)
+        {
+            continue;
+        }
+        *counts.entry(word).or_default() += 1;
+    }
+
+    let mut keywords: Vec<(String, usize)> = counts
+        .into_iter()
+        .filter(|(_, count)| *count >= MIN_KEYWORD_COUNT)
+        .collect();
+    keywords.sort_by(|a, b| b.1.cmp(&a.1).then_with(|| a.0.cmp(&b.0)));
+    keywords.truncate(MAX_KEYWORDS_PER_FILE);
+    keywords
+}
+
+/// Finds the people, organizations and dates a text mentions and its top keywords
+pub fn extract_entities(text: &str) -> Vec<Entity> {
+    let mut counts: HashMap<(String, EntityKind), usize> = HashMap::new();
+
+    for date in find_dates(text) {
+        *counts.entry((date, EntityKind::Date)).or_default() += 1;
+    }
+    for run in patterns().name_run.find_iter(text) {
+        let words: Vec<&str> = run.as_str().split_whitespace().collect();
+        // a line of capitalized words is usually a title case heading, not someone's name
+        let heading = is_whole_line(text, run.start(), run.end());
+
+        for (name, kind) in classify_run(&words) {
+            if kind == EntityKind::Person && heading {
+                continue;
+            }
+            *counts.entry((name, kind)).or_default() += 1;
+        }
+    }
+
+    let mut entities: Vec<Entity> = counts
+        .into_iter()
+        .map(|((name, kind), count)| Entity { name, kind, count })
+        .collect();
+    entities.sort_by(|a, b| b.count.cmp(&a.count).then_with(|| a.name.cmp(&b.name)));
+    entities.truncate(MAX_ENTITIES_PER_FILE);
+
+    let name_words: HashSet<String> = entities
+        .iter()
+        .filter(|e| e.kind != EntityKind::Date)
+        .flat_map(|e| e.name.split_whitespace().map(str::to_lowercase))
+        .collect();
+    entities.extend(
+        find_keywords(text, &name_words)
+            .into_iter()
+            .map(|(name, count)| Entity {
+                name,
+                kind: EntityKind::Keyword,
+                count,
+            }),
+    );
+
+    entities
+}
+
+/// Replaces the entities stored for a file with the ones found in its text
+pub async fn index_file_entities(db_path: PathBuf, file_id: i64, text: String) -> Result<usize> {
+    task::spawn_blocking(move || {
+        let entities = extract_entities(&text);
+
+        let mut conn = Connection::open(db_path)?;
+        let tx = conn.transaction()?;
+
+        tx.execute("DELETE FROM entities WHERE file_id = ?1", [file_id])?;
+        {
+            let mut stmt = tx.prepare(
+                "INSERT INTO entities (file_id, name, kind, count) VALUES (?1, ?2, ?3, ?4)",
+            )?;
+            for entity in &entities {
+                stmt.execute(params![
+                    file_id,
+                    entity.name,
+                    entity.kind.as_str(),
+                    entity.count as i64
+                ])?;
+            }
+        }
+
+        tx.commit()?;
+        Ok(entities.len())
+    })
+    .await
+    .map_err(|e| EntitiesError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+/// Ids of the files that mention an entity, the name is matched case insensitively
+pub fn file_ids_mentioning(conn: &Connection, name: &str) -> rusqlite::Result<HashSet<i64>> {
+    let mut stmt =
+        conn.prepare("SELECT DISTINCT file_id FROM entities WHERE name = ?1 COLLATE NOCASE")?;
+    let ids = stmt
+        .query_map([name.trim()], |row| row.get(0))?
+        .collect::<rusqlite::Result<HashSet<i64>>>()?;
+    Ok(ids)
+}
+
+fn find_entities(
+    conn: &Connection,
+    kind: Option<&str>,
+    query: Option<&str>,
+    limit: usize,
+) -> Result<Vec<EntityFacet>> {
+    // LIKE is case insensitive for ASCII, the wildcards in the query are escaped
+    let pattern = query.map(|query| {
+        format!(
+            "%{}%",
+            query
+                .replace('\\', r"\\")
+                .replace('%', r"\%")
+                .replace('_', r"\_")
+        )
+    });
+
+    let mut stmt = conn.prepare(
+        r#"
+        SELECT name, kind, COUNT(DISTINCT file_id) AS file_count
+        FROM entities
+        WHERE (?1 IS NULL OR kind = ?1) AND (?2 IS NULL OR name LIKE ?2 ESCAPE '\')
+        GROUP BY name COLLATE NOCASE, kind
+        ORDER BY file_count DESC, SUM(count) DESC, name
+        LIMIT ?3
+        "#,
+    )?;
+    let rows = stmt.query_map(params![kind, pattern, limit as i64], |row| {
+        Ok(EntityFacet {
+            name: row.get(0)?,
+            kind: row.get(1)?,
+            file_count: row.get(2)?,
+        })
+    })?;
+
+    let facets = rows.collect::<rusqlite::Result<Vec<_>>>()?;
+    Ok(facets)
+}
+
+fn find_entity_files(
+    conn: &Connection,
+    name: &str,
+    kind: Option<&str>,
+    limit: usize,
+) -> Result<Vec<EntityFile>> {
+    let mut stmt = conn.prepare(
+        r#"
+        SELECT f.id, f.name, f.path, SUM(e.count) AS mentions
+        FROM entities e
+        JOIN files f ON f.id = e.file_id
+        WHERE e.name = ?1 COLLATE NOCASE AND (?2 IS NULL OR e.kind = ?2)
+        GROUP BY f.id
+        ORDER BY mentions DESC, f.path
+        LIMIT ?3
+        "#,
+    )?;
+    let rows = stmt.query_map(params![name.trim(), kind, limit as i64], |row| {
+        Ok(EntityFile {
+            file_id: row.get(0)?,
+            name: row.get(1)?,
+            path: row.get(2)?,
+            mentions: row.get(3)?,
+        })
+    })?;
+
+    let files = rows.collect::<rusqlite::Result<Vec<_>>>()?;
+    Ok(files)
+}
+
+/// Lists the entities of the index by how many files mention them, optionally of one kind or containing `query`
+#[tauri::command]
+pub async fn list_entities(
+    kind: Option<EntityKind>,
+    query: Option<String>,
+    limit: Option<usize>,
+    state: State<'_, FileProcessorState>,
+) -> std::result::Result<Vec<EntityFacet>, String> {
+    let processor = get_processor(&state)?;
+    let query = query
+        .map(|q| q.trim().to_string())
+        .filter(|q| !q.is_empty());
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        find_entities(
+            &conn,
+            kind.as_ref().map(EntityKind::as_str),
+            query.as_deref(),
+            limit.unwrap_or(DEFAULT_LIST_LIMIT),
+        )
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to list entities: {}", e))
+}
+
+/// Files mentioning an entity, the ones mentioning it most first
+#[tauri::command]
+pub async fn get_entity_files(
+    name: String,
+    kind: Option<EntityKind>,
+    limit: Option<usize>,
+    state: State<'_, FileProcessorState>,
+) -> std::result::Result<Vec<EntityFile>, String> {
+    let processor = get_processor(&state)?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        find_entity_files(
+            &conn,
+            &name,
+            kind.as_ref().map(EntityKind::as_str),
+            limit.unwrap_or(DEFAULT_LIST_LIMIT),
+        )
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to get entity files: {}", e))
+}
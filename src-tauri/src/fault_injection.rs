@@ -0,0 +1,186 @@
+/*
+This file contains the fault injection mode used for integration testing. Starting the app with the hidden `--fault-inject <seed>[:<failure rate>]` option makes extraction,
+embedding and database writes randomly slow down or fail, so apps built on top of kita can test how their UI deals with partial failures and retries.
+Whether a call is delayed or fails is derived from the seed, the fault point and the file, so a file gets the same faults with the same seed
+no matter in which order the files are processed or how many run at once
+*/
+
+use rand::rngs::StdRng;
+use rand::{Rng, SeedableRng};
+use std::path::Path;
+use std::sync::OnceLock;
+use std::time::Duration;
+use thiserror::Error;
+
+const FLAG: &str = "--fault-inject";
+/// Share of calls that fail when the option doesn't give a rate
+const DEFAULT_FAILURE_RATE: f64 = 0.1;
+/// Share of calls that are delayed, on top of the failures
+const DELAY_RATE: f64 = 0.2;
+const MAX_DELAY_MS: u64 = 3_000;
+
+static INJECTOR: OnceLock<FaultInjector> = OnceLock::new();
+
+/// Places in the pipeline where faults are injected
+#[derive(Debug, Clone, Copy)]
+pub enum FaultPoint {
+    Extract,
+    Embed,
+    DbWrite,
+}
+
+impl FaultPoint {
+    fn id(&self) -> u64 {
+        match self {
+            Self::Extract => 0,
+            Self::Embed => 1,
+            Self::DbWrite => 2,
+        }
+    }
+
+    fn as_str(&self) -> &'static str {
+        match self {
+            Self::Extract => "extraction",
+            Self::Embed => "embedding",
+            Self::DbWrite => "database write",
+        }
+    }
+}
+
+#[derive(Error, Debug)]
+#[error("Injected fault in {0} (--fault-inject)")]
+pub struct InjectedFault(&'static str);
+
+/// What happens to one call at a fault point
+enum Fault {
+    None,
+    Delay(Duration),
+    Fail,
+}
+
+struct FaultInjector {
+    seed: u64,
+    failure_rate: f64,
+}
+
+impl FaultInjector {
+    fn new(seed: u64, failure_rate: f64) -> Self {
+        Self { seed, failure_rate }
+    }
+
+    fn draw(&self, point: FaultPoint, path: &Path) -> Fault {
+        let mut rng = StdRng::seed_from_u64(fault_seed(self.seed, point, path));
+
+        let roll: f64 = rng.gen();
+        if roll < self.failure_rate {
+            Fault::Fail
+        } else if roll < self.failure_rate + DELAY_RATE {
+            Fault::Delay(Duration::from_millis(rng.gen_range(1..=MAX_DELAY_MS)))
+        } else {
+            Fault::None
+        }
+    }
+}
+
+/// FNV-1a over the seed, the fault point and the path. Unlike the std hasher it is the same in every build
+fn fault_seed(seed: u64, point: FaultPoint, path: &Path) -> u64 {
+    const OFFSET: u64 = 0xcbf2_9ce4_8422_2325;
+    const PRIME: u64 = 0x0000_0100_0000_01b3;
+
+    let path = path.to_string_lossy();
+    let bytes = seed
+        .to_le_bytes()
+        .into_iter()
+        .chain(point.id().to_le_bytes())
+        .chain(path.bytes());
+
+    bytes.fold(OFFSET, |hash, byte| {
+        (hash ^ byte as u64).wrapping_mul(PRIME)
+    })
+}
+
+/// Removes the fault injection option from the command line and turns injection on if it was there
+pub fn take_fault_inject_arg(args: &[String]) -> Result<Vec<String>, String> {
+    let mut rest = Vec::with_capacity(args.len());
+    let mut value: Option<String> = None;
+
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        if arg == FLAG {
+            value = Some(
+                args.next()
+                    .cloned()
+                    .ok_or_else(|| format!("{} needs a seed, e.g. {} 42", FLAG, FLAG))?,
+            );
+        } else if let Some(inline) = arg.strip_prefix(&format!("{}=", FLAG)) {
+            value = Some(inline.to_string());
+        } else {
+            rest.push(arg.clone());
+        }
+    }
+
+    if let Some(value) = value {
+        let (seed, failure_rate) = parse_fault_inject(&value)?;
+        println!(
+            "Fault injection enabled (seed {}, failure rate {})",
+            seed, failure_rate
+        );
+        let _ = INJECTOR.set(FaultInjector::new(seed, failure_rate));
+    }
+
+    Ok(rest)
+}
+
+/// Parses `<seed>` or `<seed>:<failure rate>`
+fn parse_fault_inject(value: &str) -> Result<(u64, f64), String> {
+    let (seed, rate) = match value.split_once(':') {
+        Some((seed, rate)) => (seed, Some(rate)),
+        None => (value, None),
+    };
+
+    let seed = seed
+        .parse::<u64>()
+        .map_err(|_| format!("Invalid fault injection seed: {}", seed))?;
+    let failure_rate = match rate {
+        Some(rate) => rate
+            .parse::<f64>()
+            .ok()
+            .filter(|rate| (0.0..=1.0).contains(rate))
+            .ok_or_else(|| format!("Invalid fault injection rate (0 to 1): {}", rate))?,
+        None => DEFAULT_FAILURE_RATE,
+    };
+
+    Ok((seed, failure_rate))
+}
+
+/// Delays or fails the call for the file when fault injection is on, does nothing otherwise
+pub async fn inject(point: FaultPoint, path: &Path) -> Result<(), InjectedFault> {
+    let Some(injector) = INJECTOR.get() else {
+        return Ok(());
+    };
+
+    match injector.draw(point, path) {
+        Fault::None => Ok(()),
+        Fault::Delay(delay) => {
+            tokio::time::sleep(delay).await;
+            Ok(())
+        }
+        Fault::Fail => Err(InjectedFault(point.as_str())),
+    }
+}
+
+/// Same as `inject`, for code that already runs on a blocking thread
+pub fn inject_blocking(point: FaultPoint, path: &Path) -> Result<(), InjectedFault> {
+    let Some(injector) = INJECTOR.get() else {
+        return Ok(());
+    };
+
+    match injector.draw(point, path) {
+        Fault::None => Ok(()),
+        Fault::Delay(delay) => {
+            std::thread::sleep(delay);
+            Ok(())
+        }
+        Fault::Fail => Err(InjectedFault(point.as_str())),
+    }
+}
@@ -0,0 +1,107 @@
+/*
+This file contains the relevance feedback API: thumbs up/down and click-throughs per (query, result) are stored and turned into ranking boosts (the feedback stage in ranking.rs), so the search results adapt to each user's corpus over time
+*/
+
+use rusqlite::{params, Connection};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use tauri::State;
+use tokio::task;
+
+use crate::file_processor::{get_processor, FileProcessorState};
+
+/// Feedback given for the same query counts fully, feedback from other queries acts as a weaker prior for the file
+const OTHER_QUERY_WEIGHT: f32 = 0.25;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum FeedbackSignal {
+    Up,
+    Down,
+    Click,
+}
+
+impl FeedbackSignal {
+    fn as_str(&self) -> &'static str {
+        match self {
+            Self::Up => "up",
+            Self::Down => "down",
+            Self::Click => "click",
+        }
+    }
+}
+
+/// normalizes queries so "Tax Return " and "tax return" share feedback
+fn normalize_query(query: &str) -> String {
+    query
+        .split_whitespace()
+        .collect::<Vec<_>>()
+        .join(" ")
+        .to_lowercase()
+}
+
+fn save_feedback(
+    conn: &Connection,
+    query: &str,
+    file_id: i64,
+    signal: FeedbackSignal,
+) -> rusqlite::Result<()> {
+    conn.execute(
+        "INSERT INTO search_feedback (query, file_id, signal) VALUES (?1, ?2, ?3)",
+        params![normalize_query(query), file_id, signal.as_str()],
+    )?;
+
+    Ok(())
+}
+
+/// Computes a boost in [-1, 1] for each of the given files from the stored feedback.
+/// Files without feedback are left out of the map
+pub fn get_feedback_boosts(
+    conn: &Connection,
+    query: &str,
+    file_ids: &[i64],
+) -> rusqlite::Result<HashMap<i64, f32>> {
+    let query = normalize_query(query);
+    let mut stmt = conn.prepare(
+        r#"
+        SELECT
+          SUM(CASE WHEN query = ?2 THEN 1.0 ELSE ?3 END *
+              CASE signal WHEN 'up' THEN 1.0 WHEN 'click' THEN 0.5 WHEN 'down' THEN -1.0 ELSE 0 END)
+        FROM search_feedback
+        WHERE file_id = ?1
+        "#,
+    )?;
+
+    let mut boosts = HashMap::new();
+    for file_id in file_ids {
+        let score: Option<f64> = stmt
+            .query_row(params![file_id, query, OTHER_QUERY_WEIGHT], |row| {
+                row.get(0)
+            })?;
+
+        if let Some(score) = score {
+            // squash so a file with lots of clicks can't dominate everything
+            boosts.insert(*file_id, (score as f32).tanh());
+        }
+    }
+
+    Ok(boosts)
+}
+
+#[tauri::command]
+pub async fn record_feedback(
+    query: String,
+    file_id: i64,
+    signal: FeedbackSignal,
+    state: State<'_, FileProcessorState>,
+) -> Result<(), String> {
+    let processor = get_processor(&state)?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        save_feedback(&conn, &query, file_id, signal)
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to record feedback: {}", e))
+}
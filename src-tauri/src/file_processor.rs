@@ -1,24 +1,46 @@
 use crate::AppResult;
 use arrow_array::{Array, RecordBatch};
-use rusqlite::{params, Connection, Rows};
+use rayon::prelude::*;
+use rusqlite::{params, Connection, OptionalExtension, Rows};
 use serde::{Deserialize, Serialize};
 use std::collections::{HashMap, HashSet};
 use std::io::{Error, ErrorKind};
 use std::path::{Path, PathBuf};
 use std::process::Command;
-use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::atomic::{AtomicU64, AtomicUsize, Ordering};
 use std::sync::{Arc, Mutex};
+use std::time::{Instant, SystemTime, UNIX_EPOCH};
 use tauri::{AppHandle, Emitter, Manager, State};
-use tokio::sync::mpsc::UnboundedSender;
+use tokio::sync::mpsc::{self, UnboundedSender};
 use tokio::sync::Semaphore;
 use tokio::task;
 use tracing::error;
 use walkdir::WalkDir;
 
-use crate::chunker::{ChunkerConfig, ChunkerOrchestrator};
+use crate::chunker::code::is_code_extension;
+use crate::chunker::common::ChunkMetadata;
+use crate::chunker::txt::{is_plain_text_extension, looks_like_text};
+use crate::chunker::{util, Chunk, ChunkerConfig, ChunkerError, ChunkerOrchestrator};
 use crate::embedder::Embedder;
+use crate::encryption;
+use crate::entities;
+use crate::fault_injection::{self, FaultPoint};
+use crate::history;
+use crate::icons::{self, ResultIcon};
+use crate::index_profiles::IndexProfiles;
+use crate::index_runs;
+use crate::indexing_control::{CancelReason, IndexingControl, Lane, RunToken};
+use crate::opens;
+use crate::platform::{self, DocumentAttributes};
+use crate::ranking::{rank_files, rank_semantic_files, RankingExplanation};
+use crate::redaction::{self, SensitivePolicy};
+use crate::retention::{unix_now, RetentionPolicy};
+use crate::settings::{AppSettings, SettingsManagerState};
+use crate::summarizer;
+use crate::symbols;
+use crate::thumbnails;
 use crate::tokenizer::{build_doc_text, build_trigrams};
-use crate::utils::get_category_from_extension;
+use crate::utils::{get_category_from_extension, hash_file};
 use crate::vectordb_manager::VectorDbManager;
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -48,6 +70,47 @@ pub struct FileMetadata {
     pub size: i64,
     pub updated_at: Option<String>,
     pub created_at: Option<String>,
+
+    /// Modification time on disk (unix seconds), only known for files that were just walked
+    #[serde(skip)]
+    pub modified_at: Option<i64>,
+
+    /// Where the path points to if it is a symbolic link
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub link_target: Option<String>,
+
+    /// Title, authors and tags from the OS metadata index, if it has any
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub attributes: Option<DocumentAttributes>,
+
+    /// What the document is about, when summaries are on and it has been summarized
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub summary: Option<String>,
+
+    /// How the ranking stages scored the result, only with explain=true
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ranking: Option<RankingExplanation>,
+
+    /// Icons to render the result with, only with include_icons=true
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub icon: Option<ResultIcon>,
+}
+
+/// Narrows search results down by document attributes, all given fields have to match
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct AttributeFilters {
+    /// Substring of one of the authors
+    pub author: Option<String>,
+    /// Substring of the title
+    pub title: Option<String>,
+    /// Exact tag name
+    pub tag: Option<String>,
+}
+
+impl AttributeFilters {
+    fn is_empty(&self) -> bool {
+        self.author.is_none() && self.title.is_none() && self.tag.is_none()
+    }
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -75,12 +138,138 @@ pub struct SemanticMetadata {
     pub extension: String,
     pub distance: f32,
     pub content: Option<String>,
+    /// Page of the best matching chunk, so results can link to "report.pdf page 14"
+    pub page_number: Option<u32>,
+    pub summary: Option<String>,
+    /// How the ranking stages scored the result, only with explain=true
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ranking: Option<RankingExplanation>,
+    /// Icons to render the result with, only with include_icons=true
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub icon: Option<ResultIcon>,
 }
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct ProcessingStatus {
     pub total: usize,
     pub processed: usize,
     pub percentage: usize,
+    /// The same counts for each requested root, in the order they were requested
+    pub roots: Vec<RootProgress>,
+}
+
+/// What a run of `process_paths` did
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ProcessResult {
+    /// No errors and not cancelled
+    pub success: bool,
+    /// Files found under the requested paths
+    pub total_discovered: usize,
+    pub total_directories: usize,
+    /// Files stored with their content embedded
+    pub indexed: usize,
+    /// Files stored by name only: empty, or their content skipped for sensitive content
+    pub skipped: usize,
+    /// Files with at least one error
+    pub failed: usize,
+    /// Files a rescan found unchanged in the index and didn't process again
+    pub cache_hits: usize,
+    /// Size on disk of the files that went through the pipeline
+    pub bytes_processed: u64,
+    pub duration_ms: u64,
+    pub cancelled: Option<CancelReason>,
+    pub errors: Vec<ProcessError>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ProcessError {
+    pub path: String,
+    pub class: ErrorClass,
+    pub error: String,
+}
+
+/// The pipeline stage a file failed in
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ErrorClass {
+    /// Reading the file or splitting it into chunks
+    Extract,
+    /// Computing the embeddings
+    Embed,
+    /// Saving the file to the db or the embeddings to the vectordb
+    Store,
+}
+
+impl ProcessError {
+    fn new(path: String, class: ErrorClass, error: String) -> Self {
+        Self { path, class, error }
+    }
+}
+
+/// Counted by the store workers next to the processed files
+#[derive(Default)]
+struct StoreStats {
+    /// Files stored by name only
+    without_content: AtomicUsize,
+    /// Files that left the pipeline, stored or not
+    done: AtomicUsize,
+    bytes_processed: AtomicU64,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RootProgress {
+    pub root: String,
+    pub total: usize,
+    pub processed: usize,
+}
+
+/// Counts the processed files of each requested root. A file under nested roots counts towards the innermost one
+struct RootCounters {
+    roots: Vec<(String, usize, AtomicUsize)>,
+}
+
+impl RootCounters {
+    fn new(paths: &[String], files: &[FileMetadata]) -> Self {
+        let mut counters = Self {
+            roots: paths
+                .iter()
+                .map(|root| (root.clone(), 0, AtomicUsize::new(0)))
+                .collect(),
+        };
+        for file in files {
+            if let Some(i) = counters.root_of(&file.base.path) {
+                counters.roots[i].1 += 1;
+            }
+        }
+        counters
+    }
+
+    fn root_of(&self, path: &str) -> Option<usize> {
+        let path = Path::new(path);
+        self.roots
+            .iter()
+            .enumerate()
+            .filter(|(_, (root, _, _))| path.starts_with(root))
+            .max_by_key(|(_, (root, _, _))| Path::new(root).components().count())
+            .map(|(i, _)| i)
+    }
+
+    fn file_done(&self, path: &str) {
+        if let Some(i) = self.root_of(path) {
+            self.roots[i].2.fetch_add(1, Ordering::SeqCst);
+        }
+    }
+
+    fn progress(&self) -> Vec<RootProgress> {
+        self.roots
+            .iter()
+            .map(|(root, total, processed)| RootProgress {
+                root: root.clone(),
+                total: *total,
+                processed: processed.load(Ordering::SeqCst),
+            })
+            .collect()
+    }
 }
 
 #[derive(thiserror::Error, Debug)]
@@ -95,31 +284,229 @@ pub enum FileProcessorError {
     Other(String),
 }
 
+/// Worker counts for each stage of the indexing pipeline and the capacity of the bounded queues between them.
+/// Embedding is usually the bottleneck, so it can be scaled independently of the heavy extraction workers
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct PipelineConfig {
+    pub walk_workers: usize,
+    pub extract_workers: usize,
+    pub embed_workers: usize,
+    pub store_workers: usize,
+    pub queue_capacity: usize,
+    pub priority: IndexPriority,
+}
+
+impl PipelineConfig {
+    /// Uses the per stage values from the settings, falling back to the general index concurrency
+    pub fn from_settings(settings: &AppSettings, default_concurrency: usize) -> Self {
+        let concurrency = settings
+            .index_concurrency
+            .unwrap_or(default_concurrency)
+            .max(1);
+
+        Self {
+            walk_workers: settings.index_walk_workers.unwrap_or(concurrency).max(1),
+            extract_workers: settings.index_extract_workers.unwrap_or(concurrency).max(1),
+            embed_workers: settings.index_embed_workers.unwrap_or(concurrency).max(1),
+            store_workers: settings.index_store_workers.unwrap_or(concurrency).max(1),
+            queue_capacity: settings
+                .index_queue_capacity
+                .unwrap_or(concurrency * 4)
+                .max(1),
+            priority: settings
+                .index_priority
+                .as_deref()
+                .map(IndexPriority::from_setting)
+                .unwrap_or_default(),
+        }
+    }
+}
+
+impl Default for PipelineConfig {
+    fn default() -> Self {
+        Self::from_settings(&AppSettings::default(), 4)
+    }
+}
+
+/// Order in which the collected files are fed into the pipeline, so the files a user most likely
+/// cares about become searchable first while the long tail is indexed afterwards
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum IndexPriority {
+    /// Recently modified files first, smallest first within the same age bucket
+    #[default]
+    RecentSmall,
+    /// Newest modification time first
+    Recent,
+    /// Smallest files first
+    Small,
+    /// The order the files were walked in
+    WalkOrder,
+}
+
+impl IndexPriority {
+    pub fn from_setting(value: &str) -> Self {
+        match value {
+            "recent" => Self::Recent,
+            "small" => Self::Small,
+            "walk_order" | "none" => Self::WalkOrder,
+            _ => Self::RecentSmall,
+        }
+    }
+
+    /// Sorts the files in place, highest priority first
+    pub fn sort(&self, files: &mut [FileMetadata]) {
+        match self {
+            Self::RecentSmall => {
+                let now = SystemTime::now()
+                    .duration_since(UNIX_EPOCH)
+                    .map(|d| d.as_secs() as i64)
+                    .unwrap_or_default();
+                files.sort_by_key(|f| (age_bucket(now, f.modified_at), f.size));
+            }
+            Self::Recent => files.sort_by_key(|f| std::cmp::Reverse(f.modified_at.unwrap_or(0))),
+            Self::Small => files.sort_by_key(|f| f.size),
+            Self::WalkOrder => {}
+        }
+    }
+}
+
+/// Buckets a modification time into today, this week, this month and older
+fn age_bucket(now: i64, modified_at: Option<i64>) -> u8 {
+    const DAY: i64 = 24 * 60 * 60;
+
+    match modified_at.map(|m| now - m) {
+        Some(age) if age <= DAY => 0,
+        Some(age) if age <= 7 * DAY => 1,
+        Some(age) if age <= 30 * DAY => 2,
+        _ => 3,
+    }
+}
+
+/// What the extract and embed stages made of a file
+enum Content<T> {
+    Indexed(T),
+    /// Only the metadata gets stored
+    MetadataOnly,
+    /// A stage failed and reported it, whatever is indexed for the file is left alone
+    Failed,
+}
+
+/// A file on its way through the pipeline
+type ExtractedFile = (FileMetadata, Content<Vec<Chunk>>);
+type EmbeddedFile = (FileMetadata, Content<Vec<(Chunk, Vec<f32>)>>);
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct CategoryEstimate {
+    pub files: usize,
+    pub bytes: u64,
+}
+
+/// Result of a dry run: what would be indexed and roughly how long it would take
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct IndexEstimate {
+    pub total_files: usize,
+    pub total_directories: usize,
+    pub total_bytes: u64,
+    pub categories: HashMap<String, CategoryEstimate>,
+    pub estimated_chunks: usize,
+    pub estimated_embedding_calls: usize,
+    pub estimated_seconds: f64,
+}
+
+/// What to do with symbolic links found while walking a tree
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum LinkPolicy {
+    /// Ignore links, like walkdir does by default
+    #[default]
+    Skip,
+    /// Follow links into files and directories, each target is only indexed once
+    Follow,
+    /// Index links to files under the link path and record their target, without descending into linked directories
+    Record,
+}
+
+impl LinkPolicy {
+    pub fn from_setting(value: &str) -> Self {
+        match value {
+            "follow" => Self::Follow,
+            "record" => Self::Record,
+            _ => Self::Skip,
+        }
+    }
+}
+
+/// Runs clone the processor when they start, so a reload of the settings only applies to the runs started after it
 #[derive(Clone)]
 pub struct FileProcessor {
     pub db_path: PathBuf,
-    pub concurrency_limit: usize,
+    /// The worker count the settings fall back to, kept for reloads
+    pub default_concurrency: usize,
+    pub pipeline: PipelineConfig,
+    pub link_policy: LinkPolicy,
+    pub retention: RetentionPolicy,
+    pub profiles: IndexProfiles,
+    pub sensitive_policy: SensitivePolicy,
+    pub index_images: bool,
 }
 
 impl FileProcessor {
+    pub fn from_settings(
+        db_path: PathBuf,
+        default_concurrency: usize,
+        settings: &AppSettings,
+    ) -> Self {
+        Self {
+            db_path,
+            default_concurrency,
+            pipeline: PipelineConfig::from_settings(settings, default_concurrency),
+            link_policy: settings
+                .index_link_policy
+                .as_deref()
+                .map(LinkPolicy::from_setting)
+                .unwrap_or_default(),
+            retention: RetentionPolicy::from_settings(settings),
+            profiles: IndexProfiles::from_settings(settings),
+            sensitive_policy: settings
+                .sensitive_content_policy
+                .as_deref()
+                .map(SensitivePolicy::from_setting)
+                .unwrap_or_default(),
+            index_images: settings.index_images.unwrap_or(true),
+        }
+    }
+
     /// Main async method to process all the given paths:
-    /// 1) collect files
-    /// 2) spawn tasks with concurrency limit
-    /// 3) process files by storing them, creating chunks, embeddings and storing in vectordb
-    /// 4) track progress and emit Tauri events
-    /// If successful then this function doesn't return anything
-    /// If error, then it returns the number of errors, the file path that caused it and the error
+    /// 1) collect files, walking the roots in parallel
+    /// 2) extract chunks from the files
+    /// 3) embed the chunks
+    /// 4) store the files in the db and the embeddings in the vectordb
+    /// Stages 2-4 run concurrently with their own worker counts and are connected by bounded queues
+    /// 5) track progress and emit Tauri events
+    /// Runs in the fresh lane make the workers of background runs wait until they are done
+    /// Errors of single files don't fail the run, they are listed in the result with the stage they failed in
     pub async fn process_paths(
         &self,
         paths: Vec<String>,
         on_progress: impl Fn(ProcessingStatus) + Send + Sync + Clone + 'static,
         app_handle: AppHandle,
-    ) -> Result<serde_json::Value, FileProcessorError> {
+        lane: Lane,
+    ) -> Result<ProcessResult, FileProcessorError> {
         println!("Processing paths: {:?}", paths);
+        let started = Instant::now();
+
+        let control: Arc<IndexingControl> =
+            Arc::clone(app_handle.state::<Arc<IndexingControl>>().inner());
+        // lets the scheduler know not to start a scan while this one runs, and has background workers wait for a fresh one
+        let active_run = control.begin_run(lane);
 
         // Get all file paths and directories that need to be processed
-        let (files, unique_directories) = self.collect_all_files(&paths).await?;
+        let (mut files, unique_directories) = self.collect_all_files(&paths).await?;
         let total_files: usize = files.len();
+
+        // the feeder hands files to the pipeline in this order
+        self.pipeline.priority.sort(&mut files);
         let total_directories: usize = unique_directories.len();
 
         println!(
@@ -129,11 +516,12 @@ impl FileProcessor {
 
         // Early return if no files
         if total_files == 0 {
-            return Ok(serde_json::json!({
-                "success": true,
-                "totalFiles": 0,
-                "errors": []
-            }));
+            return Ok(ProcessResult {
+                success: true,
+                total_directories,
+                duration_ms: started.elapsed().as_millis() as u64,
+                ..ProcessResult::default()
+            });
         }
 
         // First, save all directories to the database (as a batch for efficiency)
@@ -151,64 +539,167 @@ impl FileProcessor {
             }
         }
 
-        // Create new semaphore to handle concurrency limits
-        let sem = Arc::new(Semaphore::new(self.concurrency_limit));
         let num_processed_files = Arc::new(AtomicUsize::new(0));
+        let store_stats = Arc::new(StoreStats::default());
+        let root_counters = Arc::new(RootCounters::new(&paths, &files));
+
+        // scans are recorded so `kita status` can tell how the last one went, the run record is best effort
+        let run_id = if lane == Lane::Background {
+            match index_runs::start_run(self.db_path.clone(), paths.clone(), total_files).await {
+                Ok(id) => Some(id),
+                Err(e) => {
+                    eprintln!("Failed to record index run: {}", e);
+                    None
+                }
+            }
+        } else {
+            None
+        };
+        let run_progress = run_id.map(|id| {
+            let stats = store_stats.clone();
+            index_runs::track_progress(self.db_path.clone(), id, move || {
+                stats.done.load(Ordering::SeqCst)
+            })
+        });
 
         // Channel to collect errors
         let (err_tx, mut err_rx) = tokio::sync::mpsc::unbounded_channel();
-        let mut task_handles = Vec::with_capacity(total_files);
 
-        // Now process files with concurrency
-        for file in &files {
-            // Semaphore is shared but each task needs its own reference for concurrency limit
-            let permit = sem.clone();
-            // Each task needs a reference to the current process files so it can update it
-            let pc = num_processed_files.clone();
-            // Task needs its own channel sender for errors
-            let err_sender: UnboundedSender<(String, String)> = err_tx.clone();
-            // Each task needs a reference to the processor object to call process function
-            let this = self.clone();
-            // Each task needs its own reference to the progress function to update it
-            let progress_fn = on_progress.clone();
-
-            let task_handle: task::JoinHandle<()> = create_path_embedding(
-                this.db_path,
-                file,
-                permit,
-                err_sender,
+        // Bounded queues between the stages so a fast stage can't run away from a slow one
+        let capacity = self.pipeline.queue_capacity;
+        let (file_tx, file_rx) = mpsc::channel::<FileMetadata>(capacity);
+        let (extracted_tx, extracted_rx) = mpsc::channel::<ExtractedFile>(capacity);
+        let (embedded_tx, embedded_rx) = mpsc::channel::<EmbeddedFile>(capacity);
+
+        let orchestrator = Arc::new(ChunkerOrchestrator::new(default_chunker_config()));
+        let embedder: Arc<Embedder> = Arc::clone(app_handle.state::<Arc<Embedder>>().inner());
+
+        let mut task_handles: Vec<task::JoinHandle<()>> = Vec::new();
+
+        // Feed the files into the first queue, until the run is cancelled. The OS attributes are
+        // read here a batch at a time, one call per batch is a lot cheaper than one per file
+        let feeder_run = active_run.token();
+        let feeder_profiles = self.profiles.clone();
+        task_handles.push(tokio::spawn(async move {
+            let mut files = files.into_iter().peekable();
+            while files.peek().is_some() {
+                let mut batch: Vec<FileMetadata> =
+                    files.by_ref().take(ATTRIBUTE_BATCH_SIZE).collect();
+                read_attributes(&mut batch, &feeder_profiles).await;
+
+                for file in batch {
+                    if feeder_run.cancel_reason().is_some() || file_tx.send(file).await.is_err() {
+                        return;
+                    }
+                }
+            }
+        }));
+
+        let file_rx = Arc::new(tokio::sync::Mutex::new(file_rx));
+        for _ in 0..self.pipeline.extract_workers {
+            task_handles.push(spawn_extract_worker(
+                file_rx.clone(),
+                extracted_tx.clone(),
+                err_tx.clone(),
+                orchestrator.clone(),
+                self.profiles.clone(),
+                self.sensitive_policy,
+                self.db_path.clone(),
+                control.clone(),
+                active_run.token(),
+                lane,
+            ));
+        }
+        drop(extracted_tx);
+
+        let extracted_rx = Arc::new(tokio::sync::Mutex::new(extracted_rx));
+        for _ in 0..self.pipeline.embed_workers {
+            task_handles.push(spawn_embed_worker(
+                extracted_rx.clone(),
+                embedded_tx.clone(),
+                err_tx.clone(),
+                embedder.clone(),
+                control.clone(),
+                active_run.token(),
+                lane,
+            ));
+        }
+        drop(embedded_tx);
+
+        let embedded_rx = Arc::new(tokio::sync::Mutex::new(embedded_rx));
+        for _ in 0..self.pipeline.store_workers {
+            task_handles.push(spawn_store_worker(
+                embedded_rx.clone(),
+                err_tx.clone(),
+                self.db_path.clone(),
                 total_files,
-                pc,
-                progress_fn,
+                num_processed_files.clone(),
+                store_stats.clone(),
+                root_counters.clone(),
+                self.profiles.clone(),
+                on_progress.clone(),
                 app_handle.clone(),
-            );
-
-            task_handles.push(task_handle);
+            ));
         }
 
+        // Only the workers hold the receivers, so a queue closes once the workers reading it stopped
+        // and a cancelled run can't leave the stage before it blocked on a full queue
+        drop(file_rx);
+        drop(extracted_rx);
+        drop(embedded_rx);
+
         // Wait for all tasks and process results
         drop(err_tx);
         futures::future::join_all(task_handles).await;
 
         // Collect errors with file paths
-        let mut detailed_errors = Vec::new();
-        while let Ok((file_path, error_msg)) = err_rx.try_recv() {
-            detailed_errors.push(serde_json::json!({
-                "path": file_path,
-                "error": error_msg
-            }));
+        let mut errors: Vec<ProcessError> = Vec::new();
+        while let Ok(error) = err_rx.try_recv() {
+            errors.push(error);
         }
-
-        let success = detailed_errors.is_empty();
+        let failed = errors
+            .iter()
+            .map(|error| error.path.as_str())
+            .collect::<HashSet<_>>()
+            .len();
+
+        let cancelled = active_run.cancel_reason();
+        let success = errors.is_empty() && cancelled.is_none();
         let processed_count = num_processed_files.load(Ordering::SeqCst);
 
+        if let Some(reason) = cancelled {
+            println!(
+                "Indexing cancelled ({}) after {} of {} files",
+                reason.as_str(),
+                processed_count,
+                total_files
+            );
+        }
+        if let Some(progress) = run_progress {
+            progress.abort();
+        }
+        if let Some(id) = run_id {
+            if let Err(e) = index_runs::finish_run(
+                self.db_path.clone(),
+                id,
+                store_stats.done.load(Ordering::SeqCst),
+                processed_count,
+                failed,
+                cancelled,
+            )
+            .await
+            {
+                eprintln!("Failed to record index run: {}", e);
+            }
+        }
+
         // When process is complete, emit an event with the paths to watch
         if success {
             println!("successfully processed all files during index");
             // Convert the directory paths to strings for the event payload
             let dir_paths: Vec<String> = unique_directories
                 .iter()
-                .map(|path| path.to_string_lossy().to_string())
+                .map(|path| platform::normalize_path(path))
                 .collect();
 
             // Emit the indexing_complete event with directory paths
@@ -225,199 +716,855 @@ impl FileProcessor {
             println!("successfully emitted indexing_complete event");
         }
 
-        let result = serde_json::json!({
-            "success": success,
-            "totalFiles": total_files,
-            "processedFiles": processed_count,
-            "totalDirectories": total_directories,
-            "errors": detailed_errors
-        });
+        Ok(ProcessResult {
+            success,
+            total_discovered: total_files,
+            total_directories,
+            indexed: processed_count,
+            skipped: store_stats.without_content.load(Ordering::SeqCst),
+            failed,
+            cache_hits: 0,
+            bytes_processed: store_stats.bytes_processed.load(Ordering::SeqCst),
+            duration_ms: started.elapsed().as_millis() as u64,
+            cancelled,
+            errors,
+        })
+    }
+
+    /// Indexes documents whose text was already fetched, e.g. by a connector. Nothing is read from disk,
+    /// so the paths can use any scheme. Returns the paths of the documents that were stored, the others
+    /// failed or weren't reached before the run was cancelled and keep what was indexed for them
+    pub async fn index_documents(
+        &self,
+        documents: Vec<(FileMetadata, String)>,
+        app_handle: &AppHandle,
+    ) -> Result<Vec<String>, FileProcessorError> {
+        let control = app_handle.state::<Arc<IndexingControl>>().inner().clone();
+        let run = control.begin_run(Lane::Connector);
+        let token = run.token();
+        let embedder = app_handle.state::<Arc<Embedder>>().inner().clone();
+        let config = default_chunker_config();
+        let mut stored = Vec::new();
+
+        for (file, text) in documents {
+            control.wait_for_turn(Lane::Connector, Some(&token)).await;
+            if token.cancel_reason().is_some() {
+                break;
+            }
+
+            // remote roots can have a profile too, e.g. "remote://gdrive"
+            let profile = self.profiles.profile_for(Path::new(&file.base.path));
+            if !profile.embeds_content() {
+                save_file_to_db(
+                    app_handle,
+                    self.db_path.clone(),
+                    &file,
+                    profile.reads_file(),
+                )
+                .await?;
+                stored.push(file.base.path);
+                continue;
+            }
+
+            let mut text = util::normalize_text(&text);
+            if self.sensitive_policy != SensitivePolicy::Off {
+                let findings = redaction::scan(&text);
+                let skip = self.sensitive_policy == SensitivePolicy::Skip && !findings.is_empty();
+                if self.sensitive_policy == SensitivePolicy::Redact {
+                    text = redaction::redact(&text, &findings);
+                }
+                if let Err(e) = redaction::record_findings(
+                    self.db_path.clone(),
+                    file.base.path.clone(),
+                    self.sensitive_policy,
+                    redaction::count_by_kind(&findings),
+                )
+                .await
+                {
+                    eprintln!(
+                        "Failed to record sensitive findings for {}: {}",
+                        file.base.path, e
+                    );
+                }
+                // like in the pipeline, the file is still stored so it can be found by name
+                if skip {
+                    println!(
+                        "Skipping the content of {}: sensitive content found",
+                        file.base.path
+                    );
+                    save_file_to_db(app_handle, self.db_path.clone(), &file, true).await?;
+                    stored.push(file.base.path);
+                    continue;
+                }
+            }
+
+            let chunks: Vec<Chunk> =
+                util::chunk_text(&text, config.chunk_size, config.chunk_overlap)
+                    .into_iter()
+                    .enumerate()
+                    .map(|(chunk_index, content)| Chunk {
+                        content,
+                        metadata: ChunkMetadata {
+                            source_path: PathBuf::from(&file.base.path),
+                            chunk_index,
+                            total_chunks: None,
+                            page_number: None,
+                            section: None,
+                            mime_type: "text/plain".to_string(),
+                        },
+                    })
+                    .collect();
+
+            let embedded = match util::embed_chunks(chunks, embedder.clone()).await {
+                Ok(embedded) => embedded,
+                Err(ChunkerError::QuotaExceeded(e)) => {
+                    eprintln!("Stopping indexing at {}: {}", file.base.path, e);
+                    control.cancel_run(&token, CancelReason::Quota);
+                    break;
+                }
+                Err(e) => {
+                    eprintln!("Failed to embed {}: {}", file.base.path, e);
+                    continue;
+                }
+            };
+
+            let file_id = save_file_to_db(app_handle, self.db_path.clone(), &file, true).await?;
+            if let Ok(id) = file_id.parse::<i64>() {
+                summarizer::enqueue(app_handle, id, &[text.as_str()]);
+                if let Err(e) =
+                    entities::index_file_entities(self.db_path.clone(), id, text.clone()).await
+                {
+                    eprintln!("Failed to index entities for {}: {}", file.base.path, e);
+                }
+            }
+            if !embedded.is_empty() {
+                if let Err(e) =
+                    VectorDbManager::insert_embeddings(app_handle, &file_id, embedded).await
+                {
+                    eprintln!("Failed to insert embeddings for {}: {}", file.base.path, e);
+                    continue;
+                }
+            }
+            stored.push(file.base.path);
+        }
+
+        Ok(stored)
+    }
+
+    /// Incremental version of `process_paths`: only files that are new or changed since they were
+    /// indexed go through the pipeline
+    pub async fn rescan_paths(
+        &self,
+        paths: Vec<String>,
+        on_progress: impl Fn(ProcessingStatus) + Send + Sync + Clone + 'static,
+        app_handle: AppHandle,
+        lane: Lane,
+    ) -> Result<ProcessResult, FileProcessorError> {
+        let started = Instant::now();
+        let (files, _) = self.collect_all_files(&paths).await?;
+        let total_files = files.len();
 
+        let changed = filter_changed_files(self.db_path.clone(), files).await?;
+        let changed_paths: Vec<String> = changed.into_iter().map(|f| f.base.path).collect();
+
+        println!(
+            "Rescan found {} changed files out of {}",
+            changed_paths.len(),
+            total_files
+        );
+
+        let cache_hits = total_files - changed_paths.len();
+        let mut result = self
+            .reindex_paths(changed_paths, on_progress, app_handle, lane)
+            .await?;
+        result.total_discovered = total_files;
+        result.cache_hits = cache_hits;
+        result.duration_ms = started.elapsed().as_millis() as u64;
         Ok(result)
     }
 
-    /// Given a vector of paths, this walks the tree and collects all children paths and their parent directories
+    /// Indexes the given files again, whether they look changed or not. A file keeps its index entries
+    /// until the new version is stored, so a failed extract or embed leaves the old one searchable
+    pub async fn reindex_paths(
+        &self,
+        changed_paths: Vec<String>,
+        on_progress: impl Fn(ProcessingStatus) + Send + Sync + Clone + 'static,
+        app_handle: AppHandle,
+        lane: Lane,
+    ) -> Result<ProcessResult, FileProcessorError> {
+        if changed_paths.is_empty() {
+            return Ok(ProcessResult {
+                success: true,
+                ..ProcessResult::default()
+            });
+        }
+
+        // keep the previous version around before it gets replaced, history is best effort
+        if let Err(e) =
+            history::record_versions(&app_handle, self.db_path.clone(), &changed_paths).await
+        {
+            eprintln!("Failed to record file history: {}", e);
+        }
+
+        self.process_paths(changed_paths, on_progress, app_handle, lane)
+            .await
+    }
+
+    /// Walks the given paths with the same rules as `process_paths` and reports what would be indexed
+    /// without touching the db, the vectordb or the embedding service
+    pub async fn estimate_paths(
+        &self,
+        paths: Vec<String>,
+        app_handle: &AppHandle,
+    ) -> Result<IndexEstimate, FileProcessorError> {
+        let (files, unique_directories) = self.collect_all_files(&paths).await?;
+        let config = default_chunker_config();
+
+        let mut categories: HashMap<String, CategoryEstimate> = HashMap::new();
+        let mut total_bytes: u64 = 0;
+        let mut estimated_chunks: usize = 0;
+        let mut estimated_embedding_calls: usize = 0;
+
+        for file in &files {
+            let bytes = file.size.max(0) as u64;
+            let chunks = if self
+                .profiles
+                .profile_for(Path::new(&file.base.path))
+                .embeds_content()
+            {
+                estimate_chunk_count(file, &config)
+            } else {
+                0
+            };
+
+            let category = categories
+                .entry(get_category_from_extension(&file.extension))
+                .or_default();
+            category.files += 1;
+            category.bytes += bytes;
+
+            total_bytes += bytes;
+            estimated_chunks += chunks;
+            // the chunks of a file are embedded in one batch
+            if chunks > 0 {
+                estimated_embedding_calls += 1;
+            }
+        }
+
+        // use the measured latency of the embedding service if we have one, otherwise a rough figure for the local model
+        let stats = app_handle.state::<Arc<Embedder>>().stats();
+        let embedding_ms = if stats.requests > 0 {
+            estimated_embedding_calls as f64 * stats.average_latency_ms
+        } else {
+            estimated_chunks as f64 * LOCAL_EMBEDDING_MS_PER_CHUNK
+        };
+        let estimated_seconds = embedding_ms / self.pipeline.embed_workers as f64 / 1000.0;
+
+        Ok(IndexEstimate {
+            total_files: files.len(),
+            total_directories: unique_directories.len(),
+            total_bytes,
+            categories,
+            estimated_chunks,
+            estimated_embedding_calls,
+            estimated_seconds,
+        })
+    }
+
+    /// Given a vector of paths, this walks the trees (one root per walk worker) and collects all children paths and their parent directories
     async fn collect_all_files(
         &self,
         paths: &[String],
     ) -> Result<(Vec<FileMetadata>, HashSet<PathBuf>), FileProcessorError> {
-        let path_vec: Vec<String> = paths.to_vec();
-
-        task::spawn_blocking(move || {
-            let mut all_files: Vec<FileMetadata> = Vec::new();
-            let mut unique_directories: HashSet<PathBuf> = HashSet::new();
-
-            for path_str in path_vec {
-                let path: &Path = Path::new(&path_str);
-                if path.is_dir() {
-                    // Add the root directory itself
-                    unique_directories.insert(PathBuf::from(path));
-
-                    for entry in WalkDir::new(path) {
-                        let entry: walkdir::DirEntry = match entry {
-                            Ok(e) => e,
-                            Err(e) => {
-                                eprintln!("Error walking dir: {e}");
-                                continue;
-                            }
-                        };
+        let sem = Arc::new(Semaphore::new(self.pipeline.walk_workers));
+
+        let link_policy = self.link_policy;
+        let walk_handles = paths.iter().cloned().map(|path_str| {
+            let sem = sem.clone();
+            tokio::spawn(async move {
+                let _permit = sem
+                    .acquire_owned()
+                    .await
+                    .map_err(|e| FileProcessorError::Other(format!("semaphore error: {e}")))?;
+
+                task::spawn_blocking(move || collect_files_from_path(&path_str, link_policy))
+                    .await
+                    .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))
+            })
+        });
+
+        let mut all_files: Vec<FileMetadata> = Vec::new();
+        let mut unique_directories: HashSet<PathBuf> = HashSet::new();
+        let mut seen_paths: HashSet<String> = HashSet::new();
+        let now = unix_now();
+
+        for result in futures::future::join_all(walk_handles).await {
+            let (files, directories) = result
+                .map_err(|e| FileProcessorError::Other(format!("walk task error: {e}")))??;
+
+            // overlapping roots would otherwise index the same file twice,
+            // and files past their root's retention would only be pruned again
+            all_files.extend(files.into_iter().filter(|f| {
+                let path = Path::new(&f.base.path);
+                !self.retention.is_expired(path, f.modified_at, now)
+                    && !self.profiles.is_excluded(path, &f.extension)
+                    && (self.index_images || !thumbnails::is_image_extension(&f.extension))
+                    && seen_paths.insert(f.base.path.clone())
+            }));
+            unique_directories.extend(directories);
+        }
+
+        Ok((all_files, unique_directories))
+    }
+}
+
+/// Walks a single root path and collects its files and directories
+fn collect_files_from_path(
+    path_str: &str,
+    link_policy: LinkPolicy,
+) -> (Vec<FileMetadata>, HashSet<PathBuf>) {
+    let mut all_files: Vec<FileMetadata> = Vec::new();
+    let mut unique_directories: HashSet<PathBuf> = HashSet::new();
+    let mut links = LinkTracker::default();
+
+    let path: &Path = Path::new(path_str);
+    if path.is_dir() {
+        // Add the root directory itself
+        unique_directories.insert(PathBuf::from(path));
+
+        let mut walker = WalkDir::new(path)
+            .follow_links(link_policy == LinkPolicy::Follow)
+            .into_iter();
+
+        while let Some(entry) = walker.next() {
+            let entry: walkdir::DirEntry = match entry {
+                Ok(e) => e,
+                Err(e) => {
+                    // walkdir reports symlink loops as errors when following links
+                    eprintln!("Error walking dir: {e}");
+                    continue;
+                }
+            };
+
+            // Skip hidden files, and don't descend into hidden directories.
+            // Dotfiles are the exception, they are kept if their content is text and they don't hold secrets
+            if entry.depth() > 0 && platform::is_hidden(entry.path()) {
+                if entry.file_type().is_dir() {
+                    walker.skip_current_dir();
+                    continue;
+                }
+                if is_skipped_hidden_file(entry.path()) {
+                    continue;
+                }
+            }
+
+            let link_target = if entry.path_is_symlink() {
+                std::fs::read_link(entry.path()).ok()
+            } else {
+                None
+            };
+
+            // without following, walkdir hands us the link itself
+            if entry.file_type().is_symlink() {
+                let record = link_policy == LinkPolicy::Record
+                    && entry.path().is_file()
+                    && is_valid_file_extension(entry.path())
+                    && links.first_visit(entry.path());
+
+                if record {
+                    if let Some(parent) = entry.path().parent() {
+                        unique_directories.insert(PathBuf::from(parent));
+                    }
+                    push_file_metadata(entry.path(), link_target, &mut all_files);
+                } else {
+                    links.skipped += 1;
+                }
+                continue;
+            }
+
+            if entry.file_type().is_file() {
+                // Check if the file has a valid extension before processing
+                // hardlinks and files reached through several links are only counted once
+                if is_valid_file_extension(entry.path()) && links.first_visit(entry.path()) {
+                    // Add the parent directory
+                    if let Some(parent) = entry.path().parent() {
+                        unique_directories.insert(PathBuf::from(parent));
+                    }
+
+                    push_file_metadata(entry.path(), link_target, &mut all_files);
+                }
+            } else if entry.file_type().is_dir() {
+                // a directory reached through a second link is already covered
+                if !links.first_visit(entry.path()) {
+                    walker.skip_current_dir();
+                    continue;
+                }
+
+                // Add all directories to our set
+                unique_directories.insert(entry.path().to_path_buf());
+            }
+        }
+
+        if links.skipped > 0 {
+            println!(
+                "Skipped {} symbolic links under {} (link policy: {:?})",
+                links.skipped, path_str, link_policy
+            );
+        }
+    } else {
+        // Handle single file case
+        if is_skipped_hidden_file(path) {
+            return (all_files, unique_directories);
+        }
+
+        let is_symlink = path.is_symlink();
+        if is_symlink && link_policy == LinkPolicy::Skip {
+            return (all_files, unique_directories);
+        }
+
+        // Check if the file has a valid extension before processing
+        if is_valid_file_extension(path) {
+            // Add the parent directory
+            if let Some(parent) = path.parent() {
+                unique_directories.insert(PathBuf::from(parent));
+            }
+
+            let link_target = if is_symlink {
+                std::fs::read_link(path).ok()
+            } else {
+                None
+            };
+            push_file_metadata(path, link_target, &mut all_files);
+        }
+    }
+
+    (all_files, unique_directories)
+}
+
+fn push_file_metadata(
+    path: &Path,
+    link_target: Option<PathBuf>,
+    all_files: &mut Vec<FileMetadata>,
+) {
+    if get_file_metadata(path, all_files).is_ok() {
+        if let Some(file) = all_files.last_mut() {
+            file.link_target = link_target.map(|t| t.to_string_lossy().into_owned());
+        }
+    }
+}
+
+/// Tracks the files and directories seen during a walk by device and inode, so hardlinks
+/// and trees reachable through several symlinks are only collected once
+#[derive(Default)]
+struct LinkTracker {
+    seen: HashSet<(u64, u64)>,
+    skipped: usize,
+}
+
+impl LinkTracker {
+    /// Returns false if the same file or directory was already visited
+    fn first_visit(&mut self, path: &Path) -> bool {
+        match file_identity(path) {
+            Some(id) => self.seen.insert(id),
+            None => true,
+        }
+    }
+}
+
+#[cfg(unix)]
+fn file_identity(path: &Path) -> Option<(u64, u64)> {
+    use std::os::unix::fs::MetadataExt;
+
+    std::fs::metadata(path).ok().map(|m| (m.dev(), m.ino()))
+}
+
+#[cfg(not(unix))]
+fn file_identity(_path: &Path) -> Option<(u64, u64)> {
+    None
+}
+
+/// How many files the feeder reads OS attributes for at once
+const ATTRIBUTE_BATCH_SIZE: usize = 64;
+
+/// Rough figures used by the dry run estimate
+const AVG_BYTES_PER_WORD: u64 = 6;
+const LOCAL_EMBEDDING_MS_PER_CHUNK: f64 = 5.0;
+
+/// Estimates how many chunks a file will be split into from its size.
+/// pdf and docx files are compressed containers, so only part of their bytes end up as text
+fn estimate_chunk_count(file: &FileMetadata, config: &ChunkerConfig) -> usize {
+    // images are stored without content
+    if file.size <= 0 || thumbnails::is_image_extension(&file.extension) {
+        return 0;
+    }
+
+    let text_bytes = match file.extension.to_lowercase().as_str() {
+        "pdf" | "docx" => file.size as u64 / 4,
+        _ => file.size as u64,
+    };
+    let words = (text_bytes / AVG_BYTES_PER_WORD).max(1) as usize;
+
+    if words <= config.chunk_size {
+        return 1;
+    }
+
+    let step = config
+        .chunk_size
+        .saturating_sub(config.chunk_overlap)
+        .max(1);
+    1 + (words - config.chunk_size).div_ceil(step)
+}
+
+fn default_chunker_config() -> ChunkerConfig {
+    ChunkerConfig {
+        chunk_size: 100,
+        chunk_overlap: 2,
+        normalize_text: true,
+        extract_metadata: true,
+        max_concurrent_files: 4,
+        use_gpu_acceleration: true,
+    }
+}
+
+/// Sets the OS attributes of the files that get read, with one platform call for all of them
+async fn read_attributes(files: &mut [FileMetadata], profiles: &IndexProfiles) {
+    let read: Vec<usize> = (0..files.len())
+        .filter(|&i| {
+            profiles
+                .profile_for(Path::new(&files[i].base.path))
+                .reads_file()
+        })
+        .collect();
+    let paths: Vec<PathBuf> = read
+        .iter()
+        .map(|&i| PathBuf::from(&files[i].base.path))
+        .collect();
+
+    let attributes = task::spawn_blocking(move || platform::read_document_attributes(&paths))
+        .await
+        .unwrap_or_default();
+    for (i, attributes) in read.into_iter().zip(attributes) {
+        files[i].attributes = attributes;
+    }
+}
+
+/// Pulls the next item off a queue shared by all the workers of a stage
+async fn next_item<T>(rx: &Arc<tokio::sync::Mutex<mpsc::Receiver<T>>>) -> Option<T> {
+    rx.lock().await.recv().await
+}
+
+/// Extract stage: reads files and splits them into chunks
+fn spawn_extract_worker(
+    rx: Arc<tokio::sync::Mutex<mpsc::Receiver<FileMetadata>>>,
+    tx: mpsc::Sender<ExtractedFile>,
+    err_sender: UnboundedSender<ProcessError>,
+    orchestrator: Arc<ChunkerOrchestrator>,
+    profiles: IndexProfiles,
+    sensitive_policy: SensitivePolicy,
+    db_path: PathBuf,
+    control: Arc<IndexingControl>,
+    run: Arc<RunToken>,
+    lane: Lane,
+) -> task::JoinHandle<()> {
+    tokio::spawn(async move {
+        loop {
+            // parks here while indexing is paused, or while fresh files go first
+            control.wait_for_turn(lane, Some(&run)).await;
+            if run.cancel_reason().is_some() {
+                break;
+            }
+            let Some(file) = next_item(&rx).await else {
+                break;
+            };
 
-                        // Skip hidden files
-                        if let Some(file_name) = entry.file_name().to_str() {
-                            if file_name.starts_with(".") {
-                                continue;
-                            }
-                        }
+            let profile = profiles.profile_for(Path::new(&file.base.path));
 
-                        if entry.file_type().is_file() {
-                            // Check if the file has a valid extension before processing
-                            if is_valid_file_extension(entry.path()) {
-                                // Add the parent directory
-                                if let Some(parent) = entry.path().parent() {
-                                    unique_directories.insert(PathBuf::from(parent));
-                                }
+            // Skip chunking empty files, images and files under roots whose profile doesn't embed, they only get their metadata stored
+            if file.size == 0
+                || thumbnails::is_image_extension(&file.extension)
+                || !profile.embeds_content()
+            {
+                if tx.send((file, Content::MetadataOnly)).await.is_err() {
+                    break;
+                }
+                continue;
+            }
 
-                                let _ = get_file_metadata(entry.path(), &mut all_files);
-                            }
-                        } else if entry.file_type().is_dir() {
-                            // Add all directories to our set
-                            unique_directories.insert(entry.path().to_path_buf());
-                        }
+            let slot = control.throttle(lane).await;
+            let chunks = match orchestrator.extract_chunks(&file).await {
+                Ok(chunks) => Content::Indexed(chunks),
+                Err(e) => {
+                    let _ = err_sender.send(ProcessError::new(
+                        file.base.path.clone(),
+                        ErrorClass::Extract,
+                        format!("Chunking error: {}", e),
+                    ));
+                    Content::Failed
+                }
+            };
+            drop(slot);
+
+            // secrets and PII are dealt with before anything is sent to the embedding service, see redaction.rs
+            let chunks = match chunks {
+                Content::Indexed(chunks) if sensitive_policy != SensitivePolicy::Off => {
+                    let (chunks, findings) = redaction::apply_policy(sensitive_policy, chunks);
+                    if let Err(e) = redaction::record_findings(
+                        db_path.clone(),
+                        file.base.path.clone(),
+                        sensitive_policy,
+                        findings,
+                    )
+                    .await
+                    {
+                        eprintln!(
+                            "Failed to record sensitive findings for {}: {}",
+                            file.base.path, e
+                        );
                     }
-                } else {
-                    // Handle single file case
-                    if let Some(file_name) = path.file_name().and_then(|n| n.to_str()) {
-                        if file_name.starts_with(".") {
-                            continue;
+                    match chunks {
+                        Some(chunks) => Content::Indexed(chunks),
+                        None => {
+                            println!(
+                                "Skipping the content of {}: sensitive content found",
+                                file.base.path
+                            );
+                            Content::MetadataOnly
                         }
                     }
+                }
+                chunks => chunks,
+            };
 
-                    // Check if the file has a valid extension before processing
-                    if is_valid_file_extension(path) {
-                        // Add the parent directory
-                        if let Some(parent) = path.parent() {
-                            unique_directories.insert(PathBuf::from(parent));
-                        }
+            if tx.send((file, chunks)).await.is_err() {
+                break;
+            }
+        }
+    })
+}
+
+/// Embed stage: turns the chunks of a file into embeddings
+fn spawn_embed_worker(
+    rx: Arc<tokio::sync::Mutex<mpsc::Receiver<ExtractedFile>>>,
+    tx: mpsc::Sender<EmbeddedFile>,
+    err_sender: UnboundedSender<ProcessError>,
+    embedder: Arc<Embedder>,
+    control: Arc<IndexingControl>,
+    run: Arc<RunToken>,
+    lane: Lane,
+) -> task::JoinHandle<()> {
+    tokio::spawn(async move {
+        loop {
+            control.wait_for_turn(lane, Some(&run)).await;
+            if run.cancel_reason().is_some() {
+                break;
+            }
+            let Some((file, chunks)) = next_item(&rx).await else {
+                break;
+            };
 
-                        let _ = get_file_metadata(path, &mut all_files);
+            let slot = control.throttle(lane).await;
+            let embedded = match chunks {
+                Content::Indexed(chunks) => {
+                    match util::embed_chunks(chunks, embedder.clone()).await {
+                        Ok(chunk_embeddings) => Content::Indexed(chunk_embeddings),
+                        // the rest of the run would fail the same way. The file isn't stored so the next run picks it up again
+                        Err(ChunkerError::QuotaExceeded(e)) => {
+                            eprintln!("Stopping indexing at {}: {}", file.base.path, e);
+                            control.cancel_run(&run, CancelReason::Quota);
+                            break;
+                        }
+                        Err(e) => {
+                            let _ = err_sender.send(ProcessError::new(
+                                file.base.path.clone(),
+                                ErrorClass::Embed,
+                                format!("Embedding error: {}", e),
+                            ));
+                            Content::Failed
+                        }
                     }
                 }
+                Content::MetadataOnly => Content::MetadataOnly,
+                Content::Failed => Content::Failed,
+            };
+            drop(slot);
+
+            if tx.send((file, embedded)).await.is_err() {
+                break;
             }
-            Ok::<_, FileProcessorError>((all_files, unique_directories))
-        })
-        .await
-        .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))?
-    }
+        }
+    })
 }
 
-fn create_path_embedding(
+/// Store stage: saves the file to the db and its embeddings to the vectordb, then reports progress
+fn spawn_store_worker(
+    rx: Arc<tokio::sync::Mutex<mpsc::Receiver<EmbeddedFile>>>,
+    err_sender: UnboundedSender<ProcessError>,
     db_path: PathBuf,
-    file_metadata: &FileMetadata,
-    permit: Arc<Semaphore>,
-    err_sender: UnboundedSender<(String, String)>,
     total_files: usize,
     pc: Arc<AtomicUsize>,
+    stats: Arc<StoreStats>,
+    root_counters: Arc<RootCounters>,
+    profiles: IndexProfiles,
     progress_fn: impl Fn(ProcessingStatus) + Send + Sync + Clone + 'static,
     app_handle: AppHandle,
-) -> tokio::task::JoinHandle<()> {
-    let fm_clone = file_metadata.clone();
-    let file_path = fm_clone.base.path.clone();
+) -> task::JoinHandle<()> {
+    tokio::spawn(async move {
+        while let Some((file, embedded)) = next_item(&rx).await {
+            let file_path = file.base.path.clone();
+            let stored = store_file(
+                file,
+                embedded,
+                &err_sender,
+                &db_path,
+                &stats,
+                &profiles,
+                &app_handle,
+            )
+            .await;
+            if stored {
+                pc.fetch_add(1, Ordering::SeqCst);
+            }
+
+            // Update progress, files that failed or were stored without content are done too
+            let processed: usize = stats.done.fetch_add(1, Ordering::SeqCst) + 1;
+            root_counters.file_done(&file_path);
+            let percentage: usize =
+                ((processed as f64 / total_files as f64) * 100.0).round() as usize;
+            progress_fn(ProcessingStatus {
+                total: total_files,
+                processed,
+                percentage,
+                roots: root_counters.progress(),
+            });
+        }
+    })
+}
+
+/// Store stage for a single file: saves it with its symbols, thumbnail, summary, entities and embeddings.
+/// Returns whether it was stored with its embeddings, failures are sent to `err_sender`.
+/// A file that failed has its indexed version left as it is, saving replaces it
+async fn store_file(
+    file: FileMetadata,
+    embedded: Content<Vec<(Chunk, Vec<f32>)>>,
+    err_sender: &UnboundedSender<ProcessError>,
+    db_path: &Path,
+    stats: &StoreStats,
+    profiles: &IndexProfiles,
+    app_handle: &AppHandle,
+) -> bool {
+    let file_path = file.base.path.clone();
+
+    let chunk_embeddings = match embedded {
+        Content::Indexed(chunk_embeddings) if chunk_embeddings.is_empty() => {
+            let _ = err_sender.send(ProcessError::new(
+                file_path,
+                ErrorClass::Store,
+                "No valid embeddings generated".to_string(),
+            ));
+            return false;
+        }
+        Content::Indexed(chunk_embeddings) => Some(chunk_embeddings),
+        Content::MetadataOnly => None,
+        // already reported by the stage that failed
+        Content::Failed => return false,
+    };
 
     println!(
-        "saving the path to db and creating embedding: {}",
-        file_metadata.base.path
+        "saving the path to db and storing embeddings: {}",
+        file_path
     );
 
-    tokio::spawn(async move {
-        // Acquire concurrency permit
-        let _permit = match permit.acquire().await {
-            Ok(permit) => permit,
-            Err(_) => {
-                let _ =
-                    err_sender.send((file_path, "Failed to acquire semaphore permit".to_string()));
-                return;
-            }
-        };
-
-        let saved_file_id: String = match save_file_to_db(db_path.clone(), &fm_clone).await {
+    let reads_file = profiles.profile_for(Path::new(&file_path)).reads_file();
+    let saved_file_id: String =
+        match save_file_to_db(app_handle, db_path.to_path_buf(), &file, reads_file).await {
             Ok(file_id) => file_id,
             Err(e) => {
-                let _ = err_sender.send((file_path, format!("File processing error: {:?}", e)));
-                return;
+                let _ = err_sender.send(ProcessError::new(
+                    file_path,
+                    ErrorClass::Store,
+                    format!("File processing error: {:?}", e),
+                ));
+                return false;
             }
         };
-
-        // Skip empty files
-        if fm_clone.size == 0 {
-            return;
+    stats
+        .bytes_processed
+        .fetch_add(file.size.max(0) as u64, Ordering::SeqCst);
+
+    // source files also get their definitions indexed, anything else is skipped
+    match saved_file_id.parse::<i64>() {
+        Ok(file_id) if reads_file => {
+            if let Err(e) =
+                symbols::index_file_symbols(db_path.to_path_buf(), file_id, file_path.clone()).await
+            {
+                eprintln!("Failed to index symbols for {}: {}", file_path, e);
+            }
+            if let Err(e) = thumbnails::index_file_thumbnail(
+                db_path.to_path_buf(),
+                file_id,
+                file_path.clone(),
+                file.extension.clone(),
+            )
+            .await
+            {
+                eprintln!("Failed to make a thumbnail for {}: {}", file_path, e);
+            }
         }
+        _ => {}
+    }
 
-        let config = ChunkerConfig {
-            chunk_size: 100,
-            chunk_overlap: 2,
-            normalize_text: true,
-            extract_metadata: true,
-            max_concurrent_files: 4,
-            use_gpu_acceleration: true,
-        };
+    let Some(chunk_embeddings) = chunk_embeddings else {
+        stats.without_content.fetch_add(1, Ordering::SeqCst);
+        return false;
+    };
 
-        let orchestrator = ChunkerOrchestrator::new(config);
+    if let Ok(file_id) = saved_file_id.parse::<i64>() {
+        let chunks: Vec<&str> = chunk_embeddings
+            .iter()
+            .map(|(chunk, _)| chunk.content.as_str())
+            .collect();
+        summarizer::enqueue(app_handle, file_id, &chunks);
 
-        let embedder_state: State<'_, Arc<Embedder>> = app_handle.state::<Arc<Embedder>>();
+        let text = chunks.join("\n");
+        if let Err(e) = entities::index_file_entities(db_path.to_path_buf(), file_id, text).await {
+            eprintln!("Failed to index entities for {}: {}", file_path, e);
+        }
+    }
 
-        let embedder: Arc<Embedder> = Arc::clone(&embedder_state.inner());
+    if let Err(e) =
+        VectorDbManager::insert_embeddings(app_handle, &saved_file_id, chunk_embeddings).await
+    {
+        let _ = err_sender.send(ProcessError::new(
+            file_path,
+            ErrorClass::Store,
+            format!("Failed to insert embeddings: {}", e),
+        ));
+        return false;
+    }
 
-        match orchestrator.chunk_file(&fm_clone, embedder).await {
-            Ok(chunk_embeddings) => {
-                if chunk_embeddings.is_empty() {
-                    let _ =
-                        err_sender.send((file_path, "No valid embeddings generated".to_string()));
-                } else {
-                    VectorDbManager::insert_embeddings(
-                        &app_handle,
-                        &saved_file_id,
-                        chunk_embeddings,
-                    )
-                    .await
-                    .unwrap_or_else(|e| {
-                        let _ = err_sender.send((
-                            file_path.clone(),
-                            format!("Failed to insert embeddings: {}", e),
-                        ));
-                    });
-                    // Update progress
-                    let processed: usize = pc.fetch_add(1, Ordering::SeqCst) + 1;
-                    let percentage: usize =
-                        ((processed as f64 / total_files as f64) * 100.0).round() as usize;
-                    progress_fn(ProcessingStatus {
-                        total: total_files,
-                        processed,
-                        percentage,
-                    });
-                }
-            }
-            Err(e) => {
-                let _ = err_sender.send((file_path, format!("Chunking/embedding error: {}", e)));
-            }
-        }
-    })
+    true
 }
 
-/// Saves a single file to the db and to fts
+/// Saves a single file to the db and to fts. An indexed file is replaced in place under the same id,
+/// so its previous version stays searchable until this point
 /// returns the stringified file id on success
 async fn save_file_to_db(
+    app_handle: &AppHandle,
     db_path: PathBuf,
     file: &FileMetadata,
+    reads_file: bool,
 ) -> Result<String, FileProcessorError> {
-    let file = file.clone();
-
     println!("saving the file in the db:{:?}", file.base.path);
 
-    task::spawn_blocking({
+    let (file_id, replaced) = task::spawn_blocking({
         let db_path = db_path;
-        move || -> Result<String, FileProcessorError> {
+        let file = file.clone();
+        move || -> Result<(String, bool), FileProcessorError> {
+            fault_injection::inject_blocking(FaultPoint::DbWrite, Path::new(&file.base.path))
+                .map_err(|e| FileProcessorError::Other(e.to_string()))?;
+
             // Fixed error handling with map_err instead of map
-            let conn = Connection::open(db_path).map_err(|e| FileProcessorError::Db(e))?;
+            let mut conn = Connection::open(db_path).map_err(|e| FileProcessorError::Db(e))?;
 
             // Set pragmas for better performance
             conn.execute_batch(
@@ -427,8 +1574,17 @@ async fn save_file_to_db(
                 "#,
             )?;
 
+            let attributes = file.attributes.as_ref();
+
             // Get the filename part
             let path = Path::new(&file.base.path);
+            // lets opening a result tell whether the file changed since, documents from connectors have none.
+            // Files under metadata_only roots aren't read at all
+            let content_hash = if reads_file {
+                hash_file(path).ok()
+            } else {
+                None
+            };
             let filename = path
                 .file_name()
                 .map(|f| f.to_string_lossy().to_string())
@@ -466,11 +1622,39 @@ async fn save_file_to_db(
                 Err(e) => return Err(FileProcessorError::Db(e)),
             };
 
+            // the previous version stays searchable until this one is written, both go in one transaction
+            let tx = conn.transaction()?;
+            let previous_id: Option<i64> = tx
+                .query_row(
+                    "SELECT id FROM files WHERE path = ?1",
+                    [&file.base.path],
+                    |row| row.get(0),
+                )
+                .optional()?;
+            if let Some(id) = previous_id {
+                clear_file_rows(&tx, id)?;
+            }
+
             // Insert file metadata with directory_id
-            conn.execute(
+            tx.execute(
                 r#"
-                INSERT OR IGNORE INTO files (directory_id, path, name, extension, size, category)
-                VALUES (?1, ?2, ?3, ?4, ?5, ?6);
+                INSERT INTO files (directory_id, path, name, extension, size, category, link_target,
+                                   title, authors, tags, content_created_at, content_hash, modified_at)
+                VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13)
+                ON CONFLICT(path) DO UPDATE SET
+                    directory_id = excluded.directory_id,
+                    name = excluded.name,
+                    extension = excluded.extension,
+                    size = excluded.size,
+                    category = excluded.category,
+                    link_target = excluded.link_target,
+                    title = excluded.title,
+                    authors = excluded.authors,
+                    tags = excluded.tags,
+                    content_created_at = excluded.content_created_at,
+                    content_hash = excluded.content_hash,
+                    modified_at = excluded.modified_at,
+                    updated_at = CURRENT_TIMESTAMP;
                 "#,
                 params![
                     directory_id,
@@ -478,22 +1662,34 @@ async fn save_file_to_db(
                     file.base.name,
                     file.extension,
                     file.size,
-                    get_category_from_extension(&file.extension)
+                    get_category_from_extension(&file.extension),
+                    file.link_target,
+                    attributes.and_then(|a| a.title.clone()),
+                    attributes.map(|a| serde_json::json!(a.authors).to_string()),
+                    attributes.map(|a| serde_json::json!(a.tags).to_string()),
+                    attributes.and_then(|a| a.content_created_at.clone()),
+                    content_hash,
+                    file.modified_at
                 ],
             )?;
 
             // Get the file ID for FTS insertion
-            let file_id: i64 = conn.query_row(
+            let file_id: i64 = tx.query_row(
                 "SELECT id FROM files WHERE path = ?1",
                 [file.base.path.clone()],
                 |row| row.get(0),
             )?;
 
             // Build document text from file metadata for search indexing
-            let doc_text = build_doc_text(&file.base.name, &file.base.path, &file.extension);
+            let doc_text = file_doc_text(
+                &file.base.name,
+                &file.base.path,
+                &file.extension,
+                attributes,
+            );
 
             // Insert into full-text search table
-            conn.execute(
+            tx.execute(
                 r#"
                 INSERT INTO files_fts(rowid, doc_text)
                 VALUES (?1, ?2)
@@ -501,13 +1697,125 @@ async fn save_file_to_db(
                 params![file_id, doc_text],
             )?;
 
-            Ok(file_id.to_string())
+            tx.commit()?;
+            Ok((file_id.to_string(), previous_id.is_some()))
+        }
+    })
+    .await
+    .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))??;
+
+    // the embeddings of the version that was just replaced
+    if replaced {
+        if let Err(e) = VectorDbManager::delete_embedding(app_handle, &file_id).await {
+            eprintln!(
+                "Failed to delete old embeddings for {}: {}",
+                file.base.path, e
+            );
+        }
+    }
+
+    Ok(file_id)
+}
+
+/// Returns the files that aren't indexed yet or have changed on disk since they were indexed
+pub async fn filter_changed_files(
+    db_path: PathBuf,
+    files: Vec<FileMetadata>,
+) -> Result<Vec<FileMetadata>, FileProcessorError> {
+    task::spawn_blocking(move || -> Result<Vec<FileMetadata>, FileProcessorError> {
+        let conn = Connection::open(db_path)?;
+        let mut stmt = conn.prepare(
+            "SELECT size, CAST(strftime('%s', updated_at) AS INTEGER) FROM files WHERE path = ?1",
+        )?;
+
+        let mut changed = Vec::new();
+        for file in files {
+            let indexed: Option<(i64, Option<i64>)> = stmt
+                .query_row([&file.base.path], |row| Ok((row.get(0)?, row.get(1)?)))
+                .optional()?;
+
+            let is_changed = match indexed {
+                None => true,
+                Some((size, indexed_at)) => {
+                    size != file.size
+                        || matches!((file.modified_at, indexed_at), (Some(m), Some(i)) if m > i)
+                }
+            };
+
+            if is_changed {
+                changed.push(file);
+            }
         }
+
+        Ok(changed)
     })
     .await
     .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))?
 }
 
+/// Removes files from the db, the fts table and the vectordb so they can be indexed again from scratch.
+/// Returns the number of files that were removed
+pub async fn remove_indexed_files(
+    app_handle: &AppHandle,
+    db_path: PathBuf,
+    paths: Vec<String>,
+) -> Result<usize, FileProcessorError> {
+    let file_ids = task::spawn_blocking(move || -> Result<Vec<i64>, FileProcessorError> {
+        let mut conn = Connection::open(db_path)?;
+        let tx = conn.transaction()?;
+
+        let mut file_ids = Vec::new();
+        for path in &paths {
+            let file_id: Option<i64> = tx
+                .query_row("SELECT id FROM files WHERE path = ?1", [path], |row| {
+                    row.get(0)
+                })
+                .optional()?;
+
+            if let Some(id) = file_id {
+                if delete_file_rows(&tx, id, path)? {
+                    file_ids.push(id);
+                }
+            }
+        }
+
+        tx.commit()?;
+        Ok(file_ids)
+    })
+    .await
+    .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))??;
+
+    for id in &file_ids {
+        if let Err(e) = VectorDbManager::delete_embedding(app_handle, &id.to_string()).await {
+            eprintln!("Failed to delete embeddings for file {}: {}", id, e);
+        }
+    }
+
+    Ok(file_ids.len())
+}
+
+/// Deletes a file and every row that hangs off it. The vectors live in the vectordb and
+/// have to be deleted separately with `VectorDbManager::delete_embedding`.
+/// Returns whether the file row existed
+fn delete_file_rows(conn: &Connection, id: i64, path: &str) -> rusqlite::Result<bool> {
+    clear_file_rows(conn, id)?;
+    conn.execute("DELETE FROM sensitive_findings WHERE path = ?1", [path])?;
+    let deleted = conn.execute("DELETE FROM files WHERE id = ?1", [id])?;
+    Ok(deleted > 0)
+}
+
+/// Deletes the rows made from the content of a file but keeps the file itself, so a new version
+/// can take its place under the same id
+fn clear_file_rows(conn: &Connection, id: i64) -> rusqlite::Result<()> {
+    delete_fts_row(conn, id)?;
+    conn.execute("DELETE FROM symbols WHERE file_id = ?1", [id])?;
+    conn.execute("DELETE FROM summaries WHERE file_id = ?1", [id])?;
+    conn.execute("DELETE FROM entities WHERE file_id = ?1", [id])?;
+    conn.execute("DELETE FROM thumbnails WHERE file_id = ?1", [id])?;
+    conn.execute("DELETE FROM evicted_files WHERE file_id = ?1", [id])?;
+    Ok(())
+}
+
 /// Get metadata for a given file path
 pub fn get_file_metadata(
     path: &Path,
@@ -515,6 +1823,11 @@ pub fn get_file_metadata(
 ) -> Result<(), FileProcessorError> {
     let meta = std::fs::metadata(path)?;
     let size = meta.len() as i64;
+    let modified_at = meta
+        .modified()
+        .ok()
+        .and_then(|t| t.duration_since(UNIX_EPOCH).ok())
+        .map(|d| d.as_secs() as i64);
     let ext = path
         .extension()
         .map(|os| os.to_string_lossy().into_owned())
@@ -527,13 +1840,19 @@ pub fn get_file_metadata(
                 .file_name()
                 .map(|f| f.to_string_lossy().into_owned())
                 .unwrap_or_else(|| "unknown".into()),
-            path: path.to_string_lossy().into_owned(),
+            path: platform::normalize_path(path),
         },
         file_type: SearchSectionType::Files,
         extension: ext,
         size,
         updated_at: None,
         created_at: None,
+        modified_at,
+        link_target: None,
+        attributes: None,
+        summary: None,
+        ranking: None,
+        icon: None,
     });
 
     Ok(())
@@ -545,6 +1864,7 @@ pub struct FileProcessorState(pub Mutex<Option<FileProcessor>>);
 #[tauri::command]
 pub async fn process_paths_command(
     paths: Vec<String>,
+    dry_run: Option<bool>,
     state: tauri::State<'_, FileProcessorState>,
     app_handle: AppHandle,
 ) -> Result<serde_json::Value, String> {
@@ -557,21 +1877,36 @@ pub async fn process_paths_command(
         }
     };
 
+    if dry_run.unwrap_or(false) {
+        let estimate = processor
+            .estimate_paths(paths, &app_handle)
+            .await
+            .map_err(|e: FileProcessorError| e.to_string())?;
+
+        return serde_json::to_value(estimate).map_err(|e| e.to_string());
+    }
+
     let app_handle_for_progress = app_handle.clone();
 
     let progress_handler = move |status: ProcessingStatus| {
         let _ = app_handle_for_progress.emit("file-processing-progress", &status);
     };
 
-    processor
-        .process_paths(paths, progress_handler, app_handle)
+    let result = processor
+        .process_paths(paths, progress_handler, app_handle, Lane::Background)
         .await
-        .map_err(|e: FileProcessorError| e.to_string())
+        .map_err(|e: FileProcessorError| e.to_string())?;
+
+    serde_json::to_value(result).map_err(|e| e.to_string())
 }
 
 #[tauri::command]
 pub async fn get_semantic_files_data(
     query: String,
+    filters: Option<AttributeFilters>,
+    entity: Option<String>,
+    explain: Option<bool>,
+    include_icons: Option<bool>,
     state: State<'_, FileProcessorState>,
     app_handle: AppHandle,
 ) -> Result<Vec<SemanticMetadata>, String> {
@@ -581,7 +1916,7 @@ pub async fn get_semantic_files_data(
         .map_err(|e| format!("Failed to open database: {e}"))?;
 
     // Do a vector similarity search
-    let semantic_files: Vec<SemanticMetadata> =
+    let mut semantic_files: Vec<SemanticMetadata> =
         match VectorDbManager::search_similar(&app_handle, &query).await {
             Ok(results) => convert_search_results_to_metadata(results, &conn)?,
             Err(e) => {
@@ -594,12 +1929,42 @@ pub async fn get_semantic_files_data(
             }
         };
 
+    if let Some(filters) = filters.filter(|f| !f.is_empty()) {
+        let ids = semantic_files
+            .iter()
+            .filter_map(|f| f.base.id)
+            .collect::<Vec<_>>();
+        let matching = filter_ids_by_attributes(&conn, &ids, &filters)?;
+        semantic_files.retain(|f| f.base.id.map_or(false, |id| matching.contains(&id)));
+    }
+
+    if let Some(entity) = entity.filter(|e| !e.trim().is_empty()) {
+        let mentioning = entities::file_ids_mentioning(&conn, &entity)
+            .map_err(|e| format!("Failed to filter by entity: {e}"))?;
+        semantic_files.retain(|f| f.base.id.map_or(false, |id| mentioning.contains(&id)));
+    }
+
+    rank_semantic_files(&conn, &query, &mut semantic_files, explain.unwrap_or(false));
+
+    if include_icons.unwrap_or(false) {
+        let ids: Vec<i64> = semantic_files.iter().filter_map(|f| f.base.id).collect();
+        let thumbnails = stored_thumbnails(&conn, &ids);
+        semantic_files.par_iter_mut().for_each(|f| {
+            let thumbnail = f.base.id.and_then(|id| thumbnails.get(&id).cloned());
+            f.icon = Some(icons::resolve_icon(&f.base.path, &f.extension, thumbnail));
+        });
+    }
+
     Ok(semantic_files)
 }
 
 #[tauri::command]
 pub async fn get_files_data(
     query: String,
+    filters: Option<AttributeFilters>,
+    entity: Option<String>,
+    explain: Option<bool>,
+    include_icons: Option<bool>,
     state: State<'_, FileProcessorState>,
 ) -> Result<Vec<FileMetadata>, String> {
     let processor: FileProcessor = get_processor(&state)?;
@@ -608,17 +1973,177 @@ pub async fn get_files_data(
         .map_err(|e| format!("Failed to open database: {e}"))?;
 
     // Handle short que
-    if query.len() < 3 {
-        return search_files_by_like(&conn, &query);
+    let mut files = if query.len() < 3 {
+        search_files_by_like(&conn, &query)?
+    } else {
+        // For queries with >3 characters, first do an FTS search
+        search_files_by_fts(&conn, &query)?
+    };
+
+    if let Some(filters) = filters.filter(|f| !f.is_empty()) {
+        files.retain(|f| {
+            f.attributes
+                .as_ref()
+                .map_or(false, |a| attributes_match(a, &filters))
+        });
+    }
+
+    // "everything mentioning Acme Corp", see entities.rs
+    if let Some(entity) = entity.filter(|e| !e.trim().is_empty()) {
+        let mentioning = entities::file_ids_mentioning(&conn, &entity)
+            .map_err(|e| format!("Failed to filter by entity: {e}"))?;
+        files.retain(|f| f.base.id.map_or(false, |id| mentioning.contains(&id)));
+    }
+
+    // short queries list most of the index, they keep the plain LIKE order
+    if query.len() >= 3 {
+        rank_files(&conn, &query, &mut files, explain.unwrap_or(false));
     }
 
-    // For queries with >3 characters, first do an FTS search
-    let files = search_files_by_fts(&conn, &query)?;
+    if include_icons.unwrap_or(false) {
+        let ids: Vec<i64> = files.iter().filter_map(|f| f.base.id).collect();
+        let thumbnails = stored_thumbnails(&conn, &ids);
+        files.par_iter_mut().for_each(|f| {
+            let thumbnail = f.base.id.and_then(|id| thumbnails.get(&id).cloned());
+            f.icon = Some(icons::resolve_icon(&f.base.path, &f.extension, thumbnail));
+        });
+    }
 
     Ok(files)
 }
 
-fn get_processor(state: &State<'_, FileProcessorState>) -> Result<FileProcessor, String> {
+/// Results are still returned when the thumbnails can't be read, just without them
+fn stored_thumbnails(conn: &Connection, file_ids: &[i64]) -> HashMap<i64, String> {
+    thumbnails::load_thumbnails(conn, file_ids).unwrap_or_else(|e| {
+        eprintln!("Failed to load thumbnails: {}", e);
+        HashMap::new()
+    })
+}
+
+fn attributes_match(attributes: &DocumentAttributes, filters: &AttributeFilters) -> bool {
+    let contains = |text: &str, needle: &str| text.to_lowercase().contains(&needle.to_lowercase());
+
+    let author_matches = filters.author.as_ref().map_or(true, |author| {
+        attributes.authors.iter().any(|a| contains(a, author))
+    });
+    let title_matches = filters.title.as_ref().map_or(true, |title| {
+        attributes
+            .title
+            .as_deref()
+            .map_or(false, |t| contains(t, title))
+    });
+    let tag_matches = filters.tag.as_ref().map_or(true, |tag| {
+        attributes.tags.iter().any(|t| t.eq_ignore_ascii_case(tag))
+    });
+
+    author_matches && title_matches && tag_matches
+}
+
+/// Returns the ids out of `ids` whose stored attributes match the filters
+fn filter_ids_by_attributes(
+    conn: &Connection,
+    ids: &[i64],
+    filters: &AttributeFilters,
+) -> Result<HashSet<i64>, String> {
+    let mut stmt = conn
+        .prepare("SELECT title, authors, tags, content_created_at FROM files WHERE id = ?1")
+        .map_err(|e| format!("Failed to prepare statement: {e}"))?;
+
+    let mut matching = HashSet::new();
+    for id in ids {
+        let attributes = stmt
+            .query_row([id], |row| Ok(attributes_from_row(row, 0)))
+            .optional()
+            .map_err(|e| format!("Query error: {e}"))?
+            .flatten();
+
+        if attributes.map_or(false, |a| attributes_match(&a, filters)) {
+            matching.insert(*id);
+        }
+    }
+
+    Ok(matching)
+}
+
+/// Reads the title, authors, tags and content_created_at columns starting at `first`
+/// The text files_fts indexes for a file: trigrams of its name, path and extension, and of its title,
+/// authors and tags so those can be searched like names
+pub fn file_doc_text(
+    name: &str,
+    path: &str,
+    extension: &str,
+    attributes: Option<&DocumentAttributes>,
+) -> String {
+    let mut doc_text = build_doc_text(name, path, extension);
+
+    if let Some(attributes) = attributes {
+        let extra = attributes
+            .title
+            .iter()
+            .chain(&attributes.authors)
+            .chain(&attributes.tags)
+            .map(|text| build_trigrams(text))
+            .collect::<Vec<_>>();
+        if !extra.is_empty() {
+            doc_text = format!("{} {}", doc_text, extra.join(" "));
+        }
+    }
+
+    doc_text
+}
+
+/// Rebuilds the text a file was indexed with in files_fts from its row in the files table
+pub fn stored_doc_text(conn: &Connection, id: i64) -> rusqlite::Result<Option<String>> {
+    conn.query_row(
+        "SELECT name, path, extension, title, authors, tags, content_created_at FROM files WHERE id = ?1",
+        [id],
+        |row| {
+            let name: Option<String> = row.get(0)?;
+            let path: Option<String> = row.get(1)?;
+            let extension: Option<String> = row.get(2)?;
+            Ok(file_doc_text(
+                &name.unwrap_or_default(),
+                &path.unwrap_or_default(),
+                &extension.unwrap_or_default(),
+                attributes_from_row(row, 3).as_ref(),
+            ))
+        },
+    )
+    .optional()
+}
+
+/// files_fts is contentless, so a row can't be deleted with DELETE. FTS5 takes it out when it is handed
+/// the exact text the row was indexed with, which is rebuilt from the files table.
+/// Has to run before the files row changes or goes away
+fn delete_fts_row(conn: &Connection, id: i64) -> rusqlite::Result<()> {
+    if let Some(doc_text) = stored_doc_text(conn, id)? {
+        conn.execute(
+            "INSERT INTO files_fts(files_fts, rowid, doc_text) VALUES('delete', ?1, ?2)",
+            params![id, doc_text],
+        )?;
+    }
+    Ok(())
+}
+
+pub fn attributes_from_row(row: &rusqlite::Row, first: usize) -> Option<DocumentAttributes> {
+    let text = |offset: usize| row.get::<_, Option<String>>(first + offset).ok().flatten();
+    let list = |offset: usize| {
+        text(offset)
+            .and_then(|json| serde_json::from_str::<Vec<String>>(&json).ok())
+            .unwrap_or_default()
+    };
+
+    let attributes = DocumentAttributes {
+        title: text(0),
+        authors: list(1),
+        tags: list(2),
+        content_created_at: text(3),
+    };
+
+    (!attributes.is_empty()).then_some(attributes)
+}
+
+pub fn get_processor(state: &State<'_, FileProcessorState>) -> Result<FileProcessor, String> {
     let processor: FileProcessor = {
         let guard: std::sync::MutexGuard<'_, Option<FileProcessor>> =
             state.0.lock().map_err(|e| e.to_string())?;
@@ -645,7 +2170,13 @@ fn search_files_by_like(conn: &Connection, query: &str) -> Result<Vec<FileMetada
               extension,
               size,
               created_at,
-              updated_at
+              updated_at,
+              link_target,
+              title,
+              authors,
+              tags,
+              content_created_at,
+              (SELECT summary FROM summaries WHERE file_id = files.id)
             FROM files
             WHERE name LIKE ?1 OR path LIKE ?2 OR extension LIKE ?3
        
@@ -674,7 +2205,13 @@ fn search_files_by_fts(conn: &Connection, query: &str) -> Result<Vec<FileMetadat
           f.extension,
           f.size,
           f.created_at,
-          f.updated_at
+          f.updated_at,
+          f.link_target,
+          f.title,
+          f.authors,
+          f.tags,
+          f.content_created_at,
+          (SELECT summary FROM summaries WHERE file_id = f.id)
         FROM files_fts ft
         JOIN files f ON ft.rowid = f.id
         WHERE ft.doc_text MATCH ?1
@@ -691,7 +2228,7 @@ fn search_files_by_fts(conn: &Connection, query: &str) -> Result<Vec<FileMetadat
 }
 
 // convert sqlite rows to FileMetadata type
-fn rows_to_file_metadata(mut rows: Rows) -> Result<Vec<FileMetadata>, String> {
+pub fn rows_to_file_metadata(mut rows: Rows) -> Result<Vec<FileMetadata>, String> {
     let mut files: Vec<FileMetadata> = Vec::new();
 
     while let Some(row) = rows.next().map_err(|e| format!("Row error: {e}"))? {
@@ -706,15 +2243,31 @@ fn rows_to_file_metadata(mut rows: Rows) -> Result<Vec<FileMetadata>, String> {
             size: row.get(4).map_err(|e| e.to_string())?,
             created_at: row.get(5).ok(),
             updated_at: row.get(6).ok(),
+            modified_at: None,
+            link_target: row.get::<_, Option<String>>(7).ok().flatten(),
+            attributes: attributes_from_row(row, 8),
+            summary: row
+                .get::<_, Option<String>>(12)
+                .ok()
+                .flatten()
+                .and_then(open_summary),
+            ranking: None,
+            icon: None,
         });
     }
 
     Ok(files)
 }
 
+/// Summaries are sealed with encryption at rest on, one that can't be opened is left out
+pub fn open_summary(summary: String) -> Option<String> {
+    encryption::open_text(&summary).ok()
+}
+
 fn rows_to_semantic_metadata(
     mut rows: Rows,
     distances: &HashMap<String, f32>,
+    pages: &HashMap<String, u32>,
 ) -> Result<Vec<SemanticMetadata>, String> {
     let mut files: Vec<SemanticMetadata> = Vec::new();
 
@@ -733,6 +2286,14 @@ fn rows_to_semantic_metadata(
             extension: row.get(3).map_err(|e| e.to_string())?,
             distance: distance,
             content: None, // update this later to return the exact content
+            page_number: pages.get(&id.to_string()).copied(),
+            summary: row
+                .get::<_, Option<String>>(7)
+                .ok()
+                .flatten()
+                .and_then(open_summary),
+            ranking: None,
+            icon: None,
         });
     }
 
@@ -750,9 +2311,15 @@ fn convert_search_results_to_metadata(
     }
 
     let mut file_id_distances: HashMap<String, f32> = HashMap::new();
+    // page of the closest chunk of each file, for paged documents
+    let mut file_id_pages: HashMap<String, u32> = HashMap::new();
 
     // Extract data from results
     for batch in &results {
+        let page_numbers = batch
+            .column_by_name("page_number")
+            .and_then(|c| c.as_any().downcast_ref::<arrow_array::Int32Array>());
+
         if let Some(distance_column) = batch.column_by_name("_distance") {
             if let Some(file_id_column) = batch.column_by_name("file_id") {
                 if let (Some(distance_array), Some(file_id_array)) = (
@@ -773,6 +2340,15 @@ fn convert_search_results_to_metadata(
                                     || file_id_distances[file_id] > distance
                                 {
                                     file_id_distances.insert(file_id.to_string(), distance);
+                                    match page_numbers.filter(|pages| !pages.is_null(i)) {
+                                        Some(pages) => {
+                                            file_id_pages
+                                                .insert(file_id.to_string(), pages.value(i) as u32);
+                                        }
+                                        None => {
+                                            file_id_pages.remove(file_id);
+                                        }
+                                    }
                                     println!(
                                         "Relevant match: file_id={}, distance={}",
                                         file_id, distance
@@ -803,7 +2379,8 @@ fn convert_search_results_to_metadata(
 
     let query = format!(
         r#"
-        SELECT id, name, path, extension, size, created_at, updated_at
+        SELECT id, name, path, extension, size, created_at, updated_at,
+               (SELECT summary FROM summaries WHERE file_id = files.id)
         FROM files
         WHERE id IN ({})
         "#,
@@ -824,24 +2401,133 @@ fn convert_search_results_to_metadata(
         .query(params.as_slice())
         .map_err(|e| format!("Query error: {e}"))?;
 
-    rows_to_semantic_metadata(rows, &file_id_distances)
+    rows_to_semantic_metadata(rows, &file_id_distances, &file_id_pages)
+}
+
+/// Sent when a result the user opened was stale and has been indexed again, the file gets a new id
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ResultUpdated {
+    pub path: String,
+    pub previous_file_id: i64,
+    pub file_id: i64,
 }
 
 #[tauri::command]
-pub fn open_file(file_path: &str) -> Result<(), String> {
+pub async fn open_file(
+    file_path: String,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> Result<(), String> {
     let status = Command::new("open")
-        .arg(file_path)
+        .arg(&file_path)
         .status()
         .map_err(|e| format!("Failed to open file: {}", e))?;
 
-    if status.success() {
-        Ok(())
-    } else {
-        Err(format!(
+    if !status.success() {
+        return Err(format!(
             "Failed to open file, exit code: {:?}",
             status.code()
-        ))
+        ));
+    }
+
+    // the file is opened either way, recording and checking it doesn't hold up the user
+    let processor = get_processor(&state)?;
+    tauri::async_runtime::spawn(async move {
+        if let Err(e) = opens::record_open_path(processor.db_path.clone(), file_path.clone()).await
+        {
+            eprintln!("Failed to record the open of {}: {}", file_path, e);
+        }
+        if let Err(e) = refresh_if_stale(&processor, file_path.clone(), app_handle).await {
+            eprintln!("Failed to refresh {}: {}", file_path, e);
+        }
+    });
+
+    Ok(())
+}
+
+/// Indexes an opened file again if its content no longer matches the hash it was indexed with.
+/// Entries from before hashes were stored get theirs filled in instead
+async fn refresh_if_stale(
+    processor: &FileProcessor,
+    path: String,
+    app_handle: AppHandle,
+) -> Result<(), FileProcessorError> {
+    let db_path = processor.db_path.clone();
+    let lookup_path = path.clone();
+    let stale_file_id = task::spawn_blocking(move || -> Result<Option<i64>, FileProcessorError> {
+        let conn = Connection::open(db_path)?;
+        let indexed: Option<(i64, Option<String>)> = conn
+            .query_row(
+                "SELECT id, content_hash FROM files WHERE path = ?1",
+                [&lookup_path],
+                |row| Ok((row.get(0)?, row.get(1)?)),
+            )
+            .optional()?;
+        let Some((file_id, stored_hash)) = indexed else {
+            return Ok(None);
+        };
+
+        let current_hash = hash_file(Path::new(&lookup_path))?;
+        match stored_hash {
+            Some(stored_hash) if stored_hash != current_hash => Ok(Some(file_id)),
+            Some(_) => Ok(None),
+            None => {
+                conn.execute(
+                    "UPDATE files SET content_hash = ?1 WHERE id = ?2",
+                    params![current_hash, file_id],
+                )?;
+                Ok(None)
+            }
+        }
+    })
+    .await
+    .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))??;
+
+    let Some(previous_file_id) = stale_file_id else {
+        return Ok(());
+    };
+
+    println!("Opened file {} is stale, indexing it again", path);
+    let progress_handler = move |_status: ProcessingStatus| { /* do nothing */ };
+    // someone is looking at this file right now, so it goes ahead of running scans
+    processor
+        .reindex_paths(
+            vec![path.clone()],
+            progress_handler,
+            app_handle.clone(),
+            Lane::Fresh,
+        )
+        .await?;
+
+    let db_path = processor.db_path.clone();
+    let lookup_path = path.clone();
+    let file_id = task::spawn_blocking(move || -> Result<Option<i64>, FileProcessorError> {
+        let conn = Connection::open(db_path)?;
+        let file_id = conn
+            .query_row(
+                "SELECT id FROM files WHERE path = ?1",
+                [&lookup_path],
+                |row| row.get(0),
+            )
+            .optional()?;
+        Ok(file_id)
+    })
+    .await
+    .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))??;
+
+    if let Some(file_id) = file_id {
+        let _ = app_handle.emit(
+            "result-updated",
+            ResultUpdated {
+                path,
+                previous_file_id,
+                file_id,
+            },
+        );
+        let _ = app_handle.emit("files-updated", ());
     }
+
+    Ok(())
 }
 
 pub fn init_file_processor(
@@ -854,10 +2540,17 @@ pub fn init_file_processor(
 
     match lock_result {
         Ok(mut processor_guard) => {
-            *processor_guard = Some(FileProcessor {
-                db_path: PathBuf::from(db_path),
-                concurrency_limit: concurrency,
-            });
+            let settings = app_handle
+                .state::<SettingsManagerState>()
+                .0
+                .get_settings()
+                .unwrap_or_default();
+
+            *processor_guard = Some(FileProcessor::from_settings(
+                PathBuf::from(db_path),
+                concurrency,
+                &settings,
+            ));
 
             println!("File processor initialized.");
             Ok(())
@@ -870,18 +2563,68 @@ pub fn init_file_processor(
     }
 }
 
+/// Files with a dedicated chunker, plus everything on the plain text allowlist.
+/// Files without an extension or with one that isn't on any list are kept when their content looks like text
 pub fn is_valid_file_extension(path: &Path) -> bool {
-    let valid_extensions: HashSet<&str> = ["txt", "pdf", "docx", "md", "yaml", "yml"]
-        .iter()
-        .cloned()
-        .collect();
+    let valid_extensions: HashSet<&str> = ["pdf", "docx", "md"].iter().cloned().collect();
+
+    match path.extension().and_then(|e| e.to_str()) {
+        Some(ext_str) => {
+            let ext = ext_str.to_lowercase();
+            if valid_extensions.contains(ext.as_str())
+                || is_plain_text_extension(&ext)
+                || is_code_extension(&ext)
+                || thumbnails::is_image_extension(&ext)
+            {
+                return true;
+            }
 
-    if let Some(extension) = path.extension() {
-        if let Some(ext_str) = extension.to_str() {
-            return valid_extensions.contains(ext_str.to_lowercase().as_str());
+            // archives and other known formats are never sniffed
+            get_category_from_extension(&ext) == "other" && looks_like_text(path)
         }
+        None => looks_like_text(path),
     }
-    false
+}
+
+/// Dotfiles that hold credentials or shell and REPL history, they are never indexed
+const SECRET_DOTFILES: &[&str] = &[
+    ".env",
+    ".envrc",
+    ".netrc",
+    ".git-credentials",
+    ".npmrc",
+    ".yarnrc",
+    ".pypirc",
+    ".pgpass",
+    ".my.cnf",
+    ".viminfo",
+    ".lesshst",
+];
+
+/// Hidden files the walk and the watcher leave out: everything hidden except dotfiles, and dotfiles that hold secrets
+pub fn is_skipped_hidden_file(path: &Path) -> bool {
+    platform::is_hidden(path) && (!is_dotfile(path) || is_secret_dotfile(path))
+}
+
+/// Dotfiles like .bashrc or .gitignore, as opposed to files hidden through file system flags
+fn is_dotfile(path: &Path) -> bool {
+    path.file_name()
+        .and_then(|name| name.to_str())
+        .map(|name| name.starts_with('.'))
+        .unwrap_or(false)
+}
+
+/// .env and its variants like .env.local, the files on SECRET_DOTFILES and history files like .bash_history
+fn is_secret_dotfile(path: &Path) -> bool {
+    let Some(name) = path.file_name().and_then(|name| name.to_str()) else {
+        return false;
+    };
+    let name = name.to_lowercase();
+
+    SECRET_DOTFILES.contains(&name.as_str())
+        || name.starts_with(".env.")
+        || name.ends_with("_history")
+        || name.ends_with(".history")
 }
 
 /// Saves directories to the database, handling duplicates via the UNIQUE constraint
@@ -896,7 +2639,7 @@ async fn save_directories_to_db(
     // Convert directories to strings for insertion
     let directories_vec: Vec<String> = directories
         .iter()
-        .map(|path| path.to_string_lossy().to_string())
+        .map(|path| platform::normalize_path(path))
         .collect();
 
     task::spawn_blocking({
@@ -935,3 +2678,97 @@ async fn save_directories_to_db(
     .await
     .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))?
 }
+
+/// Rebuilds the file processor from changed settings: worker counts, priority, link, retention and sensitive content
+/// policies apply from the next run on, runs in flight carry on with what they started with. Changed index profiles
+/// are applied to the files already indexed in the background
+pub fn reload_file_processor(app_handle: &AppHandle, settings: &AppSettings) -> Result<(), String> {
+    let state = app_handle.state::<FileProcessorState>();
+    let mut guard = state.0.lock().map_err(|e| e.to_string())?;
+
+    if let Some(processor) = guard.as_mut() {
+        let previous = processor.profiles.clone();
+        *processor = FileProcessor::from_settings(
+            processor.db_path.clone(),
+            processor.default_concurrency,
+            settings,
+        );
+        println!("File processor reloaded.");
+
+        if processor.profiles != previous {
+            let app_handle = app_handle.clone();
+            let db_path = processor.db_path.clone();
+            let profiles = processor.profiles.clone();
+            tauri::async_runtime::spawn(async move {
+                if let Err(e) = apply_profile_change(&app_handle, db_path, previous, profiles).await
+                {
+                    eprintln!("Failed to apply the changed index profiles: {}", e);
+                }
+            });
+        }
+    }
+    Ok(())
+}
+
+/// Brings the indexed files whose profile changed in line with the new one: files that no longer embed lose their vectors
+/// right away, and every file whose profile changed is marked out of date so the next rescan indexes it again
+async fn apply_profile_change(
+    app_handle: &AppHandle,
+    db_path: PathBuf,
+    previous: IndexProfiles,
+    profiles: IndexProfiles,
+) -> Result<(), FileProcessorError> {
+    // lets the scheduler know not to start a scan while the rows are changed
+    let control = app_handle.state::<Arc<IndexingControl>>().inner().clone();
+    let _run = control.begin_run(Lane::Background);
+
+    let unembedded = task::spawn_blocking(move || -> Result<Vec<String>, FileProcessorError> {
+        let mut conn = Connection::open(db_path)?;
+        let tx = conn.transaction()?;
+
+        let files = tx
+            .prepare("SELECT id, path FROM files")?
+            .query_map([], |row| {
+                Ok((row.get::<_, i64>(0)?, row.get::<_, String>(1)?))
+            })?
+            .collect::<rusqlite::Result<Vec<_>>>()?;
+
+        let mut unembedded = Vec::new();
+        for (id, path) in files {
+            let before = previous.profile_for(Path::new(&path));
+            let after = profiles.profile_for(Path::new(&path));
+            if before == after {
+                continue;
+            }
+
+            tx.execute(
+                "UPDATE files SET updated_at = '1970-01-01 00:00:00' WHERE id = ?1",
+                [id],
+            )?;
+            if before.embeds_content() && !after.embeds_content() {
+                unembedded.push(id.to_string());
+            }
+        }
+
+        tx.commit()?;
+        Ok(unembedded)
+    })
+    .await
+    .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))??;
+
+    let vectordb = app_handle
+        .state::<Arc<tokio::sync::Mutex<VectorDbManager>>>()
+        .inner()
+        .clone();
+    let manager = vectordb.lock().await;
+    manager
+        .delete_files(&unembedded)
+        .await
+        .map_err(|e| FileProcessorError::Other(e.to_string()))?;
+
+    println!(
+        "Index profiles changed, dropped the vectors of {} files",
+        unembedded.len()
+    );
+    Ok(())
+}
@@ -1,22 +1,22 @@
 use crate::file_processor::{
-    is_valid_file_extension, FileProcessor, FileProcessorError, FileProcessorState,
-    ProcessingStatus,
+    is_skipped_hidden_file, is_valid_file_extension, remove_indexed_files, FileProcessorError,
+    FileProcessorState, ProcessingStatus,
 };
-use crate::vectordb_manager::VectorDbManager;
+use crate::indexing_control::{IndexingControl, Lane};
+use crate::settings::SettingsManagerState;
 use crate::AppResult;
 use notify::{
     Config, Error as NotifyError, Event as NotifyEvent, EventKind, RecommendedWatcher,
     RecursiveMode, Watcher,
 };
 use rusqlite::Connection;
-use std::collections::HashSet;
+use std::collections::{HashMap, HashSet};
 use std::path::{Path, PathBuf};
 use std::sync::{Arc, Mutex};
-use std::time::Duration;
+use std::time::{Duration, Instant};
 use tauri::{AppHandle, Emitter, Listener, Manager};
 use tokio::select;
 use tokio::sync::mpsc::Receiver;
-use tokio::task;
 use tracing::error;
 
 const DEBOUNCE_TIMEOUT_MS: u64 = 1000;
@@ -71,7 +71,7 @@ fn extract_watch_directories_from_db(db_path: &Path) -> Result<HashSet<PathBuf>,
     // extract unique parent directories
     let mut stmt = conn.prepare(
         "
-        SELECT path FROM directories
+        SELECT path FROM directories WHERE path NOT LIKE 'remote://%'
     ",
     )?;
 
@@ -195,6 +195,8 @@ async fn process_combined_events(
 ) {
     let mut pending_reindex: HashSet<PathBuf> = HashSet::new();
     let mut pending_new: HashSet<PathBuf> = HashSet::new();
+    // when each pending path was first seen changing, for the freshness metric
+    let mut first_seen: HashMap<PathBuf, Instant> = HashMap::new();
     let mut debounce_timer = Option::<tokio::time::Sleep>::None;
 
     // Get the DB path from the FileProcessorState
@@ -239,23 +241,35 @@ async fn process_combined_events(
 
                 let mut all_paths_to_process = paths_to_reindex;
                 all_paths_to_process.extend(paths_to_index_new);
+                let seen_at: Vec<Instant> = all_paths_to_process
+                    .iter()
+                    .filter_map(|p| first_seen.remove(p))
+                    .collect();
 
                 if !all_paths_to_process.is_empty() {
                     println!("Debounce finished. Processing changes/additions for: {:?}", all_paths_to_process);
 
                     let processor_state_handle = app_handle.state::<FileProcessorState>();
-                    let maybe_processor_info = {
+                    let maybe_processor = {
                         match processor_state_handle.0.lock() {
-                            Ok(guard) => guard.as_ref().map(|p| (p.db_path.clone(), p.concurrency_limit)),
+                            Ok(guard) => guard.as_ref().cloned(),
                             Err(e) => { error!("Mutex poisoned (debounce processing): {}", e); None }
                         }
                     };
 
-                    if let Some((db_path, concurrency_limit)) = maybe_processor_info {
+                    // changes the user just made go ahead of any scan that is running
+                    let fresh_first = app_handle
+                        .state::<SettingsManagerState>()
+                        .0
+                        .get_settings()
+                        .map(|settings| settings.index_fresh_first.unwrap_or(true))
+                        .unwrap_or(true);
+                    let lane = if fresh_first { Lane::Fresh } else { Lane::Background };
+
+                    if let Some(processor) = maybe_processor {
                         let app_handle_clone = app_handle.clone();
 
                         tokio::spawn(async move {
-                            let processor = FileProcessor { db_path, concurrency_limit };
                             let progress_handler = move |_status: ProcessingStatus| { /* do nothing */ };
                             let paths_str: Vec<String> = all_paths_to_process
                                 .iter()
@@ -263,13 +277,18 @@ async fn process_combined_events(
                                 .collect();
 
                             println!("the path str in the events: {:?}", paths_str);
-                            match processor.process_paths(
+                            match processor.rescan_paths(
                                 paths_str.clone(),
                                 progress_handler,
                                 app_handle_clone.clone(),
+                                lane,
                             ).await {
                                 Ok(_) => {
                                     println!("Successfully processed batch: {:?}", all_paths_to_process);
+                                    let control = app_handle_clone.state::<Arc<IndexingControl>>();
+                                    for seen in &seen_at {
+                                        control.record_freshness(seen.elapsed());
+                                    }
                                     if let Err(e) = app_handle_clone.emit("files-updated", ()) {
                                         error!("Failed to emit files-updaede event: {}", e);
                                     } else{
@@ -315,6 +334,10 @@ async fn process_combined_events(
                                 }
                             }).await.unwrap_or(false);
 
+                            if !matches!(event.kind, EventKind::Remove(_)) {
+                                first_seen.entry(path_clone.clone()).or_insert_with(Instant::now);
+                            }
+
                             match event.kind {
                                 EventKind::Create(_) => {
                                     if !is_indexed {
@@ -331,6 +354,7 @@ async fn process_combined_events(
                                     }
                                 },
                                 EventKind::Remove(_) => {
+                                    first_seen.remove(&path_clone);
                                     if is_indexed {
                                         pending_reindex.remove(&path_clone);
                                         pending_new.remove(&path_clone);
@@ -343,7 +367,7 @@ async fn process_combined_events(
 
                                         tokio::spawn(async move {
                                             if let Err(e) = remove_file_from_index(
-                                                path_string.clone(), db_path_clone,
+                                                &app_handle_clone, path_string.clone(), db_path_clone,
                                             ).await {
                                                 error!("Failed removal process for {}: {:?}", path_string, e);
                                             } else {
@@ -436,47 +460,16 @@ async fn process_combined_events(
 } // end process_combined_events
 
 async fn remove_file_from_index(
+    app_handle: &AppHandle,
     file_path: String,
     db_path: PathBuf,
 ) -> Result<(), FileProcessorError> {
-    let file_path_clone_log = file_path.clone();
-
-    let db_result = task::spawn_blocking(move || -> Result<bool, FileProcessorError> {
-        let mut conn = Connection::open(db_path)?;
-        let tx = conn.transaction()?;
-
-        let file_id: Option<i64> = tx
-            .query_row(
-                "SELECT id FROM files WHERE path = ?1",
-                [&file_path],
-                |row| row.get(0),
-            )
-            .ok();
-
-        let mut deleted_from_sqlite = false;
-        if let Some(id) = file_id {
-            tx.execute("DELETE FROM files_fts WHERE rowid = ?1", [id])?;
-            let files_deleted_count = tx.execute("DELETE FROM files WHERE id = ?1", [id])?;
-            deleted_from_sqlite = files_deleted_count > 0;
-        }
+    let removed = remove_indexed_files(app_handle, db_path, vec![file_path.clone()]).await?;
 
-        tx.commit()?;
-        Ok(deleted_from_sqlite)
-    })
-    .await
-    .map_err(|e| FileProcessorError::Other(format!("spawn_blocking JoinError: {e}")))?;
-
-    let was_deleted_from_sqlite = db_result?;
-
-    if was_deleted_from_sqlite {
-        // Handle vector DB deletion if needed
-        // VectorDbManager::delete_embedding(file_path);
-        println!(
-            "Successfully removed file {} from index",
-            file_path_clone_log
-        );
+    if removed > 0 {
+        println!("Successfully removed file {} from index", file_path);
     } else {
-        println!("File {} was not found in the database", file_path_clone_log);
+        println!("File {} was not found in the database", file_path);
     }
 
     Ok(())
@@ -745,10 +738,10 @@ async fn remove_file_from_index(
 // }
 
 fn is_relevant_file_event(event: &NotifyEvent, path: &Path) -> bool {
-    // Skip temporary files and hidden files
+    // Skip temporary files and the hidden files a scan leaves out
     if let Some(file_name) = path.file_name() {
         let file_name_str = file_name.to_string_lossy();
-        if file_name_str.starts_with('.')
+        if is_skipped_hidden_file(path)
             || file_name_str.ends_with('~')
             || file_name_str.starts_with('#')
             || file_name_str.contains(".tmp")
@@ -0,0 +1,561 @@
+/*
+This file contains the index health report: how much of the index is stale, which files were indexed without any content, how many files in the indexed folders
+kita can't read, how many PDFs are scans without a text layer and how much space the databases waste. Each problem comes with a recommendation the UI can nudge the
+user with. The report is made once a day in the background and kept, `get_index_health` returns the latest one and `kita status` prints it
+*/
+
+use rusqlite::{params, Connection, OptionalExtension};
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::{Duration, UNIX_EPOCH};
+use tauri::{AppHandle, Emitter, Manager, State};
+use thiserror::Error;
+use tokio::sync::Mutex;
+use tokio::task;
+use walkdir::WalkDir;
+
+use crate::file_processor::{get_processor, is_valid_file_extension, FileProcessorState};
+use crate::index_profiles::IndexProfiles;
+use crate::platform;
+use crate::storage_budget;
+use crate::thumbnails;
+use crate::vectordb_manager::VectorDbManager;
+use crate::AppResult;
+
+/// The first report waits until startup indexing had a chance to run
+const FIRST_REPORT_DELAY_SECS: u64 = 10 * 60;
+const REPORT_INTERVAL_SECS: u64 = 24 * 60 * 60;
+/// Older reports are dropped when a new one is stored
+const MAX_REPORTS: usize = 30;
+/// Paths listed with a recommendation, the rest are only counted
+const MAX_EXAMPLES: usize = 5;
+/// Extensions listed in the unsupported formats recommendation
+const MAX_LISTED_EXTENSIONS: usize = 5;
+
+/// Percentages above which a recommendation is made
+const STALE_THRESHOLD: f32 = 5.0;
+const FAILED_THRESHOLD: f32 = 2.0;
+const UNSUPPORTED_THRESHOLD: f32 = 10.0;
+const BLOAT_THRESHOLD: f32 = 20.0;
+
+#[derive(Error, Debug)]
+pub enum HealthError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Vector DB error: {0}")]
+    VectorDb(String),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = HealthError> = std::result::Result<T, E>;
+
+/// `count` of `total` files have a problem
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct HealthMetric {
+    pub count: usize,
+    pub total: usize,
+    pub percent: f32,
+}
+
+impl HealthMetric {
+    fn new(count: usize, total: usize) -> Self {
+        let percent = if total == 0 {
+            0.0
+        } else {
+            count as f32 * 100.0 / total as f32
+        };
+        Self {
+            count,
+            total,
+            percent,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct StorageBloat {
+    pub sqlite_bytes: u64,
+    /// Pages SQLite freed and keeps around until a vacuum
+    pub sqlite_free_bytes: u64,
+    pub vector_bytes: u64,
+    /// Vectors of files that are no longer indexed
+    pub orphaned_files: usize,
+    pub percent: f32,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Recommendation {
+    /// rescan, reindex, unsupported, ocr or maintenance
+    pub kind: String,
+    pub message: String,
+    pub affected: usize,
+    /// A few of the affected paths
+    pub examples: Vec<String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct HealthReport {
+    /// 0 to 100
+    pub score: u8,
+    pub indexed_files: usize,
+    /// Files that changed or were removed since they were indexed
+    pub stale: HealthMetric,
+    /// Files with readable content that were indexed without any
+    pub failed_extraction: HealthMetric,
+    /// Files in the indexed folders kita doesn't index
+    pub unsupported_format: HealthMetric,
+    /// PDFs without a text layer
+    pub scanned_pdfs: HealthMetric,
+    pub bloat: StorageBloat,
+    pub recommendations: Vec<Recommendation>,
+    /// UTC, set when the report is stored
+    #[serde(default)]
+    pub generated_at: Option<String>,
+}
+
+/// An indexed file as far as the report is concerned
+struct IndexedFile {
+    id: i64,
+    path: String,
+    extension: String,
+    size: i64,
+    /// When it was indexed, unix seconds
+    indexed_at: Option<i64>,
+}
+
+/// What the checks found, before it is turned into percentages
+#[derive(Default)]
+struct Findings {
+    stale: Vec<String>,
+    without_content: Vec<String>,
+    content_expected: usize,
+    scanned_pdfs: Vec<String>,
+    pdfs: usize,
+    unsupported: Vec<String>,
+    unsupported_extensions: HashMap<String, usize>,
+    folder_files: usize,
+}
+
+/// Makes a report in the background once a day
+pub fn init_health(app: &tauri::App) -> AppResult<()> {
+    let app_handle = app.app_handle().clone();
+    tauri::async_runtime::spawn(async move {
+        tokio::time::sleep(Duration::from_secs(FIRST_REPORT_DELAY_SECS)).await;
+
+        let mut ticker = tokio::time::interval(Duration::from_secs(REPORT_INTERVAL_SECS));
+        loop {
+            ticker.tick().await;
+            match refresh_report(&app_handle).await {
+                Ok(report) => {
+                    let _ = app_handle.emit("index-health", &report);
+                }
+                Err(e) => eprintln!("Failed to make the index health report: {}", e),
+            }
+        }
+    });
+
+    Ok(())
+}
+
+/// Makes a new report and stores it
+async fn refresh_report(app_handle: &AppHandle) -> Result<HealthReport> {
+    let state = app_handle.state::<FileProcessorState>();
+    let processor = get_processor(&state).map_err(HealthError::Other)?;
+    let db_path = processor.db_path;
+    let profiles = processor.profiles;
+    let vectordb_path = app_handle
+        .path()
+        .app_data_dir()
+        .map(|dir| dir.join("vector_db"))
+        .map_err(|_| HealthError::Other("Failed to get app data directory".into()))?;
+
+    let vectordb = app_handle
+        .state::<Arc<Mutex<VectorDbManager>>>()
+        .inner()
+        .clone();
+    let embedded: HashSet<String> = vectordb
+        .lock()
+        .await
+        .file_ids()
+        .await
+        .map_err(|e| HealthError::VectorDb(e.to_string()))?
+        .into_iter()
+        .collect();
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&db_path)?;
+        let report = build_report(&conn, &embedded, &profiles, &vectordb_path)?;
+        save_report(&conn, &report)?;
+        Ok(report)
+    })
+    .await
+    .map_err(|e| HealthError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+fn build_report(
+    conn: &Connection,
+    embedded: &HashSet<String>,
+    profiles: &IndexProfiles,
+    vectordb_path: &Path,
+) -> Result<HealthReport> {
+    let files = indexed_files(conn)?;
+    let evicted = storage_budget::evicted_file_ids(conn)
+        .map_err(|e| HealthError::Other(format!("Failed to read evicted files: {}", e)))?;
+    let mut findings = Findings::default();
+
+    for file in &files {
+        // items from connectors have no local file to check
+        let path = Path::new(&file.path);
+        if !path.is_absolute() {
+            continue;
+        }
+        if is_stale(path, file.indexed_at) {
+            findings.stale.push(file.path.clone());
+        }
+
+        // empty files, images and files under roots whose profile doesn't embed are stored without content on purpose
+        if file.size <= 0
+            || thumbnails::is_image_extension(&file.extension)
+            || !profiles.profile_for(path).embeds_content()
+        {
+            continue;
+        }
+        // evicted files lost their content to the storage budget, not to a failed extraction
+        let file_id = file.id.to_string();
+        if evicted.contains(&file_id) {
+            continue;
+        }
+        let has_content = embedded.contains(&file_id);
+        if file.extension.eq_ignore_ascii_case("pdf") {
+            findings.pdfs += 1;
+            // pdf-extract finds no text in PDFs that are only scanned images
+            if !has_content {
+                findings.scanned_pdfs.push(file.path.clone());
+            }
+        } else {
+            findings.content_expected += 1;
+            if !has_content {
+                findings.without_content.push(file.path.clone());
+            }
+        }
+    }
+
+    for directory in indexed_directories(conn)? {
+        scan_folder(Path::new(&directory), &mut findings);
+    }
+
+    let indexed_ids: HashSet<String> = files.iter().map(|file| file.id.to_string()).collect();
+    let bloat = storage_bloat(
+        conn,
+        vectordb_path,
+        embedded.difference(&indexed_ids).count(),
+        embedded.len(),
+    )?;
+
+    let stale = HealthMetric::new(findings.stale.len(), files.len());
+    let failed_extraction =
+        HealthMetric::new(findings.without_content.len(), findings.content_expected);
+    let unsupported_format = HealthMetric::new(findings.unsupported.len(), findings.folder_files);
+    let scanned_pdfs = HealthMetric::new(findings.scanned_pdfs.len(), findings.pdfs);
+
+    let penalty = stale.percent * 0.3
+        + failed_extraction.percent * 0.25
+        + unsupported_format.percent * 0.15
+        + scanned_pdfs.percent * 0.15
+        + bloat.percent * 0.15;
+    let score = (100.0 - penalty).clamp(0.0, 100.0).round() as u8;
+
+    let recommendations = recommend(
+        &findings,
+        &stale,
+        &failed_extraction,
+        &unsupported_format,
+        &bloat,
+    );
+
+    Ok(HealthReport {
+        score,
+        indexed_files: files.len(),
+        stale,
+        failed_extraction,
+        unsupported_format,
+        scanned_pdfs,
+        bloat,
+        recommendations,
+        generated_at: None,
+    })
+}
+
+fn indexed_files(conn: &Connection) -> Result<Vec<IndexedFile>> {
+    let mut stmt = conn.prepare(
+        "SELECT id, path, extension, size, CAST(strftime('%s', updated_at) AS INTEGER) FROM files",
+    )?;
+
+    let files = stmt
+        .query_map([], |row| {
+            Ok(IndexedFile {
+                id: row.get(0)?,
+                path: row.get(1)?,
+                extension: row.get::<_, Option<String>>(2)?.unwrap_or_default(),
+                size: row.get::<_, Option<i64>>(3)?.unwrap_or(0),
+                indexed_at: row.get(4)?,
+            })
+        })?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+
+    Ok(files)
+}
+
+fn indexed_directories(conn: &Connection) -> Result<Vec<String>> {
+    let mut stmt = conn.prepare("SELECT path FROM directories")?;
+    let directories = stmt
+        .query_map([], |row| row.get(0))?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+
+    Ok(directories)
+}
+
+/// Removed, or modified after it was indexed
+fn is_stale(path: &Path, indexed_at: Option<i64>) -> bool {
+    let Ok(metadata) = std::fs::metadata(path) else {
+        return true;
+    };
+
+    let modified_at = metadata
+        .modified()
+        .ok()
+        .and_then(|time| time.duration_since(UNIX_EPOCH).ok())
+        .map(|duration| duration.as_secs() as i64);
+    match (modified_at, indexed_at) {
+        (Some(modified_at), Some(indexed_at)) => modified_at > indexed_at,
+        _ => false,
+    }
+}
+
+/// Counts the files right in an indexed folder and the ones kita skips, subfolders are indexed folders of their own
+fn scan_folder(directory: &Path, findings: &mut Findings) {
+    let entries = WalkDir::new(directory)
+        .min_depth(1)
+        .max_depth(1)
+        .into_iter()
+        .filter_map(|entry| entry.ok())
+        .filter(|entry| entry.file_type().is_file());
+
+    for entry in entries {
+        if platform::is_hidden(entry.path()) {
+            continue;
+        }
+
+        findings.folder_files += 1;
+        if !is_valid_file_extension(entry.path()) {
+            let extension = entry
+                .path()
+                .extension()
+                .map(|ext| ext.to_string_lossy().to_lowercase())
+                .unwrap_or_default();
+            *findings
+                .unsupported_extensions
+                .entry(extension)
+                .or_default() += 1;
+            findings
+                .unsupported
+                .push(entry.path().to_string_lossy().into_owned());
+        }
+    }
+}
+
+/// Free SQLite pages and vectors of files that are gone, as a share of what is stored
+fn storage_bloat(
+    conn: &Connection,
+    vectordb_path: &Path,
+    orphaned_files: usize,
+    embedded_files: usize,
+) -> Result<StorageBloat> {
+    let page_size: i64 = conn.query_row("PRAGMA page_size", [], |row| row.get(0))?;
+    let page_count: i64 = conn.query_row("PRAGMA page_count", [], |row| row.get(0))?;
+    let free_pages: i64 = conn.query_row("PRAGMA freelist_count", [], |row| row.get(0))?;
+
+    let sqlite_bytes = (page_size * page_count).max(0) as u64;
+    let sqlite_free_bytes = (page_size * free_pages).max(0) as u64;
+    let vector_bytes: u64 = WalkDir::new(vectordb_path)
+        .into_iter()
+        .filter_map(|entry| entry.ok())
+        .filter(|entry| entry.file_type().is_file())
+        .filter_map(|entry| entry.metadata().ok())
+        .map(|metadata| metadata.len())
+        .sum();
+
+    let sqlite_share = if sqlite_bytes == 0 {
+        0.0
+    } else {
+        sqlite_free_bytes as f32 / sqlite_bytes as f32
+    };
+    let vector_share = if embedded_files == 0 {
+        0.0
+    } else {
+        orphaned_files as f32 / embedded_files as f32
+    };
+
+    Ok(StorageBloat {
+        sqlite_bytes,
+        sqlite_free_bytes,
+        vector_bytes,
+        orphaned_files,
+        percent: sqlite_share.max(vector_share) * 100.0,
+    })
+}
+
+fn recommend(
+    findings: &Findings,
+    stale: &HealthMetric,
+    failed_extraction: &HealthMetric,
+    unsupported_format: &HealthMetric,
+    bloat: &StorageBloat,
+) -> Vec<Recommendation> {
+    let examples = |paths: &[String]| paths.iter().take(MAX_EXAMPLES).cloned().collect();
+    let mut recommendations = Vec::new();
+
+    if stale.percent > STALE_THRESHOLD {
+        recommendations.push(Recommendation {
+            kind: "rescan".to_string(),
+            message: format!(
+                "{} indexed files changed or were removed since they were indexed, rescan their folders or add a rescan schedule",
+                stale.count
+            ),
+            affected: stale.count,
+            examples: examples(&findings.stale),
+        });
+    }
+
+    if failed_extraction.percent > FAILED_THRESHOLD {
+        recommendations.push(Recommendation {
+            kind: "reindex".to_string(),
+            message: format!(
+                "{} files were indexed without their content and only match by name, index them again and check kita status for errors",
+                failed_extraction.count
+            ),
+            affected: failed_extraction.count,
+            examples: examples(&findings.without_content),
+        });
+    }
+
+    if unsupported_format.percent > UNSUPPORTED_THRESHOLD {
+        let mut extensions: Vec<(&String, &usize)> =
+            findings.unsupported_extensions.iter().collect();
+        extensions.sort_by(|a, b| b.1.cmp(a.1).then(a.0.cmp(b.0)));
+        let listed: Vec<String> = extensions
+            .iter()
+            .take(MAX_LISTED_EXTENSIONS)
+            .map(|(extension, count)| match extension.as_str() {
+                "" => format!("no extension ({})", count),
+                extension => format!(".{} ({})", extension, count),
+            })
+            .collect();
+
+        recommendations.push(Recommendation {
+            kind: "unsupported".to_string(),
+            message: format!(
+                "{} files in your indexed folders are in formats kita can't read and can't be found: {}",
+                unsupported_format.count,
+                listed.join(", ")
+            ),
+            affected: unsupported_format.count,
+            examples: examples(&findings.unsupported),
+        });
+    }
+
+    if !findings.scanned_pdfs.is_empty() {
+        recommendations.push(Recommendation {
+            kind: "ocr".to_string(),
+            message: format!(
+                "{} PDFs are scans without a text layer, run them through OCR to make their content searchable",
+                findings.scanned_pdfs.len()
+            ),
+            affected: findings.scanned_pdfs.len(),
+            examples: examples(&findings.scanned_pdfs),
+        });
+    }
+
+    if bloat.percent > BLOAT_THRESHOLD {
+        recommendations.push(Recommendation {
+            kind: "maintenance".to_string(),
+            message: format!(
+                "{:.0}% of the index is wasted space, run database maintenance to reclaim it",
+                bloat.percent
+            ),
+            affected: bloat.orphaned_files,
+            examples: Vec::new(),
+        });
+    }
+
+    recommendations
+}
+
+fn save_report(conn: &Connection, report: &HealthReport) -> Result<()> {
+    let json = serde_json::to_string(report)
+        .map_err(|e| HealthError::Other(format!("Failed to serialize report: {}", e)))?;
+
+    conn.execute("INSERT INTO health_reports (report) VALUES (?1)", [json])?;
+    conn.execute(
+        "DELETE FROM health_reports WHERE id NOT IN (SELECT id FROM health_reports ORDER BY id DESC LIMIT ?1)",
+        params![MAX_REPORTS as i64],
+    )?;
+
+    Ok(())
+}
+
+/// The latest stored report, None before the first one was made
+pub fn latest_report(conn: &Connection) -> Result<Option<HealthReport>> {
+    let row: Option<(String, String)> = conn
+        .query_row(
+            "SELECT report, created_at FROM health_reports ORDER BY id DESC LIMIT 1",
+            [],
+            |row| Ok((row.get(0)?, row.get(1)?)),
+        )
+        .optional()?;
+
+    let Some((json, created_at)) = row else {
+        return Ok(None);
+    };
+    let mut report: HealthReport = serde_json::from_str(&json)
+        .map_err(|e| HealthError::Other(format!("Failed to read report: {}", e)))?;
+    report.generated_at = Some(created_at);
+
+    Ok(Some(report))
+}
+
+/// The latest report, made right away with refresh=true or when there is none yet
+#[tauri::command]
+pub async fn get_index_health(
+    refresh: Option<bool>,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> std::result::Result<HealthReport, String> {
+    let processor = get_processor(&state)?;
+
+    if !refresh.unwrap_or(false) {
+        let db_path: PathBuf = processor.db_path.clone();
+        let latest = task::spawn_blocking(move || {
+            let conn = Connection::open(&db_path)?;
+            latest_report(&conn)
+        })
+        .await
+        .map_err(|e| format!("spawn_blocking error: {e}"))?
+        .map_err(|e| format!("Failed to read the index health: {}", e))?;
+
+        if let Some(report) = latest {
+            return Ok(report);
+        }
+    }
+
+    refresh_report(&app_handle)
+        .await
+        .map_err(|e| format!("Failed to check the index health: {}", e))
+}
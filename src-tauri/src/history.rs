@@ -0,0 +1,469 @@
+/*
+This file contains the bounded version history of indexed files. Before a changed file is re-indexed its previous text and a summary embedding are kept as a version,
+which allows queries like "the version of this report from before March" and showing what changed between indexed versions
+*/
+
+use rusqlite::{params, Connection, OptionalExtension};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use similar::{ChangeTag, TextDiff};
+use std::path::PathBuf;
+use std::sync::Arc;
+use tauri::{AppHandle, Manager, State};
+use thiserror::Error;
+use tokio::task;
+
+use crate::embedder::Embedder;
+use crate::encryption::{self, EncryptionError};
+use crate::file_processor::{get_processor, FileProcessorState};
+use crate::settings::SettingsManagerState;
+use crate::vectordb_manager::VectorDbManager;
+
+const DEFAULT_MAX_VERSIONS: usize = 5;
+const DEFAULT_SEARCH_LIMIT: usize = 10;
+const SNIPPET_CHARS: usize = 300;
+const VERSION_COLUMNS: &str = "version, path, size, content_hash, indexed_at, replaced_at";
+
+#[derive(Error, Debug)]
+pub enum HistoryError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Vector DB error: {0}")]
+    VectorDb(String),
+
+    #[error("Not found: {0}")]
+    NotFound(String),
+
+    #[error("Encryption error: {0}")]
+    Encryption(#[from] EncryptionError),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = HistoryError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct FileVersion {
+    pub version: i64,
+    pub path: String,
+    pub size: i64,
+    pub content_hash: String,
+    /// When this version was indexed
+    pub indexed_at: String,
+    /// When a newer version replaced it
+    pub replaced_at: String,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct VersionMatch {
+    pub version: FileVersion,
+    pub similarity: f32,
+    pub snippet: String,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DiffChange {
+    /// "equal", "insert" or "delete"
+    pub tag: String,
+    pub text: String,
+}
+
+/// A file's state captured right before it is re-indexed
+struct VersionSnapshot {
+    path: String,
+    size: i64,
+    indexed_at: String,
+    text: String,
+    embedding: Vec<f32>,
+}
+
+/// Stores the currently indexed state of the given files as versions before they are replaced.
+/// Files that aren't indexed yet are ignored
+pub async fn record_versions(
+    app_handle: &AppHandle,
+    db_path: PathBuf,
+    paths: &[String],
+) -> Result<usize> {
+    let max_versions = app_handle
+        .state::<SettingsManagerState>()
+        .0
+        .get_settings()
+        .ok()
+        .and_then(|s| s.history_max_versions)
+        .unwrap_or(DEFAULT_MAX_VERSIONS);
+
+    if max_versions == 0 || paths.is_empty() {
+        return Ok(0);
+    }
+
+    let read_path = db_path.clone();
+    let lookup_paths = paths.to_vec();
+    let indexed = task::spawn_blocking(move || -> Result<Vec<(i64, String, i64, String)>> {
+        let conn = Connection::open(read_path)?;
+        let mut stmt =
+            conn.prepare("SELECT id, path, size, updated_at FROM files WHERE path = ?1")?;
+
+        let mut rows = Vec::new();
+        for path in &lookup_paths {
+            if let Some(row) = stmt
+                .query_row([path], |row| {
+                    Ok((row.get(0)?, row.get(1)?, row.get(2)?, row.get(3)?))
+                })
+                .optional()?
+            {
+                rows.push(row);
+            }
+        }
+        Ok(rows)
+    })
+    .await
+    .map_err(|e| HistoryError::Other(format!("spawn_blocking error: {e}")))??;
+
+    let mut snapshots = Vec::new();
+    for (file_id, path, size, indexed_at) in indexed {
+        let chunks = VectorDbManager::get_chunks_for_file(app_handle, &file_id.to_string())
+            .await
+            .map_err(|e| HistoryError::VectorDb(e.to_string()))?;
+
+        if chunks.is_empty() {
+            continue;
+        }
+
+        let text = chunks
+            .iter()
+            .map(|c| c.text.as_str())
+            .collect::<Vec<_>>()
+            .join("\n");
+        let embedding = mean_embedding(chunks.iter().map(|c| c.embedding.as_slice()));
+
+        snapshots.push(VersionSnapshot {
+            path,
+            size,
+            indexed_at,
+            text,
+            embedding,
+        });
+    }
+
+    task::spawn_blocking(move || save_versions(&db_path, snapshots, max_versions))
+        .await
+        .map_err(|e| HistoryError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+fn save_versions(
+    db_path: &PathBuf,
+    snapshots: Vec<VersionSnapshot>,
+    max_versions: usize,
+) -> Result<usize> {
+    let mut conn = Connection::open(db_path)?;
+    let tx = conn.transaction()?;
+    let mut saved = 0;
+
+    for snapshot in snapshots {
+        let content_hash = format!("{:x}", Sha256::digest(snapshot.text.as_bytes()));
+
+        // metadata changes without a content change don't make a new version
+        let latest_hash: Option<String> = tx
+            .query_row(
+                "SELECT content_hash FROM file_versions WHERE path = ?1 ORDER BY version DESC LIMIT 1",
+                [&snapshot.path],
+                |row| row.get(0),
+            )
+            .optional()?;
+        if latest_hash.as_deref() == Some(content_hash.as_str()) {
+            continue;
+        }
+
+        tx.execute(
+            r#"
+            INSERT INTO file_versions (path, version, size, content_hash, text, embedding, indexed_at)
+            VALUES (?1, COALESCE((SELECT MAX(version) FROM file_versions WHERE path = ?1), 0) + 1, ?2, ?3, ?4, ?5, ?6)
+            "#,
+            params![
+                snapshot.path,
+                snapshot.size,
+                content_hash,
+                encryption::seal_text(&snapshot.text)?,
+                encryption::seal_bytes(&embedding_to_blob(&snapshot.embedding))?,
+                snapshot.indexed_at
+            ],
+        )?;
+
+        // keep the history bounded
+        tx.execute(
+            r#"
+            DELETE FROM file_versions
+            WHERE path = ?1 AND version NOT IN (
+                SELECT version FROM file_versions WHERE path = ?1 ORDER BY version DESC LIMIT ?2
+            )
+            "#,
+            params![snapshot.path, max_versions as i64],
+        )?;
+
+        saved += 1;
+    }
+
+    tx.commit()?;
+    Ok(saved)
+}
+
+fn row_to_version(row: &rusqlite::Row) -> rusqlite::Result<FileVersion> {
+    Ok(FileVersion {
+        version: row.get(0)?,
+        path: row.get(1)?,
+        size: row.get(2)?,
+        content_hash: row.get(3)?,
+        indexed_at: row.get(4)?,
+        replaced_at: row.get(5)?,
+    })
+}
+
+pub fn list_versions(conn: &Connection, path: &str) -> Result<Vec<FileVersion>> {
+    let mut stmt = conn.prepare(&format!(
+        "SELECT {} FROM file_versions WHERE path = ?1 ORDER BY version DESC",
+        VERSION_COLUMNS
+    ))?;
+    let versions = stmt
+        .query_map([path], row_to_version)?
+        .collect::<std::result::Result<Vec<_>, _>>()?;
+
+    Ok(versions)
+}
+
+/// Semantic search over the stored versions. `before` and `after` are dates like "2024-03-01"
+/// and are compared against the time each version was indexed
+pub fn search_versions(
+    conn: &Connection,
+    query_embedding: &[f32],
+    path: Option<&str>,
+    before: Option<&str>,
+    after: Option<&str>,
+    limit: usize,
+) -> Result<Vec<VersionMatch>> {
+    let mut stmt = conn.prepare(&format!(
+        r#"
+        SELECT {}, text, embedding
+        FROM file_versions
+        WHERE (?1 IS NULL OR path = ?1)
+          AND (?2 IS NULL OR indexed_at < datetime(?2))
+          AND (?3 IS NULL OR indexed_at >= datetime(?3))
+        "#,
+        VERSION_COLUMNS
+    ))?;
+
+    let mut matches = stmt
+        .query_map(params![path, before, after], |row| {
+            let version = row_to_version(row)?;
+            let text: String = row.get(6)?;
+            let embedding: Vec<u8> = row.get(7)?;
+            Ok((version, text, embedding))
+        })?
+        .filter_map(|row| row.ok())
+        .filter_map(|(version, text, embedding)| {
+            // versions that can't be decrypted are left out
+            let text = encryption::open_text(&text).ok()?;
+            let embedding = encryption::open_bytes(&embedding).ok()?;
+            Some(VersionMatch {
+                version,
+                similarity: cosine_similarity(query_embedding, &blob_to_embedding(&embedding)),
+                snippet: text.chars().take(SNIPPET_CHARS).collect(),
+            })
+        })
+        .collect::<Vec<_>>();
+
+    matches.sort_by(|a, b| b.similarity.total_cmp(&a.similarity));
+    matches.truncate(limit);
+
+    Ok(matches)
+}
+
+fn version_text(conn: &Connection, path: &str, version: i64) -> Result<String> {
+    let text: String = conn
+        .query_row(
+            "SELECT text FROM file_versions WHERE path = ?1 AND version = ?2",
+            params![path, version],
+            |row| row.get(0),
+        )
+        .optional()?
+        .ok_or_else(|| HistoryError::NotFound(format!("version {} of {}", version, path)))?;
+
+    Ok(encryption::open_text(&text)?)
+}
+
+/// Text of the currently indexed version of a file
+async fn current_text(app_handle: &AppHandle, db_path: PathBuf, path: String) -> Result<String> {
+    let file_id: i64 = task::spawn_blocking(move || -> Result<i64> {
+        let conn = Connection::open(db_path)?;
+        conn.query_row("SELECT id FROM files WHERE path = ?1", [&path], |row| {
+            row.get(0)
+        })
+        .optional()?
+        .ok_or_else(|| HistoryError::NotFound(format!("file {}", path)))
+    })
+    .await
+    .map_err(|e| HistoryError::Other(format!("spawn_blocking error: {e}")))??;
+
+    let chunks = VectorDbManager::get_chunks_for_file(app_handle, &file_id.to_string())
+        .await
+        .map_err(|e| HistoryError::VectorDb(e.to_string()))?;
+
+    Ok(chunks
+        .iter()
+        .map(|c| c.text.as_str())
+        .collect::<Vec<_>>()
+        .join("\n"))
+}
+
+/// Word level diff, with consecutive changes of the same kind merged
+pub fn diff_texts(old: &str, new: &str) -> Vec<DiffChange> {
+    let diff = TextDiff::from_words(old, new);
+    let mut changes: Vec<DiffChange> = Vec::new();
+
+    for change in diff.iter_all_changes() {
+        let tag = match change.tag() {
+            ChangeTag::Equal => "equal",
+            ChangeTag::Insert => "insert",
+            ChangeTag::Delete => "delete",
+        };
+
+        match changes.last_mut() {
+            Some(last) if last.tag == tag => last.text.push_str(change.value()),
+            _ => changes.push(DiffChange {
+                tag: tag.to_string(),
+                text: change.value().to_string(),
+            }),
+        }
+    }
+
+    changes
+}
+
+fn mean_embedding<'a>(embeddings: impl Iterator<Item = &'a [f32]>) -> Vec<f32> {
+    let mut sum: Vec<f32> = Vec::new();
+    let mut count = 0;
+
+    for embedding in embeddings {
+        if sum.is_empty() {
+            sum = vec![0.0; embedding.len()];
+        }
+        for (s, v) in sum.iter_mut().zip(embedding) {
+            *s += v;
+        }
+        count += 1;
+    }
+
+    if count > 0 {
+        sum.iter_mut().for_each(|s| *s /= count as f32);
+    }
+    sum
+}
+
+pub fn cosine_similarity(a: &[f32], b: &[f32]) -> f32 {
+    let dot: f32 = a.iter().zip(b).map(|(x, y)| x * y).sum();
+    let norm_a: f32 = a.iter().map(|x| x * x).sum::<f32>().sqrt();
+    let norm_b: f32 = b.iter().map(|x| x * x).sum::<f32>().sqrt();
+
+    if norm_a == 0.0 || norm_b == 0.0 {
+        0.0
+    } else {
+        dot / (norm_a * norm_b)
+    }
+}
+
+fn embedding_to_blob(embedding: &[f32]) -> Vec<u8> {
+    embedding.iter().flat_map(|v| v.to_le_bytes()).collect()
+}
+
+fn blob_to_embedding(blob: &[u8]) -> Vec<f32> {
+    blob.chunks_exact(4)
+        .map(|b| f32::from_le_bytes([b[0], b[1], b[2], b[3]]))
+        .collect()
+}
+
+#[tauri::command]
+pub async fn get_file_history(
+    path: String,
+    state: State<'_, FileProcessorState>,
+) -> std::result::Result<Vec<FileVersion>, String> {
+    let processor = get_processor(&state)?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        list_versions(&conn, &path)
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to get file history: {}", e))
+}
+
+#[tauri::command]
+pub async fn search_file_history(
+    query: String,
+    path: Option<String>,
+    before: Option<String>,
+    after: Option<String>,
+    limit: Option<usize>,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> std::result::Result<Vec<VersionMatch>, String> {
+    let processor = get_processor(&state)?;
+
+    let embedder = Arc::clone(app_handle.state::<Arc<Embedder>>().inner());
+    let query_embedding = embedder.embed_single_text(&query).await;
+    if query_embedding.is_empty() {
+        return Err("Failed to embed query".to_string());
+    }
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        search_versions(
+            &conn,
+            &query_embedding,
+            path.as_deref(),
+            before.as_deref(),
+            after.as_deref(),
+            limit.unwrap_or(DEFAULT_SEARCH_LIMIT),
+        )
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to search file history: {}", e))
+}
+
+/// Diffs two versions of a file. Without `to_version` the diff is against the currently indexed version
+#[tauri::command]
+pub async fn diff_file_versions(
+    path: String,
+    from_version: i64,
+    to_version: Option<i64>,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> std::result::Result<Vec<DiffChange>, String> {
+    let processor = get_processor(&state)?;
+
+    let db_path = processor.db_path.clone();
+    let version_path = path.clone();
+    let (old, new) = task::spawn_blocking(move || -> Result<(String, Option<String>)> {
+        let conn = Connection::open(&db_path)?;
+        let old = version_text(&conn, &version_path, from_version)?;
+        let new = match to_version {
+            Some(version) => Some(version_text(&conn, &version_path, version)?),
+            None => None,
+        };
+        Ok((old, new))
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to read version: {}", e))?;
+
+    let new = match new {
+        Some(text) => text,
+        None => current_text(&app_handle, processor.db_path, path)
+            .await
+            .map_err(|e| format!("Failed to read current version: {}", e))?,
+    };
+
+    Ok(diff_texts(&old, &new))
+}
@@ -0,0 +1,60 @@
+/*
+This file contains the icons that come with search results when include_icons is set, so the UI can render a rich result row without a call per result. Every result
+gets the name of its file type icon, images and PDFs come with the thumbnail made when they were indexed (see thumbnails.rs) and applications with their app icon,
+both as data URLs. App icons are slow to extract, they are kept for the session once they were resolved
+*/
+
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::{Mutex, OnceLock};
+
+use crate::platform;
+use crate::utils::get_category_from_extension;
+
+/// Extensions of the files that are applications, their icon is extracted instead of drawn from the file type
+const APP_EXTENSIONS: &[&str] = &["app", "desktop", "exe", "lnk"];
+
+static APP_ICONS: OnceLock<Mutex<HashMap<String, Option<String>>>> = OnceLock::new();
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct ResultIcon {
+    /// File type icon the UI draws: document, spreadsheet, presentation, image, audio, video, archive, code, executable or other
+    pub file_type: String,
+    /// data: URL of a preview of the file, for images and PDFs
+    pub thumbnail: Option<String>,
+    /// data: URL of the app icon, for applications
+    pub app_icon: Option<String>,
+}
+
+/// `thumbnail` is the stored thumbnail of the file, if it has one
+pub fn resolve_icon(path: &str, extension: &str, thumbnail: Option<String>) -> ResultIcon {
+    let extension = extension.to_lowercase();
+    // results from connectors have no local file to read
+    let local = Path::new(path).is_absolute();
+
+    ResultIcon {
+        file_type: get_category_from_extension(&extension),
+        thumbnail,
+        app_icon: (local && APP_EXTENSIONS.contains(&extension.as_str()))
+            .then(|| app_icon(path))
+            .flatten(),
+    }
+}
+
+fn app_icon(path: &str) -> Option<String> {
+    let cache = APP_ICONS.get_or_init(Default::default);
+    if let Some(icon) = cache.lock().unwrap_or_else(|e| e.into_inner()).get(path) {
+        return icon.clone();
+    }
+
+    let icon = platform::get_app_icon(path).unwrap_or_else(|e| {
+        eprintln!("Failed to get the icon of {}: {}", path, e);
+        None
+    });
+    cache
+        .lock()
+        .unwrap_or_else(|e| e.into_inner())
+        .insert(path.to_string(), icon.clone());
+    icon
+}
@@ -0,0 +1,715 @@
+/*
+This file contains functions to export the index (file metadata, chunk text and embeddings) into a portable archive and import it back, so an index can be backed up, moved to a new machine or shared without re-embedding everything.
+Both are available from the app and from the terminal as `kita export` and `kita import`
+
+An archive is a single zstd stream of JSON lines: a manifest line followed by one line each for the directories, files and chunks.
+The manifest records the schema version, the embedding model, the counts and a sha256 checksum of every section line, so imports can be verified before anything is written
+*/
+
+use rusqlite::{params, Connection};
+use serde::{de::DeserializeOwned, Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::io::{BufRead, BufReader, Read, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::{SystemTime, UNIX_EPOCH};
+use tauri::{AppHandle, Emitter, Manager, State};
+use thiserror::Error;
+use tokio::sync::Mutex;
+use tokio::task;
+
+use crate::database_handler::default_database_path;
+use crate::embedder::Embedder;
+use crate::encryption;
+use crate::file_processor::{
+    attributes_from_row, get_processor, stored_doc_text, FileProcessorState,
+};
+use crate::platform::DocumentAttributes;
+use crate::settings::SettingsManager;
+use crate::vectordb_manager::{StoredChunk, VectorDbManager};
+
+const ARCHIVE_FORMAT: &str = "kita-index";
+const ARCHIVE_VERSION: u32 = 2;
+const ZSTD_MAGIC: [u8; 4] = [0x28, 0xB5, 0x2F, 0xFD];
+const ZSTD_LEVEL: i32 = 3;
+
+#[derive(Error, Debug)]
+pub enum ArchiveError {
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("JSON error: {0}")]
+    Json(#[from] serde_json::Error),
+
+    #[error("Vector DB error: {0}")]
+    VectorDb(String),
+
+    #[error("Unsupported archive version: {0}")]
+    UnsupportedVersion(u32),
+
+    #[error("Archive verification failed: {0}")]
+    Verification(String),
+
+    #[error("Encryption error: {0}")]
+    Encryption(String),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = ArchiveError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ArchivedFile {
+    pub id: i64,
+    pub directory: String,
+    pub path: String,
+    pub name: String,
+    pub extension: String,
+    pub size: i64,
+    pub category: Option<String>,
+    pub created_at: Option<String>,
+    pub updated_at: Option<String>,
+    /// Title, authors and tags are indexed in files_fts like the name
+    #[serde(default)]
+    pub attributes: Option<DocumentAttributes>,
+}
+
+/// The full contents of an exported index
+#[derive(Debug, Serialize, Deserialize)]
+pub struct IndexArchive {
+    pub version: u32,
+    pub exported_at: u64,
+    pub directories: Vec<String>,
+    pub files: Vec<ArchivedFile>,
+    pub chunks: Vec<StoredChunk>,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SectionCounts {
+    pub directories: usize,
+    pub files: usize,
+    pub chunks: usize,
+}
+
+/// sha256 of each serialized section, hex encoded
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct SectionChecksums {
+    pub directories: String,
+    pub files: String,
+    pub chunks: String,
+}
+
+/// First line of an archive, describing what the rest of it contains
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ArchiveManifest {
+    pub format: String,
+    pub schema_version: u32,
+    pub exported_at: u64,
+    pub embedding_model: String,
+    pub embedding_dimension: usize,
+    pub counts: SectionCounts,
+    pub checksums: SectionChecksums,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ExportSummary {
+    pub path: String,
+    pub files: usize,
+    pub chunks: usize,
+    pub bytes: u64,
+    pub manifest: ArchiveManifest,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ImportSummary {
+    pub files_imported: usize,
+    pub files_skipped: usize,
+    pub chunks_imported: usize,
+}
+
+/// Writes the sqlite metadata and all vectors into a single compressed archive file.
+/// The archive holds the chunks opened, so an index that is encrypted at rest is only exported when `plaintext` says so
+pub async fn export_index_to_path(
+    vectordb: &VectorDbManager,
+    embedding_model: String,
+    db_path: PathBuf,
+    archive_path: PathBuf,
+    plaintext: bool,
+) -> Result<ExportSummary> {
+    if encryption::is_sealing() && !plaintext {
+        return Err(ArchiveError::Encryption(
+            "the index is encrypted at rest and the archive wouldn't be".into(),
+        ));
+    }
+
+    let (directories, files) = task::spawn_blocking(move || read_index_metadata(&db_path))
+        .await
+        .map_err(|e| ArchiveError::Other(format!("spawn_blocking error: {e}")))??;
+
+    let chunks = vectordb
+        .stored_chunks(None)
+        .await
+        .map_err(|e| ArchiveError::VectorDb(e.to_string()))?;
+
+    let exported_at = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0);
+
+    let archive = IndexArchive {
+        version: ARCHIVE_VERSION,
+        exported_at,
+        directories,
+        files,
+        chunks,
+    };
+
+    let file_count = archive.files.len();
+    let chunk_count = archive.chunks.len();
+    let dimension = vectordb.dimension();
+
+    let output_path = archive_path.clone();
+    let (bytes, manifest) = task::spawn_blocking(move || {
+        write_archive(&archive, &embedding_model, dimension, &output_path)
+    })
+    .await
+    .map_err(|e| ArchiveError::Other(format!("spawn_blocking error: {e}")))??;
+
+    println!(
+        "Exported {} files and {} chunks to {:?}",
+        file_count, chunk_count, archive_path
+    );
+
+    Ok(ExportSummary {
+        path: archive_path.to_string_lossy().to_string(),
+        files: file_count,
+        chunks: chunk_count,
+        bytes,
+        manifest,
+    })
+}
+
+/// Loads an archive into the current index after verifying it. Files that are already indexed are left untouched.
+/// If a prefix rewrite is given, every path starting with `source_prefix` is moved under `target_prefix`
+pub async fn import_index_from_path(
+    vectordb: &VectorDbManager,
+    embedding_model: String,
+    db_path: PathBuf,
+    archive_path: PathBuf,
+    prefix_rewrite: Option<(String, String)>,
+) -> Result<(ImportSummary, Vec<String>)> {
+    let dimension = vectordb.dimension();
+    let (manifest, mut archive) =
+        task::spawn_blocking(move || read_archive(&archive_path, dimension))
+            .await
+            .map_err(|e| ArchiveError::Other(format!("spawn_blocking error: {e}")))??;
+
+    // vectors from a different model live in a different space and would poison the search results
+    if manifest.embedding_model != embedding_model {
+        return Err(ArchiveError::Verification(format!(
+            "archive was embedded with {} but this index uses {}",
+            manifest.embedding_model, embedding_model
+        )));
+    }
+
+    if let Some((from, to)) = &prefix_rewrite {
+        rewrite_archive_paths(&mut archive, from, to);
+    }
+
+    let directories = archive.directories.clone();
+    let files = std::mem::take(&mut archive.files);
+
+    // maps the file id in the archive to the id the file got in this database
+    let (id_map, files_skipped) =
+        task::spawn_blocking(move || write_index_metadata(&db_path, &directories, &files))
+            .await
+            .map_err(|e| ArchiveError::Other(format!("spawn_blocking error: {e}")))??;
+
+    // older archives don't record the model per chunk, the manifest says which one it is
+    let chunks: Vec<StoredChunk> = remap_chunks(archive.chunks, &id_map)
+        .into_iter()
+        .map(|chunk| StoredChunk {
+            embedding_model: Some(embedding_model.clone()),
+            ..chunk
+        })
+        .collect();
+
+    let chunks_imported = chunks.len();
+
+    vectordb
+        .add_stored_chunks(chunks)
+        .await
+        .map_err(|e| ArchiveError::VectorDb(e.to_string()))?;
+
+    println!(
+        "Imported {} files ({} skipped) and {} chunks",
+        id_map.len(),
+        files_skipped,
+        chunks_imported
+    );
+
+    Ok((
+        ImportSummary {
+            files_imported: id_map.len(),
+            files_skipped,
+            chunks_imported,
+        },
+        archive.directories,
+    ))
+}
+
+pub fn read_index_metadata(db_path: &Path) -> Result<(Vec<String>, Vec<ArchivedFile>)> {
+    let conn = Connection::open(db_path)?;
+
+    let mut dir_stmt = conn.prepare("SELECT path FROM directories")?;
+    let directories = dir_stmt
+        .query_map([], |row| row.get::<_, String>(0))?
+        .collect::<std::result::Result<Vec<_>, _>>()?;
+
+    let mut file_stmt = conn.prepare(
+        r#"
+        SELECT f.id, d.path, f.path, f.name, f.extension, f.size, f.category, f.created_at, f.updated_at,
+               f.title, f.authors, f.tags, f.content_created_at
+        FROM files f
+        JOIN directories d ON f.directory_id = d.id
+        "#,
+    )?;
+
+    let files = file_stmt
+        .query_map([], |row| {
+            Ok(ArchivedFile {
+                id: row.get(0)?,
+                directory: row.get(1)?,
+                path: row.get(2)?,
+                name: row.get(3)?,
+                extension: row.get(4)?,
+                size: row.get(5)?,
+                category: row.get(6)?,
+                created_at: row.get(7)?,
+                updated_at: row.get(8)?,
+                attributes: attributes_from_row(row, 9),
+            })
+        })?
+        .collect::<std::result::Result<Vec<_>, _>>()?;
+
+    Ok((directories, files))
+}
+
+/// Inserts the archived directories and files, returning the old -> new file id mapping and the number of skipped files
+pub fn write_index_metadata(
+    db_path: &Path,
+    directories: &[String],
+    files: &[ArchivedFile],
+) -> Result<(HashMap<String, String>, usize)> {
+    let mut conn = Connection::open(db_path)?;
+    let tx = conn.transaction()?;
+
+    let mut id_map: HashMap<String, String> = HashMap::new();
+    let mut skipped = 0;
+
+    {
+        let mut dir_stmt = tx.prepare("INSERT OR IGNORE INTO directories (path) VALUES (?1)")?;
+        let all_dirs: HashSet<&str> = directories
+            .iter()
+            .map(|d| d.as_str())
+            .chain(files.iter().map(|f| f.directory.as_str()))
+            .collect();
+        for dir in all_dirs {
+            dir_stmt.execute(params![dir])?;
+        }
+
+        for file in files {
+            let exists: bool = tx
+                .query_row("SELECT 1 FROM files WHERE path = ?1", [&file.path], |_| {
+                    Ok(())
+                })
+                .is_ok();
+
+            if exists {
+                skipped += 1;
+                continue;
+            }
+
+            let attributes = file.attributes.as_ref();
+            let directory_id: i64 = tx.query_row(
+                "SELECT id FROM directories WHERE path = ?1",
+                [&file.directory],
+                |row| row.get(0),
+            )?;
+
+            tx.execute(
+                r#"
+                INSERT INTO files (directory_id, path, name, extension, size, category, created_at, updated_at,
+                                   title, authors, tags, content_created_at)
+                VALUES (?1, ?2, ?3, ?4, ?5, ?6, COALESCE(?7, CURRENT_TIMESTAMP), COALESCE(?8, CURRENT_TIMESTAMP),
+                        ?9, ?10, ?11, ?12)
+                "#,
+                params![
+                    directory_id,
+                    file.path,
+                    file.name,
+                    file.extension,
+                    file.size,
+                    file.category,
+                    file.created_at,
+                    file.updated_at,
+                    attributes.and_then(|a| a.title.clone()),
+                    attributes.map(|a| serde_json::json!(a.authors).to_string()),
+                    attributes.map(|a| serde_json::json!(a.tags).to_string()),
+                    attributes.and_then(|a| a.content_created_at.clone())
+                ],
+            )?;
+
+            let new_id = tx.last_insert_rowid();
+
+            if let Some(doc_text) = stored_doc_text(&tx, new_id)? {
+                tx.execute(
+                    "INSERT INTO files_fts(rowid, doc_text) VALUES (?1, ?2)",
+                    params![new_id, doc_text],
+                )?;
+            }
+
+            id_map.insert(file.id.to_string(), new_id.to_string());
+        }
+    }
+
+    tx.commit()?;
+
+    Ok((id_map, skipped))
+}
+
+/// Moves chunks to the ids their files got in this database, dropping the chunks of files that weren't written
+pub fn remap_chunks(
+    chunks: Vec<StoredChunk>,
+    id_map: &HashMap<String, String>,
+) -> Vec<StoredChunk> {
+    let mut chunk_counters: HashMap<String, usize> = HashMap::new();
+    chunks
+        .into_iter()
+        .filter_map(|chunk| {
+            let new_id = id_map.get(&chunk.file_id)?;
+            let counter = chunk_counters.entry(new_id.clone()).or_insert(0);
+            let id = format!("{}_chunk_{}", new_id, counter);
+            *counter += 1;
+
+            Some(StoredChunk {
+                id,
+                file_id: new_id.clone(),
+                ..chunk
+            })
+        })
+        .collect()
+}
+
+fn rewrite_archive_paths(archive: &mut IndexArchive, from: &str, to: &str) {
+    let rewrite = |path: &str| -> String {
+        match path.strip_prefix(from) {
+            Some(rest) => format!("{}{}", to, rest),
+            None => path.to_string(),
+        }
+    };
+
+    for dir in archive.directories.iter_mut() {
+        *dir = rewrite(dir);
+    }
+
+    for file in archive.files.iter_mut() {
+        file.directory = rewrite(&file.directory);
+        file.path = rewrite(&file.path);
+    }
+
+    for chunk in archive.chunks.iter_mut() {
+        chunk.file_path = rewrite(&chunk.file_path);
+    }
+}
+
+/// Serializes the archive as zstd compressed JSON lines and returns the number of bytes written and the manifest
+fn write_archive(
+    archive: &IndexArchive,
+    embedding_model: &str,
+    dimension: i32,
+    path: &Path,
+) -> Result<(u64, ArchiveManifest)> {
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+
+    let directories = serde_json::to_vec(&archive.directories)?;
+    let files = serde_json::to_vec(&archive.files)?;
+    let chunks = serde_json::to_vec(&archive.chunks)?;
+
+    let manifest = ArchiveManifest {
+        format: ARCHIVE_FORMAT.to_string(),
+        schema_version: ARCHIVE_VERSION,
+        exported_at: archive.exported_at,
+        embedding_model: embedding_model.to_string(),
+        embedding_dimension: dimension as usize,
+        counts: SectionCounts {
+            directories: archive.directories.len(),
+            files: archive.files.len(),
+            chunks: archive.chunks.len(),
+        },
+        checksums: SectionChecksums {
+            directories: sha256_hex(&directories),
+            files: sha256_hex(&files),
+            chunks: sha256_hex(&chunks),
+        },
+    };
+
+    let file = fs::File::create(path)?;
+    let mut encoder = zstd::Encoder::new(file, ZSTD_LEVEL)?;
+
+    // serde_json escapes newlines inside strings, so every section fits on one line
+    for line in [serde_json::to_vec(&manifest)?, directories, files, chunks] {
+        encoder.write_all(&line)?;
+        encoder.write_all(b"\n")?;
+    }
+    encoder.finish()?.flush()?;
+
+    Ok((fs::metadata(path)?.len(), manifest))
+}
+
+/// Reads and verifies an archive against its manifest
+fn read_archive(path: &Path, dimension: i32) -> Result<(ArchiveManifest, IndexArchive)> {
+    let mut file = fs::File::open(path)?;
+    let mut magic = [0u8; 4];
+    file.read_exact(&mut magic)
+        .map_err(|_| ArchiveError::Verification("archive is truncated".into()))?;
+    if magic != ZSTD_MAGIC {
+        return Err(ArchiveError::Verification(
+            "archive is not zstd compressed".into(),
+        ));
+    }
+
+    let file = fs::File::open(path)?;
+    let mut lines = BufReader::new(zstd::Decoder::new(file)?).split(b'\n');
+    let mut next_line = |section: &str| -> Result<Vec<u8>> {
+        lines
+            .next()
+            .transpose()?
+            .ok_or_else(|| ArchiveError::Verification(format!("missing {} section", section)))
+    };
+
+    let manifest: ArchiveManifest = serde_json::from_slice(&next_line("manifest")?)?;
+
+    if manifest.format != ARCHIVE_FORMAT {
+        return Err(ArchiveError::Verification(format!(
+            "unknown archive format {}",
+            manifest.format
+        )));
+    }
+    if manifest.schema_version != ARCHIVE_VERSION {
+        return Err(ArchiveError::UnsupportedVersion(manifest.schema_version));
+    }
+    if manifest.embedding_dimension != dimension as usize {
+        return Err(ArchiveError::Verification(format!(
+            "archive has {} dimensional embeddings, expected {}",
+            manifest.embedding_dimension, dimension
+        )));
+    }
+
+    let directories: Vec<String> = read_section(
+        &next_line("directories")?,
+        "directories",
+        &manifest.checksums.directories,
+    )?;
+    let files: Vec<ArchivedFile> =
+        read_section(&next_line("files")?, "files", &manifest.checksums.files)?;
+    let chunks: Vec<StoredChunk> =
+        read_section(&next_line("chunks")?, "chunks", &manifest.checksums.chunks)?;
+
+    let counts = SectionCounts {
+        directories: directories.len(),
+        files: files.len(),
+        chunks: chunks.len(),
+    };
+    if counts != manifest.counts {
+        return Err(ArchiveError::Verification(format!(
+            "section counts {:?} don't match the manifest {:?}",
+            counts, manifest.counts
+        )));
+    }
+
+    let archive = IndexArchive {
+        version: manifest.schema_version,
+        exported_at: manifest.exported_at,
+        directories,
+        files,
+        chunks,
+    };
+
+    Ok((manifest, archive))
+}
+
+/// Checks a section line against its checksum before deserializing it
+fn read_section<T: DeserializeOwned>(bytes: &[u8], section: &str, checksum: &str) -> Result<T> {
+    if sha256_hex(bytes) != checksum {
+        return Err(ArchiveError::Verification(format!(
+            "checksum mismatch in {} section",
+            section
+        )));
+    }
+
+    Ok(serde_json::from_slice(bytes)?)
+}
+
+fn sha256_hex(bytes: &[u8]) -> String {
+    format!("{:x}", Sha256::digest(bytes))
+}
+
+#[tauri::command]
+pub async fn export_index(
+    archive_path: String,
+    plaintext: Option<bool>,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> std::result::Result<ExportSummary, String> {
+    let processor = get_processor(&state)?;
+    let embedding_model = app_handle.state::<Arc<Embedder>>().model_name();
+    let vectordb = app_handle.state::<Arc<Mutex<VectorDbManager>>>();
+    let vectordb = vectordb.lock().await;
+
+    export_index_to_path(
+        &vectordb,
+        embedding_model,
+        processor.db_path,
+        PathBuf::from(archive_path),
+        plaintext.unwrap_or(false),
+    )
+    .await
+    .map_err(|e| format!("Failed to export index: {}", e))
+}
+
+#[tauri::command]
+pub async fn import_index(
+    archive_path: String,
+    source_prefix: Option<String>,
+    target_prefix: Option<String>,
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> std::result::Result<ImportSummary, String> {
+    let processor = get_processor(&state)?;
+
+    let prefix_rewrite = match (source_prefix, target_prefix) {
+        (Some(from), Some(to)) => Some((from, to)),
+        _ => None,
+    };
+
+    let embedding_model = app_handle.state::<Arc<Embedder>>().model_name();
+    let vectordb = app_handle.state::<Arc<Mutex<VectorDbManager>>>();
+    let (summary, directories) = import_index_from_path(
+        &*vectordb.lock().await,
+        embedding_model,
+        processor.db_path,
+        PathBuf::from(archive_path),
+        prefix_rewrite,
+    )
+    .await
+    .map_err(|e| format!("Failed to import index: {}", e))?;
+
+    // let the watcher pick up the imported directories and the UI refresh its results
+    if let Err(e) = app_handle.emit("indexing_complete", &directories) {
+        println!("Warning: Failed to emit indexing_complete event: {}", e);
+    }
+    let _ = app_handle.emit("files-updated", ());
+
+    Ok(summary)
+}
+
+/// What the export and import commands work on when they run from the terminal
+struct CliIndex {
+    db_path: PathBuf,
+    embedding_model: String,
+    runtime: tokio::runtime::Runtime,
+    vectordb: VectorDbManager,
+}
+
+fn open_cli_index() -> std::result::Result<CliIndex, String> {
+    let db_path = default_database_path()
+        .filter(|path| path.exists())
+        .ok_or_else(|| "No kita database found, start kita once first".to_string())?;
+
+    let settings_manager = SettingsManager::new(&db_path.to_string_lossy());
+    settings_manager
+        .initialize()
+        .map_err(|e| format!("Failed to load settings: {}", e))?;
+    let settings = settings_manager.get_settings().unwrap_or_default();
+    encryption::init_encryption(&settings, &db_path);
+
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .map_err(|e| format!("Failed to start runtime: {}", e))?;
+    let vectordb = runtime
+        .block_on(VectorDbManager::open_default())
+        .map_err(|e| format!("Failed to open the vector DB: {}", e))?;
+
+    Ok(CliIndex {
+        db_path,
+        embedding_model: Embedder::configured_model_name(&settings),
+        runtime,
+        vectordb,
+    })
+}
+
+/// `kita export <archive> [--plaintext]` writes the index to an archive, `--plaintext` allows it for an index that is encrypted at rest
+pub fn run_export_command(args: &[String]) -> std::result::Result<(), String> {
+    let (archive_path, plaintext) = match args {
+        [archive_path] => (archive_path, false),
+        [archive_path, flag] if flag == "--plaintext" => (archive_path, true),
+        _ => return Err("Usage: kita export <archive> [--plaintext]".to_string()),
+    };
+
+    let index = open_cli_index()?;
+    let summary = index
+        .runtime
+        .block_on(export_index_to_path(
+            &index.vectordb,
+            index.embedding_model.clone(),
+            index.db_path.clone(),
+            PathBuf::from(archive_path),
+            plaintext,
+        ))
+        .map_err(|e| match e {
+            ArchiveError::Encryption(_) => format!(
+                "Failed to export index: {}, pass --plaintext to export it anyway",
+                e
+            ),
+            e => format!("Failed to export index: {}", e),
+        })?;
+
+    println!("{} bytes written to {}", summary.bytes, summary.path);
+    Ok(())
+}
+
+/// `kita import <archive> [<from prefix> <to prefix>]` adds an archive to the index, moving paths under
+/// `from prefix` to `to prefix` when the files live somewhere else on this machine
+pub fn run_import_command(args: &[String]) -> std::result::Result<(), String> {
+    let (archive_path, prefix_rewrite) = match args {
+        [archive_path] => (archive_path, None),
+        [archive_path, from, to] => (archive_path, Some((from.clone(), to.clone()))),
+        _ => return Err("Usage: kita import <archive> [<from prefix> <to prefix>]".to_string()),
+    };
+
+    let index = open_cli_index()?;
+    index
+        .runtime
+        .block_on(import_index_from_path(
+            &index.vectordb,
+            index.embedding_model.clone(),
+            index.db_path.clone(),
+            PathBuf::from(archive_path),
+            prefix_rewrite,
+        ))
+        .map_err(|e| format!("Failed to import index: {}", e))?;
+
+    // a running app only picks up folders to watch when it starts
+    println!("Restart kita if it is running so it watches the imported folders");
+    Ok(())
+}
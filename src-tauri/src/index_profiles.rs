@@ -0,0 +1,117 @@
+/*
+This file contains the indexing profiles attached to roots, so the heavy work is only done where it pays off: a code folder can skip embeddings and binaries,
+while documents get everything, e.g. `{ "path": "~/Code", "profile": "no_embeddings", "exclude_binaries": true }` or `{ "path": "~/Downloads", "profile": "metadata_only" }`.
+Roots without a profile are indexed in full. When the profile of a root changes, its files lose the vectors the new profile doesn't keep
+and are indexed again on the next rescan, see apply_profile_change in file_processor.rs
+*/
+
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+
+use crate::scheduler::expand_path;
+use crate::settings::AppSettings;
+use crate::thumbnails;
+
+/// How much of a file gets indexed
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum IndexProfile {
+    /// Content is extracted and embedded, symbols and thumbnails are kept
+    #[default]
+    Full,
+    /// Found by name, path, title and tags, and by symbol for code. The content isn't searchable,
+    /// it is neither embedded nor put in the full-text index
+    NoEmbeddings,
+    /// Only the file row is stored, the file isn't read at all
+    MetadataOnly,
+}
+
+impl IndexProfile {
+    /// "fts_only" and "fts" are the names no_embeddings had before, kept so existing settings still apply
+    pub fn from_setting(value: &str) -> Option<Self> {
+        match value {
+            "full" => Some(Self::Full),
+            "no_embeddings" | "fts_only" | "fts" => Some(Self::NoEmbeddings),
+            "metadata_only" | "metadata" => Some(Self::MetadataOnly),
+            _ => None,
+        }
+    }
+
+    pub fn embeds_content(&self) -> bool {
+        *self == Self::Full
+    }
+
+    /// Attributes, symbols and thumbnails are read from the file itself
+    pub fn reads_file(&self) -> bool {
+        *self != Self::MetadataOnly
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct ProfileRule {
+    profile: IndexProfile,
+    exclude_binaries: bool,
+}
+
+/// The enabled profile rules, with their roots expanded
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct IndexProfiles {
+    rules: Vec<(PathBuf, ProfileRule)>,
+}
+
+impl IndexProfiles {
+    pub fn from_settings(settings: &AppSettings) -> Self {
+        let rules = settings
+            .index_profiles
+            .iter()
+            .flatten()
+            .filter(|rule| rule.enabled.unwrap_or(true))
+            .filter_map(|rule| match IndexProfile::from_setting(&rule.profile) {
+                Some(profile) => Some((
+                    PathBuf::from(expand_path(&rule.path)),
+                    ProfileRule {
+                        profile,
+                        exclude_binaries: rule.exclude_binaries.unwrap_or(false),
+                    },
+                )),
+                None => {
+                    eprintln!(
+                        "Ignoring index profile for {}: unknown profile {}",
+                        rule.path, rule.profile
+                    );
+                    None
+                }
+            })
+            .collect();
+
+        Self { rules }
+    }
+
+    /// The rule for files under `path`. When roots are nested, the rule of the innermost one applies
+    fn rule_for(&self, path: &Path) -> Option<&ProfileRule> {
+        self.rules
+            .iter()
+            .filter(|(root, _)| path.starts_with(root))
+            .max_by_key(|(root, _)| root.components().count())
+            .map(|(_, rule)| rule)
+    }
+
+    pub fn profile_for(&self, path: &Path) -> IndexProfile {
+        self.rule_for(path)
+            .map(|rule| rule.profile)
+            .unwrap_or_default()
+    }
+
+    /// Whether the walk leaves the file out, binaries are only left out under roots that ask for it
+    pub fn is_excluded(&self, path: &Path, extension: &str) -> bool {
+        self.rule_for(path)
+            .map(|rule| rule.exclude_binaries && is_binary_extension(extension))
+            .unwrap_or(false)
+    }
+}
+
+/// Files kita indexes whose content isn't text
+fn is_binary_extension(extension: &str) -> bool {
+    let extension = extension.to_lowercase();
+    matches!(extension.as_str(), "pdf" | "docx") || thumbnails::is_image_extension(&extension)
+}
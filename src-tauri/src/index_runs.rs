@@ -0,0 +1,368 @@
+/*
+This file contains the record of indexing runs: when each scan started and stopped, how far it got and, if it didn't finish, why it was cancelled (by the user, on shutdown,
+because the embedding quota ran out or because the laptop went on battery). Only background scans are recorded, the handful of files the watcher hands over are not.
+`kita status` reads the latest run so the user can find out why the last index stopped at 43%
+*/
+
+use rusqlite::{params, Connection, OptionalExtension};
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+use tauri::State;
+use thiserror::Error;
+use tokio::task;
+
+use crate::database_handler::default_database_path;
+use crate::file_processor::{get_processor, FileProcessorState};
+use crate::health;
+use crate::indexing_control::CancelReason;
+use crate::maintenance;
+use crate::settings::SettingsManager;
+use crate::storage_budget::{self, format_bytes};
+use crate::vectordb_manager::VECTOR_DB_DIR;
+
+/// Older runs are dropped when a new one starts
+const MAX_RUNS: usize = 100;
+const DEFAULT_LIST_LIMIT: usize = 20;
+/// How often the progress of a running run is written, so a run cut short by the app exiting still shows how far it got
+const PROGRESS_INTERVAL_SECS: u64 = 5;
+/// Tables `kita status` lists, the largest first
+const STATUS_TABLES: usize = 5;
+
+#[derive(Error, Debug)]
+pub enum IndexRunsError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = IndexRunsError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct IndexRun {
+    pub id: i64,
+    pub paths: Vec<String>,
+    /// running, completed or cancelled
+    pub status: String,
+    /// Set when the run was cancelled
+    pub reason: Option<CancelReason>,
+    pub total_files: usize,
+    /// Files that left the pipeline, whether they were indexed, stored by name only or failed
+    pub processed_files: usize,
+    /// Files stored with their content embedded
+    pub indexed_files: usize,
+    pub errors: usize,
+    pub started_at: String,
+    pub finished_at: Option<String>,
+}
+
+impl IndexRun {
+    fn percent_done(&self) -> usize {
+        if self.total_files == 0 {
+            return 100;
+        }
+        self.processed_files * 100 / self.total_files
+    }
+}
+
+/// Records a run as started and returns its id
+pub async fn start_run(db_path: PathBuf, paths: Vec<String>, total_files: usize) -> Result<i64> {
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&db_path)?;
+        conn.execute(
+            "INSERT INTO index_runs (paths, total_files, status) VALUES (?1, ?2, 'running')",
+            params![serde_json::json!(paths).to_string(), total_files as i64],
+        )?;
+        let id = conn.last_insert_rowid();
+
+        conn.execute(
+            "DELETE FROM index_runs WHERE id NOT IN (SELECT id FROM index_runs ORDER BY id DESC LIMIT ?1)",
+            params![MAX_RUNS as i64],
+        )?;
+        Ok(id)
+    })
+    .await
+    .map_err(|e| IndexRunsError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+/// Writes the processed count of a running run every few seconds until the returned task is aborted
+pub fn track_progress(
+    db_path: PathBuf,
+    id: i64,
+    processed_files: impl Fn() -> usize + Send + 'static,
+) -> task::JoinHandle<()> {
+    tokio::spawn(async move {
+        let mut ticker = tokio::time::interval(Duration::from_secs(PROGRESS_INTERVAL_SECS));
+        let mut written = 0;
+
+        loop {
+            ticker.tick().await;
+
+            let processed = processed_files();
+            if processed == written {
+                continue;
+            }
+            let db_path = db_path.clone();
+            let result = task::spawn_blocking(move || {
+                Connection::open(&db_path)?.execute(
+                    "UPDATE index_runs SET processed_files = ?1 WHERE id = ?2",
+                    params![processed as i64, id],
+                )
+            })
+            .await;
+            match result {
+                Ok(Ok(_)) => written = processed,
+                Ok(Err(e)) => eprintln!("Failed to record index run progress: {}", e),
+                Err(e) => eprintln!("spawn_blocking error: {e}"),
+            }
+        }
+    })
+}
+
+/// Records how far the run got, and why it stopped when it was cancelled
+pub async fn finish_run(
+    db_path: PathBuf,
+    id: i64,
+    processed_files: usize,
+    indexed_files: usize,
+    errors: usize,
+    cancelled: Option<CancelReason>,
+) -> Result<()> {
+    let status = if cancelled.is_some() {
+        "cancelled"
+    } else {
+        "completed"
+    };
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&db_path)?;
+        conn.execute(
+            "UPDATE index_runs SET processed_files = ?1, indexed_files = ?2, errors = ?3, status = ?4,
+                reason = ?5, finished_at = CURRENT_TIMESTAMP
+             WHERE id = ?6",
+            params![
+                processed_files as i64,
+                indexed_files as i64,
+                errors as i64,
+                status,
+                cancelled.as_ref().map(CancelReason::as_str),
+                id
+            ],
+        )?;
+        Ok(())
+    })
+    .await
+    .map_err(|e| IndexRunsError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+/// Runs still marked as running when the app starts were cut short by the app exiting
+pub fn close_interrupted_runs(conn: &Connection) -> rusqlite::Result<usize> {
+    conn.execute(
+        "UPDATE index_runs SET status = 'cancelled', reason = ?1, finished_at = CURRENT_TIMESTAMP
+         WHERE status = 'running'",
+        params![CancelReason::Shutdown.as_str()],
+    )
+}
+
+fn latest_runs(conn: &Connection, limit: usize) -> Result<Vec<IndexRun>> {
+    let mut stmt = conn.prepare(
+        "SELECT id, paths, status, reason, total_files, processed_files, indexed_files, errors,
+                started_at, finished_at
+         FROM index_runs
+         ORDER BY id DESC
+         LIMIT ?1",
+    )?;
+
+    let runs = stmt
+        .query_map(params![limit as i64], |row| {
+            let paths: String = row.get(1)?;
+            let reason: Option<String> = row.get(3)?;
+            Ok(IndexRun {
+                id: row.get(0)?,
+                paths: serde_json::from_str(&paths).unwrap_or_default(),
+                status: row.get(2)?,
+                reason: reason.as_deref().and_then(CancelReason::parse),
+                total_files: row.get::<_, i64>(4)?.max(0) as usize,
+                processed_files: row.get::<_, i64>(5)?.max(0) as usize,
+                indexed_files: row.get::<_, i64>(6)?.max(0) as usize,
+                errors: row.get::<_, i64>(7)?.max(0) as usize,
+                started_at: row.get(8)?,
+                finished_at: row.get(9)?,
+            })
+        })?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+
+    Ok(runs)
+}
+
+/// Latest runs first
+#[tauri::command]
+pub async fn get_index_runs(
+    limit: Option<usize>,
+    state: State<'_, FileProcessorState>,
+) -> std::result::Result<Vec<IndexRun>, String> {
+    let processor = get_processor(&state)?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        latest_runs(&conn, limit.unwrap_or(DEFAULT_LIST_LIMIT))
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to get index runs: {}", e))
+}
+
+/// `kita status`: prints how the latest indexing run went
+pub fn run_status_command(args: &[String]) -> std::result::Result<(), String> {
+    if !args.is_empty() {
+        return Err("Usage: kita status".to_string());
+    }
+
+    let db_path = default_database_path()
+        .filter(|path| path.exists())
+        .ok_or_else(|| "No kita database found, start kita once first".to_string())?;
+    let conn =
+        Connection::open(&db_path).map_err(|e| format!("Failed to open the database: {}", e))?;
+
+    let last = if has_table(&conn, "index_runs")
+        .map_err(|e| format!("Failed to read index runs: {}", e))?
+    {
+        latest_runs(&conn, 1)
+            .map_err(|e| format!("Failed to read index runs: {}", e))?
+            .pop()
+    } else {
+        None
+    };
+
+    let Some(run) = last else {
+        println!("No indexing runs recorded yet");
+        return print_storage(&conn, &db_path);
+    };
+
+    println!("Last index: {}", run.paths.join(", "));
+    match (run.status.as_str(), run.reason) {
+        ("running", _) => println!(
+            "  Running since {} UTC, {} files to index",
+            run.started_at, run.total_files
+        ),
+        ("cancelled", reason) => println!(
+            "  Stopped at {}% ({} of {} files): {}",
+            run.percent_done(),
+            run.processed_files,
+            run.total_files,
+            reason.map(|r| r.describe()).unwrap_or("cancelled")
+        ),
+        _ => println!(
+            "  Completed: {} of {} files processed, {} indexed with their content",
+            run.processed_files, run.total_files, run.indexed_files
+        ),
+    }
+    if let Some(finished_at) = &run.finished_at {
+        println!(
+            "  Started {} UTC, stopped {} UTC",
+            run.started_at, finished_at
+        );
+    }
+    if run.errors > 0 {
+        println!("  {} files failed to index", run.errors);
+    }
+
+    let health = if has_table(&conn, "health_reports")
+        .map_err(|e| format!("Failed to read the index health: {}", e))?
+    {
+        health::latest_report(&conn)
+            .map_err(|e| format!("Failed to read the index health: {}", e))?
+    } else {
+        None
+    };
+    if let Some(report) = health {
+        println!(
+            "Index health: {}/100 ({} UTC)",
+            report.score,
+            report.generated_at.as_deref().unwrap_or("unknown")
+        );
+        println!(
+            "  {:.1}% stale, {:.1}% without content, {:.1}% unsupported, {} scanned PDFs, {:.1}% wasted space",
+            report.stale.percent,
+            report.failed_extraction.percent,
+            report.unsupported_format.percent,
+            report.scanned_pdfs.count,
+            report.bloat.percent
+        );
+        for recommendation in &report.recommendations {
+            println!("  - {}", recommendation.message);
+        }
+    }
+
+    print_storage(&conn, &db_path)
+}
+
+/// How much space the index takes up against its budget, and the tables that take up the most
+fn print_storage(conn: &Connection, db_path: &Path) -> std::result::Result<(), String> {
+    let sqlite_bytes = maintenance::sqlite_size(db_path);
+    let vector_bytes = db_path
+        .parent()
+        .map(|dir| maintenance::vector_size(&dir.join(VECTOR_DB_DIR)))
+        .unwrap_or(0);
+
+    let settings_manager = SettingsManager::new(&db_path.to_string_lossy());
+    settings_manager
+        .initialize()
+        .map_err(|e| format!("Failed to load settings: {}", e))?;
+    let budget = storage_budget::budget_bytes(&settings_manager.get_settings().unwrap_or_default());
+
+    println!(
+        "Storage: {}{} ({} database, {} vectors)",
+        format_bytes(sqlite_bytes + vector_bytes),
+        budget
+            .map(|budget| format!(" of a {} budget", format_bytes(budget)))
+            .unwrap_or_default(),
+        format_bytes(sqlite_bytes),
+        format_bytes(vector_bytes)
+    );
+
+    if has_table(conn, "evicted_files")
+        .map_err(|e| format!("Failed to read evicted files: {}", e))?
+    {
+        let evicted: i64 = conn
+            .query_row("SELECT COUNT(*) FROM evicted_files", [], |row| row.get(0))
+            .map_err(|e| format!("Failed to read evicted files: {}", e))?;
+        if evicted > 0 {
+            println!(
+                "  {} files had their content evicted to stay within the budget",
+                evicted
+            );
+        }
+    }
+
+    let tables = storage_budget::table_usage(conn)
+        .map_err(|e| format!("Failed to read table sizes: {}", e))?;
+    for table in tables
+        .iter()
+        .filter(|table| table.bytes.is_some())
+        .take(STATUS_TABLES)
+    {
+        println!(
+            "  {}: {} rows, {}",
+            table.name,
+            table.rows,
+            format_bytes(table.bytes.unwrap_or(0))
+        );
+    }
+
+    Ok(())
+}
+
+/// Older databases don't have newer tables until the app has started once
+fn has_table(conn: &Connection, name: &str) -> rusqlite::Result<bool> {
+    conn.query_row(
+        "SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?1",
+        [name],
+        |_| Ok(()),
+    )
+    .optional()
+    .map(|row| row.is_some())
+}
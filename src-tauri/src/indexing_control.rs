@@ -0,0 +1,451 @@
+/*
+This file contains the pause/resume/cancel controls for background indexing and the low-power mode that throttles the pipeline workers while the laptop is on battery or the user is keeping the CPU busy.
+It also holds the fresh-first lane: files the watcher just saw change are indexed ahead of running scans, and the time they take to become searchable is tracked
+*/
+
+use serde::{Deserialize, Serialize};
+use std::collections::VecDeque;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+use sysinfo::{CpuExt, PidExt, ProcessExt, System, SystemExt};
+use tauri::{AppHandle, Emitter, Manager, State};
+use tokio::sync::{Mutex, MutexGuard, Notify};
+
+use crate::settings::SettingsManagerState;
+use crate::AppResult;
+
+const CHECK_INTERVAL_SECS: u64 = 10;
+const DEFAULT_CPU_THRESHOLD: f32 = 60.0;
+/// How many of the latest fresh files the freshness figures are computed over
+const FRESHNESS_WINDOW: usize = 200;
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct IndexingStatus {
+    pub paused: bool,
+    pub running: bool,
+    pub low_power: bool,
+    pub on_battery: bool,
+    pub user_cpu_usage: f32,
+    pub freshness: FreshnessStats,
+}
+
+/// Time from the watcher seeing a file change to the file being searchable
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct FreshnessStats {
+    /// Fresh files indexed since the app started
+    pub files: usize,
+    pub last_ms: Option<u64>,
+    pub average_ms: Option<u64>,
+    pub p95_ms: Option<u64>,
+    pub max_ms: Option<u64>,
+}
+
+/// Why an indexing run was stopped, recorded with the run, see index_runs.rs
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum CancelReason {
+    /// Cancelled from the app
+    User,
+    /// The app exited while the run was going
+    Shutdown,
+    /// The embedding service said the quota or rate limit was used up
+    Quota,
+    /// The laptop went on battery with index_stop_on_battery on
+    Battery,
+}
+
+impl CancelReason {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::User => "user",
+            Self::Shutdown => "shutdown",
+            Self::Quota => "quota",
+            Self::Battery => "battery",
+        }
+    }
+
+    pub fn parse(value: &str) -> Option<Self> {
+        match value {
+            "user" => Some(Self::User),
+            "shutdown" => Some(Self::Shutdown),
+            "quota" => Some(Self::Quota),
+            "battery" => Some(Self::Battery),
+            _ => None,
+        }
+    }
+
+    /// For `kita status`
+    pub fn describe(&self) -> &'static str {
+        match self {
+            Self::User => "cancelled by the user",
+            Self::Shutdown => "kita exited before it finished",
+            Self::Quota => "the embedding service quota was used up",
+            Self::Battery => "the laptop went on battery",
+        }
+    }
+}
+
+/// Which queue a pipeline run belongs to
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Lane {
+    /// Scans and re-scans of whole roots
+    Background,
+    /// Files the watcher just saw change, background workers step aside for them
+    Fresh,
+    /// Documents a connector fetched. They wait for fresh files like scans do, but cancelling the scans leaves them running
+    Connector,
+}
+
+/// The cancel of one run. The run's workers check it before picking up each file
+#[derive(Debug, Default)]
+pub struct RunToken {
+    reason: std::sync::Mutex<Option<CancelReason>>,
+}
+
+impl RunToken {
+    /// Why the run is stopping, None when it isn't
+    pub fn cancel_reason(&self) -> Option<CancelReason> {
+        *self.reason.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// The first reason given wins
+    fn cancel(&self, reason: CancelReason) {
+        self.reason
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .get_or_insert(reason);
+    }
+}
+
+/// Shared by the pipeline workers, which check in before picking up each file
+#[derive(Default)]
+pub struct IndexingControl {
+    paused: AtomicBool,
+    low_power: AtomicBool,
+    /// The active runs with their lane, a run is removed when its guard is dropped
+    runs: std::sync::Mutex<Vec<(Lane, Arc<RunToken>)>>,
+    changed: Notify,
+    /// In low-power mode the extract and embed work runs one file at a time through this slot
+    low_power_slot: Mutex<()>,
+    fresh_files: AtomicUsize,
+    /// Latest fresh latencies in milliseconds, oldest first
+    fresh_latencies: std::sync::Mutex<VecDeque<u64>>,
+}
+
+impl IndexingControl {
+    pub fn pause(&self) {
+        self.paused.store(true, Ordering::SeqCst);
+        self.changed.notify_waiters();
+    }
+
+    pub fn resume(&self) {
+        self.paused.store(false, Ordering::SeqCst);
+        self.changed.notify_waiters();
+    }
+
+    pub fn is_paused(&self) -> bool {
+        self.paused.load(Ordering::SeqCst)
+    }
+
+    pub fn is_low_power(&self) -> bool {
+        self.low_power.load(Ordering::SeqCst)
+    }
+
+    fn runs(&self) -> std::sync::MutexGuard<'_, Vec<(Lane, Arc<RunToken>)>> {
+        self.runs.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Stops the runs of the background lane that are running now, their workers finish the file they are on.
+    /// Fresh files and connector syncs carry on, and runs started afterwards aren't affected.
+    /// Returns false when no background run was running
+    pub fn cancel(&self, reason: CancelReason) -> bool {
+        let mut cancelled = false;
+        for (lane, run) in self.runs().iter() {
+            if *lane == Lane::Background {
+                run.cancel(reason);
+                cancelled = true;
+            }
+        }
+
+        // paused workers have to wake up to stop
+        self.changed.notify_waiters();
+        cancelled
+    }
+
+    /// Stops a single run, e.g. the one that used up the embedding quota
+    pub fn cancel_run(&self, run: &RunToken, reason: CancelReason) {
+        run.cancel(reason);
+        self.changed.notify_waiters();
+    }
+
+    /// Marks an indexing run as active until the returned guard is dropped.
+    /// While a run of the fresh lane is active, the workers of the other lanes wait
+    pub fn begin_run(&self, lane: Lane) -> ActiveRun<'_> {
+        let token = Arc::new(RunToken::default());
+        self.runs().push((lane, token.clone()));
+        ActiveRun {
+            control: self,
+            token,
+        }
+    }
+
+    pub fn is_running(&self) -> bool {
+        !self.runs().is_empty()
+    }
+
+    /// Returns true if the mode changed
+    fn set_low_power(&self, low_power: bool) -> bool {
+        self.low_power.swap(low_power, Ordering::SeqCst) != low_power
+    }
+
+    fn has_fresh_runs(&self) -> bool {
+        self.runs().iter().any(|(lane, _)| *lane == Lane::Fresh)
+    }
+
+    /// Waits until a worker of the given lane may pick up its next file: never while paused,
+    /// and outside the fresh lane not while fresh files are being indexed. Returns right away
+    /// once `run` is cancelled, workers check its `cancel_reason` after it
+    pub async fn wait_for_turn(&self, lane: Lane, run: Option<&RunToken>) {
+        loop {
+            // register for wakeups before checking so a change in between isn't missed
+            let notified = self.changed.notified();
+            let cancelled = run.is_some_and(|run| run.cancel_reason().is_some());
+            let blocked =
+                !cancelled && (self.is_paused() || (lane != Lane::Fresh && self.has_fresh_runs()));
+            if !blocked {
+                return;
+            }
+            notified.await;
+        }
+    }
+
+    /// In low-power mode, waits for the shared slot so heavy work runs one file at a time.
+    /// Fresh files are a handful and someone is waiting for them, so they don't queue for the slot.
+    /// The guard must be dropped before waiting on a pipeline queue, otherwise the stages can deadlock
+    pub async fn throttle(&self, lane: Lane) -> Option<MutexGuard<'_, ()>> {
+        if self.is_low_power() && lane != Lane::Fresh {
+            Some(self.low_power_slot.lock().await)
+        } else {
+            None
+        }
+    }
+
+    /// Records how long a fresh file took to become searchable
+    pub fn record_freshness(&self, latency: Duration) {
+        self.fresh_files.fetch_add(1, Ordering::SeqCst);
+
+        let mut latencies = self
+            .fresh_latencies
+            .lock()
+            .unwrap_or_else(|e| e.into_inner());
+        if latencies.len() == FRESHNESS_WINDOW {
+            latencies.pop_front();
+        }
+        latencies.push_back(latency.as_millis() as u64);
+    }
+
+    pub fn freshness(&self) -> FreshnessStats {
+        let latencies = self
+            .fresh_latencies
+            .lock()
+            .unwrap_or_else(|e| e.into_inner());
+
+        let mut sorted: Vec<u64> = latencies.iter().copied().collect();
+        sorted.sort_unstable();
+        let percentile = |p: f64| {
+            let rank = ((sorted.len() as f64 * p).ceil() as usize).max(1);
+            sorted.get(rank - 1).copied()
+        };
+
+        FreshnessStats {
+            files: self.fresh_files.load(Ordering::SeqCst),
+            last_ms: latencies.back().copied(),
+            average_ms: (!sorted.is_empty())
+                .then(|| sorted.iter().sum::<u64>() / sorted.len() as u64),
+            p95_ms: percentile(0.95),
+            max_ms: sorted.last().copied(),
+        }
+    }
+}
+
+pub struct ActiveRun<'a> {
+    control: &'a IndexingControl,
+    token: Arc<RunToken>,
+}
+
+impl ActiveRun<'_> {
+    /// The run's cancel, for its workers
+    pub fn token(&self) -> Arc<RunToken> {
+        self.token.clone()
+    }
+
+    pub fn cancel_reason(&self) -> Option<CancelReason> {
+        self.token.cancel_reason()
+    }
+}
+
+impl Drop for ActiveRun<'_> {
+    fn drop(&mut self) {
+        self.control
+            .runs()
+            .retain(|(_, run)| !Arc::ptr_eq(run, &self.token));
+        // when it was a fresh run, let the other workers carry on
+        self.control.changed.notify_waiters();
+    }
+}
+
+/// Initialize the indexing controls and start the resource watcher
+pub fn init_indexing_control(app: &tauri::App) -> AppResult<()> {
+    let control = Arc::new(IndexingControl::default());
+    app.manage(control.clone());
+
+    let app_handle = app.app_handle().clone();
+    tauri::async_runtime::spawn(async move {
+        watch_resources(app_handle, control).await;
+    });
+
+    println!("Indexing control initialized");
+    Ok(())
+}
+
+/// Periodically checks the power source and the CPU load from other processes and toggles low-power mode
+async fn watch_resources(app_handle: AppHandle, control: Arc<IndexingControl>) {
+    let mut system = System::new();
+    let own_pid = sysinfo::Pid::from_u32(std::process::id());
+    let mut ticker = tokio::time::interval(Duration::from_secs(CHECK_INTERVAL_SECS));
+
+    loop {
+        ticker.tick().await;
+
+        let settings = app_handle
+            .state::<SettingsManagerState>()
+            .0
+            .get_settings()
+            .unwrap_or_default();
+
+        // sysinfo computes CPU usage as a delta between refreshes, so the first tick reads 0
+        system.refresh_cpu();
+        system.refresh_process(own_pid);
+
+        let cpu_count = system.cpus().len().max(1) as f32;
+        let total_usage = system.global_cpu_info().cpu_usage();
+        // our own process usage is per core, so scale it down before subtracting it from the global average
+        let own_usage = system
+            .process(own_pid)
+            .map(|p| p.cpu_usage() / cpu_count)
+            .unwrap_or(0.0);
+        let user_cpu_usage = (total_usage - own_usage).max(0.0);
+
+        let on_battery = is_on_battery().await;
+
+        if on_battery
+            && settings.index_stop_on_battery.unwrap_or(false)
+            && control.cancel(CancelReason::Battery)
+        {
+            println!("Stopping indexing: on battery");
+        }
+
+        let low_power = (settings.index_throttle_on_battery.unwrap_or(true) && on_battery)
+            || user_cpu_usage
+                > settings
+                    .index_cpu_threshold
+                    .unwrap_or(DEFAULT_CPU_THRESHOLD);
+
+        if control.set_low_power(low_power) {
+            println!(
+                "Indexing low-power mode {} (on battery: {}, user cpu: {:.1}%)",
+                if low_power { "enabled" } else { "disabled" },
+                on_battery,
+                user_cpu_usage
+            );
+
+            let _ = app_handle.emit(
+                "indexing-status-changed",
+                IndexingStatus {
+                    paused: control.is_paused(),
+                    running: control.is_running(),
+                    low_power,
+                    on_battery,
+                    user_cpu_usage,
+                    freshness: control.freshness(),
+                },
+            );
+        }
+    }
+}
+
+/// Reads the power source from pmset
+#[cfg(target_os = "macos")]
+async fn is_on_battery() -> bool {
+    match tokio::process::Command::new("pmset")
+        .args(["-g", "ps"])
+        .output()
+        .await
+    {
+        Ok(output) => String::from_utf8_lossy(&output.stdout).contains("Battery Power"),
+        Err(e) => {
+            eprintln!("Failed to read power source: {}", e);
+            false
+        }
+    }
+}
+
+#[cfg(not(target_os = "macos"))]
+async fn is_on_battery() -> bool {
+    false
+}
+
+fn current_status(control: &IndexingControl) -> IndexingStatus {
+    IndexingStatus {
+        paused: control.is_paused(),
+        running: control.is_running(),
+        low_power: control.is_low_power(),
+        freshness: control.freshness(),
+        ..IndexingStatus::default()
+    }
+}
+
+#[tauri::command]
+pub fn pause_indexing(
+    control: State<'_, Arc<IndexingControl>>,
+    app_handle: AppHandle,
+) -> Result<IndexingStatus, String> {
+    control.pause();
+
+    let status = current_status(&control);
+    let _ = app_handle.emit("indexing-status-changed", &status);
+    Ok(status)
+}
+
+#[tauri::command]
+pub fn resume_indexing(
+    control: State<'_, Arc<IndexingControl>>,
+    app_handle: AppHandle,
+) -> Result<IndexingStatus, String> {
+    control.resume();
+
+    let status = current_status(&control);
+    let _ = app_handle.emit("indexing-status-changed", &status);
+    Ok(status)
+}
+
+/// Stops the running background runs. They are recorded as cancelled by the user
+#[tauri::command]
+pub fn cancel_indexing(
+    control: State<'_, Arc<IndexingControl>>,
+    app_handle: AppHandle,
+) -> Result<IndexingStatus, String> {
+    control.cancel(CancelReason::User);
+
+    let status = current_status(&control);
+    let _ = app_handle.emit("indexing-status-changed", &status);
+    Ok(status)
+}
+
+#[tauri::command]
+pub fn get_indexing_status(
+    control: State<'_, Arc<IndexingControl>>,
+) -> Result<IndexingStatus, String> {
+    Ok(current_status(&control))
+}
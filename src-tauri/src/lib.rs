@@ -1,14 +1,44 @@
 mod app_handler;
 mod chunker;
+mod connectors;
 mod contacts;
+mod content;
 mod database_handler;
 mod embedder;
+mod embedding_migration;
+mod encryption;
+mod entities;
+mod fault_injection;
+mod feedback;
 mod file_processor;
 mod file_watcher;
+mod health;
+mod history;
+mod icons;
+mod index_archive;
+mod index_profiles;
+mod index_runs;
+mod indexing_control;
+mod maintenance;
 mod model_registry;
+mod network;
+mod opens;
+mod platform;
+mod ranking;
+mod redaction;
+mod reembed;
 mod resource_monitor;
+mod retention;
+mod retrieval;
+mod scheduler;
+mod secrets;
 mod server;
 mod settings;
+mod storage_budget;
+mod summarizer;
+mod symbols;
+mod sync;
+mod thumbnails;
 mod tokenizer;
 mod utils;
 mod vectordb_manager;
@@ -19,6 +49,40 @@ use tauri::Manager;
 
 type AppResult<T> = Result<T, Box<dyn std::error::Error>>;
 
+/// Handles `kita <command>` invocations from a terminal. Returns the exit code, or None when the app should start
+pub fn run_cli(args: &[String]) -> Option<i32> {
+    let args = match fault_injection::take_fault_inject_arg(args) {
+        Ok(args) => args,
+        Err(e) => {
+            eprintln!("{}", e);
+            return Some(1);
+        }
+    };
+
+    let result = match args.split_first() {
+        Some((command, rest)) if command == "auth" => secrets::run_auth_command(rest),
+        Some((command, rest)) if command == "connect" => connectors::run_connect_command(rest),
+        Some((command, rest)) if command == "export" => index_archive::run_export_command(rest),
+        Some((command, rest)) if command == "import" => index_archive::run_import_command(rest),
+        Some((command, rest)) if command == "maintain" => maintenance::run_maintain_command(rest),
+        Some((command, rest)) if command == "migrate-embeddings" => {
+            embedding_migration::run_migrate_embeddings_command(rest)
+        }
+        Some((command, rest)) if command == "reembed" => reembed::run_reembed_command(rest),
+        Some((command, rest)) if command == "status" => index_runs::run_status_command(rest),
+        Some((command, rest)) if command == "sync" => sync::run_sync_command(rest),
+        _ => return None,
+    };
+
+    match result {
+        Ok(()) => Some(0),
+        Err(e) => {
+            eprintln!("{}", e);
+            Some(1)
+        }
+    }
+}
+
 #[cfg_attr(mobile, tauri::mobile_entry_point)]
 pub fn run() {
     tauri::Builder::default()
@@ -30,10 +94,24 @@ pub fn run() {
             let db_path_str = &db_path.to_string_lossy();
 
             settings::init_settings(&db_path_str, app.app_handle().clone())?;
+            // before anything reads or writes the index
+            let settings = app
+                .state::<settings::SettingsManagerState>()
+                .0
+                .get_settings()
+                .unwrap_or_default();
+            encryption::init_encryption(&settings, &db_path);
             file_processor::init_file_processor(&db_path_str, 4, app.app_handle().clone())?;
+            indexing_control::init_indexing_control(app)?;
             file_watcher::init_file_watcher(app, &db_path)?;
+            scheduler::init_scheduler(app)?;
             resource_monitor::init_resource_monitor(app)?;
             vectordb_manager::init_vector_db(app)?;
+            embedding_migration::init_migration_watch(app)?;
+            reembed::init_reembed(app)?;
+            health::init_health(app)?;
+            storage_budget::init_storage_budget(app)?;
+            summarizer::init_summarizer(app)?;
             // server::init_server(app)?;
             // server::register_llm_commands(app)?;
 
@@ -52,6 +130,44 @@ pub fn run() {
             file_processor::get_files_data,
             file_processor::get_semantic_files_data,
             file_processor::open_file,
+            opens::record_open,
+            opens::get_recent_files,
+            opens::get_frequent_files,
+            index_archive::export_index,
+            index_archive::import_index,
+            maintenance::maintain_database,
+            health::get_index_health,
+            storage_budget::get_storage_stats,
+            embedder::get_embedder_stats,
+            content::get_file,
+            content::get_chunk,
+            indexing_control::pause_indexing,
+            indexing_control::resume_indexing,
+            indexing_control::cancel_indexing,
+            indexing_control::get_indexing_status,
+            index_runs::get_index_runs,
+            retrieval::retrieve,
+            scheduler::get_scan_schedules,
+            feedback::record_feedback,
+            ranking::set_file_pinned,
+            redaction::get_sensitive_findings,
+            history::get_file_history,
+            history::search_file_history,
+            history::diff_file_versions,
+            connectors::get_connector_auth_url,
+            connectors::authorize_connector,
+            connectors::connect_connector,
+            connectors::connect_local_connector,
+            connectors::sync_connector_command,
+            connectors::list_connectors,
+            connectors::disconnect_connector,
+            connectors::mailbox::get_email_thread,
+            secrets::get_secrets,
+            secrets::store_secret,
+            secrets::remove_secret,
+            symbols::search_symbols,
+            entities::list_entities,
+            entities::get_entity_files,
             model_registry::get_models,
             model_registry::get_downloaded_models,
             model_registry::start_model_download,
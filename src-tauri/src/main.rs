@@ -2,5 +2,10 @@
 #![cfg_attr(not(debug_assertions), windows_subsystem = "windows")]
 
 fn main() {
+    let args: Vec<String> = std::env::args().skip(1).collect();
+    if let Some(code) = kita_lib::run_cli(&args) {
+        std::process::exit(code);
+    }
+
     kita_lib::run()
 }
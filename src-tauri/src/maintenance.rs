@@ -0,0 +1,366 @@
+/*
+This file contains the database maintenance routine: pruning files past their root's retention, integrity check, vacuum, rebuilding the FTS index from the stored data, dropping orphaned vectors and rewriting the ones encryption at rest left behind,
+since long-lived indexes bloat and occasionally corrupt. Files are evicted here too when the index is over its storage budget, see storage_budget.rs.
+`kita maintain` runs the same steps from the terminal, except retention and the storage budget, which need the running app
+*/
+
+use rusqlite::{params, Connection};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use tauri::{AppHandle, Manager, State};
+use thiserror::Error;
+use tokio::sync::Mutex;
+use tokio::task;
+use walkdir::WalkDir;
+
+use crate::database_handler::default_database_path;
+use crate::encryption;
+use crate::file_processor::{get_processor, stored_doc_text, FileProcessorState};
+use crate::retention::{prune_expired, RetentionPolicy};
+use crate::settings::{SettingsManager, SettingsManagerState};
+use crate::storage_budget;
+use crate::vectordb_manager::{VectorDbManager, VECTOR_DB_DIR};
+
+#[derive(Error, Debug)]
+pub enum MaintenanceError {
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Vector DB error: {0}")]
+    VectorDb(String),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = MaintenanceError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct MaintenanceReport {
+    /// Files dropped by the retention rules
+    pub pruned_files: usize,
+    pub integrity_ok: bool,
+    pub integrity_messages: Vec<String>,
+    pub fts_rows_rebuilt: usize,
+    pub vector_chunks_kept: usize,
+    pub orphaned_chunks_removed: usize,
+    /// Files whose content was dropped to get under the storage budget
+    pub evicted_files: usize,
+    pub bytes_before: u64,
+    pub bytes_after: u64,
+    pub bytes_reclaimed: u64,
+}
+
+/// Runs all the maintenance steps against the sqlite database and the vector db
+pub async fn maintain_index(app_handle: &AppHandle, db_path: PathBuf) -> Result<MaintenanceReport> {
+    let data_dir = db_path
+        .parent()
+        .map(Path::to_path_buf)
+        .ok_or_else(|| MaintenanceError::Other("Database has no parent directory".into()))?;
+    let vectordb_path = vectordb_path(app_handle).unwrap_or_else(|_| data_dir.join("vector_db"));
+
+    let bytes_before = storage_size(&db_path, &vectordb_path);
+
+    // retention goes first, the rebuilds below then drop whatever the pruned files left behind
+    let settings = app_handle
+        .state::<SettingsManagerState>()
+        .0
+        .get_settings()
+        .unwrap_or_default();
+    let pruned_files = prune_expired(
+        app_handle,
+        db_path.clone(),
+        &RetentionPolicy::from_settings(&settings),
+    )
+    .await
+    .map_err(|e| MaintenanceError::Other(format!("Failed to prune expired files: {}", e)))?;
+
+    // over the storage budget, the content of the least used files goes before the table is rebuilt
+    let evicted_files = storage_budget::evict_to_budget(app_handle, db_path.clone())
+        .await
+        .map_err(|e| MaintenanceError::Other(format!("Failed to evict files: {}", e)))?;
+
+    let vectordb = app_handle
+        .state::<Arc<Mutex<VectorDbManager>>>()
+        .inner()
+        .clone();
+    let report = maintain_storage(&vectordb, db_path, &vectordb_path).await?;
+    let report = MaintenanceReport {
+        pruned_files,
+        evicted_files,
+        bytes_before,
+        bytes_reclaimed: bytes_before.saturating_sub(report.bytes_after),
+        ..report
+    };
+
+    println!("Maintenance finished: {:?}", report);
+
+    Ok(report)
+}
+
+/// The steps that only need the two databases: integrity check, FTS rebuild, vector cleanup and vacuum
+async fn maintain_storage(
+    vectordb: &Mutex<VectorDbManager>,
+    db_path: PathBuf,
+    vectordb_path: &Path,
+) -> Result<MaintenanceReport> {
+    let bytes_before = storage_size(&db_path, vectordb_path);
+
+    // integrity check and FTS rebuild
+    let sqlite_path = db_path.clone();
+    let (integrity_messages, fts_rows_rebuilt) =
+        task::spawn_blocking(move || -> Result<(Vec<String>, usize)> {
+            let conn = Connection::open(&sqlite_path)?;
+
+            let integrity_messages = check_integrity(&conn)?;
+            if !is_integrity_ok(&integrity_messages) {
+                eprintln!("Integrity check failed: {:?}", integrity_messages);
+                // rebuilding the btree indexes fixes the most common kind of corruption
+                conn.execute_batch("REINDEX;")?;
+            }
+
+            let fts_rows_rebuilt = rebuild_fts(&conn)?;
+
+            Ok((integrity_messages, fts_rows_rebuilt))
+        })
+        .await
+        .map_err(|e| MaintenanceError::Other(format!("spawn_blocking error: {e}")))??;
+
+    // drop the chunks of files that are no longer indexed in place, then compact the table.
+    // The vectors are read before the files, a file is always stored before its vectors, so a file indexed meanwhile isn't taken for an orphan
+    let manager = vectordb.lock().await;
+    let total_chunks = manager
+        .row_count()
+        .await
+        .map_err(|e| MaintenanceError::VectorDb(e.to_string()))?;
+    let vector_file_ids = manager
+        .file_ids()
+        .await
+        .map_err(|e| MaintenanceError::VectorDb(e.to_string()))?;
+
+    let sqlite_path = db_path.clone();
+    let file_ids = task::spawn_blocking(move || -> Result<HashSet<String>> {
+        let conn = Connection::open(&sqlite_path)?;
+        get_file_ids(&conn)
+    })
+    .await
+    .map_err(|e| MaintenanceError::Other(format!("spawn_blocking error: {e}")))??;
+
+    let orphaned: Vec<String> = vector_file_ids
+        .into_iter()
+        .filter(|id| !file_ids.contains(id))
+        .collect();
+    manager
+        .delete_files(&orphaned)
+        .await
+        .map_err(|e| MaintenanceError::VectorDb(e.to_string()))?;
+    // rows written before encryption at rest was turned on or off are rewritten the way it is set now
+    let to_reseal = manager
+        .files_to_reseal()
+        .await
+        .map_err(|e| MaintenanceError::VectorDb(e.to_string()))?;
+    for file_id in &to_reseal {
+        manager
+            .reseal_file(file_id)
+            .await
+            .map_err(|e| MaintenanceError::VectorDb(e.to_string()))?;
+    }
+    manager
+        .compact()
+        .await
+        .map_err(|e| MaintenanceError::VectorDb(e.to_string()))?;
+    let vector_chunks_kept = manager
+        .row_count()
+        .await
+        .map_err(|e| MaintenanceError::VectorDb(e.to_string()))?;
+    let orphaned_chunks_removed = total_chunks.saturating_sub(vector_chunks_kept);
+    drop(manager);
+
+    // vacuum last so it reclaims the pages freed by the FTS rebuild
+    let sqlite_path = db_path.clone();
+    task::spawn_blocking(move || -> Result<()> {
+        let conn = Connection::open(&sqlite_path)?;
+        conn.execute_batch(
+            r#"
+            PRAGMA wal_checkpoint(TRUNCATE);
+            VACUUM;
+            "#,
+        )?;
+        Ok(())
+    })
+    .await
+    .map_err(|e| MaintenanceError::Other(format!("spawn_blocking error: {e}")))??;
+
+    let bytes_after = storage_size(&db_path, vectordb_path);
+
+    Ok(MaintenanceReport {
+        pruned_files: 0,
+        integrity_ok: is_integrity_ok(&integrity_messages),
+        integrity_messages,
+        fts_rows_rebuilt,
+        vector_chunks_kept,
+        orphaned_chunks_removed,
+        evicted_files: 0,
+        bytes_before,
+        bytes_after,
+        bytes_reclaimed: bytes_before.saturating_sub(bytes_after),
+    })
+}
+
+fn check_integrity(conn: &Connection) -> Result<Vec<String>> {
+    let mut stmt = conn.prepare("PRAGMA integrity_check")?;
+    let messages = stmt
+        .query_map([], |row| row.get::<_, String>(0))?
+        .collect::<std::result::Result<Vec<_>, _>>()?;
+
+    Ok(messages)
+}
+
+fn is_integrity_ok(messages: &[String]) -> bool {
+    messages.len() == 1 && messages[0] == "ok"
+}
+
+/// files_fts is contentless, so it is rebuilt by clearing it and re-deriving doc_text from the files table
+fn rebuild_fts(conn: &Connection) -> Result<usize> {
+    conn.execute("INSERT INTO files_fts(files_fts) VALUES('delete-all')", [])?;
+
+    let mut select = conn.prepare("SELECT id FROM files")?;
+    let ids = select
+        .query_map([], |row| row.get::<_, i64>(0))?
+        .collect::<std::result::Result<Vec<_>, _>>()?;
+
+    let mut insert = conn.prepare("INSERT INTO files_fts(rowid, doc_text) VALUES (?1, ?2)")?;
+    for id in &ids {
+        if let Some(doc_text) = stored_doc_text(conn, *id)? {
+            insert.execute(params![id, doc_text])?;
+        }
+    }
+
+    conn.execute("INSERT INTO files_fts(files_fts) VALUES('optimize')", [])?;
+
+    Ok(ids.len())
+}
+
+fn get_file_ids(conn: &Connection) -> Result<HashSet<String>> {
+    let mut stmt = conn.prepare("SELECT id FROM files")?;
+    let ids = stmt
+        .query_map([], |row| row.get::<_, i64>(0))?
+        .filter_map(|id| id.ok())
+        .map(|id| id.to_string())
+        .collect();
+
+    Ok(ids)
+}
+
+/// Where the vector db lives
+pub fn vectordb_path(app_handle: &AppHandle) -> Result<PathBuf> {
+    app_handle
+        .path()
+        .app_data_dir()
+        .map(|dir| dir.join("vector_db"))
+        .map_err(|_| MaintenanceError::Other("Failed to get app data directory".into()))
+}
+
+/// Total bytes used by the sqlite database (including WAL files) and the vector db directory
+pub fn storage_size(db_path: &Path, vectordb_path: &Path) -> u64 {
+    sqlite_size(db_path) + vector_size(vectordb_path)
+}
+
+pub fn sqlite_size(db_path: &Path) -> u64 {
+    let db_str = db_path.to_string_lossy();
+    [
+        db_str.to_string(),
+        format!("{}-wal", db_str),
+        format!("{}-shm", db_str),
+    ]
+    .iter()
+    .filter_map(|p| std::fs::metadata(p).ok())
+    .map(|m| m.len())
+    .sum()
+}
+
+pub fn vector_size(vectordb_path: &Path) -> u64 {
+    WalkDir::new(vectordb_path)
+        .into_iter()
+        .filter_map(|e| e.ok())
+        .filter(|e| e.file_type().is_file())
+        .filter_map(|e| e.metadata().ok())
+        .map(|m| m.len())
+        .sum()
+}
+
+#[tauri::command]
+pub async fn maintain_database(
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> std::result::Result<MaintenanceReport, String> {
+    let processor = get_processor(&state)?;
+
+    maintain_index(&app_handle, processor.db_path)
+        .await
+        .map_err(|e| format!("Maintenance failed: {}", e))
+}
+
+/// `kita maintain` checks and compacts the index from the terminal
+pub fn run_maintain_command(args: &[String]) -> std::result::Result<(), String> {
+    if !args.is_empty() {
+        return Err("Usage: kita maintain".to_string());
+    }
+
+    let db_path = default_database_path()
+        .filter(|path| path.exists())
+        .ok_or_else(|| "No kita database found, start kita once first".to_string())?;
+    let vectordb_path = db_path
+        .parent()
+        .map(|dir| dir.join(VECTOR_DB_DIR))
+        .ok_or_else(|| "Database has no parent directory".to_string())?;
+
+    let settings_manager = SettingsManager::new(&db_path.to_string_lossy());
+    settings_manager
+        .initialize()
+        .map_err(|e| format!("Failed to load settings: {}", e))?;
+    let settings = settings_manager.get_settings().unwrap_or_default();
+    // rewriting the rows encryption at rest left behind needs the key
+    encryption::init_encryption(&settings, &db_path);
+
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .map_err(|e| format!("Failed to start runtime: {}", e))?;
+    let vectordb = Mutex::new(
+        runtime
+            .block_on(VectorDbManager::open_default())
+            .map_err(|e| format!("Failed to open the vector DB: {}", e))?,
+    );
+
+    let report = runtime
+        .block_on(maintain_storage(&vectordb, db_path, &vectordb_path))
+        .map_err(|e| format!("Maintenance failed: {}", e))?;
+
+    if report.integrity_ok {
+        println!("Integrity check passed");
+    } else {
+        println!(
+            "Integrity check found problems, the indexes were rebuilt:\n{}",
+            report.integrity_messages.join("\n")
+        );
+    }
+    println!(
+        "Rebuilt the full-text index for {} files",
+        report.fts_rows_rebuilt
+    );
+    println!(
+        "Kept {} vector chunks, removed {} orphaned ones",
+        report.vector_chunks_kept, report.orphaned_chunks_removed
+    );
+    println!(
+        "Reclaimed {} bytes ({} -> {})",
+        report.bytes_reclaimed, report.bytes_before, report.bytes_after
+    );
+    Ok(())
+}
@@ -0,0 +1,173 @@
+/*
+This file contains the proxy and TLS configuration shared by every outgoing HTTP client (embedding service, connectors), so kita works behind corporate proxies that intercept TLS.
+Without a proxy in the settings reqwest falls back to the HTTP_PROXY, HTTPS_PROXY, ALL_PROXY and NO_PROXY environment variables.
+It also has the small HTTP/1.1 client used for services listening on a Unix socket, which reqwest can't connect to
+*/
+
+use reqwest::{Certificate, ClientBuilder, Identity, NoProxy, Proxy};
+use std::path::Path;
+use thiserror::Error;
+
+use crate::settings::AppSettings;
+
+#[derive(Error, Debug)]
+pub enum NetworkError {
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("HTTP client error: {0}")]
+    Http(#[from] reqwest::Error),
+
+    #[error("Invalid CA bundle {0}: no certificates found")]
+    EmptyCaBundle(String),
+
+    #[error("Invalid HTTP response: {0}")]
+    InvalidResponse(String),
+
+    #[error("Unix socket endpoints aren't supported on this platform")]
+    UnixSocketUnsupported,
+}
+
+type Result<T, E = NetworkError> = std::result::Result<T, E>;
+
+/// Applies the proxy, CA bundle and certificate verification settings to a client builder
+pub fn configure_client(builder: ClientBuilder, settings: &AppSettings) -> Result<ClientBuilder> {
+    let mut builder = builder;
+
+    if let Some(proxy_url) = settings.http_proxy.as_deref().filter(|p| !p.is_empty()) {
+        // an explicit proxy turns off the environment variables, so NO_PROXY has to be carried over
+        let no_proxy = settings
+            .no_proxy
+            .clone()
+            .or_else(|| std::env::var("NO_PROXY").ok())
+            .or_else(|| std::env::var("no_proxy").ok());
+
+        builder = builder.proxy(Proxy::all(proxy_url)?.no_proxy(NoProxy::from_string(
+            no_proxy.as_deref().unwrap_or_default(),
+        )));
+    }
+
+    if let Some(path) = settings.tls_ca_bundle.as_deref().filter(|p| !p.is_empty()) {
+        let pem = std::fs::read(path)?;
+        let certificates = Certificate::from_pem_bundle(&pem)?;
+        if certificates.is_empty() {
+            return Err(NetworkError::EmptyCaBundle(path.to_string()));
+        }
+
+        // added on top of the system roots, so public endpoints keep working
+        for certificate in certificates {
+            builder = builder.add_root_certificate(certificate);
+        }
+    }
+
+    if settings.tls_skip_verify.unwrap_or(false) {
+        eprintln!("TLS certificate verification is disabled for outgoing requests");
+        builder = builder.danger_accept_invalid_certs(true);
+    }
+
+    Ok(builder)
+}
+
+/// Client certificate for services that require mutual TLS, from a PEM certificate (chain) and its PKCS#8 PEM key
+pub fn client_identity(cert_path: &str, key_path: &str) -> Result<Identity> {
+    let cert = std::fs::read(cert_path)?;
+    let key = std::fs::read(key_path)?;
+    Ok(Identity::from_pkcs8_pem(&cert, &key)?)
+}
+
+/// The socket path of a "unix:/path" or "unix:///path" endpoint, None for any other endpoint
+pub fn unix_socket_path(endpoint: &str) -> Option<&str> {
+    endpoint
+        .strip_prefix("unix://")
+        .or_else(|| endpoint.strip_prefix("unix:"))
+        .filter(|path| !path.is_empty())
+}
+
+/// POSTs a JSON body over a Unix socket, one connection per request. Returns the status and the body of the response
+#[cfg(unix)]
+pub async fn post_json_unix(
+    socket: &Path,
+    path: &str,
+    headers: &[(String, String)],
+    body: &[u8],
+) -> Result<(u16, Vec<u8>)> {
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+    let mut stream = tokio::net::UnixStream::connect(socket).await?;
+
+    let mut request = format!(
+        "POST {} HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n",
+        path,
+        body.len()
+    );
+    for (name, value) in headers {
+        request.push_str(&format!("{}: {}\r\n", name, value));
+    }
+    request.push_str("\r\n");
+
+    stream.write_all(request.as_bytes()).await?;
+    stream.write_all(body).await?;
+
+    // the server closes the connection after the response
+    let mut response = Vec::new();
+    stream.read_to_end(&mut response).await?;
+    parse_http_response(&response)
+}
+
+#[cfg(not(unix))]
+pub async fn post_json_unix(
+    _socket: &Path,
+    _path: &str,
+    _headers: &[(String, String)],
+    _body: &[u8],
+) -> Result<(u16, Vec<u8>)> {
+    Err(NetworkError::UnixSocketUnsupported)
+}
+
+fn find(haystack: &[u8], needle: &[u8]) -> Option<usize> {
+    haystack
+        .windows(needle.len())
+        .position(|window| window == needle)
+}
+
+fn parse_http_response(response: &[u8]) -> Result<(u16, Vec<u8>)> {
+    let invalid = |reason: &str| NetworkError::InvalidResponse(reason.to_string());
+
+    let header_end = find(response, b"\r\n\r\n").ok_or_else(|| invalid("no end of headers"))?;
+    let head = String::from_utf8_lossy(&response[..header_end]);
+    let mut lines = head.split("\r\n");
+
+    let status = lines
+        .next()
+        .and_then(|status_line| status_line.split_whitespace().nth(1))
+        .and_then(|code| code.parse::<u16>().ok())
+        .ok_or_else(|| invalid("no status code"))?;
+    let chunked = lines.any(|line| {
+        let line = line.to_ascii_lowercase();
+        line.starts_with("transfer-encoding:") && line.contains("chunked")
+    });
+
+    let body = &response[header_end + 4..];
+    if !chunked {
+        return Ok((status, body.to_vec()));
+    }
+
+    let mut decoded = Vec::new();
+    let mut rest = body;
+    loop {
+        let line_end = find(rest, b"\r\n").ok_or_else(|| invalid("truncated chunk"))?;
+        let size_line = String::from_utf8_lossy(&rest[..line_end]);
+        let size = usize::from_str_radix(size_line.split(';').next().unwrap_or("").trim(), 16)
+            .map_err(|_| invalid("bad chunk size"))?;
+        rest = &rest[line_end + 2..];
+
+        if size == 0 {
+            return Ok((status, decoded));
+        }
+        if rest.len() < size {
+            return Err(invalid("truncated chunk"));
+        }
+        decoded.extend_from_slice(&rest[..size]);
+        rest = &rest[(size + 2).min(rest.len())..];
+    }
+}
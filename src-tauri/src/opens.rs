@@ -0,0 +1,181 @@
+/*
+This file contains the record of the files the user opened from kita. Every launch of a result is stored with its time, which gives the launcher its recent
+and frequently used files before anything is typed, and the frecency stage in ranking.rs what it learns from. Opens are kept by path, so they survive a file
+being indexed again under a new id, and files that are no longer indexed drop out of the lists
+*/
+
+use rusqlite::{params, Connection};
+use std::path::PathBuf;
+use tauri::State;
+use thiserror::Error;
+use tokio::task;
+
+use crate::file_processor::{
+    get_processor, rows_to_file_metadata, FileMetadata, FileProcessorState,
+};
+
+const DEFAULT_LIST_LIMIT: usize = 20;
+/// Frequent files are counted over this many days, so a file used a lot last year doesn't stay on top
+const DEFAULT_FREQUENT_DAYS: u32 = 30;
+/// Older opens are dropped when a new one is recorded, the frecency stage gives them next to no weight by then
+const MAX_OPEN_AGE_DAYS: u32 = 365;
+
+#[derive(Error, Debug)]
+pub enum OpensError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("File {0} is not indexed")]
+    NotIndexed(i64),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = OpensError> = std::result::Result<T, E>;
+
+/// The columns rows_to_file_metadata reads, for files `f` that have opens `o`
+const FILE_COLUMNS: &str = r#"
+    f.id,
+    f.name,
+    f.path,
+    f.extension,
+    f.size,
+    f.created_at,
+    f.updated_at,
+    f.link_target,
+    f.title,
+    f.authors,
+    f.tags,
+    f.content_created_at,
+    (SELECT summary FROM summaries WHERE file_id = f.id)
+"#;
+
+fn save_open(conn: &Connection, path: &str) -> rusqlite::Result<()> {
+    conn.execute("INSERT INTO opens (path) VALUES (?1)", [path])?;
+    conn.execute(
+        "DELETE FROM opens WHERE opened_at < datetime('now', ?1)",
+        [format!("-{} days", MAX_OPEN_AGE_DAYS)],
+    )?;
+
+    Ok(())
+}
+
+/// Records that the file at `path` was opened, for files opened through open_file
+pub async fn record_open_path(db_path: PathBuf, path: String) -> Result<()> {
+    task::spawn_blocking(move || {
+        let conn = Connection::open(db_path)?;
+        save_open(&conn, &path)?;
+        Ok(())
+    })
+    .await
+    .map_err(|e| OpensError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+fn record_open_id(conn: &Connection, file_id: i64) -> Result<()> {
+    let path: String = conn
+        .query_row("SELECT path FROM files WHERE id = ?1", [file_id], |row| {
+            row.get(0)
+        })
+        .map_err(|e| match e {
+            rusqlite::Error::QueryReturnedNoRows => OpensError::NotIndexed(file_id),
+            e => OpensError::Db(e),
+        })?;
+
+    save_open(conn, &path)?;
+    Ok(())
+}
+
+/// Files by their last open, latest first
+fn recent_files(conn: &Connection, limit: usize) -> Result<Vec<FileMetadata>> {
+    let mut stmt = conn.prepare(&format!(
+        r#"
+        SELECT {}
+        FROM files f
+        JOIN (SELECT path, MAX(opened_at) AS last_opened_at FROM opens GROUP BY path) o
+          ON o.path = f.path
+        ORDER BY o.last_opened_at DESC
+        LIMIT ?1
+        "#,
+        FILE_COLUMNS
+    ))?;
+
+    let rows = stmt.query(params![limit as i64])?;
+    rows_to_file_metadata(rows).map_err(OpensError::Other)
+}
+
+/// Files by how often they were opened in the last `days` days, the more recent one first on a tie
+fn frequent_files(conn: &Connection, limit: usize, days: u32) -> Result<Vec<FileMetadata>> {
+    let mut stmt = conn.prepare(&format!(
+        r#"
+        SELECT {}
+        FROM files f
+        JOIN (
+          SELECT path, COUNT(*) AS open_count, MAX(opened_at) AS last_opened_at
+          FROM opens
+          WHERE opened_at >= datetime('now', ?2)
+          GROUP BY path
+        ) o ON o.path = f.path
+        ORDER BY o.open_count DESC, o.last_opened_at DESC
+        LIMIT ?1
+        "#,
+        FILE_COLUMNS
+    ))?;
+
+    let rows = stmt.query(params![limit as i64, format!("-{} days", days)])?;
+    rows_to_file_metadata(rows).map_err(OpensError::Other)
+}
+
+/// For results the UI launches without open_file, which records its opens itself
+#[tauri::command]
+pub async fn record_open(
+    file_id: i64,
+    state: State<'_, FileProcessorState>,
+) -> std::result::Result<(), String> {
+    let processor = get_processor(&state)?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        record_open_id(&conn, file_id)
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to record open: {}", e))
+}
+
+#[tauri::command]
+pub async fn get_recent_files(
+    limit: Option<usize>,
+    state: State<'_, FileProcessorState>,
+) -> std::result::Result<Vec<FileMetadata>, String> {
+    let processor = get_processor(&state)?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        recent_files(&conn, limit.unwrap_or(DEFAULT_LIST_LIMIT))
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to get recent files: {}", e))
+}
+
+#[tauri::command]
+pub async fn get_frequent_files(
+    limit: Option<usize>,
+    days: Option<u32>,
+    state: State<'_, FileProcessorState>,
+) -> std::result::Result<Vec<FileMetadata>, String> {
+    let processor = get_processor(&state)?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        frequent_files(
+            &conn,
+            limit.unwrap_or(DEFAULT_LIST_LIMIT),
+            days.unwrap_or(DEFAULT_FREQUENT_DAYS),
+        )
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to get frequent files: {}", e))
+}
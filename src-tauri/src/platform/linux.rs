@@ -0,0 +1,329 @@
+/// Linux implementation. Apps come from the .desktop entries in the XDG data dirs, icons are resolved
+/// through the icon themes and process control goes through sysinfo
+use base64::{engine::general_purpose::STANDARD, Engine};
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use super::processes;
+use super::DocumentAttributes;
+use crate::app_handler::AppMetadata;
+
+const ICON_SIZES: [&str; 6] = ["256x256", "128x128", "96x96", "64x64", "48x48", "scalable"];
+
+/// The fields of a [Desktop Entry] section kita uses
+#[derive(Debug, Default)]
+struct DesktopEntry {
+    name: Option<String>,
+    exec: Option<String>,
+    icon: Option<String>,
+    entry_type: Option<String>,
+    no_display: bool,
+    hidden: bool,
+}
+
+/// $XDG_DATA_HOME followed by $XDG_DATA_DIRS, with the defaults from the base directory spec
+fn xdg_data_dirs() -> Vec<PathBuf> {
+    let mut roots: Vec<PathBuf> = Vec::new();
+
+    if let Some(data_home) = dirs::data_dir() {
+        roots.push(data_home);
+    }
+
+    let data_dirs = std::env::var("XDG_DATA_DIRS")
+        .ok()
+        .filter(|value| !value.is_empty())
+        .unwrap_or_else(|| "/usr/local/share:/usr/share".to_string());
+
+    roots.extend(
+        data_dirs
+            .split(':')
+            .filter(|dir| !dir.is_empty())
+            .map(PathBuf::from),
+    );
+    roots
+}
+
+fn parse_desktop_entry(path: &Path) -> Option<DesktopEntry> {
+    let content = std::fs::read_to_string(path).ok()?;
+    let mut entry = DesktopEntry::default();
+    let mut in_entry_section = false;
+
+    for line in content.lines() {
+        let line = line.trim();
+        if line.starts_with('[') {
+            in_entry_section = line == "[Desktop Entry]";
+            continue;
+        }
+        if !in_entry_section || line.starts_with('#') {
+            continue;
+        }
+
+        // localized keys like Name[de] are skipped, the plain key is the fallback for every locale
+        let Some((key, value)) = line.split_once('=') else {
+            continue;
+        };
+        let value = value.trim().to_string();
+
+        match key.trim() {
+            "Name" => entry.name = Some(value),
+            "Exec" => entry.exec = Some(value),
+            "Icon" => entry.icon = Some(value),
+            "Type" => entry.entry_type = Some(value),
+            "NoDisplay" => entry.no_display = value == "true",
+            "Hidden" => entry.hidden = value == "true",
+            _ => {}
+        }
+    }
+
+    Some(entry)
+}
+
+/// Strips the field codes (%f, %U, ...) from an Exec line, they only make sense when opening files
+fn strip_field_codes(exec: &str) -> String {
+    exec.split_whitespace()
+        .filter(|arg| !(arg.len() == 2 && arg.starts_with('%') && arg != &"%%"))
+        .map(|arg| arg.replace("%%", "%"))
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+/// The binary an Exec line starts, skipping `env` and VAR=value prefixes
+fn exec_binary(exec: &str) -> Option<String> {
+    exec.split_whitespace()
+        .find(|arg| *arg != "env" && !arg.contains('='))
+        .and_then(|arg| Path::new(arg.trim_matches('"')).file_name())
+        .map(|name| name.to_string_lossy().into_owned())
+}
+
+fn get_installed_apps() -> Vec<(AppMetadata, DesktopEntry)> {
+    let mut ids = HashSet::new();
+    let mut apps = Vec::new();
+
+    for data_dir in xdg_data_dirs() {
+        let Ok(entries) = std::fs::read_dir(data_dir.join("applications")) else {
+            continue;
+        };
+
+        for file in entries.filter_map(|e| e.ok()) {
+            let path = file.path();
+            if path.extension().map(|ext| ext != "desktop").unwrap_or(true) {
+                continue;
+            }
+
+            // the same desktop file id in an earlier dir overrides the later ones, even when it hides the app
+            let id = file.file_name().to_string_lossy().into_owned();
+            if !ids.insert(id) {
+                continue;
+            }
+
+            let Some(entry) = parse_desktop_entry(&path) else {
+                continue;
+            };
+
+            let is_app = entry.entry_type.as_deref() == Some("Application")
+                && !entry.no_display
+                && !entry.hidden
+                && entry.exec.is_some();
+
+            if let (true, Some(name)) = (is_app, entry.name.clone()) {
+                apps.push((
+                    AppMetadata {
+                        name,
+                        path: normalize_path(&path),
+                        pid: None,
+                        icon: None,
+                        resource_usage: None,
+                    },
+                    entry,
+                ));
+            }
+        }
+    }
+
+    apps
+}
+
+/// Running processes matched to the desktop entry that launches their binary
+fn match_running_apps(installed: &[(AppMetadata, DesktopEntry)]) -> Vec<AppMetadata> {
+    let by_binary: HashMap<String, &AppMetadata> = installed
+        .iter()
+        .filter_map(|(app, entry)| {
+            entry
+                .exec
+                .as_deref()
+                .and_then(exec_binary)
+                .map(|binary| (binary, app))
+        })
+        .collect();
+
+    let mut running = Vec::new();
+    let mut seen = HashSet::new();
+
+    for process in processes::list_processes() {
+        let binary = process
+            .exe
+            .file_name()
+            .map(|name| name.to_string_lossy().into_owned())
+            .unwrap_or(process.name);
+
+        if let Some(app) = by_binary.get(&binary) {
+            // apps like browsers run many processes, the first one stands for the app
+            if seen.insert(app.path.clone()) {
+                running.push(AppMetadata {
+                    pid: Some(process.pid),
+                    ..(*app).clone()
+                });
+            }
+        }
+    }
+
+    running
+}
+
+/// Returns the running and the installed apps
+pub fn get_apps() -> Result<(Vec<AppMetadata>, Vec<AppMetadata>), String> {
+    let installed = get_installed_apps();
+    let running = match_running_apps(&installed);
+
+    Ok((running, installed.into_iter().map(|(app, _)| app).collect()))
+}
+
+pub fn get_running_apps() -> Result<Vec<AppMetadata>, String> {
+    Ok(match_running_apps(&get_installed_apps()))
+}
+
+/// Looks the icon name up in the hicolor theme and the pixmaps dir, largest size first
+fn find_icon(icon: &str) -> Option<PathBuf> {
+    let icon_path = Path::new(icon);
+    if icon_path.is_absolute() {
+        return icon_path.is_file().then(|| icon_path.to_path_buf());
+    }
+
+    let mut bases: Vec<PathBuf> = xdg_data_dirs()
+        .into_iter()
+        .map(|dir| dir.join("icons"))
+        .collect();
+    if let Some(home) = dirs::home_dir() {
+        bases.insert(0, home.join(".icons"));
+    }
+
+    for base in &bases {
+        for size in ICON_SIZES {
+            let ext = if size == "scalable" { "svg" } else { "png" };
+            let candidate = base
+                .join("hicolor")
+                .join(size)
+                .join("apps")
+                .join(format!("{}.{}", icon, ext));
+            if candidate.is_file() {
+                return Some(candidate);
+            }
+        }
+    }
+
+    ["png", "svg"]
+        .iter()
+        .map(|ext| Path::new("/usr/share/pixmaps").join(format!("{}.{}", icon, ext)))
+        .find(|candidate| candidate.is_file())
+}
+
+pub fn get_app_icon(app_path: &str) -> Result<Option<String>, String> {
+    let Some(icon) = parse_desktop_entry(Path::new(app_path)).and_then(|entry| entry.icon) else {
+        return Ok(None);
+    };
+    let Some(icon_path) = find_icon(&icon) else {
+        return Ok(None);
+    };
+
+    let mime = match icon_path.extension().and_then(|ext| ext.to_str()) {
+        Some("svg") => "image/svg+xml",
+        Some("png") => "image/png",
+        _ => return Ok(None),
+    };
+
+    let data = std::fs::read(&icon_path).map_err(|e| e.to_string())?;
+    Ok(Some(format!(
+        "data:{};base64,{}",
+        mime,
+        STANDARD.encode(data)
+    )))
+}
+
+/// Needs xdotool, which only works on X11. Callers fall back to launching the app when this fails
+pub fn switch_to_app(pid: u32) -> bool {
+    Command::new("xdotool")
+        .args([
+            "search",
+            "--onlyvisible",
+            "--pid",
+            &pid.to_string(),
+            "windowactivate",
+        ])
+        .status()
+        .map(|status| status.success())
+        .unwrap_or(false)
+}
+
+pub fn force_quit_app(pid: u32) -> bool {
+    processes::kill_process(pid)
+}
+
+pub fn launch_app(app_path: &str) -> bool {
+    let path = Path::new(app_path);
+    if path.extension().map(|ext| ext != "desktop").unwrap_or(true) {
+        return Command::new(path).spawn().is_ok();
+    }
+
+    let Some(exec) = parse_desktop_entry(path).and_then(|entry| entry.exec) else {
+        return false;
+    };
+
+    Command::new("sh")
+        .arg("-c")
+        .arg(strip_field_codes(&exec))
+        .spawn()
+        .is_ok()
+}
+
+pub fn is_process_running(pid: u32) -> bool {
+    processes::is_process_running(pid)
+}
+
+pub fn is_auxiliary_app_path(path: &str) -> bool {
+    path.contains("/usr/libexec") || path.contains("/usr/lib/")
+}
+
+pub fn is_hidden(path: &Path) -> bool {
+    super::has_hidden_name(path)
+}
+
+pub fn normalize_path(path: &Path) -> String {
+    path.to_string_lossy().into_owned()
+}
+
+/// There is no system wide metadata index to read from
+pub fn read_document_attributes(paths: &[PathBuf]) -> Vec<Option<DocumentAttributes>> {
+    paths.iter().map(|_| None).collect()
+}
+
+/// Renders the first page of a PDF as a PNG that fits in size x size, through pdftoppm from poppler-utils.
+/// None when it isn't installed
+pub fn render_pdf_preview(path: &Path, size: u32) -> Option<Vec<u8>> {
+    let dir = super::scratch_dir().ok()?;
+    let output = dir.join("preview");
+
+    let rendered = super::run_tool(
+        Command::new("pdftoppm")
+            .args(["-png", "-f", "1", "-l", "1", "-singlefile", "-scale-to"])
+            .arg(size.to_string())
+            .arg(path)
+            .arg(&output),
+    );
+    let png = rendered
+        .then(|| std::fs::read(output.with_extension("png")).ok())
+        .flatten();
+
+    let _ = std::fs::remove_dir_all(&dir);
+    png
+}
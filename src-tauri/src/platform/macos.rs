@@ -0,0 +1,255 @@
+/// macOS implementation, backed by the Swift bridge in src/swift/apps.swift
+use serde::Deserialize;
+use std::ffi::{CStr, CString};
+use std::os::macos::fs::MetadataExt;
+use std::os::raw::c_char;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use super::DocumentAttributes;
+use crate::app_handler::AppMetadata;
+
+/// In the order mdls -raw prints them
+const SPOTLIGHT_ATTRIBUTES: [&str; 4] = [
+    "kMDItemAuthors",
+    "kMDItemContentCreationDate",
+    "kMDItemTitle",
+    "kMDItemUserTags",
+];
+
+/// st_flags bit set on files hidden in Finder (chflags hidden)
+const UF_HIDDEN: u32 = 0x8000;
+
+extern "C" {
+    fn get_combined_apps_swift() -> *mut c_char;
+    fn get_running_apps_swift() -> *mut c_char;
+    fn get_app_icon_swift(path: *const c_char) -> *mut c_char;
+    fn switch_to_app_swift(pid: i32) -> bool;
+    fn force_quit_app_swift(pid: i32) -> bool;
+    fn restart_app_swift(path: *const c_char) -> bool;
+    fn check_process_running_swift(pid: i32) -> bool;
+    fn free_string_swift(pointer: *mut c_char);
+}
+
+#[derive(Deserialize)]
+struct AppsResponse {
+    running_apps: Vec<AppMetadata>,
+    installed_apps: Vec<AppMetadata>,
+}
+
+/// Copies a string returned by the Swift bridge and frees the original
+fn take_swift_string(pointer: *mut c_char) -> Result<String, String> {
+    unsafe {
+        let c_str = CStr::from_ptr(pointer);
+        let result = c_str
+            .to_str()
+            .map_err(|_| "Invalid UTF-8".to_string())
+            .map(|s| s.to_owned());
+        free_string_swift(pointer);
+        result
+    }
+}
+
+/// Returns the running and the installed apps
+pub fn get_apps() -> Result<(Vec<AppMetadata>, Vec<AppMetadata>), String> {
+    let apps_json_ptr = unsafe { get_combined_apps_swift() };
+    if apps_json_ptr.is_null() {
+        return Err("Failed to get apps".to_string());
+    }
+
+    let apps_json = take_swift_string(apps_json_ptr)?;
+    let apps_response: AppsResponse =
+        serde_json::from_str(&apps_json).map_err(|e| e.to_string())?;
+
+    Ok((apps_response.running_apps, apps_response.installed_apps))
+}
+
+pub fn get_running_apps() -> Result<Vec<AppMetadata>, String> {
+    let apps_json_ptr = unsafe { get_running_apps_swift() };
+    if apps_json_ptr.is_null() {
+        return Err("Failed to get apps".to_string());
+    }
+
+    let apps_json = take_swift_string(apps_json_ptr)?;
+    serde_json::from_str(&apps_json).map_err(|e| e.to_string())
+}
+
+pub fn get_app_icon(app_path: &str) -> Result<Option<String>, String> {
+    let path_cstring =
+        CString::new(app_path).map_err(|_| "Failed to create C string".to_string())?;
+
+    let icon_ptr = unsafe { get_app_icon_swift(path_cstring.as_ptr()) };
+    if icon_ptr.is_null() {
+        return Ok(None);
+    }
+
+    take_swift_string(icon_ptr).map(Some)
+}
+
+pub fn switch_to_app(pid: u32) -> bool {
+    unsafe { switch_to_app_swift(pid as i32) }
+}
+
+/// Asks the app to terminate, it may take a moment to actually exit
+pub fn force_quit_app(pid: u32) -> bool {
+    unsafe { force_quit_app_swift(pid as i32) }
+}
+
+pub fn launch_app(app_path: &str) -> bool {
+    match CString::new(app_path) {
+        Ok(path_cstring) => unsafe { restart_app_swift(path_cstring.as_ptr()) },
+        Err(_) => false,
+    }
+}
+
+pub fn is_process_running(pid: u32) -> bool {
+    unsafe { check_process_running_swift(pid as i32) }
+}
+
+/// Helpers, frameworks and plugins bundled inside other apps
+pub fn is_auxiliary_app_path(path: &str) -> bool {
+    path.contains(".framework")
+        || path.contains("Contents/Frameworks/")
+        || path.contains("Contents/XPCServices/")
+        || path.contains("Contents/PlugIns/")
+        || path.contains("Contents/Helpers/")
+        || path.contains("/usr/libexec")
+        || path.contains("System/Library/CoreServices/")
+}
+
+pub fn is_hidden(path: &Path) -> bool {
+    super::has_hidden_name(path)
+        || std::fs::symlink_metadata(path)
+            .map(|meta| meta.st_flags() & UF_HIDDEN != 0)
+            .unwrap_or(false)
+}
+
+pub fn normalize_path(path: &Path) -> String {
+    path.to_string_lossy().into_owned()
+}
+
+/// Reads the Spotlight attributes of several files with a single mdls call, in the order of `paths`.
+/// Files Spotlight doesn't know about (excluded volumes, indexing disabled) come back as None
+pub fn read_document_attributes(paths: &[PathBuf]) -> Vec<Option<DocumentAttributes>> {
+    if paths.is_empty() {
+        return Vec::new();
+    }
+
+    match read_raw_values(paths) {
+        Some(values) if values.len() == paths.len() * SPOTLIGHT_ATTRIBUTES.len() => values
+            .chunks(SPOTLIGHT_ATTRIBUTES.len())
+            .map(|values| {
+                let attributes = parse_raw_values(values);
+                (!attributes.is_empty()).then_some(attributes)
+            })
+            .collect(),
+        // one file mdls can't read fails the whole call, so each file is asked on its own
+        _ if paths.len() > 1 => paths
+            .iter()
+            .map(|path| {
+                read_document_attributes(std::slice::from_ref(path))
+                    .pop()
+                    .flatten()
+            })
+            .collect(),
+        _ => vec![None],
+    }
+}
+
+/// The values mdls -raw prints for every file and attribute, separated by NUL characters
+fn read_raw_values(paths: &[PathBuf]) -> Option<Vec<String>> {
+    let mut command = Command::new("mdls");
+    command.arg("-raw");
+    for attribute in SPOTLIGHT_ATTRIBUTES {
+        command.args(["-name", attribute]);
+    }
+
+    let output = command.args(paths).output().ok()?;
+    if !output.status.success() {
+        return None;
+    }
+
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    Some(
+        stdout
+            .strip_suffix('\0')
+            .unwrap_or(&stdout)
+            .split('\0')
+            .map(str::to_string)
+            .collect(),
+    )
+}
+
+/// Renders the first page of a PDF as a PNG that fits in size x size, through the Quick Look thumbnailer
+pub fn render_pdf_preview(path: &Path, size: u32) -> Option<Vec<u8>> {
+    let dir = super::scratch_dir().ok()?;
+
+    let rendered = super::run_tool(
+        Command::new("qlmanage")
+            .args(["-t", "-s"])
+            .arg(size.to_string())
+            .arg("-o")
+            .arg(&dir)
+            .arg(path),
+    );
+    // qlmanage names the thumbnail after the file, with .png appended
+    let png = rendered
+        .then(|| path.file_name())
+        .flatten()
+        .and_then(|name| std::fs::read(dir.join(format!("{}.png", name.to_string_lossy()))).ok());
+
+    let _ = std::fs::remove_dir_all(&dir);
+    png
+}
+
+/// Parses the raw values of one file, in the order of `SPOTLIGHT_ATTRIBUTES`. Values are either scalars
+/// or parenthesized lists over several lines:
+///
+/// (
+///     "Jane Doe"
+/// )
+fn parse_raw_values(values: &[String]) -> DocumentAttributes {
+    let mut attributes = DocumentAttributes::default();
+
+    for (key, value) in SPOTLIGHT_ATTRIBUTES.iter().zip(values) {
+        let value = value.trim();
+        if value == "(null)" {
+            continue;
+        }
+
+        if let Some(list) = value.strip_prefix('(').and_then(|v| v.strip_suffix(')')) {
+            let items: Vec<String> = list
+                .lines()
+                .map(|item| unquote(item.trim().trim_end_matches(',')))
+                .filter(|item| !item.is_empty())
+                .collect();
+
+            match *key {
+                "kMDItemAuthors" => attributes.authors = items,
+                "kMDItemUserTags" => attributes.tags = items,
+                _ => {}
+            }
+            continue;
+        }
+
+        match *key {
+            "kMDItemTitle" => attributes.title = Some(unquote(value)).filter(|t| !t.is_empty()),
+            // mdls prints dates in UTC as "2024-03-01 09:30:00 +0000"
+            "kMDItemContentCreationDate" => {
+                attributes.content_created_at =
+                    Some(value.trim_end_matches("+0000").trim().to_string())
+            }
+            _ => {}
+        }
+    }
+
+    attributes
+}
+
+fn unquote(value: &str) -> String {
+    value
+        .strip_prefix('"')
+        .and_then(|v| v.strip_suffix('"'))
+        .unwrap_or(value)
+        .replace("\\\"", "\"")
+}
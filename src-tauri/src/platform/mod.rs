@@ -0,0 +1,144 @@
+/// Platform specific implementations of app discovery, app control, icon extraction and file system conventions.
+/// Every platform module exposes the same set of functions, the rest of the app only goes through this module
+use serde::{Deserialize, Serialize};
+use std::path::Path;
+#[cfg(not(target_os = "windows"))]
+use std::path::PathBuf;
+#[cfg(not(target_os = "windows"))]
+use std::process::{Command, Stdio};
+#[cfg(not(target_os = "windows"))]
+use std::sync::atomic::{AtomicUsize, Ordering};
+#[cfg(not(target_os = "windows"))]
+use std::time::{Duration, Instant};
+
+#[cfg(target_os = "linux")]
+mod linux;
+#[cfg(target_os = "macos")]
+mod macos;
+#[cfg(target_os = "windows")]
+mod windows;
+
+#[cfg(target_os = "linux")]
+pub use self::linux::*;
+#[cfg(target_os = "macos")]
+pub use self::macos::*;
+#[cfg(target_os = "windows")]
+pub use self::windows::*;
+
+/// Document attributes kept by the OS outside of the file contents (Spotlight on macOS)
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct DocumentAttributes {
+    pub title: Option<String>,
+    pub authors: Vec<String>,
+    /// Finder tags
+    pub tags: Vec<String>,
+    /// When the content was created, as "YYYY-MM-DD HH:MM:SS" in UTC. Survives copies, unlike the file creation time
+    pub content_created_at: Option<String>,
+}
+
+impl DocumentAttributes {
+    pub fn is_empty(&self) -> bool {
+        self.title.is_none()
+            && self.authors.is_empty()
+            && self.tags.is_empty()
+            && self.content_created_at.is_none()
+    }
+}
+
+/// A new directory for the output of a command line tool, the caller removes it when done
+#[cfg(not(target_os = "windows"))]
+fn scratch_dir() -> std::io::Result<PathBuf> {
+    static NEXT: AtomicUsize = AtomicUsize::new(0);
+
+    let dir = std::env::temp_dir().join(format!(
+        "kita-{}-{}",
+        std::process::id(),
+        NEXT.fetch_add(1, Ordering::SeqCst)
+    ));
+    std::fs::create_dir_all(&dir)?;
+    Ok(dir)
+}
+
+/// How long a command line tool gets before it is killed, a broken or huge file can keep a renderer busy forever
+#[cfg(not(target_os = "windows"))]
+const TOOL_TIMEOUT: Duration = Duration::from_secs(15);
+
+/// Runs a command line tool with its output discarded and returns whether it succeeded, a tool that runs past TOOL_TIMEOUT is killed
+#[cfg(not(target_os = "windows"))]
+fn run_tool(command: &mut Command) -> bool {
+    let Ok(mut child) = command
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()
+    else {
+        return false;
+    };
+
+    let started = Instant::now();
+    loop {
+        match child.try_wait() {
+            Ok(Some(status)) => return status.success(),
+            Ok(None) if started.elapsed() < TOOL_TIMEOUT => {
+                std::thread::sleep(Duration::from_millis(50))
+            }
+            _ => {
+                let _ = child.kill();
+                let _ = child.wait();
+                return false;
+            }
+        }
+    }
+}
+
+/// Dot files are hidden on every platform, the platform modules add their own hidden flags on top
+fn has_hidden_name(path: &Path) -> bool {
+    path.file_name()
+        .and_then(|name| name.to_str())
+        .map(|name| name.starts_with('.'))
+        .unwrap_or(false)
+}
+
+/// Process control shared by the platforms that don't have a native bridge
+#[cfg(not(target_os = "macos"))]
+mod processes {
+    use std::path::PathBuf;
+    use sysinfo::{PidExt, ProcessExt, System, SystemExt};
+
+    pub struct RunningProcess {
+        pub pid: u32,
+        pub name: String,
+        pub exe: PathBuf,
+    }
+
+    pub fn list_processes() -> Vec<RunningProcess> {
+        let mut system = System::new();
+        system.refresh_processes();
+
+        system
+            .processes()
+            .values()
+            .map(|process| RunningProcess {
+                pid: process.pid().as_u32(),
+                name: process.name().to_string(),
+                exe: process.exe().to_path_buf(),
+            })
+            .collect()
+    }
+
+    pub fn is_process_running(pid: u32) -> bool {
+        let mut system = System::new();
+        system.refresh_process(sysinfo::Pid::from(pid as usize))
+    }
+
+    pub fn kill_process(pid: u32) -> bool {
+        let mut system = System::new();
+        let sys_pid = sysinfo::Pid::from(pid as usize);
+        system.refresh_process(sys_pid);
+
+        system
+            .process(sys_pid)
+            .map(|process| process.kill())
+            .unwrap_or(false)
+    }
+}
@@ -0,0 +1,239 @@
+/// Windows implementation. Apps are discovered by scanning the Program Files directories, process control goes
+/// through sysinfo and icons are extracted with the .NET icon APIs through PowerShell
+use base64::{engine::general_purpose::STANDARD, Engine};
+use std::collections::HashSet;
+use std::os::windows::fs::MetadataExt;
+use std::os::windows::process::CommandExt;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use walkdir::WalkDir;
+
+use super::processes;
+use super::DocumentAttributes;
+use crate::app_handler::AppMetadata;
+
+const FILE_ATTRIBUTE_HIDDEN: u32 = 0x2;
+/// Keeps PowerShell from flashing a console window
+const CREATE_NO_WINDOW: u32 = 0x0800_0000;
+/// Program Files\Vendor\App\app.exe is as deep as installed apps usually go
+const PROGRAM_FILES_DEPTH: usize = 3;
+
+/// Installers, updaters and other executables that ship next to the actual app
+const NON_APP_PREFIXES: [&str; 8] = [
+    "unins",
+    "uninstall",
+    "setup",
+    "install",
+    "update",
+    "crash",
+    "elevation_service",
+    "notification_helper",
+];
+
+fn program_files_dirs() -> Vec<PathBuf> {
+    let mut roots: Vec<PathBuf> = ["ProgramFiles", "ProgramFiles(x86)", "ProgramW6432"]
+        .iter()
+        .filter_map(|var| std::env::var_os(var).map(PathBuf::from))
+        .collect();
+
+    // per user installs (VS Code, Slack, ...) end up here
+    if let Some(local) = dirs::data_local_dir() {
+        roots.push(local.join("Programs"));
+    }
+
+    let mut seen = HashSet::new();
+    roots.retain(|dir| dir.is_dir() && seen.insert(dir.to_string_lossy().to_lowercase()));
+    roots
+}
+
+fn is_app_executable(path: &Path) -> bool {
+    let is_exe = path
+        .extension()
+        .map(|ext| ext.eq_ignore_ascii_case("exe"))
+        .unwrap_or(false);
+
+    let stem = path
+        .file_stem()
+        .map(|s| s.to_string_lossy().to_lowercase())
+        .unwrap_or_default();
+
+    is_exe
+        && !NON_APP_PREFIXES
+            .iter()
+            .any(|prefix| stem.starts_with(prefix))
+}
+
+fn get_installed_apps() -> Vec<AppMetadata> {
+    let mut names = HashSet::new();
+    let mut apps = Vec::new();
+
+    for dir in program_files_dirs() {
+        for entry in WalkDir::new(&dir)
+            .max_depth(PROGRAM_FILES_DEPTH)
+            .into_iter()
+            .filter_map(|e| e.ok())
+        {
+            if !entry.file_type().is_file() || !is_app_executable(entry.path()) {
+                continue;
+            }
+
+            let name = entry
+                .path()
+                .file_stem()
+                .map(|s| s.to_string_lossy().into_owned())
+                .unwrap_or_default();
+
+            if names.insert(name.to_lowercase()) {
+                apps.push(AppMetadata {
+                    name,
+                    path: normalize_path(entry.path()),
+                    pid: None,
+                    icon: None,
+                    resource_usage: None,
+                });
+            }
+        }
+    }
+
+    apps
+}
+
+/// Running processes whose executable is one of the installed apps
+fn match_running_apps(installed: &[AppMetadata]) -> Vec<AppMetadata> {
+    let mut running = Vec::new();
+    let mut seen = HashSet::new();
+
+    for process in processes::list_processes() {
+        let exe = normalize_path(&process.exe).to_lowercase();
+        if let Some(app) = installed.iter().find(|app| app.path.to_lowercase() == exe) {
+            // apps like browsers run many processes, the first one stands for the app
+            if seen.insert(exe) {
+                running.push(AppMetadata {
+                    pid: Some(process.pid),
+                    ..app.clone()
+                });
+            }
+        }
+    }
+
+    running
+}
+
+/// Returns the running and the installed apps
+pub fn get_apps() -> Result<(Vec<AppMetadata>, Vec<AppMetadata>), String> {
+    let installed = get_installed_apps();
+    let running = match_running_apps(&installed);
+
+    Ok((running, installed))
+}
+
+pub fn get_running_apps() -> Result<Vec<AppMetadata>, String> {
+    Ok(match_running_apps(&get_installed_apps()))
+}
+
+fn powershell(script: &str, envs: &[(&str, &str)]) -> Option<String> {
+    let output = Command::new("powershell")
+        .args(["-NoProfile", "-NonInteractive", "-Command", script])
+        .envs(envs.iter().copied())
+        .creation_flags(CREATE_NO_WINDOW)
+        .output()
+        .ok()?;
+
+    if !output.status.success() {
+        return None;
+    }
+
+    Some(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+pub fn get_app_icon(app_path: &str) -> Result<Option<String>, String> {
+    // the path goes through the environment so it never has to be quoted into the script
+    let script = r#"
+        Add-Type -AssemblyName System.Drawing
+        $icon = [System.Drawing.Icon]::ExtractAssociatedIcon($env:KITA_ICON_PATH)
+        if ($icon) {
+            $stream = New-Object System.IO.MemoryStream
+            $icon.ToBitmap().Save($stream, [System.Drawing.Imaging.ImageFormat]::Png)
+            [Convert]::ToBase64String($stream.ToArray())
+        }
+    "#;
+
+    let icon = powershell(script, &[("KITA_ICON_PATH", app_path)])
+        .filter(|data| !data.is_empty() && STANDARD.decode(data).is_ok())
+        .map(|data| format!("data:image/png;base64,{}", data));
+
+    Ok(icon)
+}
+
+pub fn switch_to_app(pid: u32) -> bool {
+    let script = "(New-Object -ComObject WScript.Shell).AppActivate([int]$env:KITA_APP_PID)";
+
+    powershell(script, &[("KITA_APP_PID", &pid.to_string())])
+        .map(|output| output.eq_ignore_ascii_case("true"))
+        .unwrap_or(false)
+}
+
+pub fn force_quit_app(pid: u32) -> bool {
+    processes::kill_process(pid)
+}
+
+pub fn launch_app(app_path: &str) -> bool {
+    let working_dir = Path::new(app_path).parent().unwrap_or(Path::new("."));
+
+    Command::new(app_path)
+        .current_dir(working_dir)
+        .spawn()
+        .is_ok()
+}
+
+pub fn is_process_running(pid: u32) -> bool {
+    processes::is_process_running(pid)
+}
+
+pub fn is_auxiliary_app_path(path: &str) -> bool {
+    let path = path.to_lowercase();
+
+    path.contains("\\windows\\")
+        || path.contains("\\common files\\")
+        || path.contains("\\windowsapps\\")
+        || path.contains("\\installer\\")
+}
+
+pub fn is_hidden(path: &Path) -> bool {
+    super::has_hidden_name(path)
+        || std::fs::symlink_metadata(path)
+            .map(|meta| meta.file_attributes() & FILE_ATTRIBUTE_HIDDEN != 0)
+            .unwrap_or(false)
+}
+
+/// Strips the verbatim prefix canonicalize adds (\\?\C:\ and \\?\UNC\server) and uppercases the drive letter,
+/// so paths from the walker, the watcher and the change journal all compare equal
+pub fn normalize_path(path: &Path) -> String {
+    let path = path.to_string_lossy();
+
+    let path = if let Some(unc) = path.strip_prefix(r"\\?\UNC\") {
+        format!(r"\\{}", unc)
+    } else if let Some(local) = path.strip_prefix(r"\\?\") {
+        local.to_string()
+    } else {
+        path.into_owned()
+    };
+
+    let mut chars = path.chars();
+    match (chars.next(), chars.next()) {
+        (Some(drive), Some(':')) if drive.is_ascii_alphabetic() => {
+            format!("{}{}", drive.to_ascii_uppercase(), &path[1..])
+        }
+        _ => path,
+    }
+}
+
+/// There is no system wide metadata index to read from
+pub fn read_document_attributes(paths: &[PathBuf]) -> Vec<Option<DocumentAttributes>> {
+    paths.iter().map(|_| None).collect()
+}
+
+/// Windows has no PDF renderer that can be called from the command line, PDFs are shown with their file type icon
+pub fn render_pdf_preview(_path: &Path, _size: u32) -> Option<Vec<u8>> {
+    None
+}
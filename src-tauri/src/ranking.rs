@@ -0,0 +1,414 @@
+/*
+This file contains the ranking pipeline for search results. A result's score is the weighted sum of independent scoring stages (vector similarity, BM25, recency,
+frecency, relevance feedback and pins), and with explain=true each result carries what every stage contributed, so it is possible to see why something ranked where it did
+*/
+
+use rusqlite::{params, Connection, OptionalExtension};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use tauri::State;
+use tokio::task;
+
+use crate::feedback::get_feedback_boosts;
+use crate::file_processor::{get_processor, FileMetadata, FileProcessorState, SemanticMetadata};
+use crate::tokenizer::build_trigrams;
+
+/// Age in days at which a file's recency score halves
+const RECENCY_HALF_LIFE_DAYS: f64 = 30.0;
+/// Age in days at which a click stops counting for half as much towards frecency
+const FRECENCY_HALF_LIFE_DAYS: f64 = 14.0;
+
+/// A result going through the pipeline
+pub struct Candidate {
+    pub file_id: i64,
+    /// Cosine distance of the closest chunk, only semantic results have one
+    pub distance: Option<f32>,
+}
+
+pub struct RankingContext<'a> {
+    pub conn: &'a Connection,
+    pub query: &'a str,
+}
+
+/// One signal the ranking is made of
+pub trait RankingStage: Send + Sync {
+    fn name(&self) -> &'static str;
+
+    /// Raw scores, roughly in [0, 1] ([-1, 1] for signals that can push a result down).
+    /// Candidates the stage has nothing to say about are left out of the map and score 0
+    fn score(
+        &self,
+        ctx: &RankingContext,
+        candidates: &[Candidate],
+    ) -> rusqlite::Result<HashMap<i64, f32>>;
+}
+
+/// What one stage added to a result's score
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct StageContribution {
+    pub stage: String,
+    pub raw: f32,
+    pub weight: f32,
+    pub contribution: f32,
+}
+
+/// Returned with each result when explain=true
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RankingExplanation {
+    pub score: f32,
+    pub stages: Vec<StageContribution>,
+}
+
+/// Similarity of the closest chunk to the query
+pub struct VectorStage;
+
+impl RankingStage for VectorStage {
+    fn name(&self) -> &'static str {
+        "vector"
+    }
+
+    fn score(
+        &self,
+        _ctx: &RankingContext,
+        candidates: &[Candidate],
+    ) -> rusqlite::Result<HashMap<i64, f32>> {
+        Ok(candidates
+            .iter()
+            .filter_map(|c| c.distance.map(|distance| (c.file_id, 1.0 - distance)))
+            .collect())
+    }
+}
+
+/// BM25 of the query trigrams against the name, path and extension trigrams in files_fts
+pub struct Bm25Stage;
+
+impl RankingStage for Bm25Stage {
+    fn name(&self) -> &'static str {
+        "bm25"
+    }
+
+    fn score(
+        &self,
+        ctx: &RankingContext,
+        candidates: &[Candidate],
+    ) -> rusqlite::Result<HashMap<i64, f32>> {
+        let mut scores = HashMap::new();
+        // shorter queries have no trigrams to match
+        if ctx.query.len() < 3 {
+            return Ok(scores);
+        }
+
+        let mut stmt = ctx.conn.prepare(
+            "SELECT bm25(files_fts) FROM files_fts WHERE doc_text MATCH ?1 AND rowid = ?2",
+        )?;
+        let trigrams = build_trigrams(ctx.query);
+        for candidate in candidates {
+            let bm25: Option<f64> = stmt
+                .query_row(params![trigrams, candidate.file_id], |row| row.get(0))
+                .optional()?;
+
+            // sqlite's bm25 is negative, the better the match the lower it is
+            if let Some(relevance) = bm25.map(|bm25| -bm25).filter(|r| *r > 0.0) {
+                scores.insert(candidate.file_id, (relevance / (1.0 + relevance)) as f32);
+            }
+        }
+
+        Ok(scores)
+    }
+}
+
+/// Favors files that changed recently on disk. Files stored before their modification time was kept, and documents
+/// from connectors, go by when they were indexed
+pub struct RecencyStage;
+
+impl RankingStage for RecencyStage {
+    fn name(&self) -> &'static str {
+        "recency"
+    }
+
+    fn score(
+        &self,
+        ctx: &RankingContext,
+        candidates: &[Candidate],
+    ) -> rusqlite::Result<HashMap<i64, f32>> {
+        let mut stmt = ctx.conn.prepare(
+            r#"
+            SELECT julianday('now') - COALESCE(julianday(modified_at, 'unixepoch'), julianday(updated_at))
+            FROM files
+            WHERE id = ?1
+            "#,
+        )?;
+
+        let mut scores = HashMap::new();
+        for candidate in candidates {
+            let age_days: Option<f64> = stmt
+                .query_row([candidate.file_id], |row| row.get(0))
+                .optional()?
+                .flatten();
+
+            if let Some(age_days) = age_days {
+                let score = 0.5f64.powf(age_days.max(0.0) / RECENCY_HALF_LIFE_DAYS);
+                scores.insert(candidate.file_id, score as f32);
+            }
+        }
+
+        Ok(scores)
+    }
+}
+
+/// How often and how lately a file was opened, whatever the query was, see opens.rs
+pub struct FrecencyStage;
+
+impl RankingStage for FrecencyStage {
+    fn name(&self) -> &'static str {
+        "frecency"
+    }
+
+    fn score(
+        &self,
+        ctx: &RankingContext,
+        candidates: &[Candidate],
+    ) -> rusqlite::Result<HashMap<i64, f32>> {
+        let mut stmt = ctx.conn.prepare(
+            r#"
+            SELECT julianday('now') - julianday(opens.opened_at)
+            FROM opens
+            JOIN files ON files.path = opens.path
+            WHERE files.id = ?1
+            "#,
+        )?;
+
+        let mut scores = HashMap::new();
+        for candidate in candidates {
+            let ages = stmt
+                .query_map([candidate.file_id], |row| row.get::<_, Option<f64>>(0))?
+                .collect::<rusqlite::Result<Vec<_>>>()?;
+
+            let frecency: f64 = ages
+                .into_iter()
+                .flatten()
+                .map(|age_days| 0.5f64.powf(age_days.max(0.0) / FRECENCY_HALF_LIFE_DAYS))
+                .sum();
+            if frecency > 0.0 {
+                // squash so a file opened every day can't dominate everything
+                scores.insert(candidate.file_id, frecency.tanh() as f32);
+            }
+        }
+
+        Ok(scores)
+    }
+}
+
+/// Thumbs up/down and clicks given for this query, see feedback.rs
+pub struct FeedbackStage;
+
+impl RankingStage for FeedbackStage {
+    fn name(&self) -> &'static str {
+        "feedback"
+    }
+
+    fn score(
+        &self,
+        ctx: &RankingContext,
+        candidates: &[Candidate],
+    ) -> rusqlite::Result<HashMap<i64, f32>> {
+        let ids: Vec<i64> = candidates.iter().map(|c| c.file_id).collect();
+        get_feedback_boosts(ctx.conn, ctx.query, &ids)
+    }
+}
+
+/// Files the user pinned, by path so a pin outlives the file being indexed again
+pub struct PinStage;
+
+impl RankingStage for PinStage {
+    fn name(&self) -> &'static str {
+        "pin"
+    }
+
+    fn score(
+        &self,
+        ctx: &RankingContext,
+        candidates: &[Candidate],
+    ) -> rusqlite::Result<HashMap<i64, f32>> {
+        let mut stmt = ctx.conn.prepare(
+            "SELECT 1 FROM pins JOIN files ON files.path = pins.path WHERE files.id = ?1",
+        )?;
+
+        let mut scores = HashMap::new();
+        for candidate in candidates {
+            let pinned = stmt
+                .query_row([candidate.file_id], |_| Ok(()))
+                .optional()?
+                .is_some();
+            if pinned {
+                scores.insert(candidate.file_id, 1.0);
+            }
+        }
+
+        Ok(scores)
+    }
+}
+
+/// Weighted stages, a result's score is the sum of what each stage contributes
+#[derive(Default)]
+pub struct RankingPipeline {
+    stages: Vec<(Box<dyn RankingStage>, f32)>,
+}
+
+impl RankingPipeline {
+    pub fn stage(mut self, stage: impl RankingStage + 'static, weight: f32) -> Self {
+        self.stages.push((Box::new(stage), weight));
+        self
+    }
+
+    /// Ranking for the name and path search, the text match comes first and the rest only reorders close matches
+    pub fn files() -> Self {
+        Self::default()
+            .stage(Bm25Stage, 1.0)
+            .stage(FeedbackStage, 1.0)
+            .stage(FrecencyStage, 0.3)
+            .stage(RecencyStage, 0.1)
+            .stage(PinStage, 2.0)
+    }
+
+    /// Ranking for the semantic search. The weights keep the other stages small next to the vector
+    /// similarity, a pinned file moves up about one relevance band
+    pub fn semantic() -> Self {
+        Self::default()
+            .stage(VectorStage, 1.0)
+            .stage(FeedbackStage, 0.1)
+            .stage(FrecencyStage, 0.05)
+            .stage(RecencyStage, 0.02)
+            .stage(PinStage, 0.3)
+    }
+
+    /// Scores the candidates, in the order they were given. A stage that fails is logged and left out
+    pub fn score(
+        &self,
+        conn: &Connection,
+        query: &str,
+        candidates: &[Candidate],
+    ) -> Vec<RankingExplanation> {
+        let ctx = RankingContext { conn, query };
+        let mut explanations: Vec<RankingExplanation> = candidates
+            .iter()
+            .map(|_| RankingExplanation {
+                score: 0.0,
+                stages: Vec::with_capacity(self.stages.len()),
+            })
+            .collect();
+
+        for (stage, weight) in &self.stages {
+            let scores = match stage.score(&ctx, candidates) {
+                Ok(scores) => scores,
+                Err(e) => {
+                    eprintln!("Failed to run the {} ranking stage: {}", stage.name(), e);
+                    continue;
+                }
+            };
+
+            for (candidate, explanation) in candidates.iter().zip(explanations.iter_mut()) {
+                let raw = scores.get(&candidate.file_id).copied().unwrap_or(0.0);
+                let contribution = raw * weight;
+                explanation.score += contribution;
+                explanation.stages.push(StageContribution {
+                    stage: stage.name().to_string(),
+                    raw,
+                    weight: *weight,
+                    contribution,
+                });
+            }
+        }
+
+        explanations
+    }
+}
+
+/// Sorts name and path results by their pipeline score, attaching the explanation when asked for
+pub fn rank_files(conn: &Connection, query: &str, files: &mut Vec<FileMetadata>, explain: bool) {
+    let candidates: Vec<Candidate> = files
+        .iter()
+        .filter_map(|f| f.base.id)
+        .map(|file_id| Candidate {
+            file_id,
+            distance: None,
+        })
+        .collect();
+    // results come from the files table, so they all have an id
+    if candidates.len() != files.len() {
+        return;
+    }
+
+    let explanations = RankingPipeline::files().score(conn, query, &candidates);
+    let mut ranked: Vec<(FileMetadata, RankingExplanation)> =
+        files.drain(..).zip(explanations).collect();
+    // stable sort, so results the stages can't tell apart keep the order of the search
+    ranked.sort_by(|(_, a), (_, b)| b.score.total_cmp(&a.score));
+
+    for (mut file, explanation) in ranked {
+        if explain {
+            file.ranking = Some(explanation);
+        }
+        files.push(file);
+    }
+}
+
+/// Sorts semantic results by their pipeline score. The distance becomes 1 - score, so it includes the other stages
+/// the same way feedback used to shift it, and the UI's relevance bands follow the ranking
+pub fn rank_semantic_files(
+    conn: &Connection,
+    query: &str,
+    files: &mut [SemanticMetadata],
+    explain: bool,
+) {
+    let candidates: Vec<Candidate> = files
+        .iter()
+        .filter_map(|f| {
+            f.base.id.map(|file_id| Candidate {
+                file_id,
+                distance: Some(f.distance),
+            })
+        })
+        .collect();
+    if candidates.len() != files.len() {
+        return;
+    }
+
+    let explanations = RankingPipeline::semantic().score(conn, query, &candidates);
+    for (file, explanation) in files.iter_mut().zip(explanations) {
+        file.distance = 1.0 - explanation.score;
+        if explain {
+            file.ranking = Some(explanation);
+        }
+    }
+
+    files.sort_by(|a, b| a.distance.total_cmp(&b.distance));
+}
+
+#[tauri::command]
+pub async fn set_file_pinned(
+    file_id: i64,
+    pinned: bool,
+    state: State<'_, FileProcessorState>,
+) -> Result<(), String> {
+    let processor = get_processor(&state)?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        if pinned {
+            conn.execute(
+                "INSERT OR IGNORE INTO pins (path) SELECT path FROM files WHERE id = ?1",
+                [file_id],
+            )?;
+        } else {
+            conn.execute(
+                "DELETE FROM pins WHERE path = (SELECT path FROM files WHERE id = ?1)",
+                [file_id],
+            )?;
+        }
+        Ok::<_, rusqlite::Error>(())
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to update pinned file: {}", e))
+}
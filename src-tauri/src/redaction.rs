@@ -0,0 +1,376 @@
+/*
+This file contains the sensitive content pass that runs between extraction and embedding. Chunks are scanned for secrets (API keys, tokens, private keys, credentials,
+long random strings) and PII (social security and credit card numbers) with regexes and an entropy check, and depending on the policy the file is indexed as is,
+indexed with the matches replaced by [REDACTED:<kind>], or indexed by name only. What was found in each file is recorded, never the matched text itself
+*/
+
+use regex::Regex;
+use rusqlite::{params, Connection};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::ops::Range;
+use std::path::PathBuf;
+use std::sync::OnceLock;
+use tauri::State;
+use thiserror::Error;
+use tokio::task;
+
+use crate::chunker::Chunk;
+use crate::file_processor::{get_processor, FileProcessorState};
+
+const DEFAULT_LIST_LIMIT: usize = 200;
+/// Bits per character above which a long token is taken for a random secret, base64 of random bytes is around 5
+const MIN_SECRET_ENTROPY: f64 = 4.5;
+/// Values assigned to password/token/... keys only need to look somewhat random, "password = password" doesn't count
+const MIN_CREDENTIAL_ENTROPY: f64 = 2.5;
+
+#[derive(Error, Debug)]
+pub enum RedactionError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = RedactionError> = std::result::Result<T, E>;
+
+/// What happens to files with sensitive content
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SensitivePolicy {
+    /// No scanning
+    Off,
+    /// Index the content as is and only record what was found
+    Flag,
+    /// Replace what was found before the content is embedded and stored
+    #[default]
+    Redact,
+    /// Don't index the content of the file, it stays findable by name
+    Skip,
+}
+
+impl SensitivePolicy {
+    pub fn from_setting(value: &str) -> Self {
+        match value {
+            "off" => Self::Off,
+            "flag" => Self::Flag,
+            "skip" => Self::Skip,
+            _ => Self::Redact,
+        }
+    }
+
+    fn as_str(&self) -> &'static str {
+        match self {
+            Self::Off => "off",
+            Self::Flag => "flag",
+            Self::Redact => "redact",
+            Self::Skip => "skip",
+        }
+    }
+}
+
+/// Where something sensitive is in a text
+#[derive(Debug, Clone, PartialEq)]
+pub struct Finding {
+    /// "aws_access_key", "private_key", "ssn", "credit_card", ...
+    pub kind: &'static str,
+    pub range: Range<usize>,
+}
+
+/// Recorded for a file, without the matched text
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SensitiveFinding {
+    pub path: String,
+    pub kind: String,
+    pub count: i64,
+    /// The policy that was applied: "flag", "redact" or "skip"
+    pub action: String,
+    pub found_at: String,
+}
+
+/// Matches of the whole pattern are sensitive, or only of its first group when it has one
+struct Detector {
+    kind: &'static str,
+    regex: Regex,
+    is_match: fn(&str) -> bool,
+}
+
+fn detector(kind: &'static str, regex: &str, is_match: fn(&str) -> bool) -> Detector {
+    Detector {
+        kind,
+        regex: Regex::new(regex).unwrap(),
+        is_match,
+    }
+}
+
+fn always(_: &str) -> bool {
+    true
+}
+
+fn detectors() -> &'static [Detector] {
+    static DETECTORS: OnceLock<Vec<Detector>> = OnceLock::new();
+    DETECTORS.get_or_init(|| {
+        vec![
+            // a key split over two chunks is still caught on both sides
+            detector(
+                "private_key",
+                r"-----BEGIN [A-Z ]*PRIVATE KEY-----(?s:.*?)(?:-----END [A-Z ]*PRIVATE KEY-----|\z)",
+                always,
+            ),
+            detector(
+                "private_key",
+                r"\A[A-Za-z0-9+/=\s]{40,}-----END [A-Z ]*PRIVATE KEY-----",
+                always,
+            ),
+            detector("aws_access_key", r"\b(?:AKIA|ASIA)[0-9A-Z]{16}\b", always),
+            detector("github_token", r"\bgh[pousr]_[A-Za-z0-9]{36,}\b", always),
+            detector("slack_token", r"\bxox[abprs]-[A-Za-z0-9-]{10,}", always),
+            detector("stripe_key", r"\b[sr]k_live_[0-9A-Za-z]{20,}\b", always),
+            detector("google_api_key", r"\bAIza[0-9A-Za-z_-]{35}\b", always),
+            detector("api_key", r"\bsk-[A-Za-z0-9_-]{20,}", always),
+            detector(
+                "jwt",
+                r"\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}",
+                always,
+            ),
+            detector(
+                "credential",
+                r#"(?i)\b(?:api[_-]?key|secret(?:[_-]?key)?|access[_-]?token|auth[_-]?token|token|password|passwd|pwd)["']?\s*[:=]\s*["']?([^\s"'`,;]{8,})"#,
+                looks_like_credential,
+            ),
+            detector("ssn", r"\b\d{3}-\d{2}-\d{4}\b", is_valid_ssn),
+            detector("credit_card", r"\b\d(?:[ -]?\d){12,18}\b", is_valid_card_number),
+            detector(
+                "high_entropy_string",
+                r"[A-Za-z0-9+/_=-]{32,}",
+                looks_like_random_secret,
+            ),
+        ]
+    })
+}
+
+/// Shannon entropy in bits per character
+fn entropy(text: &str) -> f64 {
+    let mut counts = [0usize; 256];
+    let mut total = 0usize;
+    for byte in text.bytes() {
+        counts[byte as usize] += 1;
+        total += 1;
+    }
+    if total == 0 {
+        return 0.0;
+    }
+
+    counts
+        .iter()
+        .filter(|count| **count > 0)
+        .map(|count| {
+            let p = *count as f64 / total as f64;
+            -p * p.log2()
+        })
+        .sum()
+}
+
+/// Leaves out placeholders and references like ${TOKEN}, <password> or process.env.API_KEY
+fn looks_like_credential(value: &str) -> bool {
+    let placeholder = value.starts_with(['$', '<', '{', '%'])
+        || value.contains("env.")
+        || value.contains("environ")
+        || value
+            .chars()
+            .all(|c| c == value.chars().next().unwrap_or('*'));
+    !placeholder && entropy(value) >= MIN_CREDENTIAL_ENTROPY
+}
+
+/// Area 000, 666 and 9xx, group 00 and serial 0000 are never issued
+fn is_valid_ssn(value: &str) -> bool {
+    let parts: Vec<&str> = value.split('-').collect();
+    let [area, group, serial] = parts.as_slice() else {
+        return false;
+    };
+    *area != "000"
+        && *area != "666"
+        && !area.starts_with('9')
+        && *group != "00"
+        && *serial != "0000"
+}
+
+/// Luhn checksum over 13 to 19 digits
+fn is_valid_card_number(value: &str) -> bool {
+    let digits: Vec<u32> = value.chars().filter_map(|c| c.to_digit(10)).collect();
+    if !(13..=19).contains(&digits.len()) || digits.iter().all(|d| *d == digits[0]) {
+        return false;
+    }
+
+    let sum: u32 = digits
+        .iter()
+        .rev()
+        .enumerate()
+        .map(|(i, digit)| match (i % 2 == 1, digit * 2) {
+            (true, doubled) if doubled > 9 => doubled - 9,
+            (true, doubled) => doubled,
+            (false, _) => *digit,
+        })
+        .sum();
+    sum % 10 == 0
+}
+
+/// Random looking tokens: mixed case with digits and high entropy. Hex strings are left out,
+/// they are mostly hashes (commits, lockfiles, checksums)
+fn looks_like_random_secret(token: &str) -> bool {
+    let has_upper = token.chars().any(|c| c.is_ascii_uppercase());
+    let has_lower = token.chars().any(|c| c.is_ascii_lowercase());
+    let digits = token.chars().filter(|c| c.is_ascii_digit()).count();
+    let is_hex = token.chars().all(|c| c.is_ascii_hexdigit());
+
+    has_upper && has_lower && digits >= 4 && !is_hex && entropy(token) >= MIN_SECRET_ENTROPY
+}
+
+/// Finds the sensitive parts of a text, in order and without overlaps. Earlier detectors win
+/// over later ones for the same text, so a GitHub token isn't also reported as a random string
+pub fn scan(text: &str) -> Vec<Finding> {
+    let mut findings: Vec<Finding> = Vec::new();
+
+    for detector in detectors() {
+        for captures in detector.regex.captures_iter(text) {
+            let Some(found) = captures.get(1).or_else(|| captures.get(0)) else {
+                continue;
+            };
+            let overlaps = findings
+                .iter()
+                .any(|f| f.range.start < found.end() && found.start() < f.range.end);
+            if !overlaps && (detector.is_match)(found.as_str()) {
+                findings.push(Finding {
+                    kind: detector.kind,
+                    range: found.range(),
+                });
+            }
+        }
+    }
+
+    findings.sort_by_key(|f| f.range.start);
+    findings
+}
+
+/// Replaces each finding with [REDACTED:<kind>]
+pub fn redact(text: &str, findings: &[Finding]) -> String {
+    let mut redacted = String::with_capacity(text.len());
+    let mut last = 0;
+    for finding in findings {
+        redacted.push_str(&text[last..finding.range.start]);
+        redacted.push_str(&format!("[REDACTED:{}]", finding.kind));
+        last = finding.range.end;
+    }
+    redacted.push_str(&text[last..]);
+    redacted
+}
+
+/// Number of findings of each kind
+pub fn count_by_kind(findings: &[Finding]) -> BTreeMap<&'static str, usize> {
+    let mut counts = BTreeMap::new();
+    for finding in findings {
+        *counts.entry(finding.kind).or_default() += 1;
+    }
+    counts
+}
+
+/// Scans the chunks of a file and applies the policy to them. Returns the number of findings of each kind,
+/// and None instead of the chunks when the file's content shouldn't be indexed
+pub fn apply_policy(
+    policy: SensitivePolicy,
+    mut chunks: Vec<Chunk>,
+) -> (Option<Vec<Chunk>>, BTreeMap<&'static str, usize>) {
+    let mut counts: BTreeMap<&'static str, usize> = BTreeMap::new();
+    if policy == SensitivePolicy::Off {
+        return (Some(chunks), counts);
+    }
+
+    for chunk in chunks.iter_mut() {
+        let findings = scan(&chunk.content);
+        for (kind, count) in count_by_kind(&findings) {
+            *counts.entry(kind).or_default() += count;
+        }
+        if policy == SensitivePolicy::Redact && !findings.is_empty() {
+            chunk.content = redact(&chunk.content, &findings);
+        }
+    }
+
+    if policy == SensitivePolicy::Skip && !counts.is_empty() {
+        return (None, counts);
+    }
+    (Some(chunks), counts)
+}
+
+/// Replaces what is recorded for a file with the latest findings, a file that came out clean has its old findings cleared
+pub async fn record_findings(
+    db_path: PathBuf,
+    path: String,
+    policy: SensitivePolicy,
+    counts: BTreeMap<&'static str, usize>,
+) -> Result<()> {
+    task::spawn_blocking(move || {
+        let mut conn = Connection::open(db_path)?;
+        let tx = conn.transaction()?;
+
+        tx.execute("DELETE FROM sensitive_findings WHERE path = ?1", [&path])?;
+        {
+            let mut stmt = tx.prepare(
+                "INSERT INTO sensitive_findings (path, kind, count, action) VALUES (?1, ?2, ?3, ?4)",
+            )?;
+            for (kind, count) in &counts {
+                stmt.execute(params![path, kind, *count as i64, policy.as_str()])?;
+            }
+        }
+
+        tx.commit()?;
+        Ok(())
+    })
+    .await
+    .map_err(|e| RedactionError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+fn find_sensitive_findings(
+    conn: &Connection,
+    path: Option<&str>,
+    limit: usize,
+) -> rusqlite::Result<Vec<SensitiveFinding>> {
+    let mut stmt = conn.prepare(
+        r#"
+        SELECT path, kind, count, action, found_at
+        FROM sensitive_findings
+        WHERE ?1 IS NULL OR path = ?1
+        ORDER BY found_at DESC, path, kind
+        LIMIT ?2
+        "#,
+    )?;
+    let rows = stmt.query_map(params![path, limit as i64], |row| {
+        Ok(SensitiveFinding {
+            path: row.get(0)?,
+            kind: row.get(1)?,
+            count: row.get(2)?,
+            action: row.get(3)?,
+            found_at: row.get(4)?,
+        })
+    })?;
+
+    rows.collect()
+}
+
+/// What the sensitive content pass found, for one file or the most recent across the index
+#[tauri::command]
+pub async fn get_sensitive_findings(
+    path: Option<String>,
+    limit: Option<usize>,
+    state: State<'_, FileProcessorState>,
+) -> std::result::Result<Vec<SensitiveFinding>, String> {
+    let processor = get_processor(&state)?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        find_sensitive_findings(&conn, path.as_deref(), limit.unwrap_or(DEFAULT_LIST_LIMIT))
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to get sensitive findings: {}", e))
+}
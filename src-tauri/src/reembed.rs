@@ -0,0 +1,315 @@
+/*
+This file contains the re-embedding of the index after the embedding model changed. Every vector is stored with the model it comes from and searches only compare
+vectors of the configured model, so two vector spaces never get mixed: at startup the files whose vectors come from another model are embedded again in the background,
+with the same pause and cancel controls as a scan, and become searchable again one by one. `kita reembed --model X` switches the model of the remote embedding
+endpoint and migrates the index right away. A running kita notices the new model within seconds and embeds searches and new files with it,
+see follow_switch in embedding_migration.rs
+*/
+
+use serde::{Deserialize, Serialize};
+use std::sync::Arc;
+use tauri::{AppHandle, Emitter, Manager};
+use thiserror::Error;
+use tokio::sync::Mutex;
+use tokio::task;
+
+use crate::database_handler::default_database_path;
+use crate::embedder::{Embedder, EmbedderError};
+use crate::encryption;
+use crate::indexing_control::{CancelReason, IndexingControl, Lane};
+use crate::settings::SettingsManager;
+use crate::vectordb_manager::{StoredChunk, VectorDbError, VectorDbManager};
+use crate::AppResult;
+
+#[derive(Error, Debug)]
+pub enum ReembedError {
+    #[error("Vector DB error: {0}")]
+    VectorDb(#[from] VectorDbError),
+
+    #[error("Embedding error: {0}")]
+    Embed(#[from] EmbedderError),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = ReembedError> = std::result::Result<T, E>;
+
+/// Emitted as reembed-progress after each file
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ReembedStatus {
+    pub model: String,
+    pub total: usize,
+    pub processed: usize,
+}
+
+/// Looks for vectors of another model once the vector DB and the embedder are up, and re-embeds them in the background
+pub fn init_reembed(app: &tauri::App) -> AppResult<()> {
+    let app_handle = app.app_handle().clone();
+    tauri::async_runtime::spawn(async move {
+        if let Err(e) = reembed_stale_files(&app_handle).await {
+            eprintln!("Failed to re-embed the index: {}", e);
+        }
+    });
+
+    Ok(())
+}
+
+async fn reembed_stale_files(app_handle: &AppHandle) -> Result<()> {
+    let vectordb = app_handle
+        .state::<Arc<Mutex<VectorDbManager>>>()
+        .inner()
+        .clone();
+    let embedder = app_handle.state::<Arc<Embedder>>().inner().clone();
+    let control = app_handle.state::<Arc<IndexingControl>>().inner().clone();
+    let model = embedder.model_name();
+
+    let stamped = vectordb.lock().await.stamp_unversioned_rows(&model).await?;
+    if stamped > 0 {
+        println!("Recorded {} as the model of {} vectors", model, stamped);
+    }
+
+    let file_ids = vectordb
+        .lock()
+        .await
+        .files_not_embedded_with(&model)
+        .await?;
+    if file_ids.is_empty() {
+        return Ok(());
+    }
+
+    println!(
+        "{} files have vectors of another model, re-embedding them with {}",
+        file_ids.len(),
+        model
+    );
+    let dimension = vectordb.lock().await.dimension();
+    check_dimension(&embedder, dimension).await?;
+
+    // counts as an indexing run, so scans wait for it and it can be paused and cancelled like one
+    let run = control.begin_run(Lane::Background);
+    let token = run.token();
+    let total = file_ids.len();
+    let mut processed = 0;
+
+    for file_id in &file_ids {
+        control.wait_for_turn(Lane::Background, Some(&token)).await;
+        if token.cancel_reason().is_some() {
+            break;
+        }
+
+        let slot = control.throttle(Lane::Background).await;
+        let result = reembed_file(&vectordb, embedder.clone(), file_id).await;
+        drop(slot);
+
+        match result {
+            Ok(()) => processed += 1,
+            Err(ReembedError::Embed(e)) if e.is_quota_exceeded() => {
+                eprintln!("Stopping the re-embedding: {}", e);
+                control.cancel_run(&token, CancelReason::Quota);
+                break;
+            }
+            // the file keeps its old vectors and is tried again on the next start
+            Err(e) => eprintln!("Failed to re-embed file {}: {}", file_id, e),
+        }
+
+        let _ = app_handle.emit(
+            "reembed-progress",
+            ReembedStatus {
+                model: model.clone(),
+                total,
+                processed,
+            },
+        );
+    }
+
+    println!(
+        "Re-embedded {} of {} files with {}",
+        processed, total, model
+    );
+    Ok(())
+}
+
+/// Size of the vectors the embedder returns, asked with a short text
+pub async fn probe_dimension(embedder: &Arc<Embedder>) -> Result<usize> {
+    let embedder = embedder.clone();
+    let embeddings = task::spawn_blocking(move || embedder.embed_batch(vec!["kita"]))
+        .await
+        .map_err(|e| ReembedError::Other(format!("spawn_blocking error: {e}")))??;
+
+    Ok(embeddings.first().map(Vec::len).unwrap_or(0))
+}
+
+/// The vectors have to fit the table, a model with another size would fail on every file
+async fn check_dimension(embedder: &Arc<Embedder>, expected: i32) -> Result<()> {
+    let dimension = probe_dimension(embedder).await?;
+    if dimension != expected as usize {
+        return Err(ReembedError::Other(format!(
+            "the model returns {} dimensions, the index stores {}, use kita migrate-embeddings to move the index to it",
+            dimension, expected
+        )));
+    }
+
+    Ok(())
+}
+
+/// Embeds the chunks of a file again with the embedder's model, keeping their ids, text and pages
+async fn reembed_file(
+    vectordb: &Mutex<VectorDbManager>,
+    embedder: Arc<Embedder>,
+    file_id: &str,
+) -> Result<()> {
+    let chunks = vectordb
+        .lock()
+        .await
+        .chunks_for_files(&[file_id.to_string()])
+        .await?;
+    if chunks.is_empty() {
+        return Ok(());
+    }
+
+    let chunks = embed_stored_chunks(embedder, chunks).await?;
+    vectordb
+        .lock()
+        .await
+        .replace_file_chunks(file_id, chunks)
+        .await?;
+    Ok(())
+}
+
+/// Replaces the embeddings of stored chunks with the embedder's, the text is taken from the chunks so no file is read again
+pub async fn embed_stored_chunks(
+    embedder: Arc<Embedder>,
+    chunks: Vec<StoredChunk>,
+) -> Result<Vec<StoredChunk>> {
+    let model = embedder.model_name();
+    let texts: Vec<String> = chunks.iter().map(|chunk| chunk.text.clone()).collect();
+    let embeddings = task::spawn_blocking(move || {
+        embedder.embed_batch(texts.iter().map(String::as_str).collect())
+    })
+    .await
+    .map_err(|e| ReembedError::Other(format!("spawn_blocking error: {e}")))??;
+
+    if embeddings.len() != chunks.len() {
+        return Err(ReembedError::Other(format!(
+            "got {} embeddings for {} chunks",
+            embeddings.len(),
+            chunks.len()
+        )));
+    }
+
+    Ok(chunks
+        .into_iter()
+        .zip(embeddings)
+        .map(|(chunk, embedding)| StoredChunk {
+            embedding,
+            embedding_model: Some(model.clone()),
+            ..chunk
+        })
+        .collect())
+}
+
+/// `kita reembed --model <model>`: switches the model of the remote embedding endpoint and re-embeds the index with it
+pub fn run_reembed_command(args: &[String]) -> std::result::Result<(), String> {
+    let model = match args {
+        [flag, model] if flag == "--model" && !model.is_empty() => model.clone(),
+        _ => return Err("Usage: kita reembed --model <model>".to_string()),
+    };
+
+    let db_path = default_database_path()
+        .filter(|path| path.exists())
+        .ok_or_else(|| "No kita database found, start kita once first".to_string())?;
+
+    let settings_manager = SettingsManager::new(&db_path.to_string_lossy());
+    settings_manager
+        .initialize()
+        .map_err(|e| format!("Failed to load settings: {}", e))?;
+    let mut settings = settings_manager.get_settings().unwrap_or_default();
+    if !settings
+        .embedding_endpoint
+        .as_deref()
+        .is_some_and(|endpoint| !endpoint.is_empty())
+    {
+        return Err(
+            "The built-in model can't be changed, set embedding_endpoint to use another model"
+                .to_string(),
+        );
+    }
+
+    let previous = Embedder::configured_model_name(&settings);
+    encryption::init_encryption(&settings, &db_path);
+
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .map_err(|e| format!("Failed to start runtime: {}", e))?;
+    let vectordb = Mutex::new(
+        runtime
+            .block_on(VectorDbManager::open_default())
+            .map_err(|e| format!("Failed to open the vector DB: {}", e))?,
+    );
+
+    // vectors stored before models were recorded come from the model configured until now
+    runtime
+        .block_on(async {
+            vectordb
+                .lock()
+                .await
+                .stamp_unversioned_rows(&previous)
+                .await
+        })
+        .map_err(|e| format!("Failed to read the vector DB: {}", e))?;
+
+    settings.embedding_model = Some(model.clone());
+    let embedder = Arc::new(
+        Embedder::from_settings(&settings)
+            .map_err(|e| format!("Failed to set up the embedder: {}", e))?,
+    );
+    runtime
+        .block_on(async {
+            let dimension = vectordb.lock().await.dimension();
+            check_dimension(&embedder, dimension).await
+        })
+        .map_err(|e| format!("Can't switch to {}: {}", model, e))?;
+
+    settings_manager
+        .update(settings)
+        .map_err(|e| format!("Failed to save settings: {}", e))?;
+    println!(
+        "Switched the embedding model from {} to {}",
+        previous, model
+    );
+
+    let file_ids = runtime
+        .block_on(async { vectordb.lock().await.files_not_embedded_with(&model).await })
+        .map_err(|e| format!("Failed to read the vector DB: {}", e))?;
+
+    let total = file_ids.len();
+    let mut failed = 0;
+    for (i, file_id) in file_ids.iter().enumerate() {
+        if let Err(e) = runtime.block_on(reembed_file(&vectordb, embedder.clone(), file_id)) {
+            // a used up quota fails every other file the same way
+            if matches!(&e, ReembedError::Embed(err) if err.is_quota_exceeded()) {
+                return Err(format!(
+                    "Stopped after {} of {} files: {}. Run the command again to carry on",
+                    i, total, e
+                ));
+            }
+            eprintln!("Failed to re-embed file {}: {}", file_id, e);
+            failed += 1;
+        }
+        println!("Re-embedded {}/{} files", i + 1, total);
+    }
+
+    if failed > 0 {
+        println!(
+            "{} files failed, kita tries them again when it starts",
+            failed
+        );
+    }
+    println!(
+        "A running kita embeds new files with {} within a few seconds",
+        model
+    );
+    Ok(())
+}
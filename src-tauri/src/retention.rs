@@ -0,0 +1,121 @@
+/*
+This file contains the retention rules for roots that fill up with things nobody looks at again, like ~/Downloads ("drop files not modified in 180 days").
+Expired files are pruned from the index during maintenance and skipped when the root is walked again, so rescans don't bring them back
+*/
+
+use rusqlite::Connection;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use tauri::AppHandle;
+use tokio::task;
+
+use crate::file_processor::{remove_indexed_files, FileProcessorError};
+use crate::scheduler::{expand_path, parse_interval};
+use crate::settings::AppSettings;
+
+/// The enabled retention rules, with their roots expanded
+#[derive(Debug, Clone, Default)]
+pub struct RetentionPolicy {
+    rules: Vec<(PathBuf, Duration)>,
+}
+
+impl RetentionPolicy {
+    pub fn from_settings(settings: &AppSettings) -> Self {
+        let rules = settings
+            .retention_rules
+            .iter()
+            .flatten()
+            .filter(|rule| rule.enabled.unwrap_or(true))
+            .filter_map(|rule| match parse_interval(&rule.max_age) {
+                Some(max_age) => Some((PathBuf::from(expand_path(&rule.path)), max_age)),
+                None => {
+                    eprintln!(
+                        "Ignoring retention rule for {}: invalid max_age {}",
+                        rule.path, rule.max_age
+                    );
+                    None
+                }
+            })
+            .collect();
+
+        Self { rules }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.rules.is_empty()
+    }
+
+    /// The max age for files under `path`. When roots are nested, the rule of the innermost one applies
+    fn max_age_for(&self, path: &Path) -> Option<Duration> {
+        self.rules
+            .iter()
+            .filter(|(root, _)| path.starts_with(root))
+            .max_by_key(|(root, _)| root.components().count())
+            .map(|(_, max_age)| *max_age)
+    }
+
+    /// Whether a file falls under a rule and wasn't modified within its max age
+    pub fn is_expired(&self, path: &Path, modified_at: Option<i64>, now: i64) -> bool {
+        match (self.max_age_for(path), modified_at) {
+            (Some(max_age), Some(modified_at)) => now - modified_at > max_age.as_secs() as i64,
+            _ => false,
+        }
+    }
+}
+
+pub fn unix_now() -> i64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs() as i64)
+        .unwrap_or(0)
+}
+
+fn modified_at(path: &Path) -> Option<i64> {
+    std::fs::metadata(path)
+        .and_then(|meta| meta.modified())
+        .ok()
+        .and_then(|time| time.duration_since(UNIX_EPOCH).ok())
+        .map(|d| d.as_secs() as i64)
+}
+
+/// Removes the index entries of every indexed file the policy says has expired, returns how many were removed.
+/// Files that are gone from disk are left to the watcher
+pub async fn prune_expired(
+    app_handle: &AppHandle,
+    db_path: PathBuf,
+    policy: &RetentionPolicy,
+) -> Result<usize, FileProcessorError> {
+    if policy.is_empty() {
+        return Ok(0);
+    }
+
+    let sqlite_path = db_path.clone();
+    let policy_for_scan = policy.clone();
+    let expired = task::spawn_blocking(move || -> Result<Vec<String>, FileProcessorError> {
+        let conn = Connection::open(&sqlite_path)?;
+        let mut stmt = conn.prepare("SELECT path FROM files")?;
+        let paths = stmt
+            .query_map([], |row| row.get::<_, String>(0))?
+            .collect::<rusqlite::Result<Vec<_>>>()?;
+
+        let now = unix_now();
+        Ok(paths
+            .into_iter()
+            .filter(|path| {
+                let path = Path::new(path);
+                // only files under a rule's root are looked up on disk
+                policy_for_scan.max_age_for(path).is_some()
+                    && policy_for_scan.is_expired(path, modified_at(path), now)
+            })
+            .collect())
+    })
+    .await
+    .map_err(|e| FileProcessorError::Other(format!("spawn_blocking error: {e}")))??;
+
+    if expired.is_empty() {
+        return Ok(0);
+    }
+
+    println!("Pruning {} expired files from the index", expired.len());
+    remove_indexed_files(app_handle, db_path, expired).await
+}
@@ -0,0 +1,175 @@
+/*
+This file contains the retrieval endpoint for RAG: given a query and a token budget it returns deduplicated chunks annotated with citations, packed so they fit the budget of the caller's LLM context
+*/
+
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use tauri::AppHandle;
+use thiserror::Error;
+
+use crate::vectordb_manager::{chunk_index, ScoredChunk, VectorDbManager};
+
+const DEFAULT_TOKEN_BUDGET: usize = 2000;
+const DEFAULT_MAX_CHUNKS_PER_FILE: usize = 3;
+/// How many candidates to pull from the vector search before deduplicating and packing
+const CANDIDATE_LIMIT: usize = 50;
+/// Rough number of characters per token for English text, good enough for budgeting without a tokenizer
+const CHARS_PER_TOKEN: usize = 4;
+
+#[derive(Error, Debug)]
+pub enum RetrievalError {
+    #[error("Vector DB error: {0}")]
+    VectorDb(String),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = RetrievalError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RetrievedChunk {
+    /// Number used to cite this chunk, e.g. [1]
+    pub citation: usize,
+    pub chunk_id: String,
+    pub chunk_index: usize,
+    pub file_id: String,
+    pub file_path: String,
+    /// Page the chunk is on, for paged documents like PDFs
+    pub page_number: Option<u32>,
+    pub text: String,
+    pub distance: f32,
+    pub tokens: usize,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RetrievalResult {
+    pub query: String,
+    pub token_budget: usize,
+    pub tokens_used: usize,
+    pub chunks: Vec<RetrievedChunk>,
+    /// The chunks formatted as citation annotated blocks, ready to be dropped into a prompt
+    pub context: String,
+}
+
+pub async fn retrieve_chunks(
+    app_handle: &AppHandle,
+    query: &str,
+    token_budget: usize,
+    max_chunks_per_file: usize,
+) -> Result<RetrievalResult> {
+    if query.trim().is_empty() {
+        return Err(RetrievalError::Other("Query is empty".into()));
+    }
+
+    let candidates = VectorDbManager::search_chunks(app_handle, query, CANDIDATE_LIMIT)
+        .await
+        .map_err(|e| RetrievalError::VectorDb(e.to_string()))?;
+
+    let chunks = pack_chunks(dedupe_chunks(candidates, max_chunks_per_file), token_budget);
+
+    let tokens_used = chunks.iter().map(|c| c.tokens).sum();
+    let context = chunks
+        .iter()
+        .map(format_chunk)
+        .collect::<Vec<_>>()
+        .join("\n\n");
+
+    Ok(RetrievalResult {
+        query: query.to_string(),
+        token_budget,
+        tokens_used,
+        chunks,
+        context,
+    })
+}
+
+/// Drops chunks with the same text (the same file indexed under two paths, copies, boilerplate)
+/// and limits how many chunks a single file can contribute. Expects the candidates closest first
+fn dedupe_chunks(candidates: Vec<ScoredChunk>, max_chunks_per_file: usize) -> Vec<ScoredChunk> {
+    let mut seen_texts: HashSet<String> = HashSet::new();
+    let mut per_file: HashMap<String, usize> = HashMap::new();
+
+    candidates
+        .into_iter()
+        .filter(|chunk| {
+            let normalized = chunk.text.split_whitespace().collect::<Vec<_>>().join(" ");
+            if normalized.is_empty() || !seen_texts.insert(normalized.to_lowercase()) {
+                return false;
+            }
+
+            let count = per_file.entry(chunk.file_id.clone()).or_insert(0);
+            if *count >= max_chunks_per_file {
+                return false;
+            }
+            *count += 1;
+            true
+        })
+        .collect()
+}
+
+/// Greedily takes the closest chunks that still fit in the budget, skipping ones that are too large
+fn pack_chunks(chunks: Vec<ScoredChunk>, token_budget: usize) -> Vec<RetrievedChunk> {
+    let mut packed: Vec<RetrievedChunk> = Vec::new();
+    let mut remaining = token_budget;
+
+    for chunk in chunks {
+        let mut retrieved = RetrievedChunk {
+            citation: packed.len() + 1,
+            chunk_index: chunk_index(&chunk.id),
+            chunk_id: chunk.id,
+            file_id: chunk.file_id,
+            file_path: chunk.file_path,
+            page_number: chunk.page_number,
+            text: chunk.text,
+            distance: chunk.distance,
+            tokens: 0,
+        };
+        // count the citation header too, since it ends up in the prompt
+        retrieved.tokens = estimate_tokens(&format_chunk(&retrieved));
+
+        if retrieved.tokens > remaining {
+            continue;
+        }
+
+        remaining -= retrieved.tokens;
+        packed.push(retrieved);
+    }
+
+    packed
+}
+
+fn format_chunk(chunk: &RetrievedChunk) -> String {
+    // a page is something the reader can look up, a chunk index isn't
+    let location = match chunk.page_number {
+        Some(page) => format!("page {}", page),
+        None => format!("chunk {}", chunk.chunk_index),
+    };
+    format!(
+        "[{}] {} ({})\n{}",
+        chunk.citation, chunk.file_path, location, chunk.text
+    )
+}
+
+fn estimate_tokens(text: &str) -> usize {
+    text.chars().count().div_ceil(CHARS_PER_TOKEN)
+}
+
+#[tauri::command]
+pub async fn retrieve(
+    query: String,
+    token_budget: Option<usize>,
+    max_chunks_per_file: Option<usize>,
+    app_handle: AppHandle,
+) -> std::result::Result<RetrievalResult, String> {
+    retrieve_chunks(
+        &app_handle,
+        &query,
+        token_budget.unwrap_or(DEFAULT_TOKEN_BUDGET),
+        max_chunks_per_file
+            .unwrap_or(DEFAULT_MAX_CHUNKS_PER_FILE)
+            .max(1),
+    )
+    .await
+    .map_err(|e| format!("Failed to retrieve chunks: {}", e))
+}
@@ -0,0 +1,207 @@
+/*
+This file contains the scheduler for periodic re-scans of indexed roots ("rescan ~/Documents every 6h").
+Scans are incremental and never overlap: a due scan is skipped while any other indexing run is in progress and retried on the next tick
+*/
+
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+use tauri::{AppHandle, Emitter, Manager, State};
+
+use crate::connectors::{self, REMOTE_SCHEME};
+use crate::file_processor::{FileProcessorState, ProcessingStatus};
+use crate::indexing_control::{IndexingControl, Lane};
+use crate::settings::{RescanSchedule, SettingsManagerState};
+use crate::AppResult;
+
+const TICK_INTERVAL_SECS: u64 = 60;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ScheduleStatus {
+    pub path: String,
+    pub every: String,
+    pub enabled: bool,
+    pub last_run_secs_ago: Option<u64>,
+    pub next_run_in_secs: Option<u64>,
+}
+
+/// When each scheduled root was last scanned, keyed by the expanded path
+#[derive(Default)]
+pub struct SchedulerState(pub Mutex<HashMap<String, Instant>>);
+
+/// Parses intervals like "90s", "30m", "6h" or "1d"
+pub fn parse_interval(value: &str) -> Option<Duration> {
+    let value = value.trim();
+    let split = value.find(|c: char| !c.is_ascii_digit())?;
+    let (amount, unit) = value.split_at(split);
+    let amount: u64 = amount.parse().ok()?;
+
+    let secs = match unit.trim() {
+        "s" => amount,
+        "m" => amount * 60,
+        "h" => amount * 60 * 60,
+        "d" => amount * 24 * 60 * 60,
+        _ => return None,
+    };
+
+    (secs > 0).then(|| Duration::from_secs(secs))
+}
+
+/// Expands a leading ~ to the home directory
+pub fn expand_path(path: &str) -> String {
+    match (path.strip_prefix("~"), dirs::home_dir()) {
+        (Some(rest), Some(home)) => format!("{}{}", home.to_string_lossy(), rest),
+        _ => path.to_string(),
+    }
+}
+
+fn get_schedules(app_handle: &AppHandle) -> Vec<RescanSchedule> {
+    app_handle
+        .state::<SettingsManagerState>()
+        .0
+        .get_settings()
+        .ok()
+        .and_then(|settings| settings.rescan_schedules)
+        .unwrap_or_default()
+}
+
+/// Initialize the scheduler state and start the scheduler loop
+pub fn init_scheduler(app: &tauri::App) -> AppResult<()> {
+    app.manage(SchedulerState::default());
+
+    let app_handle = app.app_handle().clone();
+    tauri::async_runtime::spawn(async move {
+        run_scheduler(app_handle).await;
+    });
+
+    println!("Scheduler initialized");
+    Ok(())
+}
+
+/// Checks the schedules every tick. The schedules are re-read from the settings each time,
+/// so changes apply without a restart. A schedule first runs one interval after startup
+async fn run_scheduler(app_handle: AppHandle) {
+    let started = Instant::now();
+    let mut ticker = tokio::time::interval(Duration::from_secs(TICK_INTERVAL_SECS));
+
+    loop {
+        ticker.tick().await;
+
+        for schedule in get_schedules(&app_handle) {
+            if !schedule.enabled.unwrap_or(true) {
+                continue;
+            }
+
+            let Some(interval) = parse_interval(&schedule.every) else {
+                eprintln!(
+                    "Invalid rescan interval {:?} for {}",
+                    schedule.every, schedule.path
+                );
+                continue;
+            };
+
+            let path = expand_path(&schedule.path);
+            let last_run = {
+                let state = app_handle.state::<SchedulerState>();
+                let last_runs = state.0.lock().unwrap();
+                last_runs.get(&path).copied().unwrap_or(started)
+            };
+
+            if last_run.elapsed() < interval {
+                continue;
+            }
+
+            let control = app_handle.state::<Arc<IndexingControl>>();
+            if control.is_running() || control.is_paused() {
+                println!("Skipping scheduled scan of {}: indexing is busy", path);
+                continue;
+            }
+
+            run_scan(&app_handle, path).await;
+        }
+    }
+}
+
+/// Runs one incremental scan. Awaited by the scheduler loop, so scheduled scans never overlap each other
+async fn run_scan(app_handle: &AppHandle, path: String) {
+    let processor = {
+        let state = app_handle.state::<FileProcessorState>();
+        let guard = state.0.lock().unwrap();
+        guard.as_ref().cloned()
+    };
+
+    let Some(processor) = processor else {
+        eprintln!("FileProcessor not available (scheduled scan).");
+        return;
+    };
+
+    println!("Starting scheduled scan of {}", path);
+
+    // remote://gdrive style roots are synced through their connector
+    let result = match path.strip_prefix(REMOTE_SCHEME) {
+        Some(kind) => connectors::sync_connector(app_handle, &processor, kind)
+            .await
+            .map(|summary| serde_json::json!(summary))
+            .map_err(|e| e.to_string()),
+        None => {
+            let progress_handler = move |_status: ProcessingStatus| { /* do nothing */ };
+            processor
+                .rescan_paths(
+                    vec![path.clone()],
+                    progress_handler,
+                    app_handle.clone(),
+                    Lane::Background,
+                )
+                .await
+                .map(|result| serde_json::json!(result))
+                .map_err(|e| e.to_string())
+        }
+    };
+
+    // record the attempt even if it failed, so a broken root doesn't get retried every tick
+    app_handle
+        .state::<SchedulerState>()
+        .0
+        .lock()
+        .unwrap()
+        .insert(path.clone(), Instant::now());
+
+    match result {
+        Ok(summary) => {
+            println!("Scheduled scan of {} finished: {}", path, summary);
+            let _ = app_handle.emit("files-updated", ());
+            let _ = app_handle.emit("scheduled-scan-complete", &summary);
+        }
+        Err(e) => eprintln!("Scheduled scan of {} failed: {}", path, e),
+    }
+}
+
+#[tauri::command]
+pub fn get_scan_schedules(
+    state: State<'_, SchedulerState>,
+    app_handle: AppHandle,
+) -> Result<Vec<ScheduleStatus>, String> {
+    let last_runs = state.0.lock().map_err(|e| e.to_string())?;
+
+    let statuses = get_schedules(&app_handle)
+        .into_iter()
+        .map(|schedule| {
+            let last_run = last_runs.get(&expand_path(&schedule.path));
+            let interval = parse_interval(&schedule.every);
+
+            ScheduleStatus {
+                last_run_secs_ago: last_run.map(|t| t.elapsed().as_secs()),
+                next_run_in_secs: match (last_run, interval) {
+                    (Some(t), Some(i)) => Some(i.saturating_sub(t.elapsed()).as_secs()),
+                    _ => None,
+                },
+                enabled: schedule.enabled.unwrap_or(true),
+                path: schedule.path,
+                every: schedule.every,
+            }
+        })
+        .collect();
+
+    Ok(statuses)
+}
@@ -0,0 +1,165 @@
+/*
+This file contains the secrets store: API keys and connector OAuth tokens live in the OS keychain (macOS Keychain, Windows Credential Manager, libsecret on Linux), never in the settings or SQLite.
+Secrets are managed from the app with the commands below or from the terminal with `kita auth`
+*/
+
+use keyring::Entry;
+use serde::{Deserialize, Serialize};
+use thiserror::Error;
+
+use crate::connectors::CONNECTOR_KINDS;
+
+/// Service name every kita entry is stored under in the keychain
+const SERVICE: &str = "kita";
+
+/// Bearer token sent to the remote embedding endpoint
+pub const EMBEDDING_API_KEY: &str = "embedding_api_key";
+/// Bearer token sent to the summary endpoint
+pub const SUMMARY_API_KEY: &str = "summary_api_key";
+/// Passphrase the encryption at rest key is derived from, see encryption.rs
+pub const ENCRYPTION_PASSPHRASE: &str = "encryption_passphrase";
+/// Generated encryption at rest key, used when no passphrase is set. Internal, it can't be set from outside
+pub const ENCRYPTION_KEY: &str = "encryption_key";
+
+#[derive(Error, Debug)]
+pub enum SecretsError {
+    #[error("Keychain error: {0}")]
+    Keychain(#[from] keyring::Error),
+
+    #[error("Unknown secret: {0}")]
+    Unknown(String),
+}
+
+pub type Result<T, E = SecretsError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SecretStatus {
+    pub name: String,
+    pub is_set: bool,
+}
+
+pub fn connector_tokens_name(kind: &str) -> String {
+    format!("connector/{}/tokens", kind)
+}
+
+pub fn connector_client_secret_name(kind: &str) -> String {
+    format!("connector/{}/client_secret", kind)
+}
+
+/// Every secret kita knows about. Only these can be set from outside
+pub fn known_secret_names() -> Vec<String> {
+    let mut names = vec![
+        EMBEDDING_API_KEY.to_string(),
+        SUMMARY_API_KEY.to_string(),
+        ENCRYPTION_PASSPHRASE.to_string(),
+    ];
+    for kind in CONNECTOR_KINDS {
+        names.push(connector_tokens_name(kind));
+        names.push(connector_client_secret_name(kind));
+    }
+    names
+}
+
+fn check_known(name: &str) -> Result<()> {
+    if known_secret_names().iter().any(|known| known == name) {
+        Ok(())
+    } else {
+        Err(SecretsError::Unknown(name.to_string()))
+    }
+}
+
+/// None when the secret was never stored
+pub fn get_secret(name: &str) -> Result<Option<String>> {
+    match Entry::new(SERVICE, name)?.get_password() {
+        Ok(secret) => Ok(Some(secret)),
+        Err(keyring::Error::NoEntry) => Ok(None),
+        Err(e) => Err(e.into()),
+    }
+}
+
+pub fn set_secret(name: &str, secret: &str) -> Result<()> {
+    Entry::new(SERVICE, name)?.set_password(secret)?;
+    Ok(())
+}
+
+/// Deleting a secret that doesn't exist is not an error
+pub fn delete_secret(name: &str) -> Result<()> {
+    match Entry::new(SERVICE, name)?.delete_credential() {
+        Ok(()) | Err(keyring::Error::NoEntry) => Ok(()),
+        Err(e) => Err(e.into()),
+    }
+}
+
+/// Which of the known secrets are set, without revealing their values
+pub fn list_secrets() -> Result<Vec<SecretStatus>> {
+    known_secret_names()
+        .into_iter()
+        .map(|name| {
+            let is_set = get_secret(&name)?.is_some();
+            Ok(SecretStatus { name, is_set })
+        })
+        .collect()
+}
+
+#[tauri::command]
+pub fn get_secrets() -> Result<Vec<SecretStatus>, String> {
+    list_secrets().map_err(|e| format!("Failed to list secrets: {}", e))
+}
+
+#[tauri::command]
+pub fn store_secret(name: String, secret: String) -> Result<(), String> {
+    check_known(&name)
+        .and_then(|_| set_secret(&name, &secret))
+        .map_err(|e| format!("Failed to store secret: {}", e))
+}
+
+#[tauri::command]
+pub fn remove_secret(name: String) -> Result<(), String> {
+    check_known(&name)
+        .and_then(|_| delete_secret(&name))
+        .map_err(|e| format!("Failed to remove secret: {}", e))
+}
+
+/// `kita auth list`, `kita auth set <name>` (reads the secret from stdin) and `kita auth delete <name>`
+pub fn run_auth_command(args: &[String]) -> Result<(), String> {
+    match args {
+        [command] if command == "list" => {
+            let secrets = list_secrets().map_err(|e| e.to_string())?;
+            for secret in secrets {
+                println!(
+                    "{:<40} {}",
+                    secret.name,
+                    if secret.is_set { "set" } else { "-" }
+                );
+            }
+            Ok(())
+        }
+        [command, name] if command == "set" => {
+            check_known(name).map_err(|e| e.to_string())?;
+
+            // read from stdin so the secret doesn't end up in the shell history
+            eprint!("Value for {}: ", name);
+            let mut secret = String::new();
+            std::io::stdin()
+                .read_line(&mut secret)
+                .map_err(|e| format!("Failed to read secret: {}", e))?;
+            let secret = secret.trim_end_matches(['\r', '\n']);
+            if secret.is_empty() {
+                return Err("Secret is empty".to_string());
+            }
+
+            set_secret(name, secret).map_err(|e| e.to_string())?;
+            println!("Stored {}", name);
+            Ok(())
+        }
+        [command, name] if command == "delete" => {
+            check_known(name).map_err(|e| e.to_string())?;
+            delete_secret(name).map_err(|e| e.to_string())?;
+            println!("Deleted {}", name);
+            Ok(())
+        }
+        _ => Err(
+            "Usage: kita auth list | kita auth set <name> | kita auth delete <name>".to_string(),
+        ),
+    }
+}
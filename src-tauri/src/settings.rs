@@ -4,6 +4,9 @@ use std::sync::{Arc, Mutex};
 use tauri::{AppHandle, Manager};
 use thiserror::Error;
 
+use crate::chunker::txt::set_plain_text_extensions;
+use crate::file_processor;
+
 #[derive(Serialize, Deserialize, Debug, Clone, Default)]
 pub struct AppSettings {
     pub theme: Option<String>,
@@ -13,7 +16,86 @@ pub struct AppSettings {
     pub window_height: Option<u32>,
     pub global_hotkey: Option<String>,
     pub index_concurrency: Option<usize>,
+    pub index_walk_workers: Option<usize>,
+    pub index_extract_workers: Option<usize>,
+    pub index_embed_workers: Option<usize>,
+    pub index_store_workers: Option<usize>,
+    pub index_queue_capacity: Option<usize>,
+    pub index_priority: Option<String>,
+    pub index_throttle_on_battery: Option<bool>,
+    /// Stop running scans when the laptop goes on battery instead of only throttling them, off unless set
+    pub index_stop_on_battery: Option<bool>,
+    pub index_cpu_threshold: Option<f32>,
+    /// Files the watcher sees change go ahead of running scans, on unless set to false
+    pub index_fresh_first: Option<bool>,
+    pub index_link_policy: Option<String>,
+    /// Index images by name and store a thumbnail of them, on unless set to false
+    pub index_images: Option<bool>,
+    /// What to do with secrets and PII found in extracted text: "redact" (default), "flag", "skip" or "off"
+    pub sensitive_content_policy: Option<String>,
+    /// Encrypt chunk text, embeddings, summaries, version history and thumbnails when they are stored, see encryption.rs
+    pub encrypt_at_rest: Option<bool>,
+    pub rescan_schedules: Option<Vec<RescanSchedule>>,
+    pub retention_rules: Option<Vec<RetentionRule>>,
+    pub index_profiles: Option<Vec<IndexProfileRule>>,
+    /// Size the index may grow to, e.g. "2GB". Past it the least used files lose their content, see storage_budget.rs
+    pub index_storage_budget: Option<String>,
+    pub history_max_versions: Option<usize>,
+    /// Extra extensions to index as plain text, e.g. ["proto", ".gradle"]
+    pub plain_text_extensions: Option<Vec<String>>,
     pub selected_categories: Option<Vec<String>>,
+    /// "http(s)://host:port" or "unix:/path/to/socket", a socket is only reachable by processes its file permissions allow
+    pub embedding_endpoint: Option<String>,
+    pub embedding_model: Option<String>,
+    pub embedding_connections: Option<usize>,
+    pub embedding_http2: Option<bool>,
+    /// Header the embedding API key is sent in as is, e.g. "X-Api-Key". Defaults to "Authorization: Bearer <key>"
+    pub embedding_auth_header: Option<String>,
+    /// PEM certificate and PKCS#8 key kita presents to an https embedding endpoint that requires client certificates
+    pub embedding_client_cert: Option<String>,
+    pub embedding_client_key: Option<String>,
+    /// OpenAI compatible endpoint documents are summarized with, e.g. "http://localhost:11434". Summaries are off without one
+    pub summary_endpoint: Option<String>,
+    pub summary_model: Option<String>,
+    /// Proxy for every outgoing request, e.g. "http://proxy.corp:3128". Defaults to the HTTP(S)_PROXY environment variables
+    pub http_proxy: Option<String>,
+    /// Hosts that bypass `http_proxy`, in NO_PROXY format
+    pub no_proxy: Option<String>,
+    /// PEM file with extra root certificates, for proxies that intercept TLS
+    pub tls_ca_bundle: Option<String>,
+    pub tls_skip_verify: Option<bool>,
+}
+
+/// Periodic incremental re-scan of a root, e.g. `{ "path": "~/Documents", "every": "6h" }`.
+/// Connected sources are scheduled the same way with their remote root, e.g. "remote://gdrive"
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct RescanSchedule {
+    pub path: String,
+    /// Interval like "30m", "6h" or "1d"
+    pub every: String,
+    pub enabled: Option<bool>,
+}
+
+/// Drops the index entries of files under a root that weren't modified for a while, e.g. `{ "path": "~/Downloads", "max_age": "180d" }`.
+/// Applied when the database is maintained, and expired files are skipped when the root is scanned
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct RetentionRule {
+    pub path: String,
+    /// Age like "90d" or "12h", the same format as rescan intervals
+    pub max_age: String,
+    pub enabled: Option<bool>,
+}
+
+/// How much of the files under a root gets indexed, e.g. `{ "path": "~/Code", "profile": "no_embeddings", "exclude_binaries": true }`.
+/// Applied when the root is walked, see index_profiles.rs
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct IndexProfileRule {
+    pub path: String,
+    /// "full" (default), "no_embeddings" or "metadata_only"
+    pub profile: String,
+    /// Leave out PDFs, Word documents and images
+    pub exclude_binaries: Option<bool>,
+    pub enabled: Option<bool>,
 }
 
 #[derive(Error, Debug)]
@@ -114,6 +196,16 @@ impl SettingsManager {
 
 pub struct SettingsManagerState(pub Arc<SettingsManager>);
 
+/// Pushes the settings that live outside the settings manager to where they are read
+fn apply_settings(settings: &AppSettings) {
+    set_plain_text_extensions(
+        settings
+            .plain_text_extensions
+            .as_deref()
+            .unwrap_or_default(),
+    );
+}
+
 // Initialize settings for the app
 pub fn init_settings(
     db_path: &str,
@@ -124,6 +216,7 @@ pub fn init_settings(
 
     // Initialize settings (load or create default)
     settings_manager.initialize()?;
+    apply_settings(&settings_manager.get_settings()?);
 
     // Store in app state
     app_handle.manage(SettingsManagerState(Arc::new(settings_manager)));
@@ -142,13 +235,21 @@ pub async fn get_settings(
         .map_err(|e| format!("Failed to get settings: {}", e))
 }
 
+/// Saves the settings and applies them without a restart. The scheduler, the watcher and the indexing controls
+/// read the settings as they go, the file processor is rebuilt here
 #[tauri::command]
 pub async fn update_settings(
     settings_manager: tauri::State<'_, SettingsManagerState>,
     settings: AppSettings,
+    app_handle: AppHandle,
 ) -> Result<(), String> {
+    apply_settings(&settings);
+
     settings_manager
         .0
-        .update(settings)
-        .map_err(|e| format!("Failed to update settings: {}", e))
+        .update(settings.clone())
+        .map_err(|e| format!("Failed to update settings: {}", e))?;
+
+    file_processor::reload_file_processor(&app_handle, &settings)
+        .map_err(|e| format!("Failed to apply settings: {}", e))
 }
@@ -0,0 +1,476 @@
+/*
+This file contains the storage budget of the index, e.g. "2GB", and the report of where the space goes. When the index grows past the budget, the files that were
+opened longest ago and least often lose their chunk text and vectors. They keep their metadata and FTS entries, so they can still be found by name, and pinned
+files are never evicted. The size is checked every hour and when the database is maintained
+*/
+
+use rusqlite::{params, Connection};
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tauri::{AppHandle, Emitter, Manager, State};
+use thiserror::Error;
+use tokio::sync::Mutex;
+use tokio::task;
+
+use crate::file_processor::{get_processor, FileProcessorState};
+use crate::indexing_control::{IndexingControl, Lane};
+use crate::maintenance;
+use crate::settings::{AppSettings, SettingsManagerState};
+use crate::vectordb_manager::VectorDbManager;
+use crate::AppResult;
+
+/// How often the size of the index is checked against the budget
+const CHECK_INTERVAL_SECS: u64 = 60 * 60;
+/// The vectors keep at least this fraction of the budget, 1/4, however large the sqlite database is
+const MIN_VECTOR_SHARE: u64 = 4;
+
+#[derive(Error, Debug)]
+pub enum StorageBudgetError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Vector DB error: {0}")]
+    VectorDb(String),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = StorageBudgetError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TableUsage {
+    pub name: String,
+    pub rows: i64,
+    /// None when this SQLite build can't tell the size of single tables
+    pub bytes: Option<u64>,
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct CategoryUsage {
+    pub category: String,
+    pub files: usize,
+    /// Size of the files on disk
+    pub source_bytes: u64,
+    /// Roughly what their chunks take up in the vector db
+    pub index_bytes: u64,
+    pub evicted_files: usize,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct StorageStats {
+    pub total_bytes: u64,
+    pub sqlite_bytes: u64,
+    pub vector_bytes: u64,
+    pub budget_bytes: Option<u64>,
+    pub tables: Vec<TableUsage>,
+    pub categories: Vec<CategoryUsage>,
+    pub evicted_files: usize,
+    /// What the evicted files took up when they were evicted
+    pub evicted_bytes: u64,
+}
+
+/// Parses sizes like "2GB", "500MB" or "1.5G", in powers of 1024. Plain numbers are bytes
+pub fn parse_size(value: &str) -> Option<u64> {
+    let value = value.trim();
+    let split = value
+        .find(|c: char| !c.is_ascii_digit() && c != '.')
+        .unwrap_or(value.len());
+    let (amount, unit) = value.split_at(split);
+    let amount: f64 = amount.parse().ok()?;
+
+    let multiplier: u64 = match unit.trim().to_uppercase().as_str() {
+        "" | "B" => 1,
+        "K" | "KB" => 1024,
+        "M" | "MB" => 1024 * 1024,
+        "G" | "GB" => 1024 * 1024 * 1024,
+        "T" | "TB" => 1024 * 1024 * 1024 * 1024,
+        _ => return None,
+    };
+
+    let bytes = (amount * multiplier as f64) as u64;
+    (bytes > 0).then_some(bytes)
+}
+
+pub fn format_bytes(bytes: u64) -> String {
+    const UNITS: [&str; 5] = ["B", "KB", "MB", "GB", "TB"];
+
+    let mut size = bytes as f64;
+    let mut unit = 0;
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+
+    if unit == 0 {
+        format!("{} B", bytes)
+    } else {
+        format!("{:.1} {}", size, UNITS[unit])
+    }
+}
+
+/// The configured budget in bytes, None when the index may grow as it likes
+pub fn budget_bytes(settings: &AppSettings) -> Option<u64> {
+    let value = settings.index_storage_budget.as_deref()?;
+    let bytes = parse_size(value);
+    if bytes.is_none() {
+        eprintln!("Ignoring storage budget: invalid size {}", value);
+    }
+    bytes
+}
+
+/// Picks the files whose chunks go so the chunks left take up at most `allowance` bytes, with what each of them takes up.
+/// The files opened longest ago go first, files never opened count from when they were indexed, and the less opened one on a tie
+pub fn select_evictions(
+    conn: &Connection,
+    bytes_by_file: &HashMap<String, u64>,
+    allowance: u64,
+) -> Result<Vec<(String, u64)>> {
+    let mut total: u64 = bytes_by_file.values().sum();
+    if total <= allowance {
+        return Ok(Vec::new());
+    }
+
+    let mut stmt = conn.prepare(
+        r#"
+        SELECT f.id
+        FROM files f
+        LEFT JOIN opens o ON o.path = f.path
+        WHERE f.path NOT IN (SELECT path FROM pins)
+        GROUP BY f.id
+        ORDER BY COALESCE(MAX(o.opened_at), f.updated_at) ASC, COUNT(o.id) ASC
+        "#,
+    )?;
+    let candidates = stmt
+        .query_map([], |row| row.get::<_, i64>(0))?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+
+    let mut evictions = Vec::new();
+    for file_id in candidates {
+        if total <= allowance {
+            break;
+        }
+        let file_id = file_id.to_string();
+        if let Some(&bytes) = bytes_by_file.get(&file_id) {
+            total -= bytes;
+            evictions.push((file_id, bytes));
+        }
+    }
+
+    Ok(evictions)
+}
+
+pub fn record_evictions(conn: &mut Connection, evictions: &[(String, u64)]) -> Result<()> {
+    let tx = conn.transaction()?;
+    for (file_id, bytes) in evictions {
+        tx.execute(
+            "INSERT OR REPLACE INTO evicted_files (file_id, bytes, evicted_at) VALUES (?1, ?2, CURRENT_TIMESTAMP)",
+            params![file_id, *bytes as i64],
+        )?;
+    }
+    tx.commit()?;
+
+    Ok(())
+}
+
+/// Ids of the files whose content was evicted
+pub fn evicted_file_ids(conn: &Connection) -> Result<HashSet<String>> {
+    let mut stmt = conn.prepare("SELECT file_id FROM evicted_files")?;
+    let ids = stmt
+        .query_map([], |row| row.get::<_, i64>(0))?
+        .map(|id| id.map(|id| id.to_string()))
+        .collect::<rusqlite::Result<HashSet<_>>>()?;
+
+    Ok(ids)
+}
+
+/// Evicts the content of the least used files until the vectors fit in what the budget leaves them, returns how many were evicted.
+/// Rows are deleted per file, so chunks written meanwhile are kept, and the table is compacted afterwards
+pub async fn evict_to_budget(app_handle: &AppHandle, db_path: PathBuf) -> Result<usize> {
+    let settings = app_handle
+        .state::<SettingsManagerState>()
+        .0
+        .get_settings()
+        .unwrap_or_default();
+    let Some(budget) = budget_bytes(&settings) else {
+        return Ok(0);
+    };
+
+    // lets the scheduler know not to start a scan while the table is changed
+    let control = app_handle.state::<Arc<IndexingControl>>().inner().clone();
+    let _run = control.begin_run(Lane::Background);
+
+    let vectordb = app_handle
+        .state::<Arc<Mutex<VectorDbManager>>>()
+        .inner()
+        .clone();
+    let manager = vectordb.lock().await;
+    let bytes_by_file = manager
+        .bytes_by_file()
+        .await
+        .map_err(|e| StorageBudgetError::VectorDb(e.to_string()))?;
+
+    // a database that takes up most of the budget by itself doesn't cost the vectors everything
+    let allowance = budget
+        .saturating_sub(maintenance::sqlite_size(&db_path))
+        .max(budget / MIN_VECTOR_SHARE);
+
+    let sqlite_path = db_path.clone();
+    let evictions = task::spawn_blocking(move || {
+        let conn = Connection::open(&sqlite_path)?;
+        select_evictions(&conn, &bytes_by_file, allowance)
+    })
+    .await
+    .map_err(|e| StorageBudgetError::Other(format!("spawn_blocking error: {e}")))??;
+    if evictions.is_empty() {
+        return Ok(0);
+    }
+
+    println!(
+        "Evicting the content of {} files to stay within the {} storage budget",
+        evictions.len(),
+        format_bytes(budget)
+    );
+    let file_ids: Vec<String> = evictions.iter().map(|(id, _)| id.clone()).collect();
+    manager
+        .delete_files(&file_ids)
+        .await
+        .map_err(|e| StorageBudgetError::VectorDb(e.to_string()))?;
+
+    let evicted = evictions.len();
+    task::spawn_blocking(move || {
+        let mut conn = Connection::open(&db_path)?;
+        record_evictions(&mut conn, &evictions)
+    })
+    .await
+    .map_err(|e| StorageBudgetError::Other(format!("spawn_blocking error: {e}")))??;
+
+    manager
+        .compact()
+        .await
+        .map_err(|e| StorageBudgetError::VectorDb(e.to_string()))?;
+
+    Ok(evicted)
+}
+
+/// Checks the size of the index every hour and evicts content when it's over the budget.
+/// When even that can't bring it under, the user is told once and the next try waits until the index grew further
+pub fn init_storage_budget(app: &tauri::App) -> AppResult<()> {
+    let app_handle = app.app_handle().clone();
+    tauri::async_runtime::spawn(async move {
+        let mut ticker = tokio::time::interval(Duration::from_secs(CHECK_INTERVAL_SECS));
+        let mut size_left_over: Option<u64> = None;
+
+        loop {
+            ticker.tick().await;
+
+            let settings = app_handle
+                .state::<SettingsManagerState>()
+                .0
+                .get_settings()
+                .unwrap_or_default();
+            let Some(budget) = budget_bytes(&settings) else {
+                continue;
+            };
+            let Ok(processor) = get_processor(&app_handle.state::<FileProcessorState>()) else {
+                continue;
+            };
+            let Ok(vectordb_path) = maintenance::vectordb_path(&app_handle) else {
+                continue;
+            };
+
+            let size = maintenance::storage_size(&processor.db_path, &vectordb_path);
+            if size <= budget || size_left_over.is_some_and(|left| size <= left) {
+                continue;
+            }
+
+            println!(
+                "Index uses {} of its {} budget",
+                format_bytes(size),
+                format_bytes(budget)
+            );
+            match evict_to_budget(&app_handle, processor.db_path.clone()).await {
+                Ok(evicted) => {
+                    let size_after = maintenance::storage_size(&processor.db_path, &vectordb_path);
+                    if size_after > budget {
+                        eprintln!(
+                            "Index still uses {} of its {} budget after evicting {} files",
+                            format_bytes(size_after),
+                            format_bytes(budget),
+                            evicted
+                        );
+                        size_left_over = Some(size_after);
+                        let _ = app_handle.emit(
+                            "storage-budget-exceeded",
+                            serde_json::json!({ "bytes": size_after, "budgetBytes": budget }),
+                        );
+                    } else {
+                        size_left_over = None;
+                    }
+                }
+                Err(e) => eprintln!("Failed to bring the index under its budget: {}", e),
+            }
+        }
+    });
+
+    Ok(())
+}
+
+/// Space used by every table of the SQLite database, indexes count towards their table
+pub fn table_usage(conn: &Connection) -> Result<Vec<TableUsage>> {
+    let mut stmt = conn.prepare(
+        "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND sql NOT LIKE 'CREATE VIRTUAL%' ORDER BY name",
+    )?;
+    let names = stmt
+        .query_map([], |row| row.get::<_, String>(0))?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+
+    // dbstat is only there when SQLite was built with it
+    let bytes: Option<HashMap<String, u64>> = conn
+        .prepare(
+            "SELECT m.tbl_name, SUM(d.pgsize) FROM dbstat d JOIN sqlite_master m ON m.name = d.name GROUP BY m.tbl_name",
+        )
+        .and_then(|mut stmt| {
+            stmt.query_map([], |row| {
+                Ok((row.get::<_, String>(0)?, row.get::<_, i64>(1)?.max(0) as u64))
+            })?
+            .collect()
+        })
+        .ok();
+
+    let mut tables = Vec::with_capacity(names.len());
+    for name in names {
+        let rows: i64 =
+            conn.query_row(&format!("SELECT COUNT(*) FROM \"{}\"", name), [], |row| {
+                row.get(0)
+            })?;
+        let table_bytes = bytes
+            .as_ref()
+            .map(|bytes| bytes.get(&name).copied().unwrap_or(0));
+        tables.push(TableUsage {
+            name,
+            rows,
+            bytes: table_bytes,
+        });
+    }
+
+    tables.sort_by(|a, b| b.bytes.cmp(&a.bytes).then(a.name.cmp(&b.name)));
+    Ok(tables)
+}
+
+fn category_usage(
+    conn: &Connection,
+    bytes_by_file: &HashMap<String, u64>,
+    evicted: &HashSet<String>,
+) -> Result<Vec<CategoryUsage>> {
+    let mut stmt = conn.prepare("SELECT id, category, size FROM files")?;
+    let files = stmt
+        .query_map([], |row| {
+            Ok((
+                row.get::<_, i64>(0)?.to_string(),
+                row.get::<_, Option<String>>(1)?
+                    .unwrap_or_else(|| "other".to_string()),
+                row.get::<_, Option<i64>>(2)?.unwrap_or(0),
+            ))
+        })?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+
+    let mut categories: HashMap<String, CategoryUsage> = HashMap::new();
+    for (id, category, size) in files {
+        let usage = categories
+            .entry(category.clone())
+            .or_insert_with(|| CategoryUsage {
+                category,
+                ..CategoryUsage::default()
+            });
+        usage.files += 1;
+        usage.source_bytes += size.max(0) as u64;
+        usage.index_bytes += bytes_by_file.get(&id).copied().unwrap_or(0);
+        if evicted.contains(&id) {
+            usage.evicted_files += 1;
+        }
+    }
+
+    let mut categories: Vec<CategoryUsage> = categories.into_values().collect();
+    categories.sort_by(|a, b| {
+        b.index_bytes
+            .cmp(&a.index_bytes)
+            .then(a.category.cmp(&b.category))
+    });
+    Ok(categories)
+}
+
+fn storage_stats(
+    conn: &Connection,
+    db_path: &Path,
+    vectordb_path: &Path,
+    bytes_by_file: &HashMap<String, u64>,
+    budget_bytes: Option<u64>,
+) -> Result<StorageStats> {
+    let sqlite_bytes = maintenance::sqlite_size(db_path);
+    let vector_bytes = maintenance::vector_size(vectordb_path);
+    let evicted = evicted_file_ids(conn)?;
+    let evicted_bytes: i64 = conn.query_row(
+        "SELECT COALESCE(SUM(bytes), 0) FROM evicted_files",
+        [],
+        |row| row.get(0),
+    )?;
+
+    Ok(StorageStats {
+        total_bytes: sqlite_bytes + vector_bytes,
+        sqlite_bytes,
+        vector_bytes,
+        budget_bytes,
+        tables: table_usage(conn)?,
+        categories: category_usage(conn, bytes_by_file, &evicted)?,
+        evicted_files: evicted.len(),
+        evicted_bytes: evicted_bytes.max(0) as u64,
+    })
+}
+
+#[tauri::command]
+pub async fn get_storage_stats(
+    state: State<'_, FileProcessorState>,
+    app_handle: AppHandle,
+) -> std::result::Result<StorageStats, String> {
+    let processor = get_processor(&state)?;
+    let vectordb_path = maintenance::vectordb_path(&app_handle)
+        .map_err(|e| format!("Failed to get storage stats: {}", e))?;
+    let budget = budget_bytes(
+        &app_handle
+            .state::<SettingsManagerState>()
+            .0
+            .get_settings()
+            .unwrap_or_default(),
+    );
+
+    let vectordb = app_handle
+        .state::<Arc<Mutex<VectorDbManager>>>()
+        .inner()
+        .clone();
+    let bytes_by_file = vectordb
+        .lock()
+        .await
+        .bytes_by_file()
+        .await
+        .map_err(|e| format!("Failed to get storage stats: {}", e))?;
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        storage_stats(
+            &conn,
+            &processor.db_path,
+            &vectordb_path,
+            &bytes_by_file,
+            budget,
+        )
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to get storage stats: {}", e))
+}
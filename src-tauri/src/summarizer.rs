@@ -0,0 +1,403 @@
+/*
+This file contains the optional summarization stage. When a summary endpoint is configured, every newly indexed document is queued here
+and a background worker asks an OpenAI compatible chat endpoint (Ollama, llama.cpp server, OpenAI, ...) for a short summary of it.
+Summaries are stored in the summaries table and returned with the search results, so the UI can show what a file is about instead of a raw snippet.
+The queue only holds a few documents, the worker also looks for indexed files without a summary at startup and every hour and summarizes them
+from their stored chunks. That covers documents that didn't fit in the queue, failed, were queued when the app quit or were indexed before summaries were on
+*/
+
+use reqwest::Client;
+use rusqlite::{params, Connection, OptionalExtension};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::path::PathBuf;
+use std::sync::Arc;
+use std::time::Duration;
+use tauri::{AppHandle, Emitter, Manager};
+use thiserror::Error;
+use tokio::sync::mpsc::{self, error::TrySendError, Receiver, Sender};
+use tokio::sync::Mutex;
+use tokio::task;
+
+use crate::encryption;
+use crate::file_processor::FileProcessorState;
+use crate::indexing_control::{IndexingControl, Lane};
+use crate::network::{configure_client, NetworkError};
+use crate::secrets::{get_secret, SUMMARY_API_KEY};
+use crate::settings::{AppSettings, SettingsManagerState};
+use crate::vectordb_manager::{chunk_index, VectorDbManager};
+use crate::AppResult;
+
+const DEFAULT_SUMMARY_MODEL: &str = "llama3.2";
+/// Only the start of a document is sent, which is where most documents say what they are about
+const MAX_INPUT_CHARS: usize = 12_000;
+const MAX_SUMMARY_TOKENS: u32 = 200;
+/// Local models on a laptop can take a while for a long document
+const REQUEST_TIMEOUT_SECS: u64 = 120;
+/// Documents waiting in the queue, the ones that don't fit are left to the backfill
+const QUEUE_CAPACITY: usize = 64;
+/// How often the worker looks for indexed files without a summary
+const BACKFILL_INTERVAL_SECS: u64 = 60 * 60;
+/// Files summarized per backfill, the rest wait for the next one
+const BACKFILL_BATCH: usize = 200;
+const SYSTEM_PROMPT: &str =
+    "You summarize documents for a file search app. Reply with two or three plain sentences \
+saying what the document is about and what it contains. No preamble, no lists, no markdown.";
+
+#[derive(Error, Debug)]
+pub enum SummarizerError {
+    #[error("Network error: {0}")]
+    Network(#[from] reqwest::Error),
+
+    #[error("Summary service returned {0}: {1}")]
+    Service(u16, String),
+
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("Vector DB error: {0}")]
+    VectorDb(String),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = SummarizerError> = std::result::Result<T, E>;
+
+/// A document waiting for its summary
+struct SummaryJob {
+    file_id: i64,
+    text: String,
+}
+
+/// Held in the app state, the indexing pipeline hands documents to the summary worker through it
+pub struct SummaryQueue(Option<Sender<SummaryJob>>);
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SummaryReady {
+    pub file_id: i64,
+    pub summary: String,
+}
+
+#[derive(Serialize)]
+struct ChatMessage<'a> {
+    role: &'a str,
+    content: &'a str,
+}
+
+#[derive(Serialize)]
+struct ChatRequest<'a> {
+    model: &'a str,
+    messages: Vec<ChatMessage<'a>>,
+    max_tokens: u32,
+    temperature: f32,
+    stream: bool,
+}
+
+#[derive(Deserialize)]
+struct ChatResponse {
+    choices: Vec<ChatChoice>,
+}
+
+#[derive(Deserialize)]
+struct ChatChoice {
+    message: ChatResponseMessage,
+}
+
+#[derive(Deserialize)]
+struct ChatResponseMessage {
+    content: String,
+}
+
+/// Client for the chat endpoint the summaries come from
+struct Summarizer {
+    client: Client,
+    endpoint: String,
+    /// From the keychain, sent as a bearer token when set
+    api_key: Option<String>,
+    model: String,
+}
+
+impl Summarizer {
+    fn new(settings: &AppSettings, endpoint: &str) -> std::result::Result<Self, NetworkError> {
+        let builder = Client::builder().timeout(Duration::from_secs(REQUEST_TIMEOUT_SECS));
+
+        Ok(Self {
+            client: configure_client(builder, settings)?.build()?,
+            endpoint: endpoint.trim_end_matches('/').to_string(),
+            api_key: get_secret(SUMMARY_API_KEY).unwrap_or_else(|e| {
+                eprintln!("Failed to read the summary API key: {}", e);
+                None
+            }),
+            model: settings
+                .summary_model
+                .clone()
+                .unwrap_or_else(|| DEFAULT_SUMMARY_MODEL.to_string()),
+        })
+    }
+
+    async fn summarize(&self, text: &str) -> Result<String> {
+        let mut request = self
+            .client
+            .post(format!("{}/v1/chat/completions", self.endpoint))
+            .json(&ChatRequest {
+                model: &self.model,
+                messages: vec![
+                    ChatMessage {
+                        role: "system",
+                        content: SYSTEM_PROMPT,
+                    },
+                    ChatMessage {
+                        role: "user",
+                        content: text,
+                    },
+                ],
+                max_tokens: MAX_SUMMARY_TOKENS,
+                temperature: 0.2,
+                stream: false,
+            });
+        if let Some(api_key) = &self.api_key {
+            request = request.bearer_auth(api_key);
+        }
+
+        let response = request.send().await?;
+        if !response.status().is_success() {
+            let status = response.status().as_u16();
+            let body = response.text().await.unwrap_or_default();
+            return Err(SummarizerError::Service(status, body));
+        }
+
+        let parsed: ChatResponse = response.json().await?;
+        let summary = parsed
+            .choices
+            .into_iter()
+            .next()
+            .map(|choice| choice.message.content.trim().to_string())
+            .unwrap_or_default();
+        if summary.is_empty() {
+            return Err(SummarizerError::Other("the summary is empty".into()));
+        }
+
+        Ok(summary)
+    }
+}
+
+/// Queues a freshly indexed document for a summary, does nothing when summaries are off.
+/// Never waits: when the queue is full the document is left to the backfill
+pub fn enqueue(app_handle: &AppHandle, file_id: i64, chunks: &[&str]) {
+    let Some(queue) = app_handle.try_state::<SummaryQueue>() else {
+        return;
+    };
+    let Some(sender) = &queue.0 else {
+        return;
+    };
+    let Some(text) = summary_input(chunks) else {
+        return;
+    };
+
+    if let Err(TrySendError::Full(_)) = sender.try_send(SummaryJob { file_id, text }) {
+        println!(
+            "Summary queue full, file {} is left to the backfill",
+            file_id
+        );
+    }
+}
+
+/// The start of the document, as much of it as is sent for a summary. None when there is no text
+fn summary_input(chunks: &[&str]) -> Option<String> {
+    // chunks overlap a little, which doesn't matter for a summary
+    let mut text = String::new();
+    for chunk in chunks {
+        if text.len() >= MAX_INPUT_CHARS {
+            break;
+        }
+        if !text.is_empty() {
+            text.push('\n');
+        }
+        text.push_str(chunk);
+    }
+    if text.len() > MAX_INPUT_CHARS {
+        let mut end = MAX_INPUT_CHARS;
+        while !text.is_char_boundary(end) {
+            end -= 1;
+        }
+        text.truncate(end);
+    }
+
+    (!text.trim().is_empty()).then_some(text)
+}
+
+/// Summarizes the queued documents one at a time, stepping aside while indexing is paused or fresh files are indexed.
+/// The first backfill runs right away, so what was left over from the last run is picked up at startup
+async fn run_worker(app_handle: AppHandle, summarizer: Summarizer, mut jobs: Receiver<SummaryJob>) {
+    let mut backfill = tokio::time::interval(Duration::from_secs(BACKFILL_INTERVAL_SECS));
+
+    loop {
+        tokio::select! {
+            job = jobs.recv() => match job {
+                Some(job) => summarize_job(&app_handle, &summarizer, job).await,
+                None => break,
+            },
+            _ = backfill.tick() => {
+                if let Err(e) = backfill_summaries(&app_handle, &summarizer).await {
+                    eprintln!("Failed to look for files without a summary: {}", e);
+                }
+            }
+        }
+    }
+}
+
+async fn summarize_job(app_handle: &AppHandle, summarizer: &Summarizer, job: SummaryJob) {
+    let control = app_handle.state::<Arc<IndexingControl>>().inner().clone();
+    control.wait_for_turn(Lane::Background, None).await;
+
+    let file_id = job.file_id;
+    match summarize_file(app_handle, summarizer, job).await {
+        Ok(Some(summary)) => {
+            let _ = app_handle.emit("summary-ready", SummaryReady { file_id, summary });
+        }
+        Ok(None) => {}
+        Err(e) => eprintln!("Failed to summarize file {}: {}", file_id, e),
+    }
+}
+
+/// Summarizes indexed files that have stored chunks but no summary, from the text of their chunks
+async fn backfill_summaries(app_handle: &AppHandle, summarizer: &Summarizer) -> Result<()> {
+    let db_path = db_path(app_handle)
+        .ok_or_else(|| SummarizerError::Other("File processor not initialized".into()))?;
+    let vectordb = app_handle
+        .state::<Arc<Mutex<VectorDbManager>>>()
+        .inner()
+        .clone();
+
+    // files without chunks, like images or files under metadata_only roots, have nothing to summarize
+    let with_chunks: HashSet<String> = vectordb
+        .lock()
+        .await
+        .file_ids()
+        .await
+        .map_err(|e| SummarizerError::VectorDb(e.to_string()))?
+        .into_iter()
+        .collect();
+    let missing: Vec<i64> = task::spawn_blocking(move || -> Result<Vec<i64>> {
+        let conn = Connection::open(db_path)?;
+        let mut stmt = conn.prepare(
+            "SELECT f.id FROM files f LEFT JOIN summaries s ON s.file_id = f.id WHERE s.file_id IS NULL",
+        )?;
+        let ids = stmt
+            .query_map([], |row| row.get::<_, i64>(0))?
+            .collect::<rusqlite::Result<Vec<_>>>()?;
+        Ok(ids)
+    })
+    .await
+    .map_err(|e| SummarizerError::Other(format!("spawn_blocking error: {e}")))??
+    .into_iter()
+    .filter(|id| with_chunks.contains(&id.to_string()))
+    .take(BACKFILL_BATCH)
+    .collect();
+
+    if missing.is_empty() {
+        return Ok(());
+    }
+    println!(
+        "Summarizing {} files that have no summary yet",
+        missing.len()
+    );
+
+    for file_id in missing {
+        let mut chunks = vectordb
+            .lock()
+            .await
+            .chunks_for_files(&[file_id.to_string()])
+            .await
+            .map_err(|e| SummarizerError::VectorDb(e.to_string()))?;
+        chunks.sort_by_key(|chunk| chunk_index(&chunk.id));
+
+        let texts: Vec<&str> = chunks.iter().map(|chunk| chunk.text.as_str()).collect();
+        if let Some(text) = summary_input(&texts) {
+            summarize_job(app_handle, summarizer, SummaryJob { file_id, text }).await;
+        }
+    }
+
+    Ok(())
+}
+
+/// Returns None if the file was removed from the index while it was being summarized
+async fn summarize_file(
+    app_handle: &AppHandle,
+    summarizer: &Summarizer,
+    job: SummaryJob,
+) -> Result<Option<String>> {
+    let db_path = db_path(app_handle)
+        .ok_or_else(|| SummarizerError::Other("File processor not initialized".into()))?;
+
+    let summary = summarizer.summarize(&job.text).await?;
+
+    let model = summarizer.model.clone();
+    let stored_summary = summary.clone();
+    let stored =
+        task::spawn_blocking(move || store_summary(db_path, job.file_id, &stored_summary, &model))
+            .await
+            .map_err(|e| SummarizerError::Other(format!("spawn_blocking error: {e}")))??;
+
+    Ok(stored.then_some(summary))
+}
+
+fn db_path(app_handle: &AppHandle) -> Option<PathBuf> {
+    let state = app_handle.state::<FileProcessorState>();
+    let guard = state.0.lock().ok()?;
+    guard.as_ref().map(|processor| processor.db_path.clone())
+}
+
+/// Returns false if the file was removed from the index while it was being summarized
+fn store_summary(db_path: PathBuf, file_id: i64, summary: &str, model: &str) -> Result<bool> {
+    let conn = Connection::open(db_path)?;
+    let indexed = conn
+        .query_row("SELECT 1 FROM files WHERE id = ?1", [file_id], |_| Ok(()))
+        .optional()?
+        .is_some();
+    if !indexed {
+        return Ok(false);
+    }
+
+    let summary =
+        encryption::seal_text(summary).map_err(|e| SummarizerError::Other(e.to_string()))?;
+    conn.execute(
+        "INSERT OR REPLACE INTO summaries (file_id, summary, model) VALUES (?1, ?2, ?3)",
+        params![file_id, summary, model],
+    )?;
+    Ok(true)
+}
+
+/// Starts the summary worker if a summary endpoint is configured
+pub fn init_summarizer(app: &tauri::App) -> AppResult<()> {
+    let settings = app
+        .state::<SettingsManagerState>()
+        .0
+        .get_settings()
+        .unwrap_or_default();
+
+    // the stage is off unless a summary endpoint is configured
+    let summarizer = match settings.summary_endpoint.as_deref() {
+        Some(endpoint) if !endpoint.is_empty() => Summarizer::new(&settings, endpoint)
+            .map_err(|e| eprintln!("Failed to initialize summarizer: {}", e))
+            .ok(),
+        _ => None,
+    };
+    let Some(summarizer) = summarizer else {
+        app.manage(SummaryQueue(None));
+        return Ok(());
+    };
+
+    let (sender, receiver) = mpsc::channel(QUEUE_CAPACITY);
+    app.manage(SummaryQueue(Some(sender)));
+
+    println!(
+        "Summarizer initialized ({} at {})",
+        summarizer.model, summarizer.endpoint
+    );
+    let app_handle = app.app_handle().clone();
+    tauri::async_runtime::spawn(run_worker(app_handle, summarizer, receiver));
+
+    Ok(())
+}
@@ -0,0 +1,154 @@
+/*
+This file contains the symbols index of source files. The definitions the code chunker finds (functions, classes, types) are stored with the file and line they are on,
+which allows exact and prefix lookups by symbol name next to the semantic search over the code chunks
+*/
+
+use rusqlite::{params, Connection};
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use tauri::State;
+use thiserror::Error;
+use tokio::task;
+
+use crate::chunker::code::{extract_symbols, language_for_path};
+use crate::file_processor::{get_processor, FileProcessorState};
+
+const DEFAULT_SEARCH_LIMIT: usize = 20;
+
+#[derive(Error, Debug)]
+pub enum SymbolsError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = SymbolsError> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SymbolMatch {
+    pub name: String,
+    /// "function", "class", "struct", ...
+    pub kind: String,
+    pub path: String,
+    /// 1-based line of the definition
+    pub line: i64,
+}
+
+/// Replaces the symbols stored for a file with the ones in its current content.
+/// Files that aren't source code are ignored
+pub async fn index_file_symbols(db_path: PathBuf, file_id: i64, path: String) -> Result<usize> {
+    let Some(language) = language_for_path(Path::new(&path)) else {
+        return Ok(0);
+    };
+
+    let text = tokio::fs::read_to_string(&path).await?;
+    let symbols = extract_symbols(language, &text);
+
+    task::spawn_blocking(move || {
+        let mut conn = Connection::open(db_path)?;
+        let tx = conn.transaction()?;
+
+        tx.execute("DELETE FROM symbols WHERE file_id = ?1", [file_id])?;
+        {
+            let mut stmt = tx.prepare(
+                "INSERT INTO symbols (file_id, name, kind, line) VALUES (?1, ?2, ?3, ?4)",
+            )?;
+            for symbol in &symbols {
+                stmt.execute(params![
+                    file_id,
+                    symbol.name,
+                    symbol.kind,
+                    symbol.line as i64
+                ])?;
+            }
+        }
+
+        tx.commit()?;
+        Ok(symbols.len())
+    })
+    .await
+    .map_err(|e| SymbolsError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+/// Exact matches are case sensitive, prefix matches aren't. Exact hits and shorter names come first
+fn find_symbols(
+    conn: &Connection,
+    query: &str,
+    exact: bool,
+    kind: Option<&str>,
+    limit: usize,
+) -> Result<Vec<SymbolMatch>> {
+    let name_filter = if exact {
+        "s.name = ?1"
+    } else {
+        // LIKE is case insensitive for ASCII, the wildcards in the query are escaped
+        r"s.name LIKE ?2 ESCAPE '\'"
+    };
+    let sql = format!(
+        r#"
+        SELECT s.name, s.kind, f.path, s.line
+        FROM symbols s
+        JOIN files f ON f.id = s.file_id
+        WHERE {} AND (?3 IS NULL OR s.kind = ?3)
+        ORDER BY s.name = ?1 DESC, length(s.name), f.path, s.line
+        LIMIT ?4
+        "#,
+        name_filter
+    );
+
+    let pattern = format!(
+        "{}%",
+        query
+            .replace('\\', r"\\")
+            .replace('%', r"\%")
+            .replace('_', r"\_")
+    );
+
+    let mut stmt = conn.prepare(&sql)?;
+    let rows = stmt.query_map(params![query, pattern, kind, limit as i64], |row| {
+        Ok(SymbolMatch {
+            name: row.get(0)?,
+            kind: row.get(1)?,
+            path: row.get(2)?,
+            line: row.get(3)?,
+        })
+    })?;
+
+    let matches = rows.collect::<rusqlite::Result<Vec<_>>>()?;
+    Ok(matches)
+}
+
+/// Looks up where a symbol is defined, by exact name or by name prefix
+#[tauri::command]
+pub async fn search_symbols(
+    query: String,
+    exact: Option<bool>,
+    kind: Option<String>,
+    limit: Option<usize>,
+    state: State<'_, FileProcessorState>,
+) -> std::result::Result<Vec<SymbolMatch>, String> {
+    let processor = get_processor(&state)?;
+    let query = query.trim().to_string();
+    if query.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    task::spawn_blocking(move || {
+        let conn = Connection::open(&processor.db_path)?;
+        find_symbols(
+            &conn,
+            &query,
+            exact.unwrap_or(false),
+            kind.as_deref(),
+            limit.unwrap_or(DEFAULT_SEARCH_LIMIT),
+        )
+    })
+    .await
+    .map_err(|e| format!("spawn_blocking error: {e}"))?
+    .map_err(|e| format!("Failed to search symbols: {}", e))
+}
@@ -0,0 +1,675 @@
+/*
+This file contains `kita sync`, which copies index entries between two kita installs so a machine doesn't embed files another machine already has.
+The local side starts `kita sync --serve` on the other machine over ssh and both talk in JSON lines over its stdin/stdout. Everything the serving
+side logs goes to stderr, stdout only carries the protocol. ssh also decides who may sync: the serving side runs as the user who logged in.
+
+Each side lists its up to date files with a sha256 of their content. An entry (file metadata and embeddings) is only copied to a side that
+hasn't indexed the file yet and has it on disk with the same content. Paths under one home directory are matched with the same paths under the other
+*/
+
+use rusqlite::Connection;
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::io::{BufRead, BufReader, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::time::UNIX_EPOCH;
+use thiserror::Error;
+
+use crate::database_handler::default_database_path;
+use crate::embedder::Embedder;
+use crate::encryption;
+use crate::entities;
+use crate::index_archive::{
+    read_index_metadata, remap_chunks, write_index_metadata, ArchiveError, ArchivedFile,
+};
+use crate::settings::SettingsManager;
+use crate::symbols;
+use crate::utils::hash_file;
+use crate::vectordb_manager::{StoredChunk, VectorDbManager};
+
+const PROTOCOL_VERSION: u32 = 1;
+/// Files whose entries go in one message, the embeddings make a message about 10KB per chunk
+const BATCH_SIZE: usize = 50;
+const DEFAULT_REMOTE_COMMAND: &str = "kita";
+
+#[derive(Error, Debug)]
+pub enum SyncError {
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("JSON error: {0}")]
+    Json(#[from] serde_json::Error),
+
+    #[error("Index error: {0}")]
+    Archive(#[from] ArchiveError),
+
+    #[error("Vector DB error: {0}")]
+    VectorDb(String),
+
+    #[error("Protocol error: {0}")]
+    Protocol(String),
+
+    #[error("Remote error: {0}")]
+    Remote(String),
+
+    #[error("Encryption error: {0}")]
+    Encryption(String),
+}
+
+type Result<T, E = SyncError> = std::result::Result<T, E>;
+
+/// An indexed file as one side sees it on its disk
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct SyncedFile {
+    path: String,
+    size: u64,
+    sha256: String,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+enum Message {
+    Hello {
+        version: u32,
+        embedding_model: String,
+        home: Option<String>,
+        /// Whether the side encrypts what it stores, see encryption.rs
+        sealing: bool,
+    },
+    /// Asks for the other side's files
+    ListFiles,
+    Files {
+        files: Vec<SyncedFile>,
+    },
+    /// Asks for the entries of some of the listed files
+    Fetch {
+        paths: Vec<String>,
+    },
+    /// Lists our files so the other side can say which ones it wants
+    Offer {
+        files: Vec<SyncedFile>,
+    },
+    Want {
+        paths: Vec<String>,
+    },
+    /// Entries, in reply to a fetch or pushed after a want
+    Entries {
+        files: Vec<ArchivedFile>,
+        chunks: Vec<StoredChunk>,
+    },
+    Imported {
+        files: usize,
+        chunks: usize,
+    },
+    Error {
+        message: String,
+    },
+    Bye,
+}
+
+/// One end of the connection
+struct Peer<R: BufRead, W: Write> {
+    reader: R,
+    writer: W,
+}
+
+impl<R: BufRead, W: Write> Peer<R, W> {
+    fn send(&mut self, message: &Message) -> Result<()> {
+        // serde_json escapes newlines inside strings, so every message fits on one line
+        serde_json::to_writer(&mut self.writer, message)?;
+        self.writer.write_all(b"\n")?;
+        self.writer.flush()?;
+        Ok(())
+    }
+
+    fn receive(&mut self) -> Result<Message> {
+        let mut line = String::new();
+        if self.reader.read_line(&mut line)? == 0 {
+            return Err(SyncError::Protocol("the connection was closed".into()));
+        }
+
+        match serde_json::from_str(&line)? {
+            Message::Error { message } => Err(SyncError::Remote(message)),
+            message => Ok(message),
+        }
+    }
+}
+
+/// What this side of the sync works on
+struct LocalIndex {
+    db_path: PathBuf,
+    vectordb: VectorDbManager,
+    embedding_model: String,
+    home: Option<String>,
+    runtime: tokio::runtime::Runtime,
+}
+
+impl LocalIndex {
+    fn open() -> Result<Self, String> {
+        let db_path = default_database_path()
+            .filter(|path| path.exists())
+            .ok_or_else(|| "No kita database found, start kita once first".to_string())?;
+
+        let settings_manager = SettingsManager::new(&db_path.to_string_lossy());
+        settings_manager
+            .initialize()
+            .map_err(|e| format!("Failed to load settings: {}", e))?;
+        let settings = settings_manager.get_settings().unwrap_or_default();
+        encryption::init_encryption(&settings, &db_path);
+
+        let runtime = tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()
+            .map_err(|e| format!("Failed to start runtime: {}", e))?;
+        let vectordb = runtime
+            .block_on(VectorDbManager::open_default())
+            .map_err(|e| format!("Failed to open the vector DB: {}", e))?;
+
+        Ok(Self {
+            db_path,
+            vectordb,
+            embedding_model: Embedder::configured_model_name(&settings),
+            home: dirs::home_dir().map(|home| home.to_string_lossy().to_string()),
+            runtime,
+        })
+    }
+
+    fn hello(&self) -> Message {
+        Message::Hello {
+            version: PROTOCOL_VERSION,
+            embedding_model: self.embedding_model.clone(),
+            home: self.home.clone(),
+            sealing: encryption::is_sealing(),
+        }
+    }
+
+    /// Checks the other side's hello and returns what it said about itself
+    fn check_hello(&self, message: Message) -> Result<TheirSide> {
+        let Message::Hello {
+            version,
+            embedding_model,
+            home,
+            sealing,
+        } = message
+        else {
+            return Err(SyncError::Protocol("expected a hello".into()));
+        };
+
+        if version != PROTOCOL_VERSION {
+            return Err(SyncError::Protocol(format!(
+                "the other side speaks version {}, this one {}",
+                version, PROTOCOL_VERSION
+            )));
+        }
+        // vectors from a different model live in a different space and would poison the search results
+        if embedding_model != self.embedding_model {
+            return Err(SyncError::Protocol(format!(
+                "the other side embeds with {} but this index uses {}",
+                embedding_model, self.embedding_model
+            )));
+        }
+
+        Ok(TheirSide { home, sealing })
+    }
+
+    /// The indexed files that are still on disk as they were indexed, with their hashes.
+    /// The hash stored at indexing is used while the file keeps its modification time, only files touched since are read again
+    fn list_files(&self) -> Result<Vec<SyncedFile>> {
+        let conn = Connection::open(&self.db_path)?;
+        let mut stmt = conn.prepare(
+            "SELECT path, size, CAST(strftime('%s', updated_at) AS INTEGER), modified_at, content_hash FROM files",
+        )?;
+        let indexed = stmt
+            .query_map([], |row| {
+                Ok((
+                    row.get::<_, String>(0)?,
+                    row.get::<_, i64>(1)?,
+                    row.get::<_, Option<i64>>(2)?,
+                    row.get::<_, Option<i64>>(3)?,
+                    row.get::<_, Option<String>>(4)?,
+                ))
+            })?
+            .collect::<rusqlite::Result<Vec<_>>>()?;
+
+        let mut files = Vec::new();
+        for (path, size, indexed_at, indexed_modified_at, content_hash) in indexed {
+            let Ok(metadata) = fs::metadata(&path) else {
+                continue;
+            };
+            let modified_at = metadata
+                .modified()
+                .ok()
+                .and_then(|time| time.duration_since(UNIX_EPOCH).ok())
+                .map(|duration| duration.as_secs() as i64);
+
+            // same rule as a rescan: a changed file's entry is stale and the other side would get old embeddings
+            let is_stale = metadata.len() as i64 != size
+                || matches!((modified_at, indexed_at), (Some(m), Some(i)) if m > i);
+            if !metadata.is_file() || is_stale {
+                continue;
+            }
+
+            let stored_hash = content_hash
+                .filter(|_| indexed_modified_at.is_some() && indexed_modified_at == modified_at);
+            let sha256 = match stored_hash {
+                Some(hash) => Ok(hash),
+                None => hash_file(Path::new(&path)),
+            };
+            if let Ok(sha256) = sha256 {
+                files.push(SyncedFile {
+                    path,
+                    size: metadata.len(),
+                    sha256,
+                });
+            }
+        }
+
+        Ok(files)
+    }
+
+    /// The files of the other side that are on this disk with the same content but aren't indexed here
+    fn wanted_files(
+        &self,
+        theirs: &[SyncedFile],
+        their_home: Option<&str>,
+    ) -> Result<Vec<SyncedFile>> {
+        let conn = Connection::open(&self.db_path)?;
+        let mut stmt = conn.prepare("SELECT path FROM files")?;
+        let indexed = stmt
+            .query_map([], |row| row.get::<_, String>(0))?
+            .collect::<rusqlite::Result<HashSet<_>>>()?;
+
+        let wanted = theirs
+            .iter()
+            .filter(|file| {
+                let path = move_home(&file.path, their_home, self.home.as_deref());
+                if indexed.contains(&path) {
+                    return false;
+                }
+
+                let same_size = fs::metadata(&path)
+                    .map(|metadata| metadata.is_file() && metadata.len() == file.size)
+                    .unwrap_or(false);
+                same_size && hash_file(Path::new(&path)).is_ok_and(|hash| hash == file.sha256)
+            })
+            .cloned()
+            .collect();
+
+        Ok(wanted)
+    }
+
+    /// The metadata and chunks of the given files, read to be sent to the other side
+    fn read_entries(
+        &self,
+        paths: &[String],
+        their_side: &TheirSide,
+    ) -> Result<(Vec<ArchivedFile>, Vec<StoredChunk>)> {
+        // the chunks go out opened, an encrypted index only hands them to a side that seals them again
+        if encryption::is_sealing() && !their_side.sealing {
+            return Err(SyncError::Encryption(
+                "this index is encrypted at rest and the other side's isn't, turn on encrypt_at_rest there first".into(),
+            ));
+        }
+        let paths: HashSet<&str> = paths.iter().map(String::as_str).collect();
+        let (_, files) = read_index_metadata(&self.db_path)?;
+        let files: Vec<ArchivedFile> = files
+            .into_iter()
+            .filter(|file| paths.contains(file.path.as_str()))
+            .collect();
+
+        let file_ids: Vec<String> = files.iter().map(|file| file.id.to_string()).collect();
+        let chunks = self
+            .runtime
+            .block_on(self.vectordb.chunks_for_files(&file_ids))
+            .map_err(|e| SyncError::VectorDb(e.to_string()))?;
+
+        Ok((files, chunks))
+    }
+
+    /// Adds the other side's entries under this side's paths, returns the number of files and chunks added.
+    /// Only files this side asked for in `wanted` are taken, and only while they are still on disk with
+    /// the content that was asked for. Anything else the other side sends is an error
+    fn import_entries(
+        &self,
+        files: Vec<ArchivedFile>,
+        chunks: Vec<StoredChunk>,
+        their_home: Option<&str>,
+        wanted: &HashMap<String, SyncedFile>,
+    ) -> Result<(usize, usize)> {
+        let our_home = self.home.as_deref();
+
+        let mut accepted = Vec::new();
+        for mut file in files {
+            let Some(expected) = wanted.get(&file.path) else {
+                return Err(SyncError::Protocol(format!(
+                    "the other side sent {}, which wasn't asked for",
+                    file.path
+                )));
+            };
+            file.directory = move_home(&file.directory, their_home, our_home);
+            file.path = move_home(&file.path, their_home, our_home);
+
+            // the file can have changed since it was asked for
+            if !hash_file(Path::new(&file.path)).is_ok_and(|hash| hash == expected.sha256) {
+                eprintln!("Skipping {}, it changed since the sync started", file.path);
+                continue;
+            }
+            // the content was checked to be the same, so the entry is as fresh as the file here.
+            // Keeping the other side's time would make the next rescan embed the file again
+            file.updated_at = None;
+            accepted.push(file);
+        }
+        let files = accepted;
+
+        // chunks are filed under the accepted files by id, whatever path they came with
+        let accepted_paths: HashMap<String, String> = files
+            .iter()
+            .map(|file| (file.id.to_string(), file.path.clone()))
+            .collect();
+        let chunks: Vec<StoredChunk> = chunks
+            .into_iter()
+            .filter_map(|chunk| {
+                let file_path = accepted_paths.get(&chunk.file_id)?.clone();
+                Some(StoredChunk { file_path, ..chunk })
+            })
+            .collect();
+
+        let (id_map, _) = write_index_metadata(&self.db_path, &[], &files)?;
+        // both sides were checked to use the same model when the session started
+        let chunks: Vec<StoredChunk> = remap_chunks(chunks, &id_map)
+            .into_iter()
+            .map(|chunk| StoredChunk {
+                embedding_model: Some(self.embedding_model.clone()),
+                ..chunk
+            })
+            .collect();
+        let chunk_count = chunks.len();
+
+        // the text of each file, for its entities
+        let mut texts: HashMap<String, Vec<String>> = HashMap::new();
+        for chunk in &chunks {
+            texts
+                .entry(chunk.file_id.clone())
+                .or_default()
+                .push(chunk.text.clone());
+        }
+
+        let paths: HashMap<String, String> = files
+            .into_iter()
+            .map(|file| (file.id.to_string(), file.path))
+            .collect();
+
+        self.runtime.block_on(async {
+            self.vectordb
+                .add_stored_chunks(chunks)
+                .await
+                .map_err(|e| SyncError::VectorDb(e.to_string()))?;
+
+            // symbols and entities are cheap to find again and make the files browsable right away
+            for (old_id, new_id) in &id_map {
+                let (Some(path), Ok(file_id)) = (paths.get(old_id), new_id.parse::<i64>()) else {
+                    continue;
+                };
+                if let Err(e) =
+                    symbols::index_file_symbols(self.db_path.clone(), file_id, path.clone()).await
+                {
+                    eprintln!("Failed to index symbols of {}: {}", path, e);
+                }
+
+                let text = texts.remove(new_id).unwrap_or_default().join("\n");
+                if let Err(e) =
+                    entities::index_file_entities(self.db_path.clone(), file_id, text).await
+                {
+                    eprintln!("Failed to index entities of {}: {}", path, e);
+                }
+            }
+
+            Ok::<_, SyncError>(())
+        })?;
+
+        Ok((id_map.len(), chunk_count))
+    }
+}
+
+/// Moves a path from one home directory to the other, paths outside the home directory stay as they are
+fn move_home(path: &str, from: Option<&str>, to: Option<&str>) -> String {
+    match (from, to) {
+        (Some(from), Some(to)) if from != to => match path.strip_prefix(from) {
+            Some(rest) if rest.is_empty() || rest.starts_with(['/', '\\']) => {
+                format!("{}{}", to, rest)
+            }
+            _ => path.to_string(),
+        },
+        _ => path.to_string(),
+    }
+}
+
+#[derive(Debug, Default)]
+struct SyncSummary {
+    pulled_files: usize,
+    pulled_chunks: usize,
+    pushed_files: usize,
+    pushed_chunks: usize,
+}
+
+/// Drives a sync from this side: pulls the entries this side wants, then pushes the ones the other side wants
+fn sync_with<R: BufRead, W: Write>(
+    local: &LocalIndex,
+    peer: &mut Peer<R, W>,
+) -> Result<SyncSummary> {
+    let mut summary = SyncSummary::default();
+
+    peer.send(&local.hello())?;
+    let their_side = local.check_hello(peer.receive()?)?;
+
+    peer.send(&Message::ListFiles)?;
+    let Message::Files { files } = peer.receive()? else {
+        return Err(SyncError::Protocol("expected the file list".into()));
+    };
+    let wanted = local.wanted_files(&files, their_side.home.as_deref())?;
+    for batch in wanted.chunks(BATCH_SIZE) {
+        peer.send(&Message::Fetch {
+            paths: batch.iter().map(|file| file.path.clone()).collect(),
+        })?;
+        let Message::Entries { files, chunks } = peer.receive()? else {
+            return Err(SyncError::Protocol("expected entries".into()));
+        };
+        let (files, chunks) =
+            local.import_entries(files, chunks, their_side.home.as_deref(), &by_path(batch))?;
+        summary.pulled_files += files;
+        summary.pulled_chunks += chunks;
+    }
+
+    peer.send(&Message::Offer {
+        files: local.list_files()?,
+    })?;
+    let Message::Want { paths } = peer.receive()? else {
+        return Err(SyncError::Protocol("expected the wanted files".into()));
+    };
+    for paths in paths.chunks(BATCH_SIZE) {
+        let (files, chunks) = local.read_entries(paths, &their_side)?;
+        peer.send(&Message::Entries { files, chunks })?;
+        let Message::Imported { files, chunks } = peer.receive()? else {
+            return Err(SyncError::Protocol("expected an import count".into()));
+        };
+        summary.pushed_files += files;
+        summary.pushed_chunks += chunks;
+    }
+
+    peer.send(&Message::Bye)?;
+    Ok(summary)
+}
+
+/// The wanted files by their path on the other side
+fn by_path(files: &[SyncedFile]) -> HashMap<String, SyncedFile> {
+    files
+        .iter()
+        .map(|file| (file.path.clone(), file.clone()))
+        .collect()
+}
+
+/// What one side said about itself in its hello
+#[derive(Default)]
+struct TheirSide {
+    home: Option<String>,
+    sealing: bool,
+}
+
+/// What the serving side remembers about the side that drives the sync
+#[derive(Default)]
+struct Session {
+    their_side: TheirSide,
+    /// The files this side asked for, the only ones the other side may push
+    wanted: HashMap<String, SyncedFile>,
+}
+
+/// The reply to one message of the driving side, None when it said bye
+fn answer(local: &LocalIndex, session: &mut Session, message: Message) -> Result<Option<Message>> {
+    let reply = match message {
+        hello @ Message::Hello { .. } => {
+            session.their_side = local.check_hello(hello)?;
+            local.hello()
+        }
+        Message::ListFiles => Message::Files {
+            files: local.list_files()?,
+        },
+        Message::Fetch { paths } => {
+            let (files, chunks) = local.read_entries(&paths, &session.their_side)?;
+            Message::Entries { files, chunks }
+        }
+        Message::Offer { files } => {
+            let wanted = local.wanted_files(&files, session.their_side.home.as_deref())?;
+            session.wanted = by_path(&wanted);
+            Message::Want {
+                paths: wanted.into_iter().map(|file| file.path).collect(),
+            }
+        }
+        Message::Entries { files, chunks } => {
+            let (files, chunks) = local.import_entries(
+                files,
+                chunks,
+                session.their_side.home.as_deref(),
+                &session.wanted,
+            )?;
+            Message::Imported { files, chunks }
+        }
+        Message::Bye => return Ok(None),
+        other => {
+            return Err(SyncError::Protocol(format!(
+                "unexpected message {:?}",
+                other
+            )))
+        }
+    };
+    Ok(Some(reply))
+}
+
+/// Answers the requests of the side that drives the sync until it says bye
+fn serve<R: BufRead, W: Write>(local: &LocalIndex, peer: &mut Peer<R, W>) -> Result<()> {
+    let mut session = Session::default();
+
+    loop {
+        let message = peer.receive()?;
+        match answer(local, &mut session, message)? {
+            Some(reply) => peer.send(&reply)?,
+            None => return Ok(()),
+        }
+    }
+}
+
+/// Moves stdout over to stderr, so nothing printed while serving gets mixed into the protocol, and returns the real stdout
+#[cfg(unix)]
+fn take_stdout() -> std::io::Result<fs::File> {
+    use std::os::unix::io::FromRawFd;
+
+    std::io::stdout().flush()?;
+    // SAFETY: only duplicates the process's own standard descriptors, the duplicate is owned by the returned file
+    unsafe {
+        let protocol = libc::dup(libc::STDOUT_FILENO);
+        if protocol < 0 {
+            return Err(std::io::Error::last_os_error());
+        }
+        if libc::dup2(libc::STDERR_FILENO, libc::STDOUT_FILENO) < 0 {
+            let error = std::io::Error::last_os_error();
+            libc::close(protocol);
+            return Err(error);
+        }
+        Ok(fs::File::from_raw_fd(protocol))
+    }
+}
+
+/// `kita sync <[user@]host> [remote kita command]` syncs with another machine over ssh,
+/// `kita sync --serve` is what runs on the other end
+pub fn run_sync_command(args: &[String]) -> Result<(), String> {
+    match args {
+        [flag] if flag == "--serve" => {
+            #[cfg(unix)]
+            let writer = take_stdout().map_err(|e| format!("Failed to set up stdout: {}", e))?;
+            #[cfg(not(unix))]
+            let writer = std::io::stdout();
+
+            let local = LocalIndex::open()?;
+            let stdin = std::io::stdin();
+            let mut peer = Peer {
+                reader: stdin.lock(),
+                writer,
+            };
+
+            if let Err(e) = serve(&local, &mut peer) {
+                // the driving side prints the error, stdout belongs to the protocol
+                let _ = peer.send(&Message::Error {
+                    message: e.to_string(),
+                });
+                return Err(format!("Sync failed: {}", e));
+            }
+            Ok(())
+        }
+        [remote, rest @ ..] if rest.len() <= 1 && !remote.starts_with('-') => {
+            let local = LocalIndex::open()?;
+            let remote_command = rest
+                .first()
+                .map(String::as_str)
+                .unwrap_or(DEFAULT_REMOTE_COMMAND);
+
+            let mut child = Command::new("ssh")
+                .arg(remote)
+                .arg(format!("{} sync --serve", remote_command))
+                .stdin(Stdio::piped())
+                .stdout(Stdio::piped())
+                .spawn()
+                .map_err(|e| format!("Failed to start ssh: {}", e))?;
+
+            let (Some(stdin), Some(stdout)) = (child.stdin.take(), child.stdout.take()) else {
+                return Err("Failed to connect to ssh".to_string());
+            };
+            let mut peer = Peer {
+                reader: BufReader::new(stdout),
+                writer: stdin,
+            };
+
+            let result = sync_with(&local, &mut peer);
+            // closing stdin lets the other side exit if the sync stopped halfway
+            drop(peer);
+            let _ = child.wait();
+
+            let summary = result.map_err(|e| format!("Sync with {} failed: {}", remote, e))?;
+            println!(
+                "Pulled {} files ({} chunks), pushed {} files ({} chunks)",
+                summary.pulled_files,
+                summary.pulled_chunks,
+                summary.pushed_files,
+                summary.pushed_chunks
+            );
+            Ok(())
+        }
+        _ => Err(
+            "Usage: kita sync <[user@]host> [remote kita command]\n       kita sync --serve"
+                .to_string(),
+        ),
+    }
+}
@@ -0,0 +1,166 @@
+/*
+This file contains the thumbnails of indexed images and the previews of the first page of PDFs. They are made while a file is indexed and stored with it,
+so search results can come with a preview without the original file being read while the results are shown. Images are scaled down to fit in a small square,
+SVGs are small enough to be their own thumbnail and PDF pages are rendered by the tools of the platform, see render_pdf_preview.
+Thumbnails show what is in a file, so they are sealed like chunk text when encryption at rest is on. Images are only indexed while the
+index_images setting isn't turned off
+*/
+
+use base64::{engine::general_purpose::STANDARD, Engine};
+use image::{DynamicImage, ImageFormat};
+use rusqlite::{params, params_from_iter, Connection};
+use std::collections::HashMap;
+use std::io::Cursor;
+use std::path::{Path, PathBuf};
+use thiserror::Error;
+use tokio::task;
+
+use crate::encryption;
+use crate::platform;
+
+/// Thumbnails fit in a square of this many pixels
+const THUMBNAIL_SIZE: u32 = 256;
+/// Larger images take too long to decode for a thumbnail
+const MAX_IMAGE_BYTES: u64 = 50 * 1024 * 1024;
+/// SVGs up to this size are stored as they are
+const MAX_SVG_BYTES: u64 = 256 * 1024;
+/// Images that are indexed by name and get a thumbnail, they have no text to embed
+const IMAGE_EXTENSIONS: &[&str] = &[
+    "png", "jpg", "jpeg", "gif", "webp", "bmp", "tiff", "tif", "svg",
+];
+
+#[derive(Error, Debug)]
+pub enum ThumbnailError {
+    #[error("Database error: {0}")]
+    Db(#[from] rusqlite::Error),
+
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Image error: {0}")]
+    Image(#[from] image::ImageError),
+
+    #[error("Encryption error: {0}")]
+    Encryption(#[from] encryption::EncryptionError),
+
+    #[error("Other error: {0}")]
+    Other(String),
+}
+
+type Result<T, E = ThumbnailError> = std::result::Result<T, E>;
+
+pub fn is_image_extension(extension: &str) -> bool {
+    IMAGE_EXTENSIONS.contains(&extension.to_lowercase().as_str())
+}
+
+/// Replaces the thumbnail stored for a file with one of its current content. Returns whether the file got one,
+/// files that aren't images or PDFs never do
+pub async fn index_file_thumbnail(
+    db_path: PathBuf,
+    file_id: i64,
+    path: String,
+    extension: String,
+) -> Result<bool> {
+    task::spawn_blocking(move || {
+        let thumbnail = match generate_thumbnail(Path::new(&path), &extension.to_lowercase())? {
+            Some((mime, data)) => Some((mime, encryption::seal_bytes(&data)?)),
+            None => None,
+        };
+
+        let conn = Connection::open(db_path)?;
+        match &thumbnail {
+            Some((mime, data)) => conn.execute(
+                "INSERT OR REPLACE INTO thumbnails (file_id, mime, data, created_at)
+                 VALUES (?1, ?2, ?3, CURRENT_TIMESTAMP)",
+                params![file_id, mime, data],
+            )?,
+            None => conn.execute("DELETE FROM thumbnails WHERE file_id = ?1", [file_id])?,
+        };
+
+        Ok(thumbnail.is_some())
+    })
+    .await
+    .map_err(|e| ThumbnailError::Other(format!("spawn_blocking error: {e}")))?
+}
+
+/// The mime type and bytes of the thumbnail of a file, None for files without one
+fn generate_thumbnail(path: &Path, extension: &str) -> Result<Option<(&'static str, Vec<u8>)>> {
+    match extension {
+        "svg" => {
+            if std::fs::metadata(path)?.len() > MAX_SVG_BYTES {
+                return Ok(None);
+            }
+            Ok(Some(("image/svg+xml", std::fs::read(path)?)))
+        }
+        "pdf" => match platform::render_pdf_preview(path, THUMBNAIL_SIZE) {
+            Some(png) => encode_thumbnail(image::load_from_memory(&png)?).map(Some),
+            None => Ok(None),
+        },
+        extension if is_image_extension(extension) => {
+            let size = std::fs::metadata(path)?.len();
+            if size == 0 || size > MAX_IMAGE_BYTES {
+                return Ok(None);
+            }
+            let image = image::ImageReader::open(path)?
+                .with_guessed_format()?
+                .decode()?;
+            encode_thumbnail(image).map(Some)
+        }
+        _ => Ok(None),
+    }
+}
+
+/// Scales the image down and encodes it, as JPEG unless it has transparency to keep
+fn encode_thumbnail(image: DynamicImage) -> Result<(&'static str, Vec<u8>)> {
+    let thumbnail = image.thumbnail(THUMBNAIL_SIZE, THUMBNAIL_SIZE);
+    let mut data = Vec::new();
+
+    if thumbnail.color().has_alpha() {
+        thumbnail.write_to(&mut Cursor::new(&mut data), ImageFormat::Png)?;
+        Ok(("image/png", data))
+    } else {
+        DynamicImage::ImageRgb8(thumbnail.to_rgb8())
+            .write_to(&mut Cursor::new(&mut data), ImageFormat::Jpeg)?;
+        Ok(("image/jpeg", data))
+    }
+}
+
+/// The stored thumbnails of the given files as data: URLs, by file id
+pub fn load_thumbnails(conn: &Connection, file_ids: &[i64]) -> Result<HashMap<i64, String>> {
+    if file_ids.is_empty() {
+        return Ok(HashMap::new());
+    }
+
+    let placeholders = vec!["?"; file_ids.len()].join(", ");
+    let mut stmt = conn.prepare(&format!(
+        "SELECT file_id, mime, data FROM thumbnails WHERE file_id IN ({})",
+        placeholders
+    ))?;
+
+    let thumbnails = stmt
+        .query_map(params_from_iter(file_ids), |row| {
+            let mime: String = row.get(1)?;
+            let data: Vec<u8> = row.get(2)?;
+            Ok((row.get::<_, i64>(0)?, mime, data))
+        })?
+        .collect::<rusqlite::Result<Vec<_>>>()?;
+
+    // a thumbnail that can't be opened is left out rather than failing the whole result list
+    let thumbnails = thumbnails
+        .into_iter()
+        .filter_map(
+            |(file_id, mime, data)| match encryption::open_bytes(&data) {
+                Ok(data) => Some((
+                    file_id,
+                    format!("data:{};base64,{}", mime, STANDARD.encode(data)),
+                )),
+                Err(e) => {
+                    eprintln!("Failed to open the thumbnail of file {}: {}", file_id, e);
+                    None
+                }
+            },
+        )
+        .collect();
+
+    Ok(thumbnails)
+}
@@ -1,3 +1,23 @@
+use sha2::{Digest, Sha256};
+use std::io::Read;
+use std::path::Path;
+
+/// sha256 of a file's content, hex encoded
+pub fn hash_file(path: &Path) -> std::io::Result<String> {
+    let mut file = std::fs::File::open(path)?;
+    let mut hasher = Sha256::new();
+    let mut buffer = [0u8; 64 * 1024];
+    loop {
+        let read = file.read(&mut buffer)?;
+        if read == 0 {
+            break;
+        }
+        hasher.update(&buffer[..read]);
+    }
+
+    Ok(format!("{:x}", hasher.finalize()))
+}
+
 pub fn get_category_from_extension(extension: &str) -> String {
     let ext = extension.to_lowercase();
 
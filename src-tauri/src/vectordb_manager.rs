@@ -1,13 +1,21 @@
 use arrow_array::types::Float32Type;
+use arrow_array::Array;
 use arrow_array::FixedSizeListArray;
+use arrow_array::Float32Array;
+use arrow_array::Int32Array;
 use arrow_array::RecordBatch;
 use arrow_array::RecordBatchIterator;
 use arrow_array::StringArray;
 use arrow_schema::{DataType, Field, Schema};
 use futures::TryStreamExt;
 use lancedb::query::ExecutableQuery;
+use lancedb::query::QueryBase;
 use lancedb::query::QueryExecutionOptions;
-use lancedb::{Connection, Error};
+use lancedb::query::Select;
+use lancedb::table::{NewColumnTransform, OptimizeAction};
+use lancedb::{Connection, Error, Table};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeSet, HashMap};
 use std::path::PathBuf;
 use std::sync::Arc;
 use tauri::AppHandle;
@@ -16,16 +24,45 @@ use thiserror::Error;
 use tokio::sync::Mutex;
 
 use crate::chunker::Chunk;
+use crate::database_handler::{default_database_path, DATABASE_FILE};
 use crate::embedder;
 use crate::embedder::Embedder;
+use crate::embedding_migration;
+use crate::encryption;
+use crate::fault_injection::{self, FaultPoint};
+use crate::history::cosine_similarity;
 use crate::server::TextChunkResponse;
+use crate::settings::SettingsManagerState;
 use crate::AppResult;
 
 pub struct VectorDbManager {
     client: Connection,
+    /// Table the vectors are read from and written to, a migration to another embedding model moves the index to a new one, see embedding_migration.rs
+    table: String,
+    /// Size of the vectors the table stores
+    dimension: i32,
+    /// The decrypted rows of a table with sealed embeddings, kept between searches, see opened_chunks
+    opened: std::sync::Mutex<Option<OpenedIndex>>,
 }
 
-const TABLE_NAME: &str = "embeddings";
+/// The rows of the table decrypted for similarity search, valid as long as the table stays at `version`.
+/// With encryption at rest the vectors sit decrypted in memory while the app runs, in exchange searches only decrypt
+/// the table again after it was written to
+struct OpenedIndex {
+    version: u64,
+    filter: String,
+    chunks: Arc<Vec<StoredChunk>>,
+}
+
+/// Table of an index that was never migrated to another embedding model
+pub const TABLE_NAME: &str = "embeddings";
+pub const VECTOR_DB_DIR: &str = "vector_db";
+/// Files deleted with one filter, so the filter stays a reasonable size
+const DELETE_BATCH_SIZE: usize = 200;
+/// Size of the vectors of the built-in model
+pub const EMBEDDING_DIMENSION: i32 = 384;
+/// Same as lancedb's default top k
+const DEFAULT_SEARCH_LIMIT: usize = 10;
 
 #[derive(Debug, Error)]
 pub enum VectorDbError {
@@ -41,6 +78,33 @@ pub enum VectorDbError {
 
 pub type VectorDbResult<T> = Result<T, VectorDbError>;
 
+/// A single row of the embeddings table, decoupled from arrow so it can be serialized
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct StoredChunk {
+    pub id: String,
+    pub text: String,
+    pub embedding: Vec<f32>,
+    pub file_id: String,
+    pub file_path: String,
+    /// Page the chunk is on, for paged documents like PDFs
+    #[serde(default)]
+    pub page_number: Option<u32>,
+    /// Model the embedding comes from, None for rows stored before the model was recorded
+    #[serde(default)]
+    pub embedding_model: Option<String>,
+}
+
+/// A chunk returned by a similarity search
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ScoredChunk {
+    pub id: String,
+    pub text: String,
+    pub file_id: String,
+    pub file_path: String,
+    pub page_number: Option<u32>,
+    pub distance: f32,
+}
+
 impl VectorDbManager {
     pub async fn initialize_vectordb(
         app_handle: AppHandle,
@@ -50,14 +114,33 @@ impl VectorDbManager {
             .app_data_dir()
             .map_err(|_| VectorDbError::Other("Failed to get app data directory".into()))?;
 
-        let vectordb_path: PathBuf = app_data_dir.join("vector_db");
+        let vectordb_path: PathBuf = app_data_dir.join(VECTOR_DB_DIR);
+        let space = embedding_migration::active_space(&app_data_dir.join(DATABASE_FILE));
 
-        let manager: VectorDbManager = Self::new_vectordb_client(&vectordb_path).await?;
+        let manager: VectorDbManager =
+            Self::new_vectordb_client(&vectordb_path, space.table, space.dimension).await?;
 
         Ok(Arc::new(Mutex::new(manager)))
     }
 
-    async fn new_vectordb_client(vdb_path: &PathBuf) -> VectorDbResult<Self> {
+    /// Opens the vector DB next to the default database, for the command line tools that run without the app
+    pub async fn open_default() -> VectorDbResult<Self> {
+        let db_path = default_database_path()
+            .ok_or_else(|| VectorDbError::Other("Failed to get app data directory".into()))?;
+        let vectordb_path = db_path
+            .parent()
+            .map(|dir| dir.join(VECTOR_DB_DIR))
+            .ok_or_else(|| VectorDbError::Other("Failed to get app data directory".into()))?;
+        let space = embedding_migration::active_space(&db_path);
+
+        Self::new_vectordb_client(&vectordb_path, space.table, space.dimension).await
+    }
+
+    async fn new_vectordb_client(
+        vdb_path: &PathBuf,
+        table: String,
+        dimension: i32,
+    ) -> VectorDbResult<Self> {
         let client = lancedb::connect(&vdb_path.to_string_lossy())
             .execute()
             .await
@@ -66,17 +149,52 @@ impl VectorDbManager {
                 VectorDbError::LanceError(e.to_string())
             })?;
 
-        let instance: VectorDbManager = Self { client };
+        let instance: VectorDbManager = Self {
+            client,
+            table,
+            dimension,
+            opened: Default::default(),
+        };
+
+        instance.ensure_embedding_table_exists().await?;
+
+        Ok(instance)
+    }
+
+    /// Another table of the same vector DB, created empty when it doesn't exist yet
+    pub async fn open_space(&self, table: &str, dimension: i32) -> VectorDbResult<Self> {
+        let instance = Self {
+            client: self.client.clone(),
+            table: table.to_string(),
+            dimension,
+            opened: Default::default(),
+        };
 
         instance.ensure_embedding_table_exists().await?;
 
         Ok(instance)
     }
 
+    /// Drops the table with every vector in it
+    pub async fn drop_space(&self) -> VectorDbResult<()> {
+        self.client
+            .drop_table(&self.table)
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to drop table: {}", e)))
+    }
+
+    pub fn table_name(&self) -> &str {
+        &self.table
+    }
+
+    pub fn dimension(&self) -> i32 {
+        self.dimension
+    }
+
     async fn ensure_embedding_table_exists(&self) -> VectorDbResult<()> {
-        let table_exists = match self.client.open_table(TABLE_NAME).execute().await {
+        let table_exists = match self.client.open_table(&self.table).execute().await {
             Ok(_) => true,
-            Err(Error::TableNotFound { name }) if name == TABLE_NAME => false,
+            Err(Error::TableNotFound { name }) if name == self.table => false,
             Err(e) => {
                 return Err(VectorDbError::LanceError(format!(
                     "Error checking table: {}",
@@ -86,26 +204,71 @@ impl VectorDbManager {
         };
 
         if !table_exists {
-            let schema = get_embeddings_schema();
+            let schema = get_embeddings_schema(self.dimension);
             self.client
-                .create_empty_table(TABLE_NAME, schema)
+                .create_empty_table(&self.table, schema)
                 .execute()
                 .await
                 .map_err(|e| VectorDbError::LanceError(format!("Failed to create table: {}", e)))?;
+        } else {
+            self.add_missing_columns().await?;
         }
 
         Ok(())
     }
 
+    /// Tables created before page numbers, sealed embeddings or embedding models were stored get the columns added, empty for their rows
+    async fn add_missing_columns(&self) -> VectorDbResult<()> {
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+
+        let schema = table
+            .schema()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to read schema: {}", e)))?;
+        let missing: Vec<(String, String)> = [
+            ("page_number", "CAST(NULL AS INT)"),
+            ("sealed_embedding", "CAST(NULL AS STRING)"),
+            ("embedding_model", "CAST(NULL AS STRING)"),
+            ("embedding_dimension", "CAST(NULL AS INT)"),
+        ]
+        .into_iter()
+        .filter(|(name, _)| schema.field_with_name(name).is_err())
+        .map(|(name, expression)| (name.to_string(), expression.to_string()))
+        .collect();
+        if missing.is_empty() {
+            return Ok(());
+        }
+
+        table
+            .add_columns(NewColumnTransform::SqlExpressions(missing), None)
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to add column: {}", e)))?;
+
+        Ok(())
+    }
+
     pub async fn insert_embeddings(
         app_handle: &AppHandle,
         file_id: &str,
         chunk_embeddings: Vec<(Chunk, Vec<f32>)>,
     ) -> VectorDbResult<()> {
+        let path = chunk_embeddings
+            .first()
+            .map(|(chunk, _)| chunk.metadata.source_path.clone())
+            .unwrap_or_else(|| PathBuf::from(file_id));
+        fault_injection::inject(FaultPoint::DbWrite, &path)
+            .await
+            .map_err(|e| VectorDbError::Other(e.to_string()))?;
+
         let state = app_handle.state::<Arc<Mutex<VectorDbManager>>>();
         let manager = state.lock().await;
         // open table
-        let table = match manager.client.open_table(TABLE_NAME).execute().await {
+        let table = match manager.client.open_table(&manager.table).execute().await {
             Ok(table) => table,
             Err(e) => {
                 return Err(VectorDbError::LanceError(format!(
@@ -115,7 +278,9 @@ impl VectorDbManager {
             }
         };
 
-        let batches = from_chunks_embeddings_to_data(chunk_embeddings, file_id);
+        let model = app_handle.state::<Arc<Embedder>>().model_name();
+        let batches =
+            from_chunks_embeddings_to_data(chunk_embeddings, file_id, &model, manager.dimension)?;
 
         // insert into table
         if let Err(e) = table.add(Box::new(batches)).execute().await {
@@ -132,7 +297,7 @@ impl VectorDbManager {
         let state = app_handle.state::<Arc<Mutex<VectorDbManager>>>();
         let manager = state.lock().await;
         // open table
-        let table = match manager.client.open_table(TABLE_NAME).execute().await {
+        let table = match manager.client.open_table(&manager.table).execute().await {
             Ok(table) => table,
             Err(e) => {
                 return Err(VectorDbError::LanceError(format!(
@@ -153,11 +318,421 @@ impl VectorDbManager {
         Ok(())
     }
 
+    /// Reads the chunks of a single file, ordered by their position in the file
+    pub async fn get_chunks_for_file(
+        app_handle: &AppHandle,
+        file_id: &str,
+    ) -> VectorDbResult<Vec<StoredChunk>> {
+        let filter = format!("file_id = '{}'", escape_filter_value(file_id));
+        let mut chunks = Self::get_chunks_matching(app_handle, Some(filter)).await?;
+        chunks.sort_by_key(|chunk| chunk_index(&chunk.id));
+
+        Ok(chunks)
+    }
+
+    /// Reads a single chunk by its id
+    pub async fn get_chunk(
+        app_handle: &AppHandle,
+        chunk_id: &str,
+    ) -> VectorDbResult<Option<StoredChunk>> {
+        let filter = format!("id = '{}'", escape_filter_value(chunk_id));
+        let chunks = Self::get_chunks_matching(app_handle, Some(filter)).await?;
+
+        Ok(chunks.into_iter().next())
+    }
+
+    async fn get_chunks_matching(
+        app_handle: &AppHandle,
+        filter: Option<String>,
+    ) -> VectorDbResult<Vec<StoredChunk>> {
+        let state = app_handle.state::<Arc<Mutex<VectorDbManager>>>();
+        let manager = state.lock().await;
+
+        manager.stored_chunks(filter).await
+    }
+
+    /// Reads the rows matching a filter, or every row without one
+    pub async fn stored_chunks(&self, filter: Option<String>) -> VectorDbResult<Vec<StoredChunk>> {
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+
+        let row_count = table
+            .count_rows(filter.clone())
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to count rows: {}", e)))?;
+
+        if row_count == 0 {
+            return Ok(Vec::new());
+        }
+
+        // plain queries are capped by a default limit, so ask for all matching rows explicitly
+        let mut query = table.query().limit(row_count);
+        if let Some(filter) = filter {
+            query = query.only_if(filter);
+        }
+
+        let batches: Vec<RecordBatch> = query
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to scan table: {}", e)))?
+            .try_collect::<Vec<_>>()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to collect rows: {}", e)))?;
+
+        record_batches_to_stored_chunks(&batches)
+    }
+
+    /// Reads the chunks of several files at once
+    pub async fn chunks_for_files(&self, file_ids: &[String]) -> VectorDbResult<Vec<StoredChunk>> {
+        if file_ids.is_empty() {
+            return Ok(Vec::new());
+        }
+
+        let ids: Vec<String> = file_ids
+            .iter()
+            .map(|id| format!("'{}'", escape_filter_value(id)))
+            .collect();
+        let mut chunks = self
+            .stored_chunks(Some(format!("file_id IN ({})", ids.join(", "))))
+            .await?;
+        chunks.sort_by(|a, b| {
+            a.file_id
+                .cmp(&b.file_id)
+                .then(chunk_index(&a.id).cmp(&chunk_index(&b.id)))
+        });
+
+        Ok(chunks)
+    }
+
+    pub async fn add_stored_chunks(&self, chunks: Vec<StoredChunk>) -> VectorDbResult<()> {
+        if chunks.is_empty() {
+            return Ok(());
+        }
+
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+
+        let batches = from_stored_chunks_to_data(chunks, self.dimension)?;
+
+        table.add(Box::new(batches)).execute().await.map_err(|e| {
+            VectorDbError::LanceError(format!("Failed to add stored chunks: {}", e))
+        })?;
+
+        Ok(())
+    }
+
+    /// Deletes the rows of the given files in place, other files are untouched. The space comes back with `compact`
+    pub async fn delete_files(&self, file_ids: &[String]) -> VectorDbResult<()> {
+        if file_ids.is_empty() {
+            return Ok(());
+        }
+
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+
+        for batch in file_ids.chunks(DELETE_BATCH_SIZE) {
+            let ids: Vec<String> = batch
+                .iter()
+                .map(|id| format!("'{}'", escape_filter_value(id)))
+                .collect();
+            table
+                .delete(&format!("file_id IN ({})", ids.join(", ")))
+                .await
+                .map_err(|e| VectorDbError::LanceError(format!("Failed to delete rows: {}", e)))?;
+        }
+
+        Ok(())
+    }
+
+    /// Rewrites the table without its deleted rows and removes the old versions, so deletes free their space on disk
+    pub async fn compact(&self) -> VectorDbResult<()> {
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+
+        table
+            .optimize(OptimizeAction::Compact {
+                options: Default::default(),
+                remap_options: None,
+            })
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to compact table: {}", e)))?;
+        table
+            .optimize(OptimizeAction::Prune {
+                older_than: Some(chrono::Duration::zero()),
+                delete_unverified: Some(false),
+                error_if_tagged_old_versions: None,
+            })
+            .await
+            .map_err(|e| {
+                VectorDbError::LanceError(format!("Failed to prune old versions: {}", e))
+            })?;
+
+        Ok(())
+    }
+
+    /// Number of chunks in the table
+    pub async fn row_count(&self) -> VectorDbResult<usize> {
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+
+        table
+            .count_rows(None)
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to count rows: {}", e)))
+    }
+
+    /// Records the model with the rows stored before models were recorded. They can only come from the model
+    /// that was configured until now, imports and syncs refuse vectors of another model
+    pub async fn stamp_unversioned_rows(&self, model: &str) -> VectorDbResult<usize> {
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+
+        let filter = "embedding_model IS NULL".to_string();
+        let unversioned = table
+            .count_rows(Some(filter.clone()))
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to count rows: {}", e)))?;
+        if unversioned == 0 {
+            return Ok(0);
+        }
+
+        table
+            .update()
+            .only_if(filter)
+            .column(
+                "embedding_model",
+                format!("'{}'", escape_filter_value(model)),
+            )
+            .column("embedding_dimension", self.dimension.to_string())
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to update rows: {}", e)))?;
+
+        Ok(unversioned)
+    }
+
+    /// Ids of the files with vectors from another model than the given one
+    pub async fn files_not_embedded_with(&self, model: &str) -> VectorDbResult<Vec<String>> {
+        self.file_ids_matching(Some(format!(
+            "embedding_model IS NULL OR embedding_model != '{}'",
+            escape_filter_value(model)
+        )))
+        .await
+    }
+
+    /// Ids of every file with vectors in the table
+    pub async fn file_ids(&self) -> VectorDbResult<Vec<String>> {
+        self.file_ids_matching(None).await
+    }
+
+    async fn file_ids_matching(&self, filter: Option<String>) -> VectorDbResult<Vec<String>> {
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+
+        let row_count = table
+            .count_rows(filter.clone())
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to count rows: {}", e)))?;
+        if row_count == 0 {
+            return Ok(Vec::new());
+        }
+
+        let mut query = table
+            .query()
+            .select(Select::columns(&["file_id"]))
+            .limit(row_count);
+        if let Some(filter) = filter {
+            query = query.only_if(filter);
+        }
+
+        let batches: Vec<RecordBatch> = query
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to scan table: {}", e)))?
+            .try_collect::<Vec<_>>()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to collect rows: {}", e)))?;
+
+        let mut file_ids = BTreeSet::new();
+        for batch in &batches {
+            let ids = string_column(batch, "file_id")?;
+            file_ids.extend((0..batch.num_rows()).map(|i| ids.value(i).to_string()));
+        }
+
+        Ok(file_ids.into_iter().collect())
+    }
+
+    /// Roughly how many bytes the chunks of each file take up, their text plus their vectors, by file id
+    pub async fn bytes_by_file(&self) -> VectorDbResult<HashMap<String, u64>> {
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+
+        let row_count = table
+            .count_rows(None)
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to count rows: {}", e)))?;
+        if row_count == 0 {
+            return Ok(HashMap::new());
+        }
+
+        let batches: Vec<RecordBatch> = table
+            .query()
+            .select(Select::columns(&["file_id", "text"]))
+            .limit(row_count)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to scan table: {}", e)))?
+            .try_collect::<Vec<_>>()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to collect rows: {}", e)))?;
+
+        let vector_bytes = self.dimension.max(0) as u64 * 4;
+        let mut bytes: HashMap<String, u64> = HashMap::new();
+        for batch in &batches {
+            let ids = string_column(batch, "file_id")?;
+            let texts = string_column(batch, "text")?;
+            for i in 0..batch.num_rows() {
+                *bytes.entry(ids.value(i).to_string()).or_default() +=
+                    texts.value(i).len() as u64 + vector_bytes;
+            }
+        }
+
+        Ok(bytes)
+    }
+
+    /// Ids of the files with rows that aren't stored the way encryption at rest asks for
+    pub async fn files_to_reseal(&self) -> VectorDbResult<Vec<String>> {
+        self.file_ids_matching(Some(unsealed_filter().to_string()))
+            .await
+    }
+
+    /// Writes the rows of a file again the way encryption at rest asks for. The new rows are added before the old ones go,
+    /// so a failed write leaves the file as it was
+    pub async fn reseal_file(&self, file_id: &str) -> VectorDbResult<()> {
+        let stale = format!(
+            "file_id = '{}' AND {}",
+            escape_filter_value(file_id),
+            unsealed_filter()
+        );
+        let chunks = self.stored_chunks(Some(stale.clone())).await?;
+        if chunks.is_empty() {
+            return Ok(());
+        }
+        self.add_stored_chunks(chunks).await?;
+
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+        table
+            .delete(&stale)
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to delete rows: {}", e)))
+    }
+
+    /// Swaps the rows of a file for the given chunks in a single commit, so a search never finds the file without rows
+    /// and a failed write leaves the old ones in place
+    pub async fn replace_file_chunks(
+        &self,
+        file_id: &str,
+        chunks: Vec<StoredChunk>,
+    ) -> VectorDbResult<()> {
+        let table = self
+            .client
+            .open_table(&self.table)
+            .execute()
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
+        let file_filter = format!("file_id = '{}'", escape_filter_value(file_id));
+
+        if chunks.is_empty() {
+            return table
+                .delete(&file_filter)
+                .await
+                .map_err(|e| VectorDbError::LanceError(format!("Failed to delete rows: {}", e)));
+        }
+
+        // rows are matched by chunk id, the ones of the file that aren't in `chunks` go
+        let batches = from_stored_chunks_to_data(chunks, self.dimension)?;
+        let mut merge = table.merge_insert(&["id"]);
+        merge
+            .when_matched_update_all(None)
+            .when_not_matched_insert_all()
+            .when_not_matched_by_source_delete(Some(file_filter));
+        merge
+            .execute(Box::new(batches))
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to replace rows: {}", e)))?;
+
+        Ok(())
+    }
+
     /// given a query, this function performs similarity search and returns the chunks that matched
     pub async fn search_similar(
         app_handle: &AppHandle,
         query_text: &str,
     ) -> VectorDbResult<Vec<RecordBatch>> {
+        Self::search_similar_with_limit(app_handle, query_text, DEFAULT_SEARCH_LIMIT).await
+    }
+
+    /// Similarity search returning the matched chunks with their distance, closest first
+    pub async fn search_chunks(
+        app_handle: &AppHandle,
+        query_text: &str,
+        limit: usize,
+    ) -> VectorDbResult<Vec<ScoredChunk>> {
+        let results = Self::search_similar_with_limit(app_handle, query_text, limit).await?;
+        let mut chunks = record_batches_to_scored_chunks(&results)?;
+        chunks.sort_by(|a, b| a.distance.total_cmp(&b.distance));
+
+        Ok(chunks)
+    }
+
+    pub async fn search_similar_with_limit(
+        app_handle: &AppHandle,
+        query_text: &str,
+        limit: usize,
+    ) -> VectorDbResult<Vec<RecordBatch>> {
+        // the query is embedded before the manager is locked, so a slow embedding service doesn't hold up inserts
+        let embedder = app_handle.state::<Arc<Embedder>>();
+        let query_embedding: Vec<f32> = embedder.embed_single_text(query_text).await;
+        // vectors of another model live in another space, they are left out until they are re-embedded, see reembed.rs
+        let model_filter = model_filter(&embedder.model_name());
+
         let state = app_handle.state::<Arc<Mutex<VectorDbManager>>>();
         let manager = state.lock().await;
 
@@ -166,16 +741,25 @@ impl VectorDbManager {
             return Ok(Vec::new());
         }
 
-        let embedder = app_handle.state::<Arc<Embedder>>();
-        let query_embedding: Vec<f32> = embedder.embed_single_text(query_text);
-
         let table = manager
             .client
-            .open_table(TABLE_NAME)
+            .open_table(&manager.table)
             .execute()
             .await
             .map_err(|e| VectorDbError::LanceError(format!("Failed to open table: {}", e)))?;
 
+        // lancedb can't search sealed embeddings, the rows are opened and compared here instead
+        let sealed_rows = table
+            .count_rows(Some("sealed_embedding IS NOT NULL".to_string()))
+            .await
+            .map_err(|e| VectorDbError::LanceError(format!("Failed to count rows: {}", e)))?;
+        if sealed_rows > 0 {
+            let chunks = manager.opened_chunks(&table, model_filter).await?;
+            // the comparison runs without the lock, inserts don't wait for it
+            drop(manager);
+            return search_opened(&query_embedding, &chunks, limit);
+        }
+
         let query_options: QueryExecutionOptions = QueryExecutionOptions::default();
 
         let vector_query = table.query().nearest_to(query_embedding).map_err(|e| {
@@ -184,6 +768,8 @@ impl VectorDbManager {
 
         let nev_vec = vector_query
             .distance_type(lancedb::DistanceType::Cosine)
+            .only_if(model_filter)
+            .limit(limit)
             .clone();
 
         let results: Vec<RecordBatch> = nev_vec
@@ -198,56 +784,394 @@ impl VectorDbManager {
 
         Ok(results)
     }
+
+    /// The decrypted rows matching the filter, read again only when the table changed since the last search
+    async fn opened_chunks(
+        &self,
+        table: &Table,
+        filter: String,
+    ) -> VectorDbResult<Arc<Vec<StoredChunk>>> {
+        let version = table.version().await.map_err(|e| {
+            VectorDbError::LanceError(format!("Failed to read table version: {}", e))
+        })?;
+
+        if let Some(opened) = self
+            .opened
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .as_ref()
+            .filter(|opened| opened.version == version && opened.filter == filter)
+        {
+            return Ok(opened.chunks.clone());
+        }
+
+        let chunks = Arc::new(self.stored_chunks(Some(filter.clone())).await?);
+        *self.opened.lock().unwrap_or_else(|e| e.into_inner()) = Some(OpenedIndex {
+            version,
+            filter,
+            chunks: chunks.clone(),
+        });
+
+        Ok(chunks)
+    }
+}
+
+/// Rows that are sealed while encryption at rest is off, or plain while it is on
+fn unsealed_filter() -> &'static str {
+    if encryption::is_sealing() {
+        "sealed_embedding IS NULL"
+    } else {
+        "sealed_embedding IS NOT NULL"
+    }
+}
+
+/// Brute force similarity search over decrypted rows, returns the same columns as a lancedb search
+fn search_opened(
+    query_embedding: &[f32],
+    chunks: &[StoredChunk],
+    limit: usize,
+) -> VectorDbResult<Vec<RecordBatch>> {
+    let mut scored: Vec<(f32, &StoredChunk)> = chunks
+        .iter()
+        .map(|chunk| {
+            let distance = 1.0 - cosine_similarity(query_embedding, &chunk.embedding);
+            (distance, chunk)
+        })
+        .collect();
+    scored.sort_by(|a, b| a.0.total_cmp(&b.0));
+    scored.truncate(limit);
+
+    let schema = Arc::new(Schema::new(vec![
+        Field::new("id", DataType::Utf8, false),
+        Field::new("text", DataType::Utf8, false),
+        Field::new("file_id", DataType::Utf8, false),
+        Field::new("file_path", DataType::Utf8, false),
+        Field::new("page_number", DataType::Int32, true),
+        Field::new("_distance", DataType::Float32, false),
+    ]));
+    let column = |value: fn(&StoredChunk) -> &str| {
+        StringArray::from_iter_values(scored.iter().map(|(_, chunk)| value(chunk)))
+    };
+
+    let batch = RecordBatch::try_new(
+        schema,
+        vec![
+            Arc::new(column(|chunk| chunk.id.as_str())),
+            Arc::new(column(|chunk| chunk.text.as_str())),
+            Arc::new(column(|chunk| chunk.file_id.as_str())),
+            Arc::new(column(|chunk| chunk.file_path.as_str())),
+            Arc::new(Int32Array::from_iter(
+                scored
+                    .iter()
+                    .map(|(_, chunk)| chunk.page_number.map(|page| page as i32)),
+            )),
+            Arc::new(Float32Array::from_iter_values(
+                scored.iter().map(|(distance, _)| *distance),
+            )),
+        ],
+    )
+    .map_err(|e| VectorDbError::Other(format!("Failed to build record batch: {}", e)))?;
+
+    Ok(vec![batch])
 }
 
 fn from_chunks_embeddings_to_data(
     chunk_embeddings: Vec<(Chunk, Vec<f32>)>,
     file_id: &str,
-) -> RecordBatchIterator<
-    std::iter::Map<
-        std::vec::IntoIter<RecordBatch>,
-        fn(RecordBatch) -> Result<RecordBatch, arrow_schema::ArrowError>,
+    model: &str,
+    dimension: i32,
+) -> VectorDbResult<
+    RecordBatchIterator<
+        std::iter::Map<
+            std::vec::IntoIter<RecordBatch>,
+            fn(RecordBatch) -> Result<RecordBatch, arrow_schema::ArrowError>,
+        >,
     >,
 > {
-    let schema = get_embeddings_schema();
+    let schema = get_embeddings_schema(dimension);
+    let row_count = chunk_embeddings.len();
 
     let mut ids = Vec::with_capacity(chunk_embeddings.len());
     let mut texts = Vec::with_capacity(chunk_embeddings.len());
     let mut embeddings = Vec::with_capacity(chunk_embeddings.len());
     let mut file_ids = Vec::with_capacity(chunk_embeddings.len());
     let mut file_paths: Vec<&str> = Vec::with_capacity(chunk_embeddings.len());
+    let mut page_numbers = Vec::with_capacity(chunk_embeddings.len());
+    let mut sealed_embeddings = Vec::with_capacity(chunk_embeddings.len());
 
     for (i, (chunk, embedding)) in chunk_embeddings.iter().enumerate() {
+        check_dimension(embedding, model, dimension)?;
         if let Some(path_str) = chunk.metadata.source_path.to_str() {
             file_paths.push(path_str);
         } else {
             file_paths.push("");
         }
 
+        let (text, embedding, sealed_embedding) = seal_row(&chunk.content, embedding)?;
         ids.push(format!("{}_chunk_{}", file_id, i));
-        texts.push(chunk.content.clone());
-        embeddings.push(Some(embedding.iter().map(|&f| Some(f)).collect::<Vec<_>>()));
+        texts.push(text);
+        embeddings.push(Some(embedding.into_iter().map(Some).collect::<Vec<_>>()));
         file_ids.push(file_id);
+        page_numbers.push(chunk.metadata.page_number.map(|page| page as i32));
+        sealed_embeddings.push(sealed_embedding);
     }
 
-    RecordBatchIterator::new(
+    Ok(RecordBatchIterator::new(
         vec![RecordBatch::try_new(
             schema.clone(),
             vec![
                 Arc::new(StringArray::from(ids)),
                 Arc::new(StringArray::from(texts)),
                 Arc::new(
-                    FixedSizeListArray::from_iter_primitive::<Float32Type, _, _>(embeddings, 384),
+                    FixedSizeListArray::from_iter_primitive::<Float32Type, _, _>(
+                        embeddings, dimension,
+                    ),
                 ),
                 Arc::new(StringArray::from(file_ids)),
                 Arc::new(StringArray::from(file_paths)),
+                Arc::new(Int32Array::from(page_numbers)),
+                Arc::new(StringArray::from(sealed_embeddings)),
+                Arc::new(StringArray::from(vec![model; row_count])),
+                Arc::new(Int32Array::from(vec![dimension; row_count])),
             ],
         )
-        .unwrap()]
+        .map_err(|e| VectorDbError::Other(format!("Failed to build record batch: {}", e)))?]
         .into_iter()
         .map(Ok),
         schema.clone(),
+    ))
+}
+
+/// The text, embedding and sealed embedding to store for a chunk. With encryption at rest on the text is sealed
+/// and the embedding is replaced by zeros, its real values only exist in the sealed embedding
+fn seal_row(text: &str, embedding: &[f32]) -> VectorDbResult<(String, Vec<f32>, Option<String>)> {
+    let text = encryption::seal_text(text).map_err(|e| VectorDbError::Other(e.to_string()))?;
+    let sealed_embedding =
+        encryption::seal_embedding(embedding).map_err(|e| VectorDbError::Other(e.to_string()))?;
+
+    let embedding = match sealed_embedding {
+        Some(_) => vec![0.0; embedding.len()],
+        None => embedding.to_vec(),
+    };
+    Ok((text, embedding, sealed_embedding))
+}
+
+fn from_stored_chunks_to_data(
+    chunks: Vec<StoredChunk>,
+    dimension: i32,
+) -> VectorDbResult<
+    RecordBatchIterator<
+        std::iter::Map<
+            std::vec::IntoIter<RecordBatch>,
+            fn(RecordBatch) -> Result<RecordBatch, arrow_schema::ArrowError>,
+        >,
+    >,
+> {
+    let schema = get_embeddings_schema(dimension);
+
+    let mut ids = Vec::with_capacity(chunks.len());
+    let mut texts = Vec::with_capacity(chunks.len());
+    let mut embeddings = Vec::with_capacity(chunks.len());
+    let mut file_ids = Vec::with_capacity(chunks.len());
+    let mut file_paths = Vec::with_capacity(chunks.len());
+    let mut page_numbers = Vec::with_capacity(chunks.len());
+    let mut sealed_embeddings = Vec::with_capacity(chunks.len());
+    let mut models = Vec::with_capacity(chunks.len());
+    let mut dimensions = Vec::with_capacity(chunks.len());
+
+    for chunk in chunks {
+        if chunk.embedding.len() != dimension as usize {
+            return Err(VectorDbError::Other(format!(
+                "Chunk {} has {} dimensions, expected {}",
+                chunk.id,
+                chunk.embedding.len(),
+                dimension
+            )));
+        }
+
+        let (text, embedding, sealed_embedding) = seal_row(&chunk.text, &chunk.embedding)?;
+        ids.push(chunk.id);
+        texts.push(text);
+        embeddings.push(Some(embedding.into_iter().map(Some).collect::<Vec<_>>()));
+        file_ids.push(chunk.file_id);
+        file_paths.push(chunk.file_path);
+        page_numbers.push(chunk.page_number.map(|page| page as i32));
+        sealed_embeddings.push(sealed_embedding);
+        dimensions.push(chunk.embedding_model.as_ref().map(|_| dimension));
+        models.push(chunk.embedding_model);
+    }
+
+    let batch = RecordBatch::try_new(
+        schema.clone(),
+        vec![
+            Arc::new(StringArray::from(ids)),
+            Arc::new(StringArray::from(texts)),
+            Arc::new(
+                FixedSizeListArray::from_iter_primitive::<Float32Type, _, _>(embeddings, dimension),
+            ),
+            Arc::new(StringArray::from(file_ids)),
+            Arc::new(StringArray::from(file_paths)),
+            Arc::new(Int32Array::from(page_numbers)),
+            Arc::new(StringArray::from(sealed_embeddings)),
+            Arc::new(StringArray::from(models)),
+            Arc::new(Int32Array::from(dimensions)),
+        ],
     )
+    .map_err(|e| VectorDbError::Other(format!("Failed to build record batch: {}", e)))?;
+
+    Ok(RecordBatchIterator::new(
+        vec![batch].into_iter().map(Ok),
+        schema,
+    ))
+}
+
+fn record_batches_to_stored_chunks(batches: &[RecordBatch]) -> VectorDbResult<Vec<StoredChunk>> {
+    let mut chunks = Vec::new();
+
+    for batch in batches {
+        let ids = string_column(batch, "id")?;
+        let texts = string_column(batch, "text")?;
+        let file_ids = string_column(batch, "file_id")?;
+        let file_paths = string_column(batch, "file_path")?;
+        let embeddings = batch
+            .column_by_name("embedding")
+            .and_then(|c| c.as_any().downcast_ref::<FixedSizeListArray>())
+            .ok_or_else(|| VectorDbError::Other("Missing 'embedding' column".into()))?;
+
+        for i in 0..batch.num_rows() {
+            let embedding = match sealed_embedding(batch, i) {
+                Some(sealed) => encryption::open_embedding(sealed)
+                    .map_err(|e| VectorDbError::Other(e.to_string()))?,
+                None => embeddings
+                    .value(i)
+                    .as_any()
+                    .downcast_ref::<Float32Array>()
+                    .map(|a| a.values().to_vec())
+                    .ok_or_else(|| VectorDbError::Other("Embedding is not a float array".into()))?,
+            };
+
+            chunks.push(StoredChunk {
+                id: ids.value(i).to_string(),
+                text: open_text(texts.value(i))?,
+                embedding,
+                file_id: file_ids.value(i).to_string(),
+                file_path: file_paths.value(i).to_string(),
+                page_number: page_number(batch, i),
+                embedding_model: embedding_model(batch, i).map(String::from),
+            });
+        }
+    }
+
+    Ok(chunks)
+}
+
+fn record_batches_to_scored_chunks(batches: &[RecordBatch]) -> VectorDbResult<Vec<ScoredChunk>> {
+    let mut chunks = Vec::new();
+
+    for batch in batches {
+        let ids = string_column(batch, "id")?;
+        let texts = string_column(batch, "text")?;
+        let file_ids = string_column(batch, "file_id")?;
+        let file_paths = string_column(batch, "file_path")?;
+        let distances = batch
+            .column_by_name("_distance")
+            .and_then(|c| c.as_any().downcast_ref::<Float32Array>())
+            .ok_or_else(|| VectorDbError::Other("Missing '_distance' column".into()))?;
+
+        for i in 0..batch.num_rows() {
+            chunks.push(ScoredChunk {
+                id: ids.value(i).to_string(),
+                text: open_text(texts.value(i))?,
+                file_id: file_ids.value(i).to_string(),
+                file_path: file_paths.value(i).to_string(),
+                page_number: page_number(batch, i),
+                distance: distances.value(i),
+            });
+        }
+    }
+
+    Ok(chunks)
+}
+
+/// Position of a chunk in its file, taken from the "{file_id}_chunk_{i}" id
+pub fn chunk_index(chunk_id: &str) -> usize {
+    chunk_id
+        .rsplit("_chunk_")
+        .next()
+        .and_then(|i| i.parse().ok())
+        .unwrap_or(0)
+}
+
+/// Page of the chunk at `row`, None for documents without pages
+fn page_number(batch: &RecordBatch, row: usize) -> Option<u32> {
+    let pages = batch
+        .column_by_name("page_number")
+        .and_then(|c| c.as_any().downcast_ref::<Int32Array>())?;
+
+    if pages.is_null(row) {
+        None
+    } else {
+        u32::try_from(pages.value(row)).ok()
+    }
+}
+
+/// Sealed embedding of the chunk at `row`, None when it is stored in the clear
+fn sealed_embedding(batch: &RecordBatch, row: usize) -> Option<&str> {
+    let sealed = batch
+        .column_by_name("sealed_embedding")
+        .and_then(|c| c.as_any().downcast_ref::<StringArray>())?;
+
+    if sealed.is_null(row) {
+        None
+    } else {
+        Some(sealed.value(row))
+    }
+}
+
+/// Model of the embedding at `row`, None for rows stored before models were recorded
+fn embedding_model(batch: &RecordBatch, row: usize) -> Option<&str> {
+    let models = batch
+        .column_by_name("embedding_model")
+        .and_then(|c| c.as_any().downcast_ref::<StringArray>())?;
+
+    if models.is_null(row) {
+        None
+    } else {
+        Some(models.value(row))
+    }
+}
+
+/// The table stores vectors of one size, a model with another one can't be written into it
+fn check_dimension(embedding: &[f32], model: &str, dimension: i32) -> VectorDbResult<()> {
+    if embedding.len() == dimension as usize {
+        return Ok(());
+    }
+
+    Err(VectorDbError::Other(format!(
+        "{} returns {} dimensions, the index stores {}",
+        model,
+        embedding.len(),
+        dimension
+    )))
+}
+
+fn model_filter(model: &str) -> String {
+    format!("embedding_model = '{}'", escape_filter_value(model))
+}
+
+fn open_text(text: &str) -> VectorDbResult<String> {
+    encryption::open_text(text).map_err(|e| VectorDbError::Other(e.to_string()))
+}
+
+fn escape_filter_value(value: &str) -> String {
+    value.replace('\'', "''")
+}
+
+fn string_column<'a>(batch: &'a RecordBatch, name: &str) -> VectorDbResult<&'a StringArray> {
+    batch
+        .column_by_name(name)
+        .and_then(|c| c.as_any().downcast_ref::<StringArray>())
+        .ok_or_else(|| VectorDbError::Other(format!("Missing '{}' column", name)))
 }
 
 #[tauri::command]
@@ -255,7 +1179,7 @@ pub async fn init_vectordb(app_handle: AppHandle) -> VectorDbResult<Arc<Mutex<Ve
     VectorDbManager::initialize_vectordb(app_handle).await
 }
 
-fn get_embeddings_schema() -> Arc<Schema> {
+fn get_embeddings_schema(dimension: i32) -> Arc<Schema> {
     Arc::new(Schema::new(vec![
         Field::new("id", DataType::Utf8, false),
         Field::new("text", DataType::Utf8, false),
@@ -263,12 +1187,18 @@ fn get_embeddings_schema() -> Arc<Schema> {
             "embedding",
             DataType::FixedSizeList(
                 Arc::new(Field::new("item", DataType::Float32, true)),
-                384, // embedding dimension
+                dimension,
             ),
             false,
         ),
         Field::new("file_id", DataType::Utf8, false),
         Field::new("file_path", DataType::Utf8, false),
+        Field::new("page_number", DataType::Int32, true),
+        // the embedding encrypted with encryption at rest on, the embedding column only holds zeros then
+        Field::new("sealed_embedding", DataType::Utf8, true),
+        // which vector space the embedding is in, searches only compare vectors of the configured model
+        Field::new("embedding_model", DataType::Utf8, true),
+        Field::new("embedding_dimension", DataType::Int32, true),
     ]))
 }
 
@@ -303,7 +1233,7 @@ pub fn get_text_chunks_from_similarity_search(
 
         // Build formatted context chunks
         for i in 0..std::cmp::min(batch.num_rows(), top_n) {
-            let text = texts.value(i);
+            let text = open_text(texts.value(i)).map_err(|e| e.to_string())?;
             let file_id = file_ids.value(i);
             let file_path = file_path.value(i);
 
@@ -330,11 +1260,24 @@ pub fn init_vector_db(app: &tauri::App) -> AppResult<()> {
     // Block on the future and handle the result
     let result = runtime.block_on(async { init_vectordb(app_handle).await });
 
+    let settings = app
+        .state::<SettingsManagerState>()
+        .0
+        .get_settings()
+        .unwrap_or_default();
+
     // Initialize the embedder and store it in the app state so we can use it
-    match embedder::Embedder::new() {
+    match embedder::Embedder::from_settings(&settings) {
         Ok(embedder) => {
-            app.manage(std::sync::Arc::new(embedder));
+            let embedder = std::sync::Arc::new(embedder);
+            app.manage(embedder.clone());
             println!("Embedder initialized");
+
+            // open the connections to a remote embedding service before the first index run needs them
+            tauri::async_runtime::spawn(async move {
+                embedder.warm_up().await;
+                embedder.keep_warm().await;
+            });
         }
         Err(e) => {
             eprintln!("Failed to initialize embedder: {}", e);
@@ -18,6 +18,12 @@ export interface FileMetadata extends BaseMetadata {
   size: number;
   updated_at?: string;
   created_at?: string;
+  // what the document is about, when summaries are on
+  summary?: string;
+  // only when searched with explain: true
+  ranking?: RankingExplanation;
+  // only when searched with include_icons: true
+  icon?: ResultIcon;
 }
 
 export interface AppMetadata extends BaseMetadata {
@@ -31,6 +37,151 @@ export interface SemanticMetadata extends BaseMetadata {
   distance: number;
   content?: string;
   size: number;
+  // page of the best matching chunk for paged documents like PDFs
+  page_number?: number;
+  summary?: string;
+  ranking?: RankingExplanation;
+  icon?: ResultIcon;
+}
+
+export interface ResultIcon {
+  file_type: string; // "document", "image", "code", ... for the file type icon
+  thumbnail: string | null; // data: URL, for images and PDFs
+  app_icon: string | null; // data: URL, for applications
+}
+
+// what each ranking stage (vector, bm25, recency, frecency, feedback, pin) added to a result's score
+export interface RankingExplanation {
+  score: number;
+  stages: StageContribution[];
+}
+
+export interface StageContribution {
+  stage: string;
+  raw: number;
+  weight: number;
+  contribution: number;
+}
+
+export type EntityKind = "person" | "organization" | "date" | "keyword";
+
+// an entity and how many files mention it, from list_entities
+export interface EntityFacet {
+  name: string;
+  kind: EntityKind;
+  file_count: number;
+}
+
+export interface EntityFile {
+  file_id: number;
+  name: string;
+  path: string;
+  mentions: number;
+}
+
+export interface SensitiveFinding {
+  path: string;
+  kind: string; // "aws_access_key", "private_key", "ssn", "credit_card", ...
+  count: number;
+  action: "flag" | "redact" | "skip";
+  found_at: string;
+}
+
+export type CancelReason = "user" | "shutdown" | "quota" | "battery";
+
+export interface IndexRun {
+  id: number;
+  paths: string[];
+  status: "running" | "completed" | "cancelled";
+  reason: CancelReason | null;
+  totalFiles: number;
+  processedFiles: number;
+  indexedFiles: number;
+  errors: number;
+  startedAt: string;
+  finishedAt: string | null;
+}
+
+export interface HealthMetric {
+  count: number;
+  total: number;
+  percent: number;
+}
+
+export interface HealthRecommendation {
+  kind: "rescan" | "reindex" | "unsupported" | "ocr" | "maintenance";
+  message: string;
+  affected: number;
+  examples: string[]; // a few of the affected paths
+}
+
+export interface HealthReport {
+  score: number; // 0 to 100
+  indexedFiles: number;
+  stale: HealthMetric;
+  failedExtraction: HealthMetric;
+  unsupportedFormat: HealthMetric;
+  scannedPdfs: HealthMetric;
+  bloat: {
+    sqliteBytes: number;
+    sqliteFreeBytes: number;
+    vectorBytes: number;
+    orphanedFiles: number;
+    percent: number;
+  };
+  recommendations: HealthRecommendation[];
+  generatedAt: string | null;
+}
+
+export interface TableUsage {
+  name: string;
+  rows: number;
+  bytes: number | null; // null when SQLite can't tell the size of single tables
+}
+
+export interface CategoryUsage {
+  category: string;
+  files: number;
+  sourceBytes: number;
+  indexBytes: number; // roughly what the chunks take up in the vector db
+  evictedFiles: number;
+}
+
+export interface StorageStats {
+  totalBytes: number;
+  sqliteBytes: number;
+  vectorBytes: number;
+  budgetBytes: number | null;
+  tables: TableUsage[];
+  categories: CategoryUsage[];
+  evictedFiles: number;
+  evictedBytes: number;
+}
+
+export interface ProcessResult {
+  success: boolean;
+  totalDiscovered: number;
+  totalDirectories: number;
+  indexed: number;
+  skipped: number; // stored by name only: empty or sensitive content skipped
+  failed: number;
+  cacheHits: number; // unchanged files a rescan didn't process again
+  bytesProcessed: number;
+  durationMs: number;
+  cancelled: CancelReason | null;
+  errors: ProcessError[];
+}
+
+export interface ProcessError {
+  path: string;
+  class: "extract" | "embed" | "store";
+  error: string;
+}
+
+export interface ReembedStatus {
+  model: string;
+  total: number;
+  processed: number;
 }
 
 export interface AppResourceUsage {
@@ -43,6 +194,13 @@ export interface IndexingProgress {
   total: number;
   processed: number;
   percentage: number;
+  roots: RootProgress[]; // per requested folder, in the order they were selected
+}
+
+export interface RootProgress {
+  root: string;
+  total: number;
+  processed: number;
 }
 
 export interface SelectPathsOptions {
@@ -59,6 +217,7 @@ export interface IndexingProgress {
   total: number;
   processed: number;
   percentage: number;
+  roots: RootProgress[];
 }
 
 export interface SearchResult {
@@ -110,6 +269,7 @@ export interface IndexingProgress {
   total: number;
   processed: number;
   percentage: number;
+  roots: RootProgress[];
 }
 
 export interface Column<T> {